@@ -0,0 +1,431 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+// Fsync policies: after every write, once a second, or when the OS decides.
+const (
+	FsyncAlways   = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo       = "no"
+)
+
+var (
+	ErrRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+	ErrBadFormat         = errors.New("bad file format reading the append only file")
+	ErrFsync             = errors.New("invalid appendfsync policy")
+
+	errSuperseded = errors.New("superseded by a reset")
+)
+
+type Options struct {
+	// Dir holds the files and the manifest listing them.
+	Dir       string
+	FileName  string
+	Fsync     string
+	Databases int
+	// LoadTruncated loads a last file cut short mid-command up to its last
+	// complete command, and truncates the rest.
+	LoadTruncated bool
+	// RDBPreamble writes rewritten bases as RDB snapshots.
+	RDBPreamble bool
+}
+
+// Replayer returns a function that applies commands read from the files to
+// s.
+type Replayer func(s *store.Store) func(args []string) error
+
+// AOF is a multi-part append only file: a base file holding the dataset as
+// of the last rewrite, and incremental files holding the writes since. A
+// manifest lists them in the order they are replayed.
+type AOF struct {
+	o      Options
+	replay Replayer
+
+	mu       sync.Mutex
+	man      manifest
+	f        *os.File
+	db       int
+	unsynced bool
+	// baseSeq is the last base file number handed out, and resets counts
+	// the calls to Reset, so a rewrite can tell it was overtaken by one.
+	baseSeq int64
+	resets  int
+
+	rewriting atomic.Bool
+	rewriteOK atomic.Bool
+}
+
+type Stats struct {
+	RewriteInProgress bool
+	LastRewriteOK     bool
+}
+
+// Open reads the manifest in o.Dir, creating the directory if needed.
+func Open(o Options, replay Replayer) (*AOF, error) {
+	if !slices.Contains([]string{FsyncAlways, FsyncEverysec, FsyncNo}, o.Fsync) {
+		return nil, ErrFsync
+	}
+	if err := os.MkdirAll(o.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	a := &AOF{o: o, replay: replay, db: -1}
+	a.rewriteOK.Store(true)
+	b, err := os.ReadFile(a.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.man, err = parseManifest(b); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Exists reports whether there are files to load.
+func (a *AOF) Exists() bool {
+	return a.man.base != nil || len(a.man.incrs) > 0
+}
+
+func (a *AOF) Stats() Stats {
+	return Stats{RewriteInProgress: a.rewriting.Load(), LastRewriteOK: a.rewriteOK.Load()}
+}
+
+// Load replays every file into s.
+func (a *AOF) Load(s *store.Store) error {
+	return a.load(a.man, s)
+}
+
+func (a *AOF) load(m manifest, s *store.Store) error {
+	apply := a.replay(s)
+	files := m.files()
+	for i, f := range files {
+		if err := a.loadFile(f.name, s, apply, i == len(files)-1); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// loadFile replays a file, which may start with an RDB snapshot. Only the
+// last file may be truncated, as only it was being written when the process
+// died.
+func (a *AOF) loadFile(name string, s *store.Store, apply func(args []string) error, last bool) error {
+	b, err := os.ReadFile(a.path(name))
+	if err != nil {
+		return err
+	}
+	off := 0
+	if bytes.HasPrefix(b, []byte("REDIS")) {
+		if off, err = s.LoadRDB(b); err != nil {
+			return err
+		}
+	}
+	for off < len(b) {
+		var v resp.Value
+		n, err := resp.Decode(b[off:], &v)
+		if errors.Is(err, resp.ErrIncomplete) {
+			if !last || !a.o.LoadTruncated {
+				return fmt.Errorf("%w: unexpected end of file at offset %d", ErrBadFormat, off)
+			}
+			fmt.Printf("!!! Warning: short read while loading the AOF file %s!!!\n", name)
+			if err := os.Truncate(a.path(name), int64(off)); err != nil {
+				return err
+			}
+			fmt.Printf("AOF %s loaded anyway because aof-load-truncated is enabled, truncated to %d bytes\n", name, off)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s at offset %d", ErrBadFormat, err.Error(), off)
+		}
+		if _, args, err := resp.DecodeCmd(v); err != nil {
+			return fmt.Errorf("%w: %s at offset %d", ErrBadFormat, err.Error(), off)
+		} else if err := apply(argStrings(args)); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+func argStrings(args []resp.Value) []string {
+	r := make([]string, len(args))
+	for i, v := range args {
+		r[i], _ = v.Val.(string)
+	}
+	return r
+}
+
+// Start opens the last incremental file for appending, creating one if
+// there is none. When there are no files yet, the dataset in s is first
+// written out as the base, so it must not change until Start returns.
+func (a *AOF) Start(s *store.Store) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.Exists() {
+		base, err := a.writeBase(s, 1)
+		if err != nil {
+			return err
+		}
+		m := manifest{base: &base}
+		if err := a.writeManifest(m); err != nil {
+			return err
+		}
+		a.man = m
+	}
+	if n := len(a.man.incrs); n > 0 {
+		f, err := os.OpenFile(a.path(a.man.incrs[n-1].name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		a.f = f
+	} else if err := a.openIncr(); err != nil {
+		return err
+	}
+	if a.o.Fsync == FsyncEverysec {
+		go a.syncLoop()
+	}
+	return nil
+}
+
+// Append writes a command applied to database db.
+func (a *AOF) Append(db int, args []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var b []byte
+	if db != a.db {
+		b = resp.Encode([]string{"SELECT", strconv.Itoa(db)})
+		a.db = db
+	}
+	b = append(b, resp.Encode(args)...)
+	if _, err := a.f.Write(b); err != nil {
+		fmt.Println("aof write: ", err.Error())
+		return
+	}
+	switch a.o.Fsync {
+	case FsyncAlways:
+		if err := a.f.Sync(); err != nil {
+			fmt.Println("aof fsync: ", err.Error())
+		}
+	case FsyncEverysec:
+		a.unsynced = true
+	}
+}
+
+func (a *AOF) syncLoop() {
+	for range time.Tick(time.Second) {
+		a.mu.Lock()
+		f, unsynced := a.f, a.unsynced
+		a.unsynced = false
+		a.mu.Unlock()
+		if unsynced {
+			// the file may have been closed by a rewrite, which synced it
+			if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+				fmt.Println("aof fsync: ", err.Error())
+			}
+		}
+	}
+}
+
+// openIncr switches appends to a new incremental file. It must be called
+// with a.mu held.
+func (a *AOF) openIncr() error {
+	inc, f, err := a.createIncr(a.man)
+	if err != nil {
+		return err
+	}
+	m := a.man
+	m.incrs = append(slices.Clone(m.incrs), inc)
+	return a.switchTo(m, f)
+}
+
+// createIncr creates the incremental file following those in m.
+func (a *AOF) createIncr(m manifest) (aofFile, *os.File, error) {
+	var seq int64 = 1
+	if n := len(m.incrs); n > 0 {
+		seq = m.incrs[n-1].seq + 1
+	}
+	inc := aofFile{name: fmt.Sprintf("%s.%d.incr.aof", a.o.FileName, seq), seq: seq, typ: fileIncr}
+	f, err := os.OpenFile(a.path(inc.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	return inc, f, err
+}
+
+// switchTo makes m the manifest and appends to f, the last file in m. It
+// must be called with a.mu held.
+func (a *AOF) switchTo(m manifest, f *os.File) error {
+	if err := a.writeManifest(m); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if a.f != nil {
+		a.f.Sync()
+		a.f.Close()
+	}
+	a.f, a.db, a.man = f, -1, m
+	return nil
+}
+
+// nextBaseSeq returns a base file number not used yet. It must be called
+// with a.mu held.
+func (a *AOF) nextBaseSeq() int64 {
+	if a.man.base != nil && a.man.base.seq > a.baseSeq {
+		a.baseSeq = a.man.base.seq
+	}
+	a.baseSeq++
+	return a.baseSeq
+}
+
+// Reset starts the files over from the dataset in s, as after a replica
+// replaced its dataset with its master's. s must not change until Reset
+// returns. A rewrite in progress is superseded: its result is discarded.
+func (a *AOF) Reset(s *store.Store) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	old := a.man
+	base, err := a.writeBase(s, a.nextBaseSeq())
+	if err != nil {
+		return err
+	}
+	inc, f, err := a.createIncr(old)
+	if err == nil {
+		err = a.switchTo(manifest{base: &base, incrs: []aofFile{inc}}, f)
+	}
+	if err != nil {
+		os.Remove(a.path(base.name))
+		return err
+	}
+	a.resets++
+	for _, f := range old.files() {
+		os.Remove(a.path(f.name))
+	}
+	return nil
+}
+
+// Rewrite compacts the files in the background. Writes switch to a new
+// incremental file at once; the files before it are then replayed into a
+// scratch store, which is written out as the new base. That base holds
+// exactly the writes that preceded the switch, whatever was running
+// concurrently.
+func (a *AOF) Rewrite() error {
+	if !a.rewriting.CompareAndSwap(false, true) {
+		return ErrRewriteInProgress
+	}
+	a.mu.Lock()
+	old, seq, resets := a.man, a.nextBaseSeq(), a.resets
+	err := a.openIncr()
+	a.mu.Unlock()
+	if err != nil {
+		a.rewriting.Store(false)
+		return err
+	}
+
+	go func() {
+		defer a.rewriting.Store(false)
+		err := a.rewrite(old, seq, resets)
+		if errors.Is(err, errSuperseded) {
+			fmt.Println("Background AOF rewrite discarded, the files were reset")
+			return
+		}
+		a.rewriteOK.Store(err == nil)
+		if err != nil {
+			fmt.Println("aof rewrite: ", err.Error())
+			return
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+// rewrite replays old and writes it out as the base file seq. It returns
+// errSuperseded if Reset was called since resets was read, as the files of
+// old may be gone and the new base would describe a replaced dataset.
+func (a *AOF) rewrite(old manifest, seq int64, resets int) error {
+	superseded := func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.resets != resets
+	}
+	s := store.New(a.o.Databases)
+	if err := a.load(old, s); err != nil {
+		if superseded() {
+			return errSuperseded
+		}
+		return err
+	}
+	base, err := a.writeBase(s, seq)
+	if err != nil {
+		if superseded() {
+			return errSuperseded
+		}
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.resets != resets {
+		os.Remove(a.path(base.name))
+		return errSuperseded
+	}
+	m := manifest{base: &base, incrs: slices.Clone(a.man.incrs[len(old.incrs):])}
+	if err := a.writeManifest(m); err != nil {
+		os.Remove(a.path(base.name))
+		return err
+	}
+	a.man = m
+	for _, f := range old.files() {
+		os.Remove(a.path(f.name))
+	}
+	return nil
+}
+
+// writeBase writes s out as the base file seq: an RDB snapshot with
+// RDBPreamble, otherwise the commands rebuilding it.
+func (a *AOF) writeBase(s *store.Store, seq int64) (aofFile, error) {
+	if a.o.RDBPreamble {
+		f := aofFile{name: fmt.Sprintf("%s.%d.base.rdb", a.o.FileName, seq), seq: seq, typ: fileBase}
+		return f, pkg.WriteFileAtomic(a.path(f.name), s.WriteAOFBase)
+	}
+	f := aofFile{name: fmt.Sprintf("%s.%d.base.aof", a.o.FileName, seq), seq: seq, typ: fileBase}
+	err := pkg.WriteFileAtomic(a.path(f.name), func(w *bufio.Writer) error {
+		return s.Commands(func(args []string) error {
+			_, err := w.Write(resp.Encode(args))
+			return err
+		})
+	})
+	return f, err
+}
+
+func (a *AOF) path(name string) string {
+	return filepath.Join(a.o.Dir, name)
+}
+
+func (a *AOF) manifestPath() string {
+	return a.path(a.o.FileName + ".manifest")
+}
+
+func (a *AOF) writeManifest(m manifest) error {
+	return pkg.WriteFileAtomic(a.manifestPath(), func(w *bufio.Writer) error {
+		_, err := w.WriteString(m.String())
+		return err
+	})
+}
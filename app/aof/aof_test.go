@@ -0,0 +1,330 @@
+package aof
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want manifest
+		err  bool
+	}{
+		{
+			name: "base and incrs",
+			in: "file a.aof.1.base.aof seq 1 type b\n" +
+				"file a.aof.3.incr.aof seq 3 type i\n" +
+				"file a.aof.2.incr.aof seq 2 type i\n",
+			want: manifest{
+				base: &aofFile{name: "a.aof.1.base.aof", seq: 1, typ: fileBase},
+				incrs: []aofFile{
+					{name: "a.aof.2.incr.aof", seq: 2, typ: fileIncr},
+					{name: "a.aof.3.incr.aof", seq: 3, typ: fileIncr},
+				},
+			},
+		},
+		{
+			name: "history and comments skipped",
+			in:   "# comment\nfile old seq 1 type h\n\nfile a seq 2 type i\n",
+			want: manifest{incrs: []aofFile{{name: "a", seq: 2, typ: fileIncr}}},
+		},
+		{name: "two bases", in: "file a seq 1 type b\nfile b seq 2 type b\n", err: true},
+		{name: "bad seq", in: "file a seq x type i\n", err: true},
+		{name: "odd fields", in: "file a seq 1 type\n", err: true},
+		{name: "bad type", in: "file a seq 1 type x\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseManifest([]byte(tt.in))
+			if tt.err {
+				if !errors.Is(err, ErrManifest) {
+					t.Fatalf("got err %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if again, _ := parseManifest([]byte(got.String())); !reflect.DeepEqual(again, got) {
+				t.Errorf("round trip %q", got.String())
+			}
+		})
+	}
+}
+
+// replay applies the few commands these tests write.
+func replay(s *store.Store) func(args []string) error {
+	return func(args []string) error {
+		db := s.DB(-1)
+		switch args[0] {
+		case "SELECT":
+			idx, _ := strconv.Atoi(args[1])
+			return s.Select(-1, idx)
+		case "SET":
+			_, err := db.SetString(args[1], args[2], store.SetOpts{})
+			return err
+		case "INCR":
+			_, err := db.IncrBy(args[1], 1)
+			return err
+		case "RESTORE":
+			_, err := db.Restore(args[1], []byte(args[3]), time.Time{}, true)
+			return err
+		}
+		return errors.New("unexpected command " + args[0])
+	}
+}
+
+func open(t *testing.T, dir string) *AOF {
+	t.Helper()
+	return openWith(t, Options{Dir: dir})
+}
+
+func openWith(t *testing.T, o Options) *AOF {
+	t.Helper()
+	o.FileName, o.Fsync, o.Databases = "appendonly.aof", FsyncAlways, 2
+	a, err := Open(o, replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func check(t *testing.T, dir string, want map[int]map[string]string) {
+	t.Helper()
+	a := open(t, dir)
+	if !a.Exists() {
+		t.Fatal("no files to load")
+	}
+	s := store.New(2)
+	if err := a.Load(s); err != nil {
+		t.Fatal(err)
+	}
+	for idx, keys := range want {
+		db, _ := s.Index(idx)
+		for k, v := range keys {
+			if got, _, _ := db.GetString(k); got != v {
+				t.Errorf("db %d %s: got %q, want %q", idx, k, got, v)
+			}
+		}
+		if db.Size() != len(keys)+idx {
+			t.Errorf("db %d has %d keys", idx, db.Size())
+		}
+	}
+}
+
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestAppendLoadRewrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	s := store.New(2)
+	db0, _ := s.Index(0)
+	db1, _ := s.Index(1)
+	db0.SetString("a", "1", store.SetOpts{})
+	db1.GeoAdd("z", []store.GeoPoint{{Member: "m", Lon: 13.36, Lat: 38.11}}, store.GeoAddOpts{})
+
+	a := open(t, dir)
+	if a.Exists() {
+		t.Fatal("new dir has files")
+	}
+	if err := a.Start(s); err != nil {
+		t.Fatal(err)
+	}
+	a.Append(0, []string{"SET", "b", "2"})
+	a.Append(1, []string{"SET", "c", "3"})
+	a.Append(0, []string{"INCR", "a"})
+
+	// db 1 also holds the zset z, counted by check
+	want := map[int]map[string]string{0: {"a": "2", "b": "2"}, 1: {"c": "3"}}
+	check(t, dir, want)
+
+	if err := a.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	a.Append(0, []string{"SET", "d", "4"})
+	for a.Stats().RewriteInProgress {
+		time.Sleep(time.Millisecond)
+	}
+	if !a.Stats().LastRewriteOK {
+		t.Fatal("rewrite failed")
+	}
+	wantFiles := []string{"appendonly.aof.2.base.aof", "appendonly.aof.2.incr.aof", "appendonly.aof.manifest"}
+	if got := files(t, dir); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("files after rewrite %v", got)
+	}
+	want[0]["d"] = "4"
+	check(t, dir, want)
+}
+
+func TestLoadTruncated(t *testing.T) {
+	const partial = "*3\r\n$3\r\nSET\r\n$1\r\nb"
+	tests := []struct {
+		name     string
+		truncate bool
+		// rewrite moves the partial command out of the last file
+		rewrite bool
+		err     error
+	}{
+		{name: "refused", err: ErrBadFormat},
+		{name: "truncated", truncate: true},
+		{name: "not the last file", truncate: true, rewrite: true, err: ErrBadFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := open(t, dir)
+			if err := a.Start(store.New(2)); err != nil {
+				t.Fatal(err)
+			}
+			a.Append(0, []string{"SET", "a", "1"})
+			incr := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+			f, err := os.OpenFile(incr, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(partial)
+			f.Close()
+			if tt.rewrite {
+				// switch to a new incr without compacting the old one
+				a.mu.Lock()
+				err := a.openIncr()
+				a.mu.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, _ := os.Stat(incr)
+
+			s := store.New(2)
+			err = openWith(t, Options{Dir: dir, LoadTruncated: tt.truncate}).Load(s)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got err %v, want %v", err, tt.err)
+			}
+			after, _ := os.Stat(incr)
+			if tt.err != nil {
+				if after.Size() != before.Size() {
+					t.Errorf("failed load truncated the file to %d", after.Size())
+				}
+				return
+			}
+			if after.Size() != before.Size()-int64(len(partial)) {
+				t.Errorf("size %d after truncating %d", after.Size(), before.Size())
+			}
+			db, _ := s.Index(0)
+			if v, _, _ := db.GetString("a"); v != "1" {
+				t.Errorf("a = %q", v)
+			}
+		})
+	}
+}
+
+func TestRDBPreamble(t *testing.T) {
+	dir := t.TempDir()
+	s := store.New(2)
+	db1, _ := s.Index(1)
+	db1.SetString("a", "1", store.SetOpts{})
+	db1.GeoAdd("z", []store.GeoPoint{{Member: "m", Lon: 13.36, Lat: 38.11}}, store.GeoAddOpts{})
+
+	a := openWith(t, Options{Dir: dir, RDBPreamble: true})
+	if err := a.Start(s); err != nil {
+		t.Fatal(err)
+	}
+	a.Append(0, []string{"SET", "b", "2"})
+
+	base := filepath.Join(dir, "appendonly.aof.1.base.rdb")
+	b, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("REDIS")) || !bytes.Contains(b, []byte("aof-base\xc0\x01")) {
+		t.Fatalf("base %q", b)
+	}
+	// commands may follow the snapshot
+	tail := resp.Encode([]string{"SELECT", "1"})
+	tail = append(tail, resp.Encode([]string{"INCR", "a"})...)
+	if err := os.WriteFile(base, append(b, tail...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	check(t, dir, map[int]map[string]string{0: {"b": "2"}, 1: {"a": "2"}})
+}
+
+func TestOpenBadFsync(t *testing.T) {
+	if _, err := Open(Options{Dir: t.TempDir(), Fsync: "sometimes"}, replay); !errors.Is(err, ErrFsync) {
+		t.Errorf("got err %v", err)
+	}
+}
+
+func TestResetDuringRewrite(t *testing.T) {
+	dir := t.TempDir()
+	a := open(t, dir)
+	if err := a.Start(store.New(2)); err != nil {
+		t.Fatal(err)
+	}
+	a.Append(0, []string{"SET", "a", "1"})
+
+	// a rewrite that has replayed the old files but not switched yet
+	a.mu.Lock()
+	old, seq, resets := a.man, a.nextBaseSeq(), a.resets
+	if err := a.openIncr(); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Unlock()
+
+	s := store.New(2)
+	db0, _ := s.Index(0)
+	db0.SetString("b", "2", store.SetOpts{})
+	if err := a.Reset(s); err != nil {
+		t.Fatal(err)
+	}
+	a.Append(0, []string{"SET", "c", "3"})
+	if err := a.rewrite(old, seq, resets); !errors.Is(err, errSuperseded) {
+		t.Fatalf("rewrite err %v", err)
+	}
+	wantFiles := []string{"appendonly.aof.3.base.aof", "appendonly.aof.3.incr.aof", "appendonly.aof.manifest"}
+	if got := files(t, dir); !reflect.DeepEqual(got, wantFiles) {
+		t.Errorf("files %v", got)
+	}
+	check(t, dir, map[int]map[string]string{0: {"b": "2", "c": "3"}})
+
+	// through the public calls, whichever way the race goes
+	if err := a.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	db0.SetString("d", "4", store.SetOpts{})
+	if err := a.Reset(s); err != nil {
+		t.Fatal(err)
+	}
+	for a.Stats().RewriteInProgress {
+		time.Sleep(time.Millisecond)
+	}
+	if !a.Stats().LastRewriteOK {
+		t.Fatal("rewrite failed")
+	}
+	check(t, dir, map[int]map[string]string{0: {"b": "2", "d": "4"}})
+}
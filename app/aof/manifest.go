@@ -0,0 +1,89 @@
+package aof
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrManifest = errors.New("invalid AOF manifest")
+
+// File types in the manifest. History files are left over from a rewrite
+// and are not loaded.
+const (
+	fileBase    = 'b'
+	fileHistory = 'h'
+	fileIncr    = 'i'
+)
+
+type aofFile struct {
+	name string
+	seq  int64
+	typ  byte
+}
+
+// manifest lists the files in the order they are loaded: the base, then
+// the incremental files by sequence number. Each line reads
+// "file <name> seq <seq> type <type>".
+type manifest struct {
+	base  *aofFile
+	incrs []aofFile
+}
+
+func (m manifest) files() []aofFile {
+	var files []aofFile
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m manifest) String() string {
+	var b strings.Builder
+	for _, f := range m.files() {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", f.name, f.seq, f.typ)
+	}
+	return b.String()
+}
+
+func parseManifest(b []byte) (manifest, error) {
+	var m manifest
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return m, fmt.Errorf("%w: %q", ErrManifest, line)
+		}
+		kv := make(map[string]string)
+		for i := 0; i < len(fields); i += 2 {
+			kv[fields[i]] = fields[i+1]
+		}
+		seq, err := strconv.ParseInt(kv["seq"], 10, 64)
+		if err != nil || kv["file"] == "" || len(kv["type"]) != 1 {
+			return m, fmt.Errorf("%w: %q", ErrManifest, line)
+		}
+		f := aofFile{name: kv["file"], seq: seq, typ: kv["type"][0]}
+		switch f.typ {
+		case fileBase:
+			if m.base != nil {
+				return m, fmt.Errorf("%w: more than one base file", ErrManifest)
+			}
+			m.base = &f
+		case fileIncr:
+			m.incrs = append(m.incrs, f)
+		case fileHistory:
+		default:
+			return m, fmt.Errorf("%w: %q", ErrManifest, line)
+		}
+	}
+	slices.SortFunc(m.incrs, func(a, b aofFile) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	return m, nil
+}
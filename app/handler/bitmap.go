@@ -0,0 +1,345 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+var (
+	ErrBitOffset = errors.New("bit offset is not an integer or out of range")
+	ErrBitValue  = errors.New("bit is not an integer or out of range")
+	ErrBitArg    = errors.New("The bit argument must be 1 or 0.")
+)
+
+func parseBitOffset(v resp.Value) (int64, error) {
+	n, err := strconv.ParseInt(v.Val.(string), 10, 64)
+	if err != nil || n < 0 || n > store.MaxBitOffset {
+		return 0, ErrBitOffset
+	}
+	return n, nil
+}
+
+// parseBitRange reads the optional start, end and BYTE|BIT arguments of
+// BITCOUNT and BITPOS. BITCOUNT needs both offsets when any is given.
+func parseBitRange(args []resp.Value, needEnd bool) (store.BitRange, error) {
+	var r store.BitRange
+	if len(args) == 0 {
+		return r, nil
+	}
+	if len(args) > 3 || (needEnd && len(args) == 1) {
+		return r, ErrSyntax
+	}
+	var err error
+	if r.Start, err = parseInt(args[0]); err != nil {
+		return r, err
+	}
+	r.HasStart = true
+	if len(args) > 1 {
+		if r.End, err = parseInt(args[1]); err != nil {
+			return r, err
+		}
+		r.HasEnd = true
+	}
+	if len(args) > 2 {
+		switch strings.ToUpper(args[2].Val.(string)) {
+		case "BYTE":
+		case "BIT":
+			r.Bit = true
+		default:
+			return r, ErrSyntax
+		}
+	}
+	return r, nil
+}
+
+type SetBit struct {
+	store *store.Store
+}
+
+func NewSetBit(s *store.Store) SetBit {
+	return SetBit{store: s}
+}
+func (h SetBit) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	offset, err := parseBitOffset(args[2])
+	if err != nil {
+		return err
+	}
+	var bit byte
+	switch args[3].Val.(string) {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		return ErrBitValue
+	}
+
+	db := h.store.DB(sId)
+	old, err := db.SetBit(args[1].Val.(string), offset, bit)
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(int64(old))
+	return nil
+}
+
+type GetBit struct {
+	store *store.Store
+}
+
+func NewGetBit(s *store.Store) GetBit {
+	return GetBit{store: s}
+}
+func (h GetBit) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	offset, err := parseBitOffset(args[2])
+	if err != nil {
+		return err
+	}
+	bit, err := h.store.DB(sId).GetBit(args[1].Val.(string), offset)
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(int64(bit))
+	return nil
+}
+
+type BitCount struct {
+	store *store.Store
+}
+
+func NewBitCount(s *store.Store) BitCount {
+	return BitCount{store: s}
+}
+func (h BitCount) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	r, err := parseBitRange(args[2:], true)
+	if err != nil {
+		return err
+	}
+	n, err := h.store.DB(sId).BitCount(args[1].Val.(string), r)
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(n)
+	return nil
+}
+
+type BitPos struct {
+	store *store.Store
+}
+
+func NewBitPos(s *store.Store) BitPos {
+	return BitPos{store: s}
+}
+func (h BitPos) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	var bit byte
+	switch args[2].Val.(string) {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		return ErrBitArg
+	}
+	r, err := parseBitRange(args[3:], false)
+	if err != nil {
+		return err
+	}
+	pos, err := h.store.DB(sId).BitPos(args[1].Val.(string), bit, r)
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(pos)
+	return nil
+}
+
+type BitOp struct {
+	store *store.Store
+}
+
+func NewBitOp(s *store.Store) BitOp {
+	return BitOp{store: s}
+}
+func (h BitOp) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	op := store.BitOp(strings.ToUpper(args[1].Val.(string)))
+	keys := argStrings(args[3:])
+	switch op {
+	case store.BitAnd, store.BitOr, store.BitXor, store.BitOne:
+	case store.BitNot:
+		if len(keys) != 1 {
+			return store.ErrBitOpKeys
+		}
+	case store.BitDiff, store.BitDiff1, store.BitAndOr:
+		if len(keys) < 2 {
+			return fmt.Errorf("BITOP %s must be called with at least two source keys.", op)
+		}
+	default:
+		return ErrSyntax
+	}
+
+	db := h.store.DB(sId)
+	n, err := db.BitOp(op, args[2].Val.(string), keys)
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(n)
+	return nil
+}
+
+var (
+	ErrBitFieldType     = errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	ErrBitFieldOverflow = errors.New("Invalid OVERFLOW type specified")
+	ErrBitFieldRO       = errors.New("BITFIELD_RO only supports the GET subcommand")
+)
+
+func parseBitFieldType(v resp.Value) (bool, uint, error) {
+	t := v.Val.(string)
+	if len(t) < 2 {
+		return false, 0, ErrBitFieldType
+	}
+	signed := t[0] == 'i' || t[0] == 'I'
+	if !signed && t[0] != 'u' && t[0] != 'U' {
+		return false, 0, ErrBitFieldType
+	}
+	bits, err := strconv.ParseUint(t[1:], 10, 8)
+	if err != nil || bits < 1 || (signed && bits > 64) || (!signed && bits > 63) {
+		return false, 0, ErrBitFieldType
+	}
+	return signed, uint(bits), nil
+}
+
+// parseBitFieldOffset reads a bit offset, or with a # prefix an index
+// multiplied by the field width.
+func parseBitFieldOffset(v resp.Value, bits uint) (int64, error) {
+	s := v.Val.(string)
+	scaled := strings.HasPrefix(s, "#")
+	n, err := strconv.ParseInt(strings.TrimPrefix(s, "#"), 10, 64)
+	if err != nil || n < 0 || (scaled && n > store.MaxBitOffset/int64(bits)) {
+		return 0, ErrBitOffset
+	}
+	if scaled {
+		n *= int64(bits)
+	}
+	if n+int64(bits)-1 > store.MaxBitOffset {
+		return 0, ErrBitOffset
+	}
+	return n, nil
+}
+
+// BitField handles BITFIELD and, with readOnly, BITFIELD_RO.
+type BitField struct {
+	store    *store.Store
+	readOnly bool
+}
+
+func NewBitField(s *store.Store) BitField {
+	return BitField{store: s}
+}
+func NewBitFieldRO(s *store.Store) BitField {
+	return BitField{store: s, readOnly: true}
+}
+func (h BitField) parse(args []resp.Value) ([]store.BitFieldOp, error) {
+	var ops []store.BitFieldOp
+	overflow := store.OverflowWrap
+	for i := 0; i < len(args); {
+		sub := strings.ToUpper(args[i].Val.(string))
+		if sub == "OVERFLOW" {
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			switch strings.ToUpper(args[i+1].Val.(string)) {
+			case "WRAP":
+				overflow = store.OverflowWrap
+			case "SAT":
+				overflow = store.OverflowSat
+			case "FAIL":
+				overflow = store.OverflowFail
+			default:
+				return nil, ErrBitFieldOverflow
+			}
+			i += 2
+			continue
+		}
+
+		op := store.BitFieldOp{Overflow: overflow}
+		n := 3
+		switch sub {
+		case "GET":
+			op.Kind = store.BitFieldGet
+		case "SET":
+			op.Kind, n = store.BitFieldSet, 4
+		case "INCRBY":
+			op.Kind, n = store.BitFieldIncrBy, 4
+		default:
+			return nil, ErrSyntax
+		}
+		if i+n > len(args) {
+			return nil, ErrSyntax
+		}
+		if h.readOnly && op.Kind != store.BitFieldGet {
+			return nil, ErrBitFieldRO
+		}
+		var err error
+		if op.Signed, op.Bits, err = parseBitFieldType(args[i+1]); err != nil {
+			return nil, err
+		}
+		if op.Offset, err = parseBitFieldOffset(args[i+2], op.Bits); err != nil {
+			return nil, err
+		}
+		if n == 4 {
+			if op.Val, err = parseInt(args[i+3]); err != nil {
+				return nil, err
+			}
+		}
+		ops = append(ops, op)
+		i += n
+	}
+	return ops, nil
+}
+func (h BitField) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	ops, err := h.parse(args[2:])
+	if err != nil {
+		return err
+	}
+
+	db := h.store.DB(sId)
+	vals, changed, err := db.BitField(args[1].Val.(string), ops)
+	if err != nil {
+		return err
+	}
+	if changed {
+		db.Propagate(argStrings(args)...)
+	}
+	r := make([]any, len(vals))
+	for i, v := range vals {
+		if v == nil {
+			r[i] = resp.Nil
+		} else {
+			r[i] = *v
+		}
+	}
+	res <- resp.Encode(r)
+	return nil
+}
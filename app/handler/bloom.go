@@ -0,0 +1,330 @@
+package handler
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+var (
+	ErrBloomErrorRate   = errors.New("bad error rate")
+	ErrFilterCapacity   = errors.New("bad capacity")
+	ErrFilterNonScaling = errors.New("nonscaling filters cannot expand")
+)
+
+func encodeBool(b bool) []byte {
+	if b {
+		return resp.Encode(1)
+	}
+	return resp.Encode(0)
+}
+
+type BFReserve struct {
+	store *store.Store
+}
+
+func NewBFReserve(s *store.Store) BFReserve {
+	return BFReserve{store: s}
+}
+func (h BFReserve) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	o := store.BloomOpts{Expansion: store.BloomExpansion}
+	var err error
+	if o.ErrorRate, err = parseFloat(args[2]); err != nil {
+		return ErrBloomErrorRate
+	}
+	if o.Capacity, err = parseInt(args[3]); err != nil {
+		return ErrFilterCapacity
+	}
+	var expansion, nonScaling bool
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Val.(string)) {
+		case "NONSCALING":
+			nonScaling = true
+		case "EXPANSION":
+			if i+1 == len(args) {
+				return ErrSyntax
+			}
+			n, err := parseInt(args[i+1])
+			if err != nil || n < 1 {
+				return store.ErrFilterExpansion
+			}
+			o.Expansion, expansion = n, true
+			i++
+		default:
+			return ErrSyntax
+		}
+	}
+	if nonScaling {
+		if expansion {
+			return ErrFilterNonScaling
+		}
+		o.Expansion = 0
+	}
+
+	db := h.store.DB(sId)
+	if err := db.BFReserve(args[1].Val.(string), o); err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+// BFAdd handles BF.ADD, which takes one item, and BF.MADD.
+type BFAdd struct {
+	store *store.Store
+	multi bool
+}
+
+func NewBFAdd(s *store.Store) BFAdd {
+	return BFAdd{store: s}
+}
+func NewBFMAdd(s *store.Store) BFAdd {
+	return BFAdd{store: s, multi: true}
+}
+func (h BFAdd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 || (!h.multi && len(args) != 3) {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	added, err := db.BFAdd(args[1].Val.(string), argStrings(args[2:]))
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+
+	r := make([]any, len(added))
+	for i, a := range added {
+		if err, ok := a.(error); ok {
+			r[i] = resp.EncodeError(err)
+		} else {
+			r[i] = encodeBool(a.(bool))
+		}
+	}
+	if !h.multi {
+		res <- r[0].([]byte)
+		return nil
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+// BFExists handles BF.EXISTS, which takes one item, and BF.MEXISTS.
+type BFExists struct {
+	store *store.Store
+	multi bool
+}
+
+func NewBFExists(s *store.Store) BFExists {
+	return BFExists{store: s}
+}
+func NewBFMExists(s *store.Store) BFExists {
+	return BFExists{store: s, multi: true}
+}
+func (h BFExists) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 || (!h.multi && len(args) != 3) {
+		return ErrInvalidCmd
+	}
+	found, err := h.store.DB(sId).BFExists(args[1].Val.(string), argStrings(args[2:]))
+	if err != nil {
+		return err
+	}
+	if !h.multi {
+		res <- encodeBool(found[0])
+		return nil
+	}
+	r := make([]int, len(found))
+	for i, f := range found {
+		if f {
+			r[i] = 1
+		}
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+type BFInfo struct {
+	store *store.Store
+}
+
+func NewBFInfo(s *store.Store) BFInfo {
+	return BFInfo{store: s}
+}
+func (h BFInfo) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	if len(args) > 3 {
+		return ErrSyntax
+	}
+	info, err := h.store.DB(sId).BFInfo(args[1].Val.(string))
+	if err != nil {
+		return err
+	}
+	var expansion any = info.Expansion
+	if info.Expansion == 0 {
+		expansion = resp.Nil
+	}
+	if len(args) == 2 {
+		res <- resp.Encode([]any{
+			"Capacity", info.Capacity,
+			"Size", info.Size,
+			"Number of filters", info.Filters,
+			"Number of items inserted", info.Items,
+			"Expansion rate", expansion,
+		})
+		return nil
+	}
+
+	var field any
+	switch strings.ToUpper(args[2].Val.(string)) {
+	case "CAPACITY":
+		field = info.Capacity
+	case "SIZE":
+		field = info.Size
+	case "FILTERS":
+		field = info.Filters
+	case "ITEMS":
+		field = info.Items
+	case "EXPANSION":
+		field = expansion
+	default:
+		return ErrSyntax
+	}
+	res <- resp.Encode([]any{field})
+	return nil
+}
+
+type CFReserve struct {
+	store *store.Store
+}
+
+func NewCFReserve(s *store.Store) CFReserve {
+	return CFReserve{store: s}
+}
+func (h CFReserve) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	o := store.CuckooOpts{
+		BucketSize:    store.CuckooBucketSize,
+		MaxIterations: store.CuckooMaxIterations,
+		Expansion:     store.CuckooExpansion,
+	}
+	var err error
+	if o.Capacity, err = parseInt(args[2]); err != nil {
+		return ErrFilterCapacity
+	}
+	for i := 3; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return ErrSyntax
+		}
+		n, err := parseInt(args[i+1])
+		if err != nil {
+			return err
+		}
+		switch strings.ToUpper(args[i].Val.(string)) {
+		case "BUCKETSIZE":
+			o.BucketSize = n
+		case "MAXITERATIONS":
+			o.MaxIterations = n
+		case "EXPANSION":
+			o.Expansion = n
+		default:
+			return ErrSyntax
+		}
+	}
+
+	db := h.store.DB(sId)
+	if err := db.CFReserve(args[1].Val.(string), o); err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+// CFAdd handles CF.ADD and CF.ADDNX, which skips items already present.
+type CFAdd struct {
+	store *store.Store
+	nx    bool
+}
+
+func NewCFAdd(s *store.Store) CFAdd {
+	return CFAdd{store: s}
+}
+func NewCFAddNX(s *store.Store) CFAdd {
+	return CFAdd{store: s, nx: true}
+}
+func (h CFAdd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 3 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	added, err := db.CFAdd(args[1].Val.(string), args[2].Val.(string), h.nx)
+	if err != nil {
+		return err
+	}
+	if added {
+		db.Propagate(argStrings(args)...)
+	}
+	res <- encodeBool(added)
+	return nil
+}
+
+type CFDel struct {
+	store *store.Store
+}
+
+func NewCFDel(s *store.Store) CFDel {
+	return CFDel{store: s}
+}
+func (h CFDel) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 3 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	deleted, err := db.CFDel(args[1].Val.(string), args[2].Val.(string))
+	if err != nil {
+		return err
+	}
+	if deleted {
+		db.Propagate(argStrings(args)...)
+	}
+	res <- encodeBool(deleted)
+	return nil
+}
+
+// CFCount handles CF.COUNT and CF.EXISTS, which reports whether the count
+// is non-zero.
+type CFCount struct {
+	store  *store.Store
+	exists bool
+}
+
+func NewCFCount(s *store.Store) CFCount {
+	return CFCount{store: s}
+}
+func NewCFExists(s *store.Store) CFCount {
+	return CFCount{store: s, exists: true}
+}
+func (h CFCount) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 3 {
+		return ErrInvalidCmd
+	}
+	n, err := h.store.DB(sId).CFCount(args[1].Val.(string), args[2].Val.(string))
+	if err != nil {
+		return err
+	}
+	if h.exists {
+		res <- encodeBool(n > 0)
+		return nil
+	}
+	res <- resp.Encode(n)
+	return nil
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func parseDBIndex(v resp.Value) (int, error) {
+	n, err := parseInt(v)
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// checkFlushMode checks the optional ASYNC|SYNC argument of FLUSHDB and
+// FLUSHALL. Both flush the same way.
+func checkFlushMode(args []resp.Value) error {
+	if len(args) < 2 {
+		return nil
+	}
+	if len(args) > 2 {
+		return ErrSyntax
+	}
+	switch strings.ToUpper(args[1].Val.(string)) {
+	case "ASYNC", "SYNC":
+		return nil
+	}
+	return ErrSyntax
+}
+
+type Select struct {
+	store *store.Store
+}
+
+func NewSelect(s *store.Store) Select {
+	return Select{store: s}
+}
+func (h Select) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	idx, err := parseDBIndex(args[1])
+	if err != nil {
+		return err
+	}
+	if err := h.store.Select(sId, idx); err != nil {
+		return err
+	}
+	res <- resp.Ok
+	return nil
+}
+
+// Close forgets the database selected by a closed session.
+func (h Select) Close(sId int64) {
+	h.store.Forget(sId)
+}
+
+type Move struct {
+	store *store.Store
+}
+
+func NewMove(s *store.Store) Move {
+	return Move{store: s}
+}
+func (h Move) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	dst, err := parseDBIndex(args[2])
+	if err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	moved, err := h.store.Move(db, args[1].Val.(string), dst)
+	if err != nil {
+		return err
+	}
+	if !moved {
+		res <- resp.Encode(0)
+		return nil
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(1)
+	return nil
+}
+
+type SwapDB struct {
+	store *store.Store
+}
+
+func NewSwapDB(s *store.Store) SwapDB {
+	return SwapDB{store: s}
+}
+func (h SwapDB) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	a, err := parseDBIndex(args[1])
+	if err != nil {
+		return err
+	}
+	b, err := parseDBIndex(args[2])
+	if err != nil {
+		return err
+	}
+	if err := h.store.SwapDB(a, b); err != nil {
+		return err
+	}
+	h.store.DB(sId).Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+type FlushDB struct {
+	store *store.Store
+}
+
+func NewFlushDB(s *store.Store) FlushDB {
+	return FlushDB{store: s}
+}
+func (h FlushDB) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if err := checkFlushMode(args); err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	db.Flush()
+	db.Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+type FlushAll struct {
+	store *store.Store
+}
+
+func NewFlushAll(s *store.Store) FlushAll {
+	return FlushAll{store: s}
+}
+func (h FlushAll) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if err := checkFlushMode(args); err != nil {
+		return err
+	}
+	h.store.FlushAll()
+	h.store.DB(sId).Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+type DBSize struct {
+	store *store.Store
+}
+
+func NewDBSize(s *store.Store) DBSize {
+	return DBSize{store: s}
+}
+func (h DBSize) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	res <- resp.Encode(h.store.DB(sId).Size())
+	return nil
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestDBCommands(t *testing.T) {
+	s := store.New(4)
+	handlers := map[string]Handler{
+		"SET":      NewSet(s),
+		"GET":      NewGet(s),
+		"SELECT":   NewSelect(s),
+		"MOVE":     NewMove(s),
+		"SWAPDB":   NewSwapDB(s),
+		"FLUSHDB":  NewFlushDB(s),
+		"FLUSHALL": NewFlushAll(s),
+		"DBSIZE":   NewDBSize(s),
+	}
+	const outOfRange = "-ERR DB index is out of range\r\n"
+
+	// session 1 stays on db 0, session 2 selects db 1
+	tests := []struct {
+		sId  int64
+		cmd  string
+		want string
+	}{
+		{1, "SET k a", "+OK\r\n"},
+		{2, "SELECT 1", "+OK\r\n"},
+		{2, "SET k b", "+OK\r\n"},
+		{1, "MOVE k 1", ":0\r\n"},
+		{1, "GET k", "$1\r\na\r\n"},
+		{2, "GET k", "$1\r\nb\r\n"},
+		{1, "MOVE k 0", "-ERR Source and destination objects are the same\r\n"},
+		{1, "MOVE k 2", ":1\r\n"},
+		{1, "GET k", "$-1\r\n"},
+		{1, "MOVE k 4", outOfRange},
+		{1, "SELECT 4", outOfRange},
+		{1, "SELECT -1", outOfRange},
+		{1, "SWAPDB 0 4", outOfRange},
+		{1, "SWAPDB -1 0", outOfRange},
+		// a swap changes what other sessions see without them selecting
+		{1, "SWAPDB 1 2", "+OK\r\n"},
+		{2, "GET k", "$1\r\na\r\n"},
+		{2, "DBSIZE", ":1\r\n"},
+		{1, "SET x 1", "+OK\r\n"},
+		{2, "FLUSHDB", "+OK\r\n"},
+		{2, "DBSIZE", ":0\r\n"},
+		{1, "DBSIZE", ":1\r\n"},
+		{1, "FLUSHALL BOGUS", "-ERR Syntax error\r\n"},
+		{2, "SET y 1", "+OK\r\n"},
+		{1, "FLUSHALL ASYNC", "+OK\r\n"},
+		{1, "DBSIZE", ":0\r\n"},
+		{2, "DBSIZE", ":0\r\n"},
+		// the flushed databases take new keys right away
+		{2, "SET k c", "+OK\r\n"},
+		{2, "GET k", "$1\r\nc\r\n"},
+	}
+	for _, tt := range tests {
+		var args []resp.Value
+		for _, a := range strings.Fields(tt.cmd) {
+			args = append(args, resp.Value{Type: resp.BulkString, Val: a})
+		}
+		res := make(chan []byte, 1)
+		if err := handlers[args[0].Val.(string)].Handle(tt.sId, args, res); err != nil {
+			res <- resp.EncodeError(err)
+		}
+		if got := string(<-res); got != tt.want {
+			t.Errorf("session %d %s: got %q, want %q", tt.sId, tt.cmd, got, tt.want)
+		}
+	}
+	for i := 0; i < s.Len(); i++ {
+		db, _ := s.Index(i)
+		if n := db.Size(); (i == 1) != (n == 1) {
+			t.Errorf("db %d holds %d keys", i, n)
+		}
+	}
+}
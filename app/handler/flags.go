@@ -0,0 +1,144 @@
+package handler
+
+// Flags describe what a command does, like the flags of COMMAND INFO.
+type Flags uint8
+
+const (
+	// FlagWrite marks commands that may change the dataset. When they
+	// succeed they propagate the change in its effective form, so replicas
+	// and the append only file apply exactly what the master did.
+	FlagWrite Flags = 1 << iota
+	// FlagReadonly marks commands that only read keys. Reading an expired
+	// key still propagates its deletion.
+	FlagReadonly
+	// FlagAdmin marks server, persistence and replication commands.
+	FlagAdmin
+)
+
+var commandFlags = map[string]Flags{
+	"PING":     0,
+	"ECHO":     0,
+	"SELECT":   0,
+	"INFO":     FlagAdmin,
+	"CONFIG":   FlagAdmin,
+	"PSYNC":    FlagAdmin,
+	"REPLCONF": FlagAdmin,
+	"WAIT":     0,
+
+	"REPLICAOF": FlagAdmin,
+	"SLAVEOF":   FlagAdmin,
+
+	"SAVE":         FlagAdmin,
+	"BGSAVE":       FlagAdmin,
+	"LASTSAVE":     0,
+	"BGREWRITEAOF": FlagAdmin,
+
+	"SET":         FlagWrite,
+	"GET":         FlagReadonly,
+	"KEYS":        FlagReadonly,
+	"TYPE":        FlagReadonly,
+	"XADD":        FlagWrite,
+	"XRANGE":      FlagReadonly,
+	"XREAD":       FlagReadonly,
+	"DEL":         FlagWrite,
+	"UNLINK":      FlagWrite,
+	"EXISTS":      FlagReadonly,
+	"EXPIRE":      FlagWrite,
+	"PEXPIRE":     FlagWrite,
+	"EXPIREAT":    FlagWrite,
+	"PEXPIREAT":   FlagWrite,
+	"TTL":         FlagReadonly,
+	"PTTL":        FlagReadonly,
+	"EXPIRETIME":  FlagReadonly,
+	"PEXPIRETIME": FlagReadonly,
+	"PERSIST":     FlagWrite,
+	"SCAN":        FlagReadonly,
+	"HSCAN":       FlagReadonly,
+	"SSCAN":       FlagReadonly,
+	"ZSCAN":       FlagReadonly,
+	"MOVE":        FlagWrite,
+	"SWAPDB":      FlagWrite,
+	"FLUSHDB":     FlagWrite,
+	"FLUSHALL":    FlagWrite,
+	"DBSIZE":      FlagReadonly,
+	"DUMP":        FlagReadonly,
+	"RESTORE":     FlagWrite,
+	"OBJECT":      FlagReadonly,
+
+	"INCR":        FlagWrite,
+	"DECR":        FlagWrite,
+	"INCRBY":      FlagWrite,
+	"DECRBY":      FlagWrite,
+	"INCRBYFLOAT": FlagWrite,
+	"APPEND":      FlagWrite,
+	"STRLEN":      FlagReadonly,
+	"GETRANGE":    FlagReadonly,
+	"SETRANGE":    FlagWrite,
+	"MGET":        FlagReadonly,
+	"MSET":        FlagWrite,
+	"MSETNX":      FlagWrite,
+	"GETDEL":      FlagWrite,
+	"GETEX":       FlagWrite,
+	"LCS":         FlagReadonly,
+
+	"SETBIT":      FlagWrite,
+	"GETBIT":      FlagReadonly,
+	"BITCOUNT":    FlagReadonly,
+	"BITPOS":      FlagReadonly,
+	"BITOP":       FlagWrite,
+	"BITFIELD":    FlagWrite,
+	"BITFIELD_RO": FlagReadonly,
+	"PFADD":       FlagWrite,
+	"PFCOUNT":     FlagReadonly,
+	"PFMERGE":     FlagWrite,
+
+	"GEOADD":         FlagWrite,
+	"GEODIST":        FlagReadonly,
+	"GEOPOS":         FlagReadonly,
+	"GEOHASH":        FlagReadonly,
+	"GEOSEARCH":      FlagReadonly,
+	"GEOSEARCHSTORE": FlagWrite,
+
+	"JSON.SET":       FlagWrite,
+	"JSON.GET":       FlagReadonly,
+	"JSON.MGET":      FlagReadonly,
+	"JSON.DEL":       FlagWrite,
+	"JSON.FORGET":    FlagWrite,
+	"JSON.NUMINCRBY": FlagWrite,
+	"JSON.ARRAPPEND": FlagWrite,
+	"JSON.ARRLEN":    FlagReadonly,
+	"JSON.OBJKEYS":   FlagReadonly,
+	"JSON.TYPE":      FlagReadonly,
+
+	"BF.RESERVE": FlagWrite,
+	"BF.ADD":     FlagWrite,
+	"BF.MADD":    FlagWrite,
+	"BF.EXISTS":  FlagReadonly,
+	"BF.MEXISTS": FlagReadonly,
+	"BF.INFO":    FlagReadonly,
+	"CF.RESERVE": FlagWrite,
+	"CF.ADD":     FlagWrite,
+	"CF.ADDNX":   FlagWrite,
+	"CF.DEL":     FlagWrite,
+	"CF.EXISTS":  FlagReadonly,
+	"CF.COUNT":   FlagReadonly,
+
+	"TS.CREATE":    FlagWrite,
+	"TS.ADD":       FlagWrite,
+	"TS.MADD":      FlagWrite,
+	"TS.RANGE":     FlagReadonly,
+	"TS.REVRANGE":  FlagReadonly,
+	"TS.MRANGE":    FlagReadonly,
+	"TS.MREVRANGE": FlagReadonly,
+}
+
+// CommandFlags returns the flags of the command name, given in upper case,
+// and whether it is known.
+func CommandFlags(name string) (Flags, bool) {
+	f, ok := commandFlags[name]
+	return f, ok
+}
+
+func (f Flags) Has(g Flags) bool {
+	return f&g != 0
+}
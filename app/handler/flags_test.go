@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestPropagate(t *testing.T) {
+	s := store.New(1)
+	var got [][]string
+	s.OnPropagate(func(db int, args []string) {
+		got = append(got, args)
+	})
+	handlers := map[string]Handler{
+		"SET":    NewSet(s),
+		"GET":    NewGet(s),
+		"XADD":   NewXadd(s),
+		"XRANGE": NewXrange(s),
+		"INCR":   NewIncr(s),
+		"EXPIRE": NewExpire(s),
+	}
+	// "~10s" stands for a unix time in ms about 10s from now
+	matches := func(got, want string) bool {
+		d, err := time.ParseDuration(strings.TrimPrefix(want, "~"))
+		if err != nil || want[0] != '~' {
+			return got == want
+		}
+		ms, _ := strconv.ParseInt(got, 10, 64)
+		return time.Until(time.UnixMilli(ms)).Round(time.Second) == d
+	}
+
+	tests := []struct {
+		cmd  string
+		want [][]string
+	}{
+		{cmd: "SET a 1", want: [][]string{{"SET", "a", "1"}}},
+		{cmd: "SET b 1 EX 100", want: [][]string{{"SET", "b", "1", "PXAT", "~100s"}}},
+		{cmd: "SET a 2 NX"},
+		{cmd: "GET a"},
+		{cmd: "XADD s 5-* f 1 e 2", want: [][]string{{"XADD", "s", "5-0", "f", "1", "e", "2"}}},
+		{cmd: "XRANGE s - +"},
+		{cmd: "INCR a", want: [][]string{{"INCR", "a"}}},
+		{cmd: "INCR s"},
+		{cmd: "EXPIRE a 10", want: [][]string{{"PEXPIREAT", "a", "~10s"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			got = nil
+			var args []resp.Value
+			for _, a := range strings.Fields(tt.cmd) {
+				args = append(args, resp.Value{Type: resp.BulkString, Val: a})
+			}
+			res := make(chan []byte, 1)
+			handlers[args[0].Val.(string)].Handle(1, args, res)
+
+			if f, _ := CommandFlags(args[0].Val.(string)); len(got) > 0 && !f.Has(FlagWrite) {
+				t.Errorf("%s propagated without the write flag", args[0].Val)
+			}
+			ok := len(got) == len(tt.want)
+			for i := 0; ok && i < len(got); i++ {
+				ok = len(got[i]) == len(tt.want[i])
+				for j := 0; ok && j < len(got[i]); j++ {
+					ok = matches(got[i][j], tt.want[i][j])
+				}
+			}
+			if !ok {
+				t.Errorf("propagated %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	for name, f := range commandFlags {
+		if f.Has(FlagWrite) && f.Has(FlagReadonly) {
+			t.Errorf("%s is both write and readonly", name)
+		}
+		if strings.ToUpper(name) != name {
+			t.Errorf("%s is not upper case", name)
+		}
+	}
+	if _, ok := CommandFlags("NOSUCH"); ok {
+		t.Error("unknown command has flags")
+	}
+}
@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+var (
+	ErrGeoUnit     = errors.New("unsupported unit provided. please use M, KM, FT, MI")
+	ErrGeoCount    = errors.New("COUNT must be > 0")
+	ErrGeoAny      = errors.New("the ANY argument requires COUNT argument")
+	ErrGeoRadius   = errors.New("radius cannot be negative")
+	ErrGeoBox      = errors.New("height or width cannot be negative")
+	ErrGeoStoreOpt = errors.New("GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+)
+
+func parseGeoUnit(v resp.Value) (float64, error) {
+	conv, ok := store.GeoUnits[strings.ToLower(v.Val.(string))]
+	if !ok {
+		return 0, ErrGeoUnit
+	}
+	return conv, nil
+}
+
+func parseLonLat(lon, lat resp.Value) (float64, float64, error) {
+	x, err := parseFloat(lon)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := parseFloat(lat)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !store.ValidLonLat(x, y) {
+		return 0, 0, fmt.Errorf("invalid longitude,latitude pair %f,%f", x, y)
+	}
+	return x, y, nil
+}
+
+// formatCoord formats a coordinate like Redis's human readable long doubles:
+// 17 decimals without trailing zeros.
+func formatCoord(f float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(f, 'f', 17, 64), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func formatDist(meters, conv float64) string {
+	return strconv.FormatFloat(meters/conv, 'f', 4, 64)
+}
+
+type GeoAdd struct {
+	store *store.Store
+}
+
+func NewGeoAdd(s *store.Store) GeoAdd {
+	return GeoAdd{store: s}
+}
+func (h GeoAdd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 5 {
+		return ErrInvalidCmd
+	}
+	var o store.GeoAddOpts
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Val.(string)) {
+		case "NX":
+			o.NX = true
+		case "XX":
+			o.XX = true
+		case "CH":
+			o.CH = true
+		default:
+			break options
+		}
+	}
+	if (len(args)-i)%3 != 0 || i == len(args) || (o.NX && o.XX) {
+		return ErrSyntax
+	}
+
+	var points []store.GeoPoint
+	for ; i < len(args); i += 3 {
+		lon, lat, err := parseLonLat(args[i], args[i+1])
+		if err != nil {
+			return err
+		}
+		points = append(points, store.GeoPoint{Member: args[i+2].Val.(string), Lon: lon, Lat: lat})
+	}
+
+	db := h.store.DB(sId)
+	n, err := db.GeoAdd(args[1].Val.(string), points, o)
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(n)
+	return nil
+}
+
+type GeoDist struct {
+	store *store.Store
+}
+
+func NewGeoDist(s *store.Store) GeoDist {
+	return GeoDist{store: s}
+}
+func (h GeoDist) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	if len(args) > 5 {
+		return ErrSyntax
+	}
+	conv := 1.0
+	if len(args) == 5 {
+		var err error
+		if conv, err = parseGeoUnit(args[4]); err != nil {
+			return err
+		}
+	}
+
+	pos, err := h.store.DB(sId).GeoPos(args[1].Val.(string), argStrings(args[2:4]))
+	if err != nil {
+		return err
+	}
+	if pos[0] == nil || pos[1] == nil {
+		res <- resp.Nil
+		return nil
+	}
+	d := store.GeoDistance(pos[0].Lon, pos[0].Lat, pos[1].Lon, pos[1].Lat)
+	res <- resp.Encode(formatDist(d, conv))
+	return nil
+}
+
+type GeoPos struct {
+	store *store.Store
+}
+
+func NewGeoPos(s *store.Store) GeoPos {
+	return GeoPos{store: s}
+}
+func (h GeoPos) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	pos, err := h.store.DB(sId).GeoPos(args[1].Val.(string), argStrings(args[2:]))
+	if err != nil {
+		return err
+	}
+	r := make([]any, len(pos))
+	for i, p := range pos {
+		if p == nil {
+			r[i] = resp.NilArray
+		} else {
+			r[i] = []string{formatCoord(p.Lon), formatCoord(p.Lat)}
+		}
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+type GeoHash struct {
+	store *store.Store
+}
+
+func NewGeoHash(s *store.Store) GeoHash {
+	return GeoHash{store: s}
+}
+func (h GeoHash) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	pos, err := h.store.DB(sId).GeoPos(args[1].Val.(string), argStrings(args[2:]))
+	if err != nil {
+		return err
+	}
+	r := make([]any, len(pos))
+	for i, p := range pos {
+		if p == nil {
+			r[i] = resp.Nil
+		} else {
+			r[i] = store.Geohash(p.Lon, p.Lat)
+		}
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+type geoSearchOpts struct {
+	store.GeoQuery
+	withCoord, withDist, withHash bool
+	storeDist                     bool
+}
+
+// parseGeoSearch reads the GEOSEARCH options. storeDist is only accepted by
+// GEOSEARCHSTORE.
+func parseGeoSearch(cmd string, args []resp.Value, isStore bool) (geoSearchOpts, error) {
+	var o geoSearchOpts
+	var from, by bool
+	for i := 0; i < len(args); i++ {
+		left := len(args) - 1 - i
+		switch arg := strings.ToUpper(args[i].Val.(string)); {
+		case arg == "WITHDIST":
+			o.withDist = true
+		case arg == "WITHHASH":
+			o.withHash = true
+		case arg == "WITHCOORD":
+			o.withCoord = true
+		case arg == "ANY":
+			o.Any = true
+		case arg == "ASC":
+			o.Sort = 1
+		case arg == "DESC":
+			o.Sort = -1
+		case arg == "STOREDIST" && isStore:
+			o.storeDist = true
+		case arg == "COUNT" && left >= 1:
+			n, err := parseInt(args[i+1])
+			if err != nil || n < 1 {
+				return o, ErrGeoCount
+			}
+			o.Count = int(n)
+			i++
+		case arg == "FROMMEMBER" && left >= 1:
+			if from {
+				return o, ErrSyntax
+			}
+			o.FromMember, o.Member, from = true, args[i+1].Val.(string), true
+			i++
+		case arg == "FROMLONLAT" && left >= 2:
+			if from {
+				return o, ErrSyntax
+			}
+			var err error
+			if o.Lon, o.Lat, err = parseLonLat(args[i+1], args[i+2]); err != nil {
+				return o, err
+			}
+			from = true
+			i += 2
+		case arg == "BYRADIUS" && left >= 2:
+			if by {
+				return o, ErrSyntax
+			}
+			var err error
+			if o.Radius, err = parseFloat(args[i+1]); err != nil {
+				return o, err
+			}
+			if o.Radius < 0 {
+				return o, ErrGeoRadius
+			}
+			if o.Conversion, err = parseGeoUnit(args[i+2]); err != nil {
+				return o, err
+			}
+			by = true
+			i += 2
+		case arg == "BYBOX" && left >= 3:
+			if by {
+				return o, ErrSyntax
+			}
+			var err error
+			if o.Width, err = parseFloat(args[i+1]); err != nil {
+				return o, err
+			}
+			if o.Height, err = parseFloat(args[i+2]); err != nil {
+				return o, err
+			}
+			if o.Width < 0 || o.Height < 0 {
+				return o, ErrGeoBox
+			}
+			if o.Conversion, err = parseGeoUnit(args[i+3]); err != nil {
+				return o, err
+			}
+			o.Box, by = true, true
+			i += 3
+		default:
+			return o, ErrSyntax
+		}
+	}
+
+	switch {
+	case isStore && (o.withDist || o.withHash || o.withCoord):
+		return o, ErrGeoStoreOpt
+	case !from:
+		return o, fmt.Errorf("exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", cmd)
+	case !by:
+		return o, fmt.Errorf("exactly one of BYRADIUS and BYBOX can be specified for %s", cmd)
+	case o.Any && o.Count == 0:
+		return o, ErrGeoAny
+	}
+	return o, nil
+}
+
+type GeoSearch struct {
+	store *store.Store
+}
+
+func NewGeoSearch(s *store.Store) GeoSearch {
+	return GeoSearch{store: s}
+}
+func (h GeoSearch) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	o, err := parseGeoSearch(args[0].Val.(string), args[2:], false)
+	if err != nil {
+		return err
+	}
+	points, err := h.store.DB(sId).GeoSearch(args[1].Val.(string), o.GeoQuery)
+	if err != nil {
+		return err
+	}
+
+	r := make([]any, len(points))
+	for i, p := range points {
+		if !o.withDist && !o.withHash && !o.withCoord {
+			r[i] = p.Member
+			continue
+		}
+		item := []any{p.Member}
+		if o.withDist {
+			item = append(item, formatDist(p.Dist, o.Conversion))
+		}
+		if o.withHash {
+			item = append(item, int64(p.Score))
+		}
+		if o.withCoord {
+			item = append(item, []string{formatCoord(p.Lon), formatCoord(p.Lat)})
+		}
+		r[i] = item
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+type GeoSearchStore struct {
+	store *store.Store
+}
+
+func NewGeoSearchStore(s *store.Store) GeoSearchStore {
+	return GeoSearchStore{store: s}
+}
+func (h GeoSearchStore) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	o, err := parseGeoSearch(args[0].Val.(string), args[3:], true)
+	if err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	n, err := db.GeoSearchStore(args[1].Val.(string), args[2].Val.(string), o.GeoQuery, o.storeDist)
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(n)
+	return nil
+}
@@ -3,25 +3,66 @@ package handler
 import (
 	"errors"
 	"fmt"
-	"path"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
 	"github.com/codecrafters-io/redis-starter-go/app/pkg"
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
 	"github.com/codecrafters-io/redis-starter-go/app/store"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
 )
 
 var (
 	ErrInvalidCmd = errors.New("invalid cmd")
+	ErrReadOnly   = errors.New("READONLY You can't write against a read only replica.")
 )
 
 type Handler interface {
 	Handle(sId int64, args []resp.Value, res chan<- []byte) error
 }
 
+// Closer is implemented by handlers that keep per-session state.
+type Closer interface {
+	Close(sId int64)
+}
+
+// Gated runs a handler through store.Exec, so snapshots wait for it.
+// Handlers that block or take a snapshot themselves must not be gated.
+type Gated struct {
+	h     Handler
+	store *store.Store
+}
+
+func NewGated(s *store.Store, h Handler) Gated {
+	return Gated{h: h, store: s}
+}
+func (g Gated) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	var err error
+	g.store.Exec(func() {
+		err = g.h.Handle(sId, args, res)
+	})
+	return err
+}
+
+// HandleThen runs then after the handler in the same store.Exec, so a
+// snapshot holds both or neither.
+func (g Gated) HandleThen(sId int64, args []resp.Value, res chan<- []byte, then func()) error {
+	var err error
+	g.store.Exec(func() {
+		err = g.h.Handle(sId, args, res)
+		then()
+	})
+	return err
+}
+func (g Gated) Close(sId int64) {
+	if c, ok := g.h.(Closer); ok {
+		c.Close(sId)
+	}
+}
+
 type Ping struct{}
 
 func (h Ping) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
@@ -43,29 +84,68 @@ func (h Echo) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 type Set struct {
 	store *store.Store
 }
-type setOpts struct {
-	px time.Duration
-}
 
 func NewSet(s *store.Store) *Set {
 	return &Set{store: s}
 }
-func (h *Set) parse(args []resp.Value) (*setOpts, error) {
-	var o setOpts
+func (h *Set) parse(args []resp.Value) (store.SetOpts, error) {
+	var o store.SetOpts
+	var expire bool
 	for i := 3; i < len(args); i++ {
-		switch strings.ToUpper(args[i].Val.(string)) {
-		case "PX":
-			if i+1 < len(args) {
-				v, err := strconv.Atoi(args[i+1].Val.(string))
-				if err != nil {
-					return nil, err
-				}
-				o.px = time.Duration(v) * time.Millisecond
-				i++
+		opt := strings.ToUpper(args[i].Val.(string))
+		switch opt {
+		case "NX":
+			if o.XX {
+				return o, ErrSyntax
+			}
+			o.NX = true
+			continue
+		case "XX":
+			if o.NX {
+				return o, ErrSyntax
 			}
+			o.XX = true
+			continue
+		case "GET":
+			o.Get = true
+			continue
+		case "KEEPTTL":
+			if expire {
+				return o, ErrSyntax
+			}
+			o.KeepTTL = true
+			continue
+		}
+
+		var unit time.Duration
+		var abs bool
+		switch opt {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		case "EXAT":
+			unit, abs = time.Second, true
+		case "PXAT":
+			unit, abs = time.Millisecond, true
+		default:
+			return o, ErrSyntax
+		}
+		if expire || o.KeepTTL || i+1 >= len(args) {
+			return o, ErrSyntax
+		}
+		n, err := parseInt(args[i+1])
+		if err != nil {
+			return o, err
+		}
+		o.At, err = expireAt(n, unit, abs)
+		if err != nil {
+			return o, errInvalidExpire("set")
 		}
+		expire = true
+		i++
 	}
-	return &o, nil
+	return o, nil
 }
 
 func (h *Set) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
@@ -77,9 +157,33 @@ func (h *Set) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 	if err != nil {
 		return err
 	}
-	h.store.SetString(k, v, o.px)
-	fmt.Printf("set %s:%s, store=%s\n", k, v, h.store.Print())
-	res <- resp.Ok
+	db := h.store.DB(sId)
+	r, err := db.SetString(k, v, o)
+	if err != nil {
+		return err
+	}
+
+	if r.Written {
+		switch {
+		case !o.At.IsZero() && !o.At.After(time.Now()):
+			db.Propagate("DEL", k)
+		case !o.At.IsZero():
+			db.Propagate("SET", k, v, "PXAT", strconv.FormatInt(o.At.UnixMilli(), 10))
+		case o.KeepTTL:
+			db.Propagate("SET", k, v, "KEEPTTL")
+		default:
+			db.Propagate("SET", k, v)
+		}
+	}
+
+	switch {
+	case o.Get && r.HadOld:
+		res <- resp.Encode(r.Old)
+	case o.Get, !r.Written:
+		res <- resp.Nil
+	default:
+		res <- resp.Ok
+	}
 	return nil
 }
 
@@ -95,9 +199,13 @@ func (h *Get) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		return ErrInvalidCmd
 	}
 	k := args[1].Val.(string)
+	v, ok, err := h.store.DB(sId).GetString(k)
+	if err != nil {
+		return err
+	}
 	var r []byte
-	if v, ok := h.store.Get(k); ok {
-		r = resp.Encode(v.Val)
+	if ok {
+		r = resp.Encode(v)
 	} else {
 		r = resp.Nil
 	}
@@ -106,62 +214,171 @@ func (h *Get) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 }
 
 type Info struct {
-	repl *pkg.Replication
+	repl  *pkg.Replication
+	store *store.Store
+	aof   *aof.AOF
 }
 type infoOpts struct {
 	replication bool
+	persistence bool
+	stats       bool
+	keyspace    bool
 }
 
-func NewInfo(repl *pkg.Replication) Info {
-	return Info{repl: repl}
+func NewInfo(repl *pkg.Replication, s *store.Store, a *aof.AOF) Info {
+	return Info{repl: repl, store: s, aof: a}
 }
 
 func (h Info) parse(args []resp.Value) (infoOpts, error) {
 	var opts infoOpts
 	if len(args) < 2 {
+		opts.replication, opts.persistence, opts.stats, opts.keyspace = true, true, true, true
 		return opts, nil
 	}
 	sec := strings.ToUpper(args[1].Val.(string))
 	switch sec {
 	case "REPLICATION":
 		opts.replication = true
+	case "PERSISTENCE":
+		opts.persistence = true
+	case "STATS":
+		opts.stats = true
+	case "KEYSPACE":
+		opts.keyspace = true
+	case "ALL", "DEFAULT", "EVERYTHING":
+		opts.replication, opts.persistence, opts.stats, opts.keyspace = true, true, true, true
 	}
 
 	return opts, nil
 }
 
 func (h Info) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
-	_, err := h.parse(args)
+	o, err := h.parse(args)
 	if err != nil {
 		return err
 	}
 
-	m := map[string]any{
-		"role":               h.repl.Role,
-		"master_replid":      h.repl.ID,
-		"master_repl_offset": 0,
-	}
-	r := ""
-	for k, v := range m {
-		r += fmt.Sprintf("%s:%v\r\n", k, v)
+	var sections []string
+	if o.replication {
+		st := h.repl.State()
+		active := 0
+		if st.BacklogSize > 0 {
+			active = 1
+		}
+		fields := [][2]any{{"role", h.repl.Role()}}
+		if h.repl.Role() == pkg.SlaveReplica {
+			host, port, _ := strings.Cut(h.repl.Master(), " ")
+			status, lastIO, syncing := "down", -1, 0
+			if st.Link == pkg.LinkConnected {
+				status = "up"
+			}
+			if !st.LastIO.IsZero() {
+				lastIO = int(time.Since(st.LastIO).Seconds())
+			}
+			if st.Link == pkg.LinkTransfer {
+				syncing = 1
+			}
+			fields = append(fields, [][2]any{
+				{"master_host", host},
+				{"master_port", port},
+				{"master_link_status", status},
+				{"master_last_io_seconds_ago", lastIO},
+				{"master_sync_in_progress", syncing},
+			}...)
+		}
+		sections = append(sections, infoSection("Replication", append(fields, [][2]any{
+			{"master_replid", st.ID},
+			{"master_replid2", st.ID2},
+			{"master_repl_offset", st.Offset},
+			{"second_repl_offset", st.ID2Offset},
+			{"repl_backlog_active", active},
+			{"repl_backlog_size", st.BacklogSize},
+			{"repl_backlog_first_byte_offset", st.BacklogFirstByte},
+			{"repl_backlog_histlen", st.BacklogHistlen},
+		}...)))
+	}
+	if o.persistence {
+		st := h.store.SaveStats()
+		status, inProgress := "ok", 0
+		if !st.LastOK {
+			status = "err"
+		}
+		if st.InProgress {
+			inProgress = 1
+		}
+		fields := [][2]any{
+			{"rdb_changes_since_last_save", st.Changes},
+			{"rdb_bgsave_in_progress", inProgress},
+			{"rdb_last_save_time", st.LastSave.Unix()},
+			{"rdb_last_bgsave_status", status},
+		}
+		if h.aof == nil {
+			fields = append(fields, [2]any{"aof_enabled", 0})
+		} else {
+			ast := h.aof.Stats()
+			status, inProgress := "ok", 0
+			if !ast.LastRewriteOK {
+				status = "err"
+			}
+			if ast.RewriteInProgress {
+				inProgress = 1
+			}
+			fields = append(fields, [][2]any{
+				{"aof_enabled", 1},
+				{"aof_rewrite_in_progress", inProgress},
+				{"aof_last_bgrewrite_status", status},
+			}...)
+		}
+		sections = append(sections, infoSection("Persistence", fields))
+	}
+	if o.stats {
+		st := h.store.ExpireStats()
+		sections = append(sections, infoSection("Stats", [][2]any{
+			{"expired_keys", st.ExpiredKeys},
+			{"expired_stale_perc", fmt.Sprintf("%.2f", st.ExpiredStalePerc*100)},
+			{"expired_time_cap_reached_count", st.TimeCapReachedCount},
+			{"expire_cycle_cpu_milliseconds", st.CycleCPU.Milliseconds()},
+		}))
+	}
+	if o.keyspace {
+		var fields [][2]any
+		for i := 0; i < h.store.Len(); i++ {
+			db, _ := h.store.Index(i)
+			st := db.KeyspaceStats()
+			if st.Keys == 0 {
+				continue
+			}
+			fields = append(fields, [2]any{
+				fmt.Sprintf("db%d", i),
+				fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d", st.Keys, st.Expires, st.AvgTTL.Milliseconds()),
+			})
+		}
+		sections = append(sections, infoSection("Keyspace", fields))
 	}
-	res <- resp.Encode(r)
+	res <- resp.Encode(strings.Join(sections, "\r\n"))
 	return nil
 }
 
+func infoSection(name string, fields [][2]any) string {
+	r := fmt.Sprintf("# %s\r\n", name)
+	for _, f := range fields {
+		r += fmt.Sprintf("%s:%v\r\n", f[0], f[1])
+	}
+	return r
+}
+
 type ReplicaConfig struct {
 	repl *pkg.Replication
-	ack  *atomic.Int64
 }
 type replicaConfigOpts struct {
 	listeningPort int
-	capa          string
+	capa          []string
 	getack        string
 	ack           string
 }
 
-func NewReplicaConfig(repl *pkg.Replication, ack *atomic.Int64) ReplicaConfig {
-	return ReplicaConfig{repl: repl, ack: ack}
+func NewReplicaConfig(repl *pkg.Replication) ReplicaConfig {
+	return ReplicaConfig{repl: repl}
 }
 
 func (h ReplicaConfig) parse(args []resp.Value) (replicaConfigOpts, error) {
@@ -174,7 +391,11 @@ func (h ReplicaConfig) parse(args []resp.Value) (replicaConfigOpts, error) {
 	case "listening-port":
 		opts.listeningPort, _ = strconv.Atoi(args[2].Val.(string))
 	case "capa":
-		opts.capa = args[2].Val.(string)
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.EqualFold(args[i].Val.(string), "capa") {
+				opts.capa = append(opts.capa, args[i+1].Val.(string))
+			}
+		}
 	case "getack":
 		opts.getack = args[2].Val.(string)
 	case "ack":
@@ -189,15 +410,9 @@ func (h ReplicaConfig) Handle(sId int64, args []resp.Value, res chan<- []byte) e
 		return err
 	}
 
-	s, ok := h.repl.GetSlave(sId)
-	if !ok {
-		s = pkg.NewReplica(sId)
-		h.repl.SetSlave(sId, s)
-	}
-	s.Conf = true
-
+	// a master asking its replica, on the master link
 	if o.getack != "" {
-		ack := fmt.Sprintf("%d", h.ack.Load())
+		ack := strconv.FormatInt(h.repl.Offset(), 10)
 		res <- resp.Encode([]string{"REPLCONF", "ACK", ack})
 		return nil
 	}
@@ -207,22 +422,46 @@ func (h ReplicaConfig) Handle(sId int64, args []resp.Value, res chan<- []byte) e
 		v, err := strconv.Atoi(o.ack)
 		if err != nil {
 			fmt.Println("invalid number: ", err.Error())
-		} else {
+		} else if s, ok := h.repl.GetSlave(sId); ok {
 			s.Ack = v
 		}
 		return nil
 	}
 
+	s, ok := h.repl.GetSlave(sId)
+	if !ok {
+		s = h.repl.Handshaking(sId)
+	}
+	s.Conf = true
+	for _, c := range o.capa {
+		s.AddCapa(c)
+	}
 	res <- resp.Ok
 	return nil
 }
 
 type Psync struct {
-	repl *pkg.Replication
+	repl     *pkg.Replication
+	store    *store.Store
+	diskless bool
+	delay    time.Duration
+	batch    *syncBatch
+}
+
+// syncBatch holds the replicas waiting for the next diskless transfer.
+type syncBatch struct {
+	mu      sync.Mutex
+	waiting []*pkg.Replica
 }
 
-func NewPsync(repl *pkg.Replication) Psync {
-	return Psync{repl: repl}
+func NewPsync(repl *pkg.Replication, s *store.Store, c pkg.Config) Psync {
+	return Psync{
+		repl:     repl,
+		store:    s,
+		diskless: c.ReplDisklessSync,
+		delay:    time.Duration(c.ReplDisklessSyncDelay) * time.Second,
+		batch:    &syncBatch{},
+	}
 }
 
 func (h Psync) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
@@ -232,23 +471,83 @@ func (h Psync) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 
 	s, ok := h.repl.GetSlave(sId)
 	if !ok {
-		s = pkg.NewReplica(sId)
+		s = h.repl.Handshaking(sId)
 		h.repl.SetSlave(sId, s)
 	}
 
 	s.Psync = true
 	s.Handshake = s.Conf && s.Psync
 
-	res <- resp.EncodeSimple(fmt.Sprintf("FULLRESYNC %s 0", h.repl.ID))
-	time.Sleep(1 * time.Second)
-	res <- resp.EncodeRDB()
+	// replies go through the replica's queue, ahead of the writes that
+	// follow them
+	off, err := strconv.ParseInt(args[2].Val.(string), 10, 64)
+	if err == nil && h.repl.PartialResync(args[1].Val.(string), off, func(id string, missing []byte) {
+		s.Sync(append(resp.EncodeSimple("CONTINUE "+id), missing...))
+	}) {
+		return nil
+	}
+	if !h.diskless || !s.HasCapa("eof") {
+		var start []byte
+		err := h.store.Snapshot(func() {
+			start = h.fullResync()
+			s.Hold()
+		}, func(rdb []byte) {
+			s.Sync(append(start, resp.EncodeRDB(rdb)...))
+		})
+		if err != nil {
+			s.Close()
+		}
+		return err
+	}
 
+	h.batch.mu.Lock()
+	defer h.batch.mu.Unlock()
+	h.batch.waiting = append(h.batch.waiting, s)
+	if len(h.batch.waiting) == 1 {
+		time.AfterFunc(h.delay, h.transfer)
+	}
 	return nil
 }
 
+// transfer sends one snapshot to every replica that arrived within the
+// delay, framed with a random EOF mark as its length is not sent up front.
+func (h Psync) transfer() {
+	h.batch.mu.Lock()
+	replicas := h.batch.waiting
+	h.batch.waiting = nil
+	h.batch.mu.Unlock()
+
+	var start []byte
+	err := h.store.Snapshot(func() {
+		start = h.fullResync()
+		for _, s := range replicas {
+			s.Hold()
+		}
+	}, func(rdb []byte) {
+		b := append(start, resp.EncodeRDBEOF(rdb, utils.RandomHex(resp.RDBEOFMarkLen))...)
+		for _, s := range replicas {
+			s.Sync(b)
+		}
+	})
+	if err != nil {
+		fmt.Println("diskless sync: ", err.Error())
+		for _, s := range replicas {
+			s.Close()
+		}
+	}
+}
+
+// fullResync returns the reply starting a full resynchronization from the
+// snapshot being taken. It is called while the databases are copied, when
+// the stream cannot move, so its offset is where the replica continues.
+func (h Psync) fullResync() []byte {
+	h.repl.ResetSelectedDB()
+	return resp.EncodeSimple(fmt.Sprintf("FULLRESYNC %s %d", h.repl.ID(), h.repl.Offset()))
+}
+
 type Wait struct {
-	repl *pkg.Replication
-	ack  *atomic.Int64
+	repl  *pkg.Replication
+	store *store.Store
 }
 type waitOpts struct {
 	replicas int
@@ -266,8 +565,8 @@ func (h Wait) parse(args []resp.Value) (waitOpts, error) {
 
 	return opts, nil
 }
-func NewWait(repl *pkg.Replication, ack *atomic.Int64) Wait {
-	return Wait{repl: repl, ack: ack}
+func NewWait(repl *pkg.Replication, s *store.Store) Wait {
+	return Wait{repl: repl, store: s}
 }
 func (h Wait) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 	opts, err := h.parse(args)
@@ -275,10 +574,13 @@ func (h Wait) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		return err
 	}
 
-	for _, s := range h.repl.GetSlaves() {
-		b := resp.Encode([]string{"REPLCONF", "GETACK", "*"})
-		s.Conn.Write(b)
-	}
+	// replicas reply with their offset before counting the GETACK, which is
+	// fed under the gate like any propagated write
+	var want int64
+	h.store.Exec(func() {
+		want = h.repl.Offset()
+		h.repl.Feed(resp.Encode([]string{"REPLCONF", "GETACK", "*"}))
+	})
 
 	//time.Sleep(1 * time.Second)
 
@@ -291,7 +593,7 @@ L:
 	for {
 		c = 0
 		for _, s := range h.repl.GetSlaves() {
-			if int64(s.Ack) >= h.ack.Load() {
+			if int64(s.Ack) >= want {
 				c++
 			}
 		}
@@ -311,6 +613,54 @@ L:
 	return nil
 }
 
+// MasterLink is a replica's connection to its master.
+type MasterLink interface {
+	// Connect drops the current link and connects to the master the
+	// replication state follows.
+	Connect()
+	Disconnect()
+}
+
+type ReplicaOf struct {
+	repl  *pkg.Replication
+	store *store.Store
+	link  MasterLink
+}
+
+func NewReplicaOf(repl *pkg.Replication, s *store.Store, link MasterLink) ReplicaOf {
+	return ReplicaOf{repl: repl, store: s, link: link}
+}
+func (h ReplicaOf) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 3 {
+		return ErrInvalidCmd
+	}
+	host, port := args[1].Val.(string), args[2].Val.(string)
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if h.repl.Role() == pkg.SlaveReplica {
+			h.link.Disconnect()
+			h.repl.Promote()
+			h.store.SetReplica(false)
+		}
+		res <- resp.Ok
+		return nil
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return errors.New("invalid master port")
+	}
+	of := host + " " + port
+	if h.repl.Role() == pkg.SlaveReplica && h.repl.Master() == of {
+		res <- resp.EncodeSimple("OK Already connected to specified master")
+		return nil
+	}
+	h.repl.Follow(of)
+	h.store.SetReplica(true)
+	h.link.Connect()
+	res <- resp.Ok
+	return nil
+}
+
 type Conf struct {
 	c pkg.Config
 }
@@ -330,6 +680,36 @@ func (h Conf) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		v = h.c.DbDir
 	case "dbfilename":
 		v = h.c.DbFileName
+	case "databases":
+		v = strconv.Itoa(h.c.Databases)
+	case "save":
+		v = pkg.FormatSavePoints(h.c.Save)
+	case "appendonly":
+		v = pkg.FormatYesNo(h.c.AppendOnly)
+	case "appendfsync":
+		v = h.c.AppendFsync
+	case "appendfilename":
+		v = h.c.AppendFileName
+	case "appenddirname":
+		v = h.c.AppendDirName
+	case "aof-load-truncated":
+		v = pkg.FormatYesNo(h.c.AOFLoadTruncated)
+	case "aof-use-rdb-preamble":
+		v = pkg.FormatYesNo(h.c.AOFUseRDBPreamble)
+	case "repl-diskless-sync":
+		v = pkg.FormatYesNo(h.c.ReplDisklessSync)
+	case "repl-diskless-sync-delay":
+		v = strconv.Itoa(h.c.ReplDisklessSyncDelay)
+	case "repl-diskless-load":
+		v = h.c.ReplDisklessLoad
+	case "repl-backlog-size":
+		v = strconv.Itoa(h.c.ReplBacklogSize)
+	case "repl-timeout":
+		v = strconv.Itoa(h.c.ReplTimeout)
+	case "repl-ping-replica-period":
+		v = strconv.Itoa(h.c.ReplPingReplicaPeriod)
+	case "replica-read-only", "slave-read-only":
+		v = pkg.FormatYesNo(h.c.ReplicaReadOnly)
 	}
 
 	res <- resp.Encode([]string{p, v})
@@ -337,24 +717,17 @@ func (h Conf) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 }
 
 type Keys struct {
-	conf pkg.Config
+	store *store.Store
 }
 
-func NewKeys(c pkg.Config) Keys {
-	return Keys{conf: c}
+func NewKeys(s *store.Store) Keys {
+	return Keys{store: s}
 }
 func (h Keys) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
-	r, err := pkg.ReadRDB(path.Join(h.conf.DbDir, h.conf.DbFileName))
-	if err != nil {
-		return err
-	}
-
-	var keys []string
-	for k := range r {
-		keys = append(keys, k)
+	if len(args) < 2 {
+		return ErrInvalidCmd
 	}
-	res <- resp.Encode(keys)
-
+	res <- resp.Encode(h.store.DB(sId).Keys(args[1].Val.(string)))
 	return nil
 }
 
@@ -370,7 +743,7 @@ func (h Type) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		return ErrInvalidCmd
 	}
 	key := args[1].Val.(string)
-	v, ok := h.store.Get(key)
+	v, ok := h.store.DB(sId).Get(key)
 	if ok {
 		res <- resp.EncodeSimple(v.Type)
 	} else {
@@ -399,10 +772,13 @@ func (h Xadd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		}
 		data[args[i].Val.(string)] = args[i+1].Val.(string)
 	}
-	id, err := h.s.SetStream(k, id, data, 0)
+	db := h.s.DB(sId)
+	id, err := db.SetStream(k, id, data, 0)
 	if err != nil {
 		return err
 	}
+	// replicas take the generated ID rather than generating their own
+	db.Propagate(append([]string{"XADD", k, id}, argStrings(args[3:])...)...)
 	res <- resp.Encode(id)
 	return nil
 }
@@ -419,7 +795,7 @@ func (h Xrange) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		return ErrInvalidCmd
 	}
 	k, startId, endId := args[1].Val.(string), args[2].Val.(string), args[3].Val.(string)
-	r := h.s.RangeStream(k, startId, endId)
+	r := h.s.DB(sId).RangeStream(k, startId, endId)
 	res <- resp.Encode(r)
 	return nil
 }
@@ -456,7 +832,7 @@ func (h Xread) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
 		d = append(d, []string{streams[i].Val.(string), indices[i].Val.(string)})
 	}
 
-	r := h.s.ReadStream(d, block)
+	r := h.s.DB(sId).ReadStream(d, block)
 	if block > 0 && r == nil {
 		res <- resp.Nil
 		return nil
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestXaddWrongType(t *testing.T) {
+	const wrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	// every form of id reads the last entry of the stream
+	for _, id := range []string{"1-1", "1-*", "*"} {
+		t.Run(id, func(t *testing.T) {
+			s := store.New(1)
+			s.DB(1).SetString("k", "v", store.SetOpts{})
+
+			args := []resp.Value{}
+			for _, a := range strings.Fields("XADD k " + id + " f 1") {
+				args = append(args, resp.Value{Type: resp.BulkString, Val: a})
+			}
+			res := make(chan []byte, 1)
+			if err := NewXadd(s).Handle(1, args, res); err != nil {
+				res <- resp.EncodeError(err)
+			}
+			if got := string(<-res); got != wrongType {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestReplicaRegistration(t *testing.T) {
+	repl := pkg.NewReplication(pkg.MasterReplica, "", pkg.Config{ReplBacklogSize: 16})
+	replconf := NewReplicaConfig(repl)
+	psync := NewPsync(repl, store.New(1), pkg.Config{})
+	defer repl.DelSlave(1)
+
+	tests := []struct {
+		sId    int64
+		cmd    string
+		slaves int
+	}{
+		// a master asking the master link, and a client that never synced
+		{sId: -2, cmd: "REPLCONF GETACK *"},
+		{sId: 3, cmd: "REPLCONF ACK 0"},
+		{sId: 1, cmd: "REPLCONF listening-port 6380"},
+		{sId: 1, cmd: "REPLCONF capa eof capa psync2"},
+		{sId: 1, cmd: "PSYNC ? -1", slaves: 1},
+		{sId: 1, cmd: "REPLCONF ACK 0", slaves: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd, func(t *testing.T) {
+			args := []resp.Value{}
+			for _, a := range strings.Fields(tt.cmd) {
+				args = append(args, resp.Value{Type: resp.BulkString, Val: a})
+			}
+			var h Handler = replconf
+			if args[0].Val == "PSYNC" {
+				h = psync
+			}
+			if err := h.Handle(tt.sId, args, make(chan []byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(repl.GetSlaves()); got != tt.slaves {
+				t.Errorf("%d replicas, want %d", got, tt.slaves)
+			}
+		})
+	}
+	if s, ok := repl.GetSlave(1); !ok || !s.HasCapa("eof") {
+		t.Error("capabilities announced before PSYNC lost")
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+type PFAdd struct {
+	store *store.Store
+}
+
+func NewPFAdd(s *store.Store) PFAdd {
+	return PFAdd{store: s}
+}
+func (h PFAdd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	updated, err := db.PFAdd(args[1].Val.(string), argStrings(args[2:]))
+	if err != nil {
+		return err
+	}
+	if !updated {
+		res <- resp.Encode(0)
+		return nil
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(1)
+	return nil
+}
+
+type PFCount struct {
+	store *store.Store
+}
+
+func NewPFCount(s *store.Store) PFCount {
+	return PFCount{store: s}
+}
+func (h PFCount) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	n, err := h.store.DB(sId).PFCount(argStrings(args[1:]))
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(int64(n))
+	return nil
+}
+
+type PFMerge struct {
+	store *store.Store
+}
+
+func NewPFMerge(s *store.Store) PFMerge {
+	return PFMerge{store: s}
+}
+func (h PFMerge) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	if err := db.PFMerge(args[1].Val.(string), argStrings(args[2:])); err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+// encodeJSONResults replies with the single result of a legacy path, or with
+// one result per match of a JSONPath, nil where the match had the wrong type.
+func encodeJSONResults(path string, vals []any) []byte {
+	if !store.IsJSONPath(path) {
+		if len(vals) == 0 || vals[0] == nil {
+			return resp.Nil
+		}
+		return resp.Encode(vals[0])
+	}
+	r := make([]any, len(vals))
+	for i, v := range vals {
+		if v == nil {
+			r[i] = resp.Nil
+		} else {
+			r[i] = v
+		}
+	}
+	return resp.Encode(r)
+}
+
+type JSONSet struct {
+	store *store.Store
+}
+
+func NewJSONSet(s *store.Store) JSONSet {
+	return JSONSet{store: s}
+}
+func (h JSONSet) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	var nx, xx bool
+	for _, a := range args[4:] {
+		switch strings.ToUpper(a.Val.(string)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return ErrSyntax
+		}
+	}
+	if nx && xx {
+		return ErrSyntax
+	}
+
+	db := h.store.DB(sId)
+	ok, err := db.JSONSet(args[1].Val.(string), args[2].Val.(string), args[3].Val.(string), nx, xx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res <- resp.Nil
+		return nil
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+type JSONGet struct {
+	store *store.Store
+}
+
+func NewJSONGet(s *store.Store) JSONGet {
+	return JSONGet{store: s}
+}
+func (h JSONGet) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	var f store.JSONFormat
+	var paths []string
+	for i := 2; i < len(args); i++ {
+		arg := args[i].Val.(string)
+		var opt *string
+		switch strings.ToUpper(arg) {
+		case "INDENT":
+			opt = &f.Indent
+		case "NEWLINE":
+			opt = &f.Newline
+		case "SPACE":
+			opt = &f.Space
+		default:
+			paths = append(paths, arg)
+			continue
+		}
+		if i+1 == len(args) {
+			return ErrSyntax
+		}
+		*opt = args[i+1].Val.(string)
+		i++
+	}
+
+	s, ok, err := h.store.DB(sId).JSONGet(args[1].Val.(string), paths, f)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res <- resp.Nil
+		return nil
+	}
+	res <- resp.Encode(s)
+	return nil
+}
+
+type JSONMGet struct {
+	store *store.Store
+}
+
+func NewJSONMGet(s *store.Store) JSONMGet {
+	return JSONMGet{store: s}
+}
+func (h JSONMGet) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	vals, err := h.store.DB(sId).JSONMGet(argStrings(args[1:len(args)-1]), args[len(args)-1].Val.(string))
+	if err != nil {
+		return err
+	}
+	r := make([]any, len(vals))
+	for i, v := range vals {
+		if v == nil {
+			r[i] = resp.Nil
+		} else {
+			r[i] = *v
+		}
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+// JSONDel handles JSON.DEL and its alias JSON.FORGET.
+type JSONDel struct {
+	store *store.Store
+}
+
+func NewJSONDel(s *store.Store) JSONDel {
+	return JSONDel{store: s}
+}
+func (h JSONDel) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	if len(args) > 3 {
+		return ErrSyntax
+	}
+	path := "$"
+	if len(args) == 3 {
+		path = args[2].Val.(string)
+	}
+
+	db := h.store.DB(sId)
+	n, err := db.JSONDel(args[1].Val.(string), path)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		db.Propagate(argStrings(args)...)
+	}
+	res <- resp.Encode(n)
+	return nil
+}
+
+type JSONNumIncrBy struct {
+	store *store.Store
+}
+
+func NewJSONNumIncrBy(s *store.Store) JSONNumIncrBy {
+	return JSONNumIncrBy{store: s}
+}
+func (h JSONNumIncrBy) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 4 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	s, err := db.JSONNumIncrBy(args[1].Val.(string), args[2].Val.(string), args[3].Val.(string))
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(s)
+	return nil
+}
+
+type JSONArrAppend struct {
+	store *store.Store
+}
+
+func NewJSONArrAppend(s *store.Store) JSONArrAppend {
+	return JSONArrAppend{store: s}
+}
+func (h JSONArrAppend) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	path := args[2].Val.(string)
+	lens, err := db.JSONArrAppend(args[1].Val.(string), path, argStrings(args[3:]))
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- encodeJSONResults(path, lens)
+	return nil
+}
+
+// jsonQuery is a read-only JSON command taking a key and an optional path,
+// which defaults to the root.
+type jsonQuery func(db *store.DB, k, path string) ([]any, bool, error)
+
+func handleJSONQuery(db *store.DB, args []resp.Value, res chan<- []byte, q jsonQuery) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	if len(args) > 3 {
+		return ErrSyntax
+	}
+	path := "$"
+	if len(args) == 3 {
+		path = args[2].Val.(string)
+	}
+	vals, ok, err := q(db, args[1].Val.(string), path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res <- resp.Nil
+		return nil
+	}
+	res <- encodeJSONResults(path, vals)
+	return nil
+}
+
+type JSONArrLen struct {
+	store *store.Store
+}
+
+func NewJSONArrLen(s *store.Store) JSONArrLen {
+	return JSONArrLen{store: s}
+}
+func (h JSONArrLen) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	return handleJSONQuery(h.store.DB(sId), args, res, (*store.DB).JSONArrLen)
+}
+
+type JSONObjKeys struct {
+	store *store.Store
+}
+
+func NewJSONObjKeys(s *store.Store) JSONObjKeys {
+	return JSONObjKeys{store: s}
+}
+func (h JSONObjKeys) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	return handleJSONQuery(h.store.DB(sId), args, res, (*store.DB).JSONObjKeys)
+}
+
+type JSONType struct {
+	store *store.Store
+}
+
+func NewJSONType(s *store.Store) JSONType {
+	return JSONType{store: s}
+}
+func (h JSONType) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	return handleJSONQuery(h.store.DB(sId), args, res, (*store.DB).JSONTypes)
+}
@@ -0,0 +1,432 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+var (
+	ErrNotInteger = store.ErrNotInteger
+	ErrSyntax     = errors.New("syntax error")
+)
+
+func argStrings(args []resp.Value) []string {
+	r := make([]string, len(args))
+	for i, v := range args {
+		r[i] = v.Val.(string)
+	}
+	return r
+}
+
+func errInvalidExpire(cmd string) error {
+	return fmt.Errorf("invalid expire time in '%s' command", cmd)
+}
+
+func parseInt(v resp.Value) (int64, error) {
+	n, err := strconv.ParseInt(v.Val.(string), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+type Del struct {
+	store *store.Store
+}
+
+func NewDel(s *store.Store) Del {
+	return Del{store: s}
+}
+func (h Del) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	n := db.Del(argStrings(args[1:])...)
+	if n > 0 {
+		db.Propagate(argStrings(args)...)
+	}
+	res <- resp.Encode(n)
+	return nil
+}
+
+type Exists struct {
+	store *store.Store
+}
+
+func NewExists(s *store.Store) Exists {
+	return Exists{store: s}
+}
+func (h Exists) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	res <- resp.Encode(h.store.DB(sId).Exists(argStrings(args[1:])...))
+	return nil
+}
+
+// Expire handles EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. Successful calls are
+// propagated as PEXPIREAT so replicas share the master's absolute deadline.
+type Expire struct {
+	store *store.Store
+	name  string
+	unit  time.Duration
+	abs   bool
+}
+
+func NewExpire(s *store.Store) Expire {
+	return Expire{store: s, name: "expire", unit: time.Second}
+}
+func NewPexpire(s *store.Store) Expire {
+	return Expire{store: s, name: "pexpire", unit: time.Millisecond}
+}
+func NewExpireat(s *store.Store) Expire {
+	return Expire{store: s, name: "expireat", unit: time.Second, abs: true}
+}
+func NewPexpireat(s *store.Store) Expire {
+	return Expire{store: s, name: "pexpireat", unit: time.Millisecond, abs: true}
+}
+
+func (h Expire) parse(args []resp.Value) (store.ExpireFlag, error) {
+	flag := store.ExpireAlways
+	for _, a := range args[3:] {
+		switch strings.ToUpper(a.Val.(string)) {
+		case "NX":
+			flag |= store.ExpireNX
+		case "XX":
+			flag |= store.ExpireXX
+		case "GT":
+			flag |= store.ExpireGT
+		case "LT":
+			flag |= store.ExpireLT
+		default:
+			return 0, fmt.Errorf("Unsupported option %s", a.Val.(string))
+		}
+	}
+	if flag&store.ExpireNX != 0 && flag != store.ExpireNX {
+		return 0, errors.New("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if flag&store.ExpireGT != 0 && flag&store.ExpireLT != 0 {
+		return 0, errors.New("GT and LT options at the same time are not compatible")
+	}
+	return flag, nil
+}
+
+func (h Expire) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	k := args[1].Val.(string)
+	n, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	flag, err := h.parse(args)
+	if err != nil {
+		return err
+	}
+
+	unit := int64(h.unit / time.Millisecond)
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return errInvalidExpire(h.name)
+	}
+	ms := n * unit
+	if !h.abs {
+		now := time.Now().UnixMilli()
+		if ms > 0 && now > math.MaxInt64-ms {
+			return errInvalidExpire(h.name)
+		}
+		ms += now
+	}
+
+	db := h.store.DB(sId)
+	at := time.UnixMilli(ms)
+	if !db.Expire(k, at, flag) {
+		res <- resp.Encode(0)
+		return nil
+	}
+	if at.After(time.Now()) {
+		db.Propagate("PEXPIREAT", k, strconv.FormatInt(ms, 10))
+	} else {
+		db.Propagate("DEL", k)
+	}
+	res <- resp.Encode(1)
+	return nil
+}
+
+// TTL handles TTL, PTTL, EXPIRETIME and PEXPIRETIME.
+type TTL struct {
+	store *store.Store
+	unit  time.Duration
+	abs   bool
+}
+
+func NewTTL(s *store.Store) TTL {
+	return TTL{store: s, unit: time.Second}
+}
+func NewPTTL(s *store.Store) TTL {
+	return TTL{store: s, unit: time.Millisecond}
+}
+func NewExpiretime(s *store.Store) TTL {
+	return TTL{store: s, unit: time.Second, abs: true}
+}
+func NewPexpiretime(s *store.Store) TTL {
+	return TTL{store: s, unit: time.Millisecond, abs: true}
+}
+func (h TTL) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	ex, ok, canExpire := h.store.DB(sId).Expiry(args[1].Val.(string))
+	if !ok {
+		res <- resp.Encode(-2)
+		return nil
+	}
+	if !canExpire {
+		res <- resp.Encode(-1)
+		return nil
+	}
+
+	unit := int64(h.unit / time.Millisecond)
+	if h.abs {
+		res <- resp.Encode(int(ex.UnixMilli() / unit))
+		return nil
+	}
+	ms := time.Until(ex).Milliseconds()
+	if ms < 0 {
+		ms = 0
+	}
+	res <- resp.Encode(int((ms + unit/2) / unit))
+	return nil
+}
+
+type Persist struct {
+	store *store.Store
+}
+
+func NewPersist(s *store.Store) Persist {
+	return Persist{store: s}
+}
+func (h Persist) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	if !db.Persist(args[1].Val.(string)) {
+		res <- resp.Encode(0)
+		return nil
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(1)
+	return nil
+}
+
+type Dump struct {
+	store *store.Store
+}
+
+func NewDump(s *store.Store) Dump {
+	return Dump{store: s}
+}
+func (h Dump) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 2 {
+		return ErrInvalidCmd
+	}
+	b, ok, err := h.store.DB(sId).Dump(args[1].Val.(string))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res <- resp.Nil
+		return nil
+	}
+	res <- resp.Encode(string(b))
+	return nil
+}
+
+type Restore struct {
+	store *store.Store
+}
+
+func NewRestore(s *store.Store) Restore {
+	return Restore{store: s}
+}
+func (h Restore) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	k := args[1].Val.(string)
+	ttl, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return errors.New("invalid TTL value, must be >= 0")
+	}
+	var replace, abs bool
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Val.(string)) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			abs = true
+		case "IDLETIME", "FREQ":
+			// access statistics are not tracked
+			if i+1 >= len(args) {
+				return ErrSyntax
+			}
+			if n, err := parseInt(args[i+1]); err != nil || n < 0 {
+				return fmt.Errorf("invalid %s value, must be >= 0", strings.ToUpper(args[i].Val.(string)))
+			}
+			i++
+		default:
+			return ErrSyntax
+		}
+	}
+
+	var at time.Time
+	if ttl > 0 {
+		if !abs {
+			ttl += time.Now().UnixMilli()
+		}
+		at = time.UnixMilli(ttl)
+	}
+	db := h.store.DB(sId)
+	stored, err := db.Restore(k, []byte(args[3].Val.(string)), at, replace)
+	if err != nil {
+		return err
+	}
+	if stored {
+		cmd := []string{"RESTORE", k, strconv.FormatInt(at.UnixMilli(), 10), args[3].Val.(string), "ABSTTL"}
+		if at.IsZero() {
+			cmd[2] = "0"
+		}
+		if replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		db.Propagate(cmd...)
+	} else if replace {
+		db.Propagate("DEL", k)
+	}
+	res <- resp.Ok
+	return nil
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type scanOpts struct {
+	store.ScanOpts
+	noValues bool
+}
+
+func parseScan(cursor resp.Value, args []resp.Value) (scanOpts, error) {
+	var o scanOpts
+	c, err := strconv.ParseUint(cursor.Val.(string), 10, 64)
+	if err != nil {
+		return o, ErrInvalidCursor
+	}
+	o.Cursor = c
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Val.(string))
+		if opt == "NOVALUES" {
+			o.noValues = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return o, ErrSyntax
+		}
+		switch opt {
+		case "MATCH":
+			o.Match = args[i+1].Val.(string)
+		case "COUNT":
+			n, err := parseInt(args[i+1])
+			if err != nil {
+				return o, err
+			}
+			if n < 1 {
+				return o, ErrSyntax
+			}
+			o.Count = int(n)
+		case "TYPE":
+			o.Type = args[i+1].Val.(string)
+		default:
+			return o, ErrSyntax
+		}
+		i++
+	}
+	return o, nil
+}
+
+type Scan struct {
+	store *store.Store
+}
+
+func NewScan(s *store.Store) Scan {
+	return Scan{store: s}
+}
+func (h Scan) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	o, err := parseScan(args[1], args[2:])
+	if err != nil {
+		return err
+	}
+	if o.noValues {
+		return ErrSyntax
+	}
+	next, keys := h.store.DB(sId).Scan(o.ScanOpts)
+	if keys == nil {
+		keys = []string{}
+	}
+	res <- resp.Encode([]any{strconv.FormatUint(next, 10), keys})
+	return nil
+}
+
+// CollectionScan handles HSCAN, SSCAN and ZSCAN.
+type CollectionScan struct {
+	store *store.Store
+	typ   string
+}
+
+func NewHscan(s *store.Store) CollectionScan {
+	return CollectionScan{store: s, typ: "hash"}
+}
+func NewSscan(s *store.Store) CollectionScan {
+	return CollectionScan{store: s, typ: "set"}
+}
+func NewZscan(s *store.Store) CollectionScan {
+	return CollectionScan{store: s, typ: "zset"}
+}
+func (h CollectionScan) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	o, err := parseScan(args[2], args[3:])
+	if err != nil {
+		return err
+	}
+	if o.Type != "" || (o.noValues && h.typ != "hash") {
+		return ErrSyntax
+	}
+	next, items, err := h.store.DB(sId).ScanCollection(args[1].Val.(string), h.typ, o.ScanOpts)
+	if err != nil {
+		return err
+	}
+	if o.noValues {
+		fields := []string{}
+		for i := 0; i < len(items); i += 2 {
+			fields = append(fields, items[i])
+		}
+		items = fields
+	}
+	res <- resp.Encode([]any{strconv.FormatUint(next, 10), items})
+	return nil
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestExpireOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		// ttl is the key's expiry before the call, 0 for none
+		ttl  time.Duration
+		opts string
+		want string
+	}{
+		{name: "XX GT without ttl", opts: "XX GT", want: ":0\r\n"},
+		{name: "XX LT without ttl", opts: "XX LT", want: ":0\r\n"},
+		{name: "LT without ttl", opts: "LT", want: ":1\r\n"},
+		{name: "GT without ttl", opts: "GT", want: ":0\r\n"},
+		{name: "XX GT with shorter ttl", ttl: time.Second, opts: "XX GT", want: ":1\r\n"},
+		{name: "XX LT with shorter ttl", ttl: time.Second, opts: "XX LT", want: ":0\r\n"},
+		{name: "XX LT with longer ttl", ttl: time.Hour, opts: "XX LT", want: ":1\r\n"},
+		{name: "NX with ttl", ttl: time.Hour, opts: "NX", want: ":0\r\n"},
+		{name: "NX XX", opts: "NX XX", want: "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n"},
+		{name: "NX GT", opts: "NX GT", want: "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n"},
+		{name: "GT LT", opts: "XX GT LT", want: "-ERR GT and LT options at the same time are not compatible\r\n"},
+		{name: "unknown option", opts: "FOO", want: "-ERR Unsupported option FOO\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := store.New(1)
+			db := s.DB(1)
+			o := store.SetOpts{}
+			if tt.ttl > 0 {
+				o.At = time.Now().Add(tt.ttl)
+			}
+			db.SetString("k", "v", o)
+
+			args := []resp.Value{}
+			for _, a := range append([]string{"EXPIRE", "k", "100"}, strings.Fields(tt.opts)...) {
+				args = append(args, resp.Value{Type: resp.BulkString, Val: a})
+			}
+			res := make(chan []byte, 1)
+			if err := NewExpire(s).Handle(1, args, res); err != nil {
+				res <- resp.EncodeError(err)
+			}
+			if got := string(<-res); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
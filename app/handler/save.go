@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"errors"
+	"path"
+
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+type Save struct {
+	store *store.Store
+	path  string
+}
+
+func NewSave(s *store.Store, c pkg.Config) Save {
+	return Save{store: s, path: path.Join(c.DbDir, c.DbFileName)}
+}
+func (h Save) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 1 {
+		return ErrInvalidCmd
+	}
+	if err := h.store.Save(h.path); err != nil {
+		return err
+	}
+	res <- resp.Ok
+	return nil
+}
+
+type BGSave struct {
+	store *store.Store
+	path  string
+}
+
+func NewBGSave(s *store.Store, c pkg.Config) BGSave {
+	return BGSave{store: s, path: path.Join(c.DbDir, c.DbFileName)}
+}
+func (h BGSave) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) > 2 {
+		return ErrInvalidCmd
+	}
+	if err := h.store.BGSave(h.path); err != nil {
+		return err
+	}
+	res <- resp.EncodeSimple("Background saving started")
+	return nil
+}
+
+type LastSave struct {
+	store *store.Store
+}
+
+func NewLastSave(s *store.Store) LastSave {
+	return LastSave{store: s}
+}
+func (h LastSave) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 1 {
+		return ErrInvalidCmd
+	}
+	res <- resp.Encode(h.store.LastSave().Unix())
+	return nil
+}
+
+var ErrAOFDisabled = errors.New("append only file is disabled")
+
+type BGRewriteAOF struct {
+	aof *aof.AOF
+}
+
+// NewBGRewriteAOF builds the handler; a is nil when appendonly is off.
+func NewBGRewriteAOF(a *aof.AOF) BGRewriteAOF {
+	return BGRewriteAOF{aof: a}
+}
+func (h BGRewriteAOF) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) != 1 {
+		return ErrInvalidCmd
+	}
+	if h.aof == nil {
+		return ErrAOFDisabled
+	}
+	if err := h.aof.Rewrite(); err != nil {
+		return err
+	}
+	res <- resp.EncodeSimple("Background append only file rewriting started")
+	return nil
+}
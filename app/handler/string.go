@@ -0,0 +1,580 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+var (
+	ErrNotFloat     = store.ErrNotFloat
+	ErrOffsetRange  = errors.New("offset is out of range")
+	ErrLCSType      = errors.New("the specified keys must contain string values")
+	ErrLCSLenAndIdx = errors.New("if you want both the length and indexes, please just use IDX")
+	ErrLCSMemory    = errors.New("insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+)
+
+func parseFloat(v resp.Value) (float64, error) {
+	f, err := strconv.ParseFloat(v.Val.(string), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, ErrNotFloat
+	}
+	return f, nil
+}
+
+// IncrBy handles INCR, DECR, INCRBY and DECRBY.
+type IncrBy struct {
+	store *store.Store
+	sign  int64
+	by    bool
+}
+
+func NewIncr(s *store.Store) IncrBy {
+	return IncrBy{store: s, sign: 1}
+}
+func NewDecr(s *store.Store) IncrBy {
+	return IncrBy{store: s, sign: -1}
+}
+func NewIncrBy(s *store.Store) IncrBy {
+	return IncrBy{store: s, sign: 1, by: true}
+}
+func NewDecrBy(s *store.Store) IncrBy {
+	return IncrBy{store: s, sign: -1, by: true}
+}
+func (h IncrBy) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 || (h.by && len(args) < 3) {
+		return ErrInvalidCmd
+	}
+	delta := int64(1)
+	if h.by {
+		var err error
+		delta, err = parseInt(args[2])
+		if err != nil {
+			return err
+		}
+		if h.sign < 0 && delta == math.MinInt64 {
+			return store.ErrOverflow
+		}
+	}
+
+	db := h.store.DB(sId)
+	n, err := db.IncrBy(args[1].Val.(string), h.sign*delta)
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(n)
+	return nil
+}
+
+type IncrByFloat struct {
+	store *store.Store
+}
+
+func NewIncrByFloat(s *store.Store) IncrByFloat {
+	return IncrByFloat{store: s}
+}
+func (h IncrByFloat) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	delta, err := parseFloat(args[2])
+	if err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	k := args[1].Val.(string)
+	v, err := db.IncrByFloat(k, delta)
+	if err != nil {
+		return err
+	}
+	// replicas get the result rather than redoing the float arithmetic
+	db.Propagate("SET", k, v, "KEEPTTL")
+	res <- resp.Encode(v)
+	return nil
+}
+
+type Append struct {
+	store *store.Store
+}
+
+func NewAppend(s *store.Store) Append {
+	return Append{store: s}
+}
+func (h Append) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	n, err := db.Append(args[1].Val.(string), args[2].Val.(string))
+	if err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(n)
+	return nil
+}
+
+type Strlen struct {
+	store *store.Store
+}
+
+func NewStrlen(s *store.Store) Strlen {
+	return Strlen{store: s}
+}
+func (h Strlen) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	n, err := h.store.DB(sId).Strlen(args[1].Val.(string))
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(n)
+	return nil
+}
+
+type GetRange struct {
+	store *store.Store
+}
+
+func NewGetRange(s *store.Store) GetRange {
+	return GetRange{store: s}
+}
+func (h GetRange) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	start, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	end, err := parseInt(args[3])
+	if err != nil {
+		return err
+	}
+	v, err := h.store.DB(sId).GetRange(args[1].Val.(string), start, end)
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(v)
+	return nil
+}
+
+type SetRange struct {
+	store *store.Store
+}
+
+func NewSetRange(s *store.Store) SetRange {
+	return SetRange{store: s}
+}
+func (h SetRange) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	offset, err := parseInt(args[2])
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return ErrOffsetRange
+	}
+	db := h.store.DB(sId)
+	v := args[3].Val.(string)
+	n, err := db.SetRange(args[1].Val.(string), offset, v)
+	if err != nil {
+		return err
+	}
+	if len(v) > 0 {
+		db.Propagate(argStrings(args)...)
+	}
+	res <- resp.Encode(n)
+	return nil
+}
+
+type MGet struct {
+	store *store.Store
+}
+
+func NewMGet(s *store.Store) MGet {
+	return MGet{store: s}
+}
+func (h MGet) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	vals := h.store.DB(sId).MGet(argStrings(args[1:])...)
+	r := make([]any, len(vals))
+	for i, v := range vals {
+		if v == nil {
+			r[i] = resp.Nil
+		} else {
+			r[i] = *v
+		}
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+// MSet handles MSET and MSETNX.
+type MSet struct {
+	store *store.Store
+	nx    bool
+}
+
+func NewMSet(s *store.Store) MSet {
+	return MSet{store: s}
+}
+func NewMSetNX(s *store.Store) MSet {
+	return MSet{store: s, nx: true}
+}
+func (h MSet) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	pairs := argStrings(args[1:])
+	if !h.nx {
+		db.MSet(pairs)
+		db.Propagate(argStrings(args)...)
+		res <- resp.Ok
+		return nil
+	}
+	if !db.MSetNX(pairs) {
+		res <- resp.Encode(0)
+		return nil
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Encode(1)
+	return nil
+}
+
+type GetDel struct {
+	store *store.Store
+}
+
+func NewGetDel(s *store.Store) GetDel {
+	return GetDel{store: s}
+}
+func (h GetDel) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	db := h.store.DB(sId)
+	k := args[1].Val.(string)
+	v, ok, err := db.GetDel(k)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res <- resp.Nil
+		return nil
+	}
+	db.Propagate("DEL", k)
+	res <- resp.Encode(v)
+	return nil
+}
+
+type GetEx struct {
+	store *store.Store
+}
+
+func NewGetEx(s *store.Store) GetEx {
+	return GetEx{store: s}
+}
+func (h GetEx) parse(args []resp.Value) (store.GetExOpts, error) {
+	var o store.GetExOpts
+	var set bool
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Val.(string))
+		if opt == "PERSIST" {
+			if set {
+				return o, ErrSyntax
+			}
+			o.Persist, set = true, true
+			continue
+		}
+
+		var unit time.Duration
+		var abs bool
+		switch opt {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		case "EXAT":
+			unit, abs = time.Second, true
+		case "PXAT":
+			unit, abs = time.Millisecond, true
+		default:
+			return o, ErrSyntax
+		}
+		if set || i+1 >= len(args) {
+			return o, ErrSyntax
+		}
+		n, err := parseInt(args[i+1])
+		if err != nil {
+			return o, err
+		}
+		at, err := expireAt(n, unit, abs)
+		if err != nil {
+			return o, errInvalidExpire("getex")
+		}
+		o.At, set = at, true
+		i++
+	}
+	return o, nil
+}
+func (h GetEx) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	o, err := h.parse(args)
+	if err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	k := args[1].Val.(string)
+	v, ok, err := db.GetEx(k, o)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		res <- resp.Nil
+		return nil
+	}
+	switch {
+	case o.Persist:
+		db.Propagate("PERSIST", k)
+	case !o.At.IsZero() && !o.At.After(time.Now()):
+		db.Propagate("DEL", k)
+	case !o.At.IsZero():
+		db.Propagate("PEXPIREAT", k, strconv.FormatInt(o.At.UnixMilli(), 10))
+	}
+	res <- resp.Encode(v)
+	return nil
+}
+
+// expireAt converts a relative or absolute expire argument to a deadline.
+// Non positive values are rejected as Redis does for SET and GETEX.
+func expireAt(n int64, unit time.Duration, abs bool) (time.Time, error) {
+	u := int64(unit / time.Millisecond)
+	if n <= 0 || n > math.MaxInt64/u {
+		return time.Time{}, ErrNotInteger
+	}
+	ms := n * u
+	if !abs {
+		now := time.Now().UnixMilli()
+		if now > math.MaxInt64-ms {
+			return time.Time{}, ErrNotInteger
+		}
+		ms += now
+	}
+	return time.UnixMilli(ms), nil
+}
+
+type LCS struct {
+	store *store.Store
+}
+type lcsOpts struct {
+	len          bool
+	idx          bool
+	minMatchLen  int64
+	withMatchLen bool
+}
+
+func NewLCS(s *store.Store) LCS {
+	return LCS{store: s}
+}
+func (h LCS) parse(args []resp.Value) (lcsOpts, error) {
+	var o lcsOpts
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Val.(string)) {
+		case "LEN":
+			o.len = true
+		case "IDX":
+			o.idx = true
+		case "WITHMATCHLEN":
+			o.withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return o, ErrSyntax
+			}
+			n, err := parseInt(args[i+1])
+			if err != nil {
+				return o, err
+			}
+			o.minMatchLen = max(n, 0)
+			i++
+		default:
+			return o, ErrSyntax
+		}
+	}
+	if o.len && o.idx {
+		return o, ErrLCSLenAndIdx
+	}
+	return o, nil
+}
+func (h LCS) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	o, err := h.parse(args)
+	if err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	a, _, err := db.GetString(args[1].Val.(string))
+	if err != nil {
+		return ErrLCSType
+	}
+	b, _, err := db.GetString(args[2].Val.(string))
+	if err != nil {
+		return ErrLCSType
+	}
+	if (int64(len(a))+1)*(int64(len(b))+1)*4 > store.MaxStringLen {
+		return ErrLCSMemory
+	}
+
+	r := lcs(a, b)
+	switch {
+	case o.len:
+		res <- resp.Encode(r.len)
+	case o.idx:
+		matches := []any{}
+		for _, m := range r.matches {
+			if o.minMatchLen > 0 && int64(m.len) < o.minMatchLen {
+				continue
+			}
+			match := []any{[]int{m.a[0], m.a[1]}, []int{m.b[0], m.b[1]}}
+			if o.withMatchLen {
+				match = append(match, m.len)
+			}
+			matches = append(matches, match)
+		}
+		res <- resp.Encode([]any{"matches", matches, "len", r.len})
+	default:
+		res <- resp.Encode(r.seq)
+	}
+	return nil
+}
+
+type lcsMatch struct {
+	a, b [2]int
+	len  int
+}
+type lcsResult struct {
+	seq     string
+	len     int
+	matches []lcsMatch
+}
+
+// lcs computes the longest common subsequence of a and b. Matching ranges are
+// reported from the end of the strings backwards, as Redis does.
+func lcs(a, b string) lcsResult {
+	w := len(b) + 1
+	t := make([]uint32, (len(a)+1)*w)
+	at := func(i, j int) uint32 { return t[i*w+j] }
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				t[i*w+j] = at(i-1, j-1) + 1
+			} else {
+				t[i*w+j] = max(at(i-1, j), at(i, j-1))
+			}
+		}
+	}
+
+	n := int(at(len(a), len(b)))
+	r := lcsResult{len: n}
+	seq := make([]byte, n)
+	idx := n
+
+	// aStart == len(a) means no range is being tracked
+	aStart, aEnd, bStart, bEnd := len(a), 0, 0, 0
+	i, j := len(a), len(b)
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			seq[idx-1] = a[i-1]
+			if aStart == len(a) {
+				aStart, aEnd = i-1, i-1
+				bStart, bEnd = j-1, j-1
+			} else if aStart == i && bStart == j {
+				aStart--
+				bStart--
+			} else {
+				emit = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if at(i-1, j) > at(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			if aStart != len(a) {
+				emit = true
+			}
+		}
+
+		if emit {
+			r.matches = append(r.matches, lcsMatch{
+				a:   [2]int{aStart, aEnd},
+				b:   [2]int{bStart, bEnd},
+				len: aEnd - aStart + 1,
+			})
+			aStart = len(a)
+		}
+	}
+	r.seq = string(seq)
+	return r
+}
+
+type Object struct {
+	store *store.Store
+}
+
+func NewObject(s *store.Store) Object {
+	return Object{store: s}
+}
+func (h Object) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	sub := strings.ToUpper(args[1].Val.(string))
+	if sub == "HELP" {
+		res <- resp.Encode([]string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+		})
+		return nil
+	}
+	if len(args) < 3 {
+		return ErrInvalidCmd
+	}
+	switch sub {
+	case "ENCODING":
+		v, ok := h.store.DB(sId).Get(args[2].Val.(string))
+		if !ok {
+			res <- resp.Nil
+			return nil
+		}
+		res <- resp.Encode(v.Encoding())
+		return nil
+	}
+	return fmt.Errorf("unknown subcommand '%s'. Try OBJECT HELP.", args[1].Val.(string))
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestLCS(t *testing.T) {
+	ts := []struct {
+		a, b    string
+		seq     string
+		matches []lcsMatch
+	}{
+		{
+			a:   "ohmytext",
+			b:   "mynewtext",
+			seq: "mytext",
+			matches: []lcsMatch{
+				{a: [2]int{4, 7}, b: [2]int{5, 8}, len: 4},
+				{a: [2]int{2, 3}, b: [2]int{0, 1}, len: 2},
+			},
+		},
+		{
+			a:   "abc",
+			b:   "xyz",
+			seq: "",
+		},
+		{
+			a:   "",
+			b:   "abc",
+			seq: "",
+		},
+	}
+
+	for _, tt := range ts {
+		r := lcs(tt.a, tt.b)
+		if r.seq != tt.seq {
+			t.Fatalf("want %q, got %q", tt.seq, r.seq)
+		}
+		if r.len != len(tt.seq) {
+			t.Fatalf("want %d, got %d", len(tt.seq), r.len)
+		}
+		if !reflect.DeepEqual(r.matches, tt.matches) {
+			t.Fatalf("want %+v, got %+v", tt.matches, r.matches)
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	const (
+		syntax    = "-ERR Syntax error\r\n"
+		expire    = "-ERR Invalid expire time in 'set' command\r\n"
+		wrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	)
+	inSecs := fmt.Sprint(time.Now().Add(100 * time.Second).Unix())
+	inMs := fmt.Sprint(time.Now().Add(5 * time.Second).UnixMilli())
+
+	tests := []struct {
+		// old is what k holds before the call: "", "string" holding old with
+		// an hour to live, or "stream"
+		old  string
+		opts string
+		want string
+		// val is k after the call, with ttl left on it, 0 for none
+		val string
+		ttl time.Duration
+	}{
+		{old: "", opts: "", want: "+OK\r\n", val: "new"},
+		{old: "string", opts: "", want: "+OK\r\n", val: "new"},
+		{old: "", opts: "NX", want: "+OK\r\n", val: "new"},
+		{old: "string", opts: "NX", want: "$-1\r\n", val: "old", ttl: time.Hour},
+		{old: "", opts: "XX", want: "$-1\r\n"},
+		{old: "string", opts: "XX", want: "+OK\r\n", val: "new"},
+		{old: "", opts: "GET", want: "$-1\r\n", val: "new"},
+		{old: "string", opts: "GET", want: "$3\r\nold\r\n", val: "new"},
+		{old: "string", opts: "NX GET", want: "$3\r\nold\r\n", val: "old", ttl: time.Hour},
+		{old: "", opts: "XX GET", want: "$-1\r\n"},
+		{old: "string", opts: "XX GET", want: "$3\r\nold\r\n", val: "new"},
+		{old: "", opts: "EX 100", want: "+OK\r\n", val: "new", ttl: 100 * time.Second},
+		{old: "string", opts: "PX 5000", want: "+OK\r\n", val: "new", ttl: 5 * time.Second},
+		{old: "", opts: "EXAT " + inSecs, want: "+OK\r\n", val: "new", ttl: 100 * time.Second},
+		{old: "", opts: "PXAT " + inMs, want: "+OK\r\n", val: "new", ttl: 5 * time.Second},
+		{old: "string", opts: "EXAT 1", want: "+OK\r\n"},
+		{old: "string", opts: "KEEPTTL", want: "+OK\r\n", val: "new", ttl: time.Hour},
+		{old: "", opts: "KEEPTTL", want: "+OK\r\n", val: "new"},
+		{old: "string", opts: "XX KEEPTTL GET", want: "$3\r\nold\r\n", val: "new", ttl: time.Hour},
+		{old: "string", opts: "EX 0", want: expire, val: "old", ttl: time.Hour},
+		{old: "string", opts: "PX -1", want: expire, val: "old", ttl: time.Hour},
+		{old: "string", opts: "EX soon", want: "-ERR Value is not an integer or out of range\r\n", val: "old", ttl: time.Hour},
+		{old: "string", opts: "EX", want: syntax, val: "old", ttl: time.Hour},
+		{old: "string", opts: "NX XX", want: syntax, val: "old", ttl: time.Hour},
+		{old: "string", opts: "EX 10 PX 100", want: syntax, val: "old", ttl: time.Hour},
+		{old: "string", opts: "EX 10 KEEPTTL", want: syntax, val: "old", ttl: time.Hour},
+		{old: "string", opts: "KEEPTTL PXAT " + inMs, want: syntax, val: "old", ttl: time.Hour},
+		{old: "string", opts: "FOO", want: syntax, val: "old", ttl: time.Hour},
+		{old: "stream", opts: "", want: "+OK\r\n", val: "new"},
+		{old: "stream", opts: "GET", want: wrongType, val: "stream"},
+		{old: "stream", opts: "NX GET", want: wrongType, val: "stream"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.TrimSpace(tt.old+" "+tt.opts), func(t *testing.T) {
+			s := store.New(1)
+			db := s.DB(1)
+			switch tt.old {
+			case "string":
+				db.SetString("k", "old", store.SetOpts{At: time.Now().Add(time.Hour)})
+			case "stream":
+				db.SetStream("k", "1-1", map[string]string{"f": "v"}, 0)
+			}
+
+			args := []resp.Value{}
+			for _, a := range append([]string{"SET", "k", "new"}, strings.Fields(tt.opts)...) {
+				args = append(args, resp.Value{Type: resp.BulkString, Val: a})
+			}
+			res := make(chan []byte, 1)
+			if err := NewSet(s).Handle(1, args, res); err != nil {
+				res <- resp.EncodeError(err)
+			}
+			if got := string(<-res); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			var val string
+			if v, ok := db.Get("k"); ok && v.Type == "stream" {
+				val = "stream"
+			} else if ok {
+				val, _, _ = db.GetString("k")
+			}
+			var ttl time.Duration
+			if ex, _, canExpire := db.Expiry("k"); canExpire {
+				ttl = time.Until(ex)
+			}
+			// EXAT counts in whole seconds
+			if val != tt.val || (ttl-tt.ttl).Abs() > time.Second {
+				t.Errorf("k = %q with ttl %v, want %q with ttl %v", val, ttl, tt.val, tt.ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+var (
+	ErrTSTimestamp   = errors.New("TSDB: invalid timestamp")
+	ErrTSValue       = errors.New("TSDB: invalid value")
+	ErrTSRetention   = errors.New("TSDB: Couldn't parse RETENTION")
+	ErrTSPolicy      = errors.New("TSDB: Unknown DUPLICATE_POLICY")
+	ErrTSLabels      = errors.New("TSDB: Invalid LABELS")
+	ErrTSCount       = errors.New("TSDB: Couldn't parse COUNT")
+	ErrTSAggregation = errors.New("TSDB: Unknown aggregation type")
+	ErrTSBucket      = errors.New("TSDB: bucketDuration must be greater than zero")
+	ErrTSAlign       = errors.New("TSDB: ALIGN requires AGGREGATION")
+	ErrTSFilter      = errors.New("TSDB: failed parsing labels")
+	ErrTSNoFilter    = errors.New("TSDB: missing FILTER argument")
+)
+
+func parseTimestamp(v resp.Value) (int64, error) {
+	s := v.Val.(string)
+	if s == "*" {
+		return time.Now().UnixMilli(), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrTSTimestamp
+	}
+	return n, nil
+}
+
+func parseSample(ts, val resp.Value) (store.Sample, error) {
+	t, err := parseTimestamp(ts)
+	if err != nil {
+		return store.Sample{}, err
+	}
+	f, err := strconv.ParseFloat(val.Val.(string), 64)
+	if err != nil || math.IsNaN(f) {
+		return store.Sample{}, ErrTSValue
+	}
+	return store.Sample{TS: t, Val: f}, nil
+}
+
+func parseDuplicatePolicy(v resp.Value) (store.DuplicatePolicy, error) {
+	p := store.DuplicatePolicy(strings.ToUpper(v.Val.(string)))
+	switch p {
+	case store.DuplicateBlock, store.DuplicateFirst, store.DuplicateLast,
+		store.DuplicateMin, store.DuplicateMax, store.DuplicateSum:
+		return p, nil
+	}
+	return "", ErrTSPolicy
+}
+
+// parseTSOpts reads the options of TS.CREATE, and those TS.ADD uses to create
+// a series. ON_DUPLICATE is only accepted with onDuplicate set.
+func parseTSOpts(args []resp.Value, onDuplicate bool) (store.TSOpts, store.DuplicatePolicy, error) {
+	var o store.TSOpts
+	var dup store.DuplicatePolicy
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Val.(string))
+		if opt == "LABELS" {
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return o, dup, ErrTSLabels
+			}
+			for j := 0; j < len(rest); j += 2 {
+				o.Labels = append(o.Labels, store.Label{Name: rest[j].Val.(string), Value: rest[j+1].Val.(string)})
+			}
+			break
+		}
+		if i+1 == len(args) {
+			return o, dup, ErrSyntax
+		}
+		var err error
+		switch {
+		case opt == "RETENTION":
+			o.Retention, err = strconv.ParseInt(args[i+1].Val.(string), 10, 64)
+			if err != nil || o.Retention < 0 {
+				return o, dup, ErrTSRetention
+			}
+		case opt == "DUPLICATE_POLICY":
+			if o.Policy, err = parseDuplicatePolicy(args[i+1]); err != nil {
+				return o, dup, err
+			}
+		case opt == "ON_DUPLICATE" && onDuplicate:
+			if dup, err = parseDuplicatePolicy(args[i+1]); err != nil {
+				return o, dup, err
+			}
+		default:
+			return o, dup, ErrSyntax
+		}
+		i++
+	}
+	return o, dup, nil
+}
+
+func encodeSamples(samples []store.Sample) []any {
+	r := make([]any, len(samples))
+	for i, s := range samples {
+		r[i] = []any{s.TS, utils.FormatFloat(s.Val)}
+	}
+	return r
+}
+
+type TSCreate struct {
+	store *store.Store
+}
+
+func NewTSCreate(s *store.Store) TSCreate {
+	return TSCreate{store: s}
+}
+func (h TSCreate) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 2 {
+		return ErrInvalidCmd
+	}
+	o, _, err := parseTSOpts(args[2:], false)
+	if err != nil {
+		return err
+	}
+	db := h.store.DB(sId)
+	if err := db.TSCreate(args[1].Val.(string), o); err != nil {
+		return err
+	}
+	db.Propagate(argStrings(args)...)
+	res <- resp.Ok
+	return nil
+}
+
+type TSAdd struct {
+	store *store.Store
+}
+
+func NewTSAdd(s *store.Store) TSAdd {
+	return TSAdd{store: s}
+}
+func (h TSAdd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	s, err := parseSample(args[2], args[3])
+	if err != nil {
+		return err
+	}
+	o, dup, err := parseTSOpts(args[4:], true)
+	if err != nil {
+		return err
+	}
+
+	db := h.store.DB(sId)
+	if err := db.TSAdd(args[1].Val.(string), s, o, dup); err != nil {
+		return err
+	}
+	// replicas must store the timestamp * resolved to
+	prop := argStrings(args)
+	prop[2] = strconv.FormatInt(s.TS, 10)
+	db.Propagate(prop...)
+	res <- resp.Encode(s.TS)
+	return nil
+}
+
+type TSMAdd struct {
+	store *store.Store
+}
+
+func NewTSMAdd(s *store.Store) TSMAdd {
+	return TSMAdd{store: s}
+}
+func (h TSMAdd) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 || (len(args)-1)%3 != 0 {
+		return ErrInvalidCmd
+	}
+	var keys []string
+	var samples []store.Sample
+	for i := 1; i < len(args); i += 3 {
+		s, err := parseSample(args[i+1], args[i+2])
+		if err != nil {
+			return err
+		}
+		keys = append(keys, args[i].Val.(string))
+		samples = append(samples, s)
+	}
+
+	db := h.store.DB(sId)
+	errs := db.TSMAdd(keys, samples)
+	r := make([]any, len(errs))
+	prop := []string{args[0].Val.(string)}
+	for i, err := range errs {
+		if err != nil {
+			r[i] = resp.EncodeError(err)
+			continue
+		}
+		r[i] = samples[i].TS
+		prop = append(prop, keys[i], strconv.FormatInt(samples[i].TS, 10), args[3*i+3].Val.(string))
+	}
+	if len(prop) > 1 {
+		db.Propagate(prop...)
+	}
+	res <- resp.Encode(r)
+	return nil
+}
+
+// parseTSRange reads the range and options shared by TS.RANGE, TS.REVRANGE
+// and TS.MRANGE. It returns the arguments it did not recognise.
+func parseTSRange(args []resp.Value, reverse bool) (store.TSRange, []resp.Value, error) {
+	r := store.TSRange{To: math.MaxInt64, Reverse: reverse}
+	var err error
+	if s := args[0].Val.(string); s != "-" {
+		if r.From, err = parseTimestamp(args[0]); err != nil {
+			return r, nil, err
+		}
+	}
+	if s := args[1].Val.(string); s != "+" {
+		if r.To, err = parseTimestamp(args[1]); err != nil {
+			return r, nil, err
+		}
+	}
+
+	var align string
+	var rest []resp.Value
+	args = args[2:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Val.(string)) {
+		case "COUNT":
+			if i+1 == len(args) {
+				return r, nil, ErrSyntax
+			}
+			n, err := strconv.Atoi(args[i+1].Val.(string))
+			if err != nil || n < 0 {
+				return r, nil, ErrTSCount
+			}
+			r.Count = n
+			i++
+		case "ALIGN":
+			if i+1 == len(args) {
+				return r, nil, ErrSyntax
+			}
+			align = args[i+1].Val.(string)
+			i++
+		case "AGGREGATION":
+			if i+2 >= len(args) {
+				return r, nil, ErrSyntax
+			}
+			r.Agg = store.Aggregator(strings.ToLower(args[i+1].Val.(string)))
+			switch r.Agg {
+			case store.AggAvg, store.AggSum, store.AggMin, store.AggMax,
+				store.AggCount, store.AggFirst, store.AggLast:
+			default:
+				return r, nil, ErrTSAggregation
+			}
+			r.Bucket, err = strconv.ParseInt(args[i+2].Val.(string), 10, 64)
+			if err != nil || r.Bucket <= 0 {
+				return r, nil, ErrTSBucket
+			}
+			i += 2
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+
+	switch {
+	case align == "":
+	case r.Agg == "":
+		return r, nil, ErrTSAlign
+	case align == "-" || strings.EqualFold(align, "start"):
+		r.Align = r.From
+	case align == "+" || strings.EqualFold(align, "end"):
+		r.Align = r.To
+	default:
+		if r.Align, err = strconv.ParseInt(align, 10, 64); err != nil {
+			return r, nil, ErrTSTimestamp
+		}
+	}
+	return r, rest, nil
+}
+
+// TSRange handles TS.RANGE and TS.REVRANGE.
+type TSRange struct {
+	store   *store.Store
+	reverse bool
+}
+
+func NewTSRange(s *store.Store) TSRange {
+	return TSRange{store: s}
+}
+func NewTSRevRange(s *store.Store) TSRange {
+	return TSRange{store: s, reverse: true}
+}
+func (h TSRange) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 4 {
+		return ErrInvalidCmd
+	}
+	r, rest, err := parseTSRange(args[2:], h.reverse)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return ErrSyntax
+	}
+	samples, err := h.store.DB(sId).TSRange(args[1].Val.(string), r)
+	if err != nil {
+		return err
+	}
+	res <- resp.Encode(encodeSamples(samples))
+	return nil
+}
+
+// parseTSFilter reads label=value, label!=value, or either with a
+// parenthesised list of values, (a,b).
+func parseTSFilter(s string) (store.TSFilter, error) {
+	var f store.TSFilter
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return f, ErrTSFilter
+	}
+	f.Label, f.Neq = s[:i], s[i-1] == '!'
+	if f.Neq {
+		f.Label = s[:i-1]
+	}
+	v := s[i+1:]
+	if strings.HasPrefix(v, "(") && strings.HasSuffix(v, ")") {
+		f.Values = strings.Split(v[1:len(v)-1], ",")
+	} else {
+		f.Values = []string{v}
+	}
+	if f.Label == "" {
+		return f, ErrTSFilter
+	}
+	return f, nil
+}
+
+type TSMRange struct {
+	store   *store.Store
+	reverse bool
+}
+
+func NewTSMRange(s *store.Store) TSMRange {
+	return TSMRange{store: s}
+}
+func NewTSMRevRange(s *store.Store) TSMRange {
+	return TSMRange{store: s, reverse: true}
+}
+func (h TSMRange) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	if len(args) < 5 {
+		return ErrInvalidCmd
+	}
+	r, rest, err := parseTSRange(args[1:], h.reverse)
+	if err != nil {
+		return err
+	}
+	var withLabels bool
+	var filters []store.TSFilter
+	for i := 0; i < len(rest); i++ {
+		switch strings.ToUpper(rest[i].Val.(string)) {
+		case "WITHLABELS":
+			withLabels = true
+		case "FILTER":
+			for _, a := range rest[i+1:] {
+				f, err := parseTSFilter(a.Val.(string))
+				if err != nil {
+					return err
+				}
+				filters = append(filters, f)
+			}
+			i = len(rest)
+		default:
+			return ErrSyntax
+		}
+	}
+	if len(filters) == 0 {
+		return ErrTSNoFilter
+	}
+
+	series, err := h.store.DB(sId).TSMRange(filters, r)
+	if err != nil {
+		return err
+	}
+	out := make([]any, len(series))
+	for i, s := range series {
+		labels := []any{}
+		if withLabels {
+			for _, l := range s.Labels {
+				labels = append(labels, []string{l.Name, l.Value})
+			}
+		}
+		out[i] = []any{s.Key, labels, encodeSamples(s.Samples)}
+	}
+	res <- resp.Encode(out)
+	return nil
+}
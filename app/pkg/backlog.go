@@ -0,0 +1,71 @@
+package pkg
+
+// Backlog is a circular buffer holding the last bytes of the replication
+// stream, so a replica that reconnects can be sent only what it missed.
+// Offsets count every byte of the stream; the first one is 1.
+type Backlog struct {
+	buf []byte
+	// end is the offset of the last byte written, histlen how many bytes
+	// up to it are held, and idx where the next byte goes in buf.
+	end     int64
+	histlen int
+	idx     int
+}
+
+func NewBacklog(size int) *Backlog {
+	return &Backlog{buf: make([]byte, max(size, 0))}
+}
+
+func (b *Backlog) Write(p []byte) {
+	b.end += int64(len(p))
+	if len(b.buf) == 0 {
+		return
+	}
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	n := copy(b.buf[b.idx:], p)
+	copy(b.buf, p[n:])
+	b.idx = (b.idx + len(p)) % len(b.buf)
+	b.histlen = min(b.histlen+len(p), len(b.buf))
+}
+
+// Reset drops the held bytes. The stream continues after offset.
+func (b *Backlog) Reset(offset int64) {
+	b.end, b.histlen, b.idx = offset, 0, 0
+}
+
+// Offset returns the offset of the last byte written.
+func (b *Backlog) Offset() int64 {
+	return b.end
+}
+
+// FirstByte returns the offset of the first byte held.
+func (b *Backlog) FirstByte() int64 {
+	return b.end - int64(b.histlen) + 1
+}
+
+func (b *Backlog) Len() int {
+	return b.histlen
+}
+
+func (b *Backlog) Size() int {
+	return len(b.buf)
+}
+
+// Since returns the bytes from offset off to the end, or false if some of
+// them are no longer held.
+func (b *Backlog) Since(off int64) ([]byte, bool) {
+	if off < b.FirstByte() || off > b.end+1 {
+		return nil, false
+	}
+	n := int(b.end + 1 - off)
+	out := make([]byte, n)
+	if n == 0 {
+		return out, true
+	}
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	k := copy(out, b.buf[start:])
+	copy(out[k:], b.buf)
+	return out, true
+}
@@ -1,7 +1,123 @@
 package pkg
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidSave  = errors.New("invalid save parameters")
+	ErrInvalidYesNo = errors.New("argument must be 'yes' or 'no'")
+)
+
+// DefaultSave is the save points Redis ships with.
+const DefaultSave = "3600 1 300 100 60 10000"
+
 type Config struct {
 	Port       int
 	DbDir      string
 	DbFileName string
+	Databases  int
+	Save       []SavePoint
+
+	AppendOnly     bool
+	AppendFsync    string
+	AppendFileName string
+	AppendDirName  string
+	// AOFLoadTruncated and AOFUseRDBPreamble are aof-load-truncated and
+	// aof-use-rdb-preamble.
+	AOFLoadTruncated  bool
+	AOFUseRDBPreamble bool
+
+	// ReplDisklessSync frames snapshots with an EOF mark, sent to the
+	// replicas that arrive within ReplDisklessSyncDelay seconds at once.
+	ReplDisklessSync      bool
+	ReplDisklessSyncDelay int
+	ReplDisklessLoad      string
+	// ReplBacklogSize is how many bytes of the replication stream are kept
+	// for partial resyncs.
+	ReplBacklogSize int
+	// ReplTimeout is how many seconds a replication link may stay silent
+	// before it is dropped. Masters ping replicas every
+	// ReplPingReplicaPeriod seconds to keep it alive.
+	ReplTimeout           int
+	ReplPingReplicaPeriod int
+	// ReplicaReadOnly rejects writes from clients other than the master
+	// while this server is a replica.
+	ReplicaReadOnly bool
+}
+
+// repl-diskless-load policies: buffer the whole snapshot before loading it,
+// or load it as it is read, only when there is no data or always.
+const (
+	DisklessLoadDisabled  = "disabled"
+	DisklessLoadOnEmptyDB = "on-empty-db"
+	DisklessLoadSwapDB    = "swapdb"
+)
+
+var ErrDisklessLoad = errors.New("invalid repl-diskless-load policy")
+
+func ParseDisklessLoad(s string) (string, error) {
+	switch s {
+	case DisklessLoadDisabled, DisklessLoadOnEmptyDB, DisklessLoadSwapDB:
+		return s, nil
+	}
+	return "", ErrDisklessLoad
+}
+
+// SavePoint triggers a background save once Seconds have passed since the
+// last save and at least Changes writes were made.
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+// ParseSavePoints parses "<seconds> <changes>" pairs. An empty string
+// disables saving.
+func ParseSavePoints(s string) ([]SavePoint, error) {
+	f := strings.Fields(s)
+	if len(f)%2 != 0 {
+		return nil, ErrInvalidSave
+	}
+	var points []SavePoint
+	for i := 0; i < len(f); i += 2 {
+		sec, err := strconv.ParseInt(f[i], 10, 64)
+		if err != nil || sec < 1 {
+			return nil, ErrInvalidSave
+		}
+		changes, err := strconv.ParseInt(f[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, ErrInvalidSave
+		}
+		points = append(points, SavePoint{Seconds: sec, Changes: changes})
+	}
+	return points, nil
+}
+
+func FormatSavePoints(points []SavePoint) string {
+	f := make([]string, len(points))
+	for i, p := range points {
+		f[i] = fmt.Sprintf("%d %d", p.Seconds, p.Changes)
+	}
+	return strings.Join(f, " ")
+}
+
+// ParseYesNo parses a boolean config value.
+func ParseYesNo(s string) (bool, error) {
+	switch s {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, ErrInvalidYesNo
+}
+
+func FormatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
 }
@@ -0,0 +1,15 @@
+package pkg
+
+import (
+	"hash/crc64"
+	"math/bits"
+)
+
+// crcTable is Redis's CRC-64/Jones, reflected, with no initial or final xor.
+var crcTable = crc64.MakeTable(bits.Reverse64(0xad93d23594c935a9))
+
+// CRC64 continues the checksum crc over p. hash/crc64 inverts the value
+// before and after, so it is inverted here to cancel that out.
+func CRC64(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+const (
+	lpHeaderSize = 6
+	lpEOF        = 0xff
+)
+
+// Listpack builds a listpack: a 6 byte header holding the total size and the
+// element count, the elements, and a terminating 0xff. Each element is its
+// encoding, its data, and its size encoded backwards so the list can be
+// walked from either end.
+type Listpack struct {
+	entries []byte
+	n       int
+}
+
+// Append adds s, using an integer encoding when s is a canonical integer.
+func (lp *Listpack) Append(s string) {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+		lp.AppendInt(v)
+		return
+	}
+	start := len(lp.entries)
+	switch n := len(s); {
+	case n < 64:
+		lp.entries = append(lp.entries, 0x80|byte(n))
+	case n < 4096:
+		lp.entries = append(lp.entries, 0xe0|byte(n>>8), byte(n))
+	default:
+		lp.entries = append(lp.entries, 0xf0)
+		lp.entries = binary.LittleEndian.AppendUint32(lp.entries, uint32(n))
+	}
+	lp.entries = append(lp.entries, s...)
+	lp.finish(start)
+}
+
+func (lp *Listpack) AppendInt(v int64) {
+	start := len(lp.entries)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.entries = append(lp.entries, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint16(v) & 0x1fff
+		lp.entries = append(lp.entries, 0xc0|byte(u>>8), byte(u))
+	case v >= -1<<15 && v < 1<<15:
+		lp.entries = append(lp.entries, 0xf1)
+		lp.entries = binary.LittleEndian.AppendUint16(lp.entries, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		lp.entries = append(lp.entries, 0xf2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= -1<<31 && v < 1<<31:
+		lp.entries = append(lp.entries, 0xf3)
+		lp.entries = binary.LittleEndian.AppendUint32(lp.entries, uint32(v))
+	default:
+		lp.entries = append(lp.entries, 0xf4)
+		lp.entries = binary.LittleEndian.AppendUint64(lp.entries, uint64(v))
+	}
+	lp.finish(start)
+}
+
+// finish appends the backlen of the element starting at start.
+func (lp *Listpack) finish(start int) {
+	l := len(lp.entries) - start
+	var groups []byte
+	for {
+		groups = append(groups, byte(l&127))
+		l >>= 7
+		if l == 0 {
+			break
+		}
+	}
+	for i := len(groups) - 1; i >= 0; i-- {
+		if i == len(groups)-1 {
+			lp.entries = append(lp.entries, groups[i])
+		} else {
+			lp.entries = append(lp.entries, groups[i]|128)
+		}
+	}
+	lp.n++
+}
+
+func (lp *Listpack) Bytes() []byte {
+	b := make([]byte, lpHeaderSize, lpHeaderSize+len(lp.entries)+1)
+	binary.LittleEndian.PutUint32(b, uint32(cap(b)))
+	binary.LittleEndian.PutUint16(b[4:], uint16(min(lp.n, 65535)))
+	b = append(b, lp.entries...)
+	return append(b, lpEOF)
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import "errors"
+
+var ErrLZF = errors.New("invalid LZF data")
+
+// lzfDecompress expands in, which must decompress to exactly n bytes. Each
+// control byte starts either a run of up to 32 literal bytes or a
+// back reference of at least 3 bytes into the output.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrLZF
+	}
+	out := make([]byte, 0, min(n, 1<<20))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			l := ctrl + 1
+			if i+l > len(in) {
+				return nil, ErrLZF
+			}
+			out = append(out, in[i:i+l]...)
+			i += l
+			continue
+		}
+
+		l := ctrl >> 5
+		if l == 7 {
+			if i >= len(in) {
+				return nil, ErrLZF
+			}
+			l += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrLZF
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 || len(out)+l+2 > n {
+			return nil, ErrLZF
+		}
+		// the reference may overlap the bytes being written
+		for j := 0; j < l+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, ErrLZF
+	}
+	return out, nil
+}
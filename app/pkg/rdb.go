@@ -1,342 +1,820 @@
 package pkg
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"time"
 )
 
-var ErrInvalidHeader = errors.New("invalid header")
-var ErrInvalidVersion = errors.New("invalid version")
+var (
+	ErrInvalidHeader  = errors.New("invalid header")
+	ErrInvalidVersion = errors.New("invalid version")
+	ErrRDBChecksum    = errors.New("wrong RDB checksum")
+	ErrRDBCorrupt     = errors.New("corrupt RDB")
+	ErrDumpPayload    = errors.New("DUMP payload version or checksum are wrong")
+)
+
+// rdbMaxVersion is the newest dump version that can be read.
+const rdbMaxVersion = 12
+
+const rdbOpSlotInfo = 0xf4
+
+// RDBKind is the kind of a loaded value, which decides the type of its Val.
+type RDBKind int
+
+const (
+	RDBString RDBKind = iota // string
+	RDBList                  // []string
+	RDBSet                   // map[string]struct{}
+	RDBZSet                  // []RDBZEntry
+	RDBHash                  // map[string]string
+	RDBStream                // []RDBStreamEntry
+	RDBModule                // RDBModuleValue
+)
 
-type rdbValue struct {
-	Kind  StringKind
-	Value any
+// rdbKinds maps each value type to the kind it is loaded as.
+var rdbKinds = map[byte]RDBKind{
+	RDBTypeString:          RDBString,
+	RDBTypeList:            RDBList,
+	RDBTypeListZiplist:     RDBList,
+	RDBTypeListQuicklist:   RDBList,
+	RDBTypeListQuicklist2:  RDBList,
+	RDBTypeSet:             RDBSet,
+	RDBTypeSetIntset:       RDBSet,
+	RDBTypeSetListpack:     RDBSet,
+	RDBTypeZSet:            RDBZSet,
+	RDBTypeZSet2:           RDBZSet,
+	RDBTypeZSetZiplist:     RDBZSet,
+	RDBTypeZSetListpack:    RDBZSet,
+	RDBTypeHash:            RDBHash,
+	RDBTypeHashZipmap:      RDBHash,
+	RDBTypeHashZiplist:     RDBHash,
+	RDBTypeHashListpack:    RDBHash,
+	RDBTypeStreamListpacks: RDBStream,
+	RDBTypeStream2:         RDBStream,
+	RDBTypeStream3:         RDBStream,
+	RDBTypeModule2:         RDBModule,
 }
+
+// RDBStoreValue is a loaded key.
 type RDBStoreValue struct {
+	Kind   RDBKind
 	Val    any
 	Expiry time.Time
 }
 
-type StringKind int
-
-const (
-	RegularString StringKind = iota
-	Int8String
-	Int16String
-	Int32String
-)
-
-var data map[string]RDBStoreValue
+type RDBZEntry struct {
+	Member string
+	Score  float64
+}
 
-func ReadRDB(path string) (map[string]RDBStoreValue, error) {
-	data = make(map[string]RDBStoreValue)
+// RDBModuleValue is a value saved by a module: its type name, its encoding
+// version, and the fields it saved, each an int64, uint64, float32, float64
+// or string.
+type RDBModuleValue struct {
+	Name   string
+	EncVer int
+	Fields []any
+}
 
-	f, err := os.Open(path)
+// ReadRDB reads the dump at path. Keys are grouped by database number.
+func ReadRDB(path string) (map[int]map[string]RDBStoreValue, error) {
+	b, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	defer f.Close()
-
-	buf, _ := io.ReadAll(f)
-	fmt.Println(hex.EncodeToString(buf))
-	f.Seek(0, 0)
+	return ParseRDB(b)
+}
 
-	r := bufio.NewReader(f)
+// ParseRDB decodes a whole dump and verifies its checksum.
+func ParseRDB(b []byte) (map[int]map[string]RDBStoreValue, error) {
+	data, _, err := ParseRDBPrefix(b)
+	return data, err
+}
 
-	// REDIS
-	buf = make([]byte, 5)
-	n, err := r.Read(buf[:5])
-	if n != 5 {
-		return nil, ErrInvalidHeader
-	}
+// ParseRDBPrefix decodes the dump at the start of b and returns its length,
+// so whatever follows it, such as the commands of an AOF base, can be read.
+func ParseRDBPrefix(b []byte) (map[int]map[string]RDBStoreValue, int, error) {
+	data := make(map[int]map[string]RDBStoreValue)
+	d := &rdbDecoder{b: b}
+	err := d.dump(func(db int, k string, v RDBStoreValue) error {
+		if data[db] == nil {
+			data[db] = make(map[string]RDBStoreValue)
+		}
+		data[db][k] = v
+		return nil
+	})
 	if err != nil {
-		return nil, err
-	}
-	if string(buf[:n]) != "REDIS" {
-		return nil, ErrInvalidHeader
+		return nil, 0, err
 	}
+	return data, d.off, nil
+}
 
-	// version
-	n, err = r.Read(buf[:4])
-	if n != 4 {
-		return nil, ErrInvalidVersion
+// ReadRDBStream decodes a dump as it is read from r, such as a replica's
+// socket, passing each key to emit rather than holding the whole dump.
+// Nothing past the end of the dump is read.
+func ReadRDBStream(r io.Reader, emit func(db int, k string, v RDBStoreValue) error) error {
+	return (&rdbDecoder{r: r}).dump(emit)
+}
+
+func (d *rdbDecoder) dump(emit func(db int, k string, v RDBStoreValue) error) error {
+	h := d.next(9)
+	if d.err != nil || string(h[:5]) != "REDIS" {
+		return ErrInvalidHeader
 	}
-	if err != nil {
-		return nil, err
+	ver, err := strconv.Atoi(string(h[5:9]))
+	if err != nil || ver < 1 || ver > rdbMaxVersion {
+		return ErrInvalidVersion
 	}
-	v, err := strconv.Atoi(string(buf[:n]))
-	if err != nil {
-		return nil, err
-	}
-	fmt.Println("version: ", v)
 
-L:
+	db := 0
+	var expiry time.Time
 	for {
-		b, err := r.ReadByte()
-		if err != nil {
-			return nil, err
+		op := d.byte()
+		if d.err != nil {
+			return d.err
 		}
-
-		switch b {
-		case 0xfa:
-			_, err = readFa(r)
-			if err != nil {
-				return nil, fmt.Errorf("read fa: %w", err)
-			}
-		case 0xfe:
-			_, err = readFe(r)
-			if err != nil {
-				return nil, fmt.Errorf("read fe: %w", err)
+		switch op {
+		case rdbOpEOF:
+			// dumps before version 5 have no checksum, and 0 means it
+			// was disabled
+			if ver >= 5 {
+				want := d.sum()
+				sum := d.uintLE(8)
+				if d.err != nil {
+					return d.err
+				}
+				if sum != 0 && sum != want {
+					return ErrRDBChecksum
+				}
 			}
-		case 0xfd:
-			err = readFd(r)
-			if err != nil {
-				return nil, fmt.Errorf("read fd: %w", err)
-			}
-		case 0xfb:
-			err = readFb(r)
-			if err != nil {
-				return nil, fmt.Errorf("read fb: %w", err)
-			}
-		case 0xfc:
-			err = readFc(r)
-			if err != nil {
-				return nil, fmt.Errorf("read fc: %w", err)
-			}
-		case 0xff:
-			fmt.Println("end reached")
-			break L
+			return nil
+		case rdbOpSelectDB:
+			db = int(d.length())
+		case rdbOpResizeDB:
+			d.length()
+			d.length()
+		case rdbOpSlotInfo:
+			d.length()
+			d.length()
+			d.length()
+		case rdbOpAux:
+			d.string()
+			d.string()
+		case rdbOpExpireMs:
+			expiry = time.UnixMilli(int64(d.uintLE(8)))
+		case rdbOpExpire:
+			expiry = time.Unix(int64(d.uintLE(4)), 0)
+		case rdbOpIdle:
+			d.length()
+		case rdbOpFreq:
+			d.byte()
+		case rdbOpModuleAux:
+			d.length()
+			d.length()
+			d.length()
+			d.moduleFields()
+		case rdbOpFunction2:
+			d.string()
 		default:
-			err = r.UnreadByte()
-			if err != nil {
-				return nil, fmt.Errorf("unread")
+			k := d.string()
+			v := d.value(op)
+			if d.err != nil {
+				return fmt.Errorf("key %q: %w", k, d.err)
 			}
-			err = readData(r, time.Time{})
-			if err != nil {
-				return nil, fmt.Errorf("read data: %w", err)
+			if err := emit(db, k, RDBStoreValue{Kind: rdbKinds[op], Val: v, Expiry: expiry}); err != nil {
+				return err
 			}
+			expiry = time.Time{}
 		}
 	}
-
-	return data, nil
 }
 
-func readData(r *bufio.Reader, expiry time.Time) error {
-	_, err := r.ReadByte()
-	if err != nil {
-		return err
+// ParseDump decodes a payload built by Dump.
+func ParseDump(b []byte) (RDBStoreValue, error) {
+	if len(b) < 10 {
+		return RDBStoreValue{}, ErrDumpPayload
 	}
-	key, _, err := decode(r)
-	var v rdbValue
-	err = decodeValue(r, &v)
-	if err != nil {
-		return err
+	body := b[:len(b)-10]
+	ver := binary.LittleEndian.Uint16(b[len(body):])
+	if ver > rdbMaxVersion || binary.LittleEndian.Uint64(b[len(b)-8:]) != CRC64(0, b[:len(b)-8]) {
+		return RDBStoreValue{}, ErrDumpPayload
 	}
-	data[string(key)] = RDBStoreValue{
-		Val:    v.Value,
-		Expiry: expiry,
+	d := &rdbDecoder{b: body}
+	t := d.byte()
+	v := d.value(t)
+	if d.err == nil && d.off != len(body) {
+		d.fail(fmt.Errorf("%w: trailing data", ErrRDBCorrupt))
 	}
-	return nil
+	if d.err != nil {
+		return RDBStoreValue{}, d.err
+	}
+	return RDBStoreValue{Kind: rdbKinds[t], Val: v}, nil
 }
 
-func readFe(r *bufio.Reader) ([]byte, error) {
-	// db number
-	_, err := r.ReadByte()
-	if err != nil {
-		return nil, err
+// rdbDecoder reads from b, or from r when it is set. Errors are sticky:
+// after the first one every read returns zero values.
+type rdbDecoder struct {
+	b   []byte
+	off int
+	err error
+
+	r io.Reader
+	// crc is the checksum of what was read from r.
+	crc uint64
+}
+
+func (d *rdbDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
 	}
-	return nil, nil
-}
-
-func readFb(r *bufio.Reader) error {
-	//d, t, err := decode(r)
-	//if err != nil {
-	//	return err
-	//}
-	//fmt.Println("hash length", string(d), t)
-	//
-	//d, t, err = decode(r)
-	//if err != nil {
-	//	return err
-	//}
-	//fmt.Println("expiry length: ", string(d), t)
-	//return nil
-	r.ReadByte()
-	r.ReadByte()
-	return nil
 }
 
-func readFd(r *bufio.Reader) error {
-	buf := make([]byte, 4)
-	_, err := r.Read(buf)
-	if err != nil {
-		return err
+func (d *rdbDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
 	}
-	ex := binary.LittleEndian.Uint32(buf)
-	expiry := time.Unix(int64(ex), 0)
-	fmt.Println("seconds expiry: ", expiry)
-	err = readData(r, expiry)
-	if err != nil {
-		return err
+	if d.r != nil {
+		return d.read(n)
 	}
-	return nil
+	if n < 0 || n > len(d.b)-d.off {
+		d.fail(fmt.Errorf("%w: unexpected end of data", ErrRDBCorrupt))
+		return nil
+	}
+	p := d.b[d.off : d.off+n]
+	d.off += n
+	return p
 }
 
-func readFc(r *bufio.Reader) error {
-	buf := make([]byte, 8)
-	_, err := r.Read(buf)
-	if err != nil {
-		return err
+func (d *rdbDecoder) byte() byte {
+	if p := d.next(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+// read reads n bytes from r. Large reads grow their buffer as data
+// arrives, so a corrupt length cannot allocate more than was sent.
+func (d *rdbDecoder) read(n int) []byte {
+	if n < 0 {
+		d.fail(fmt.Errorf("%w: unexpected end of data", ErrRDBCorrupt))
+		return nil
+	}
+	var p []byte
+	var err error
+	if n <= 1<<16 {
+		p = make([]byte, n)
+		_, err = io.ReadFull(d.r, p)
+	} else {
+		var buf bytes.Buffer
+		if _, err = io.Copy(&buf, io.LimitReader(d.r, int64(n))); err == nil && buf.Len() < n {
+			err = io.ErrUnexpectedEOF
+		}
+		p = buf.Bytes()
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		d.fail(fmt.Errorf("%w: unexpected end of data", ErrRDBCorrupt))
+		return nil
 	}
-	ex := binary.LittleEndian.Uint64(buf)
-	expiry := time.UnixMilli(int64(ex))
-	fmt.Println("milliseconds expiry: ", expiry)
-	err = readData(r, expiry)
 	if err != nil {
-		return err
+		d.fail(err)
+		return nil
 	}
-	return nil
+	d.crc = CRC64(d.crc, p)
+	d.off += n
+	return p
 }
 
-func readFa(r *bufio.Reader) ([]byte, error) {
-	faKey, t, err := decode(r)
-	if err != nil {
-		return nil, err
+// sum returns the checksum of everything read so far.
+func (d *rdbDecoder) sum() uint64 {
+	if d.r != nil {
+		return d.crc
 	}
-	if t != RegularString {
-		return nil, fmt.Errorf("expected regular string")
+	return CRC64(0, d.b[:d.off])
+}
+
+// peek returns the next byte without consuming it, or -1 at the end. It is
+// only used on blobs, never on r.
+func (d *rdbDecoder) peek() int {
+	if d.err != nil || d.off >= len(d.b) {
+		d.fail(fmt.Errorf("%w: unexpected end of data", ErrRDBCorrupt))
+		return -1
 	}
+	return int(d.b[d.off])
+}
 
-	faVal, _, err := decode(r)
-	if err != nil {
-		return nil, err
+func (d *rdbDecoder) uintLE(n int) uint64 {
+	var v uint64
+	for i, c := range d.next(n) {
+		v |= uint64(c) << (8 * i)
 	}
-	fmt.Println("faKey= ", string(faKey), ", faVal=", string(faVal))
-	return nil, nil
-}
-
-//func decodeInt32(r *bufio.Reader) (int32, error) {
-//	b, _, err := decode(r)
-//	if err != nil {
-//		return 0, err
-//	}
-//	return int32(binary.LittleEndian.Uint32(b)), nil
-//}
-//
-//func decodeString(r *bufio.Reader) (string, error) {
-//	b, _, err := decode(r)
-//	if err != nil {
-//		return "", err
-//	}
-//	return string(b), nil
-//}
-
-func decodeValue(r *bufio.Reader, v *rdbValue) error {
-	buf, t, err := decode(r)
-	if err != nil {
-		return err
+	return v
+}
+
+func (d *rdbDecoder) uintBE(n int) uint64 {
+	var v uint64
+	for _, c := range d.next(n) {
+		v = v<<8 | uint64(c)
 	}
+	return v
+}
 
-	v.Kind = t
-	switch t {
-	case RegularString:
-		v.Value = string(buf)
-	case Int8String:
-		v.Value = int8(binary.LittleEndian.Uint16(buf))
-	case Int16String:
-		v.Value = int16(binary.LittleEndian.Uint16(buf))
-	case Int32String:
-		v.Value = int32(binary.LittleEndian.Uint32(buf))
+// lengthOrEnc reads a length, or the format of a specially encoded string,
+// in which case enc is true.
+func (d *rdbDecoder) lengthOrEnc() (n uint64, enc bool) {
+	b := d.byte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false
+	case 1:
+		return uint64(b&0x3f)<<8 | uint64(d.byte()), false
+	case 2:
+		switch b {
+		case 0x80:
+			return d.uintBE(4), false
+		case 0x81:
+			return d.uintBE(8), false
+		}
+		d.fail(fmt.Errorf("%w: unknown length encoding %#x", ErrRDBCorrupt, b))
+		return 0, false
 	}
+	return uint64(b & 0x3f), true
+}
 
-	return nil
+func (d *rdbDecoder) length() uint64 {
+	n, enc := d.lengthOrEnc()
+	if enc {
+		d.fail(fmt.Errorf("%w: string encoding in place of a length", ErrRDBCorrupt))
+	}
+	return n
 }
 
-func decode(r *bufio.Reader) ([]byte, StringKind, error) {
-	b, err := r.ReadByte()
-	if err != nil {
-		return nil, 0, err
+// string reads a string in any of its encodings. Integers are returned in
+// their decimal form.
+func (d *rdbDecoder) string() string {
+	n, enc := d.lengthOrEnc()
+	if !enc {
+		return string(d.next(int(n)))
 	}
-	msb := (b & 0xc0) >> 6
-	if msb == 0x00 {
-		l := int(b & 0x3F)
-		buf := make([]byte, l)
-		_, err = r.Read(buf)
+	switch n {
+	case 0:
+		return strconv.FormatInt(int64(int8(d.byte())), 10)
+	case 1:
+		return strconv.FormatInt(int64(int16(d.uintLE(2))), 10)
+	case 2:
+		return strconv.FormatInt(int64(int32(d.uintLE(4))), 10)
+	case 3:
+		clen, ulen := d.length(), d.length()
+		in := d.next(int(clen))
+		if d.err != nil {
+			return ""
+		}
+		b, err := lzfDecompress(in, int(ulen))
 		if err != nil {
-			return nil, 0, err
+			d.fail(err)
+			return ""
 		}
-		return buf, RegularString, nil
+		return string(b)
+	}
+	d.fail(fmt.Errorf("%w: unknown string encoding %d", ErrRDBCorrupt, n))
+	return ""
+}
+
+func (d *rdbDecoder) strings(n uint64) []string {
+	var res []string
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		res = append(res, d.string())
 	}
+	return res
+}
 
-	if msb == 0x01 {
-		rem := b & 0x3F
-		b, err = r.ReadByte()
+// stringDouble reads a sorted set score in the old text form.
+func (d *rdbDecoder) stringDouble() float64 {
+	switch n := d.byte(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		f, err := strconv.ParseFloat(string(d.next(int(n))), 64)
 		if err != nil {
-			return nil, RegularString, err
+			d.fail(fmt.Errorf("%w: invalid score", ErrRDBCorrupt))
 		}
+		return f
+	}
+}
 
-		l0 := int(rem) << 8
-		l := l0 | int(b)
-		buf := make([]byte, l)
-		_, err = r.Read(buf)
-		if err != nil {
-			return nil, 0, err
+// blob reads a string holding one of the packed encodings and decodes it
+// with parse.
+func (d *rdbDecoder) blob(parse func([]byte) ([]string, error)) []string {
+	s := d.string()
+	if d.err != nil {
+		return nil
+	}
+	l, err := parse([]byte(s))
+	d.fail(err)
+	return l
+}
+
+func (d *rdbDecoder) value(t byte) any {
+	switch t {
+	case RDBTypeString:
+		return d.string()
+	case RDBTypeList:
+		return d.strings(d.length())
+	case RDBTypeSet:
+		return toSet(d.strings(d.length()))
+	case RDBTypeZSet, RDBTypeZSet2:
+		n := d.length()
+		var z []RDBZEntry
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			e := RDBZEntry{Member: d.string()}
+			if t == RDBTypeZSet {
+				e.Score = d.stringDouble()
+			} else {
+				e.Score = math.Float64frombits(d.uintLE(8))
+			}
+			z = append(z, e)
+		}
+		return z
+	case RDBTypeHash:
+		return toHash(d.strings(2 * d.length()))
+	case RDBTypeModule2:
+		id := d.length()
+		return RDBModuleValue{Name: ModuleName(id), EncVer: int(id & 1023), Fields: d.moduleFields()}
+	case RDBTypeHashZipmap:
+		return toHash(d.blob(parseZipmap))
+	case RDBTypeListZiplist:
+		return d.blob(parseZiplist)
+	case RDBTypeSetIntset:
+		return toSet(d.blob(parseIntset))
+	case RDBTypeZSetZiplist:
+		return d.toZSet(d.blob(parseZiplist))
+	case RDBTypeHashZiplist:
+		return toHash(d.blob(parseZiplist))
+	case RDBTypeListQuicklist:
+		n := d.length()
+		var l []string
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			l = append(l, d.blob(parseZiplist)...)
 		}
-		return buf, RegularString, nil
+		return l
+	case RDBTypeStreamListpacks, RDBTypeStream2, RDBTypeStream3:
+		return d.stream(t)
+	case RDBTypeHashListpack:
+		return toHash(d.blob(parseListpack))
+	case RDBTypeZSetListpack:
+		return d.toZSet(d.blob(parseListpack))
+	case RDBTypeListQuicklist2:
+		n := d.length()
+		var l []string
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			// plain nodes hold a single large element
+			if d.length() == 1 {
+				l = append(l, d.string())
+			} else {
+				l = append(l, d.blob(parseListpack)...)
+			}
+		}
+		return l
+	case RDBTypeSetListpack:
+		return toSet(d.blob(parseListpack))
+	}
+	d.fail(fmt.Errorf("%w: unsupported value type %d", ErrRDBCorrupt, t))
+	return nil
+}
+
+func toSet(l []string) map[string]struct{} {
+	s := make(map[string]struct{}, len(l))
+	for _, m := range l {
+		s[m] = struct{}{}
 	}
+	return s
+}
 
-	if msb == 0x10 {
-		b, err = r.ReadByte()
+func toHash(l []string) map[string]string {
+	h := make(map[string]string, len(l)/2)
+	for i := 0; i+1 < len(l); i += 2 {
+		h[l[i]] = l[i+1]
+	}
+	return h
+}
+
+func (d *rdbDecoder) toZSet(l []string) []RDBZEntry {
+	var z []RDBZEntry
+	for i := 0; i+1 < len(l); i += 2 {
+		f, err := strconv.ParseFloat(l[i+1], 64)
 		if err != nil {
-			return nil, 0, err
+			d.fail(fmt.Errorf("%w: invalid score", ErrRDBCorrupt))
+			return nil
 		}
-		l := int(b)
-		buf := make([]byte, l)
-		_, err = r.Read(buf)
-		if err != nil {
-			return nil, 0, err
+		z = append(z, RDBZEntry{Member: l[i], Score: f})
+	}
+	return z
+}
+
+// moduleFields reads the opcode tagged fields of a module value up to its
+// EOF opcode.
+func (d *rdbDecoder) moduleFields() []any {
+	var f []any
+	for d.err == nil {
+		switch op := d.length(); op {
+		case rdbModuleOpEOF:
+			return f
+		case rdbModuleOpSInt:
+			f = append(f, int64(d.length()))
+		case rdbModuleOpUInt:
+			f = append(f, d.length())
+		case rdbModuleOpFloat:
+			f = append(f, math.Float32frombits(uint32(d.uintLE(4))))
+		case rdbModuleOpDouble:
+			f = append(f, math.Float64frombits(d.uintLE(8)))
+		case rdbModuleOpString:
+			f = append(f, d.string())
+		default:
+			d.fail(fmt.Errorf("%w: unknown module opcode %d", ErrRDBCorrupt, op))
 		}
-		return buf, RegularString, nil
 	}
+	return nil
+}
 
-	t := int(b & 0x3F)
-	switch t {
-	case 0:
-		// 8 bit int
-		b, err := r.ReadByte()
-		if err != nil {
-			return nil, 0, err
+// ModuleName unpacks the type name from a module ID.
+func ModuleName(id uint64) string {
+	b := make([]byte, 9)
+	for i := range b {
+		b[i] = moduleCharset[(id>>(10+6*(8-i)))&63]
+	}
+	return string(b)
+}
+
+// stream reads a stream, dropping deleted entries and consumer groups.
+func (d *rdbDecoder) stream(t byte) []RDBStreamEntry {
+	var entries []RDBStreamEntry
+	nodes := d.length()
+	for i := uint64(0); i < nodes && d.err == nil; i++ {
+		key := d.string()
+		if d.err == nil && len(key) != 16 {
+			d.fail(fmt.Errorf("%w: invalid stream node key", ErrRDBCorrupt))
 		}
-		return []byte{b}, Int8String, nil
-	case 1:
-		// 16 bit int
-		buf := make([]byte, 2)
-		_, err := r.Read(buf)
-		if err != nil {
-			return nil, 0, err
+		lp := d.blob(parseListpack)
+		if d.err != nil {
+			return nil
 		}
-		return buf, Int16String, nil
-	case 2:
-		// 32 bit int
-		buf := make([]byte, 4)
-		_, err := r.Read(buf)
-		if err != nil {
-			return nil, 0, err
+		ms, seq := binary.BigEndian.Uint64([]byte(key[:8])), binary.BigEndian.Uint64([]byte(key[8:]))
+		es, err := streamEntries(ms, seq, lp)
+		d.fail(err)
+		entries = append(entries, es...)
+	}
+
+	d.length() // length
+	d.length() // last ID
+	d.length()
+	if t >= RDBTypeStream2 {
+		d.length() // first ID
+		d.length()
+		d.length() // max deleted entry ID
+		d.length()
+		d.length() // entries added
+	}
+	groups := d.length()
+	for i := uint64(0); i < groups && d.err == nil; i++ {
+		d.string() // name
+		d.length() // last delivered ID
+		d.length()
+		if t >= RDBTypeStream2 {
+			d.length() // entries read
 		}
-		return buf, Int32String, nil
-	case 3:
-		// read compressed string
+		pending := d.length()
+		for j := uint64(0); j < pending && d.err == nil; j++ {
+			d.next(16) // ID
+			d.next(8)  // delivery time
+			d.length() // delivery count
+		}
+		consumers := d.length()
+		for j := uint64(0); j < consumers && d.err == nil; j++ {
+			d.string() // name
+			d.next(8)  // seen time
+			if t >= RDBTypeStream3 {
+				d.next(8) // active time
+			}
+			owned := d.length()
+			for k := uint64(0); k < owned && d.err == nil; k++ {
+				d.next(16)
+			}
+		}
+	}
+	return entries
+}
+
+// streamEntries decodes the elements of a stream node, whose IDs are
+// relative to the node's master ID ms-seq.
+func streamEntries(ms, seq uint64, lp []string) ([]RDBStreamEntry, error) {
+	it := &lpIter{l: lp}
+	it.int() // count
+	it.int() // deleted
+	nf := it.int()
+	if nf < 0 || nf > int64(len(it.l)) {
+		return nil, fmt.Errorf("%w: invalid stream node", ErrRDBCorrupt)
+	}
+	master := make([]string, nf)
+	for i := range master {
+		master[i] = it.str()
+	}
+	it.str() // master entry terminator
+
+	var res []RDBStreamEntry
+	for it.err == nil && len(it.l) > 0 {
+		flags := it.int()
+		e := RDBStreamEntry{MS: ms + uint64(it.int()), Seq: seq + uint64(it.int())}
+		if flags&streamItemSameFields != 0 {
+			for _, f := range master {
+				e.Fields = append(e.Fields, f, it.str())
+			}
+		} else {
+			n := it.int()
+			for i := int64(0); i < n && it.err == nil; i++ {
+				e.Fields = append(e.Fields, it.str(), it.str())
+			}
+		}
+		it.str() // lp-count
+		if flags&streamItemDeleted == 0 {
+			res = append(res, e)
+		}
+	}
+	return res, it.err
+}
+
+type lpIter struct {
+	l   []string
+	err error
+}
+
+func (it *lpIter) str() string {
+	if len(it.l) == 0 {
+		if it.err == nil {
+			it.err = fmt.Errorf("%w: truncated stream node", ErrRDBCorrupt)
+		}
+		return ""
+	}
+	s := it.l[0]
+	it.l = it.l[1:]
+	return s
+}
+
+func (it *lpIter) int() int64 {
+	v, err := strconv.ParseInt(it.str(), 10, 64)
+	if err != nil && it.err == nil {
+		it.err = fmt.Errorf("%w: invalid stream node", ErrRDBCorrupt)
+	}
+	return v
+}
+
+// parseZiplist decodes a ziplist: a 10 byte header, then entries made of
+// the previous entry's length, an encoding and the data, then 0xff.
+func parseZiplist(b []byte) ([]string, error) {
+	z := &rdbDecoder{b: b}
+	z.next(10)
+	var res []string
+	for z.err == nil && z.peek() != 0xff {
+		if z.byte() == 0xfe {
+			z.next(4)
+		}
+		enc := z.byte()
+		var v int64
+		switch {
+		case enc>>6 == 0:
+			res = append(res, string(z.next(int(enc&0x3f))))
+			continue
+		case enc>>6 == 1:
+			res = append(res, string(z.next(int(enc&0x3f)<<8|int(z.byte()))))
+			continue
+		case enc == 0x80:
+			res = append(res, string(z.next(int(z.uintBE(4)))))
+			continue
+		case enc == 0xc0:
+			v = int64(int16(z.uintLE(2)))
+		case enc == 0xd0:
+			v = int64(int32(z.uintLE(4)))
+		case enc == 0xe0:
+			v = int64(z.uintLE(8))
+		case enc == 0xf0:
+			v = int64(int32(uint32(z.uintLE(3))<<8) >> 8)
+		case enc == 0xfe:
+			v = int64(int8(z.byte()))
+		case enc > 0xf0 && enc < 0xfe:
+			v = int64(enc&0x0f) - 1
+		default:
+			z.fail(fmt.Errorf("%w: unknown ziplist encoding %#x", ErrRDBCorrupt, enc))
+		}
+		res = append(res, strconv.FormatInt(v, 10))
+	}
+	return res, z.err
+}
+
+// parseListpack decodes a listpack as built by Listpack.
+func parseListpack(b []byte) ([]string, error) {
+	p := &rdbDecoder{b: b}
+	p.next(lpHeaderSize)
+	var res []string
+	for p.err == nil && p.peek() != lpEOF {
+		start := p.off
+		enc := p.byte()
+		var v int64
+		isInt := true
+		switch {
+		case enc < 0x80:
+			v = int64(enc)
+		case enc>>6 == 2:
+			res = append(res, string(p.next(int(enc&0x3f))))
+			isInt = false
+		case enc>>5 == 6:
+			v = int64(enc&0x1f)<<8 | int64(p.byte())
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+		case enc>>4 == 0xe:
+			res = append(res, string(p.next(int(enc&0x0f)<<8|int(p.byte()))))
+			isInt = false
+		case enc == 0xf0:
+			res = append(res, string(p.next(int(p.uintLE(4)))))
+			isInt = false
+		case enc == 0xf1:
+			v = int64(int16(p.uintLE(2)))
+		case enc == 0xf2:
+			v = int64(int32(uint32(p.uintLE(3))<<8) >> 8)
+		case enc == 0xf3:
+			v = int64(int32(p.uintLE(4)))
+		case enc == 0xf4:
+			v = int64(p.uintLE(8))
+		default:
+			p.fail(fmt.Errorf("%w: unknown listpack encoding %#x", ErrRDBCorrupt, enc))
+		}
+		if isInt {
+			res = append(res, strconv.FormatInt(v, 10))
+		}
+		p.next(lpBacklenSize(p.off - start))
+	}
+	return res, p.err
+}
+
+// lpBacklenSize is the size of the backlen of an element of l bytes.
+func lpBacklenSize(l int) int {
+	n := 1
+	for l >= 1<<7 {
+		l >>= 7
+		n++
 	}
+	return n
+}
 
-	return nil, 0, fmt.Errorf("unkown format")
+// parseIntset decodes an intset: the integer width, the count, and the
+// integers in ascending order.
+func parseIntset(b []byte) ([]string, error) {
+	p := &rdbDecoder{b: b}
+	size := int(p.uintLE(4))
+	n := p.uintLE(4)
+	if p.err == nil && size != 2 && size != 4 && size != 8 {
+		return nil, fmt.Errorf("%w: invalid intset encoding %d", ErrRDBCorrupt, size)
+	}
+	var res []string
+	shift := 64 - 8*size
+	for i := uint64(0); i < n && p.err == nil; i++ {
+		v := int64(p.uintLE(size)<<shift) >> shift
+		res = append(res, strconv.FormatInt(v, 10))
+	}
+	return res, p.err
+}
+
+// parseZipmap decodes a zipmap: a count, then length prefixed keys and
+// values, each value followed by unused bytes, then 0xff.
+func parseZipmap(b []byte) ([]string, error) {
+	p := &rdbDecoder{b: b}
+	p.byte()
+	var res []string
+	for p.err == nil && p.peek() != 0xff {
+		res = append(res, string(p.next(p.zipmapLen())))
+		l := p.zipmapLen()
+		free := int(p.byte())
+		res = append(res, string(p.next(l)))
+		p.next(free)
+	}
+	return res, p.err
+}
+
+func (d *rdbDecoder) zipmapLen() int {
+	if n := d.byte(); n != 254 {
+		return int(n)
+	}
+	return int(d.uintLE(4))
 }
@@ -1,7 +1,257 @@
 package pkg
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
 
 func TestRead(t *testing.T) {
 	ReadRDB("/Users/macbookpro/Desktop/dump.rdb")
 }
+
+// dump encodes a dump whose only database holds the keys written by fn.
+func dump(fn func(e *RDBWriter)) []byte {
+	var buf bytes.Buffer
+	e := NewRDBWriter(&buf)
+	e.Header()
+	e.Aux("redis-ver", "7.2.0")
+	e.SelectDB(0)
+	e.ResizeDB(1, 0)
+	fn(e)
+	e.End()
+	return buf.Bytes()
+}
+
+// raw writes a key of type t whose value is the raw bytes v.
+func raw(t byte, v ...byte) func(e *RDBWriter) {
+	return func(e *RDBWriter) {
+		e.Key(t, "k")
+		e.Write(v)
+	}
+}
+
+func TestParseRDB(t *testing.T) {
+	var lp Listpack
+	lpWant := []string{"5", "-100", "5000", "-40000", "1048576", "1099511627776", strings.Repeat("x", 100), strings.Repeat("y", 5000)}
+	for _, s := range lpWant {
+		lp.Append(s)
+	}
+	var stream []RDBStreamEntry
+	for i := 0; i < 150; i++ {
+		f := []string{"f", fmt.Sprint(i)}
+		if i%7 == 0 {
+			f = []string{"a", "1", "b", "2"}
+		}
+		stream = append(stream, RDBStreamEntry{MS: uint64(1000 + i/2), Seq: uint64(i % 2), Fields: f})
+	}
+	ziplist := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, 3, 0,
+		0, 1, 'a',
+		3, 0xfd,
+		2, 0xc0, 0x2c, 0x01,
+		0xff,
+	}
+
+	tests := []struct {
+		name  string
+		write func(e *RDBWriter)
+		want  any
+	}{
+		{"string", func(e *RDBWriter) { e.Key(RDBTypeString, "k"); e.String("hello") }, "hello"},
+		{"int8", func(e *RDBWriter) { e.Key(RDBTypeString, "k"); e.String("-7") }, "-7"},
+		{"int16", func(e *RDBWriter) { e.Key(RDBTypeString, "k"); e.String("-300") }, "-300"},
+		{"int32", func(e *RDBWriter) { e.Key(RDBTypeString, "k"); e.String("70000") }, "70000"},
+		{"long", func(e *RDBWriter) { e.Key(RDBTypeString, "k"); e.String(strings.Repeat("z", 20000)) }, strings.Repeat("z", 20000)},
+		{"lzf", raw(RDBTypeString, 0xc3, 5, 10, 0, 'a', 0xe0, 0, 0), "aaaaaaaaaa"},
+		{"list", raw(RDBTypeList, 2, 1, 'a', 0xc0, 5), []string{"a", "5"}},
+		{"set", raw(RDBTypeSet, 1, 1, 'a'), map[string]struct{}{"a": {}}},
+		{"zset", raw(RDBTypeZSet, 2, 1, 'a', 3, '1', '.', '5', 1, 'b', 254), []RDBZEntry{{"a", 1.5}, {"b", math.Inf(1)}}},
+		{"zset2", func(e *RDBWriter) { e.Key(RDBTypeZSet2, "k"); e.Length(1); e.String("m"); e.Double(-2.25) }, []RDBZEntry{{"m", -2.25}}},
+		{"hash", raw(RDBTypeHash, 1, 1, 'f', 1, 'v'), map[string]string{"f": "v"}},
+		{"zipmap", raw(RDBTypeHashZipmap, 14, 2, 1, 'f', 1, 0, 'v', 1, 'g', 1, 2, 'w', 0, 0, 0xff), map[string]string{"f": "v", "g": "w"}},
+		{"ziplist", raw(RDBTypeListZiplist, append([]byte{byte(len(ziplist))}, ziplist...)...), []string{"a", "12", "300"}},
+		{"quicklist", raw(RDBTypeListQuicklist, append([]byte{1, byte(len(ziplist))}, ziplist...)...), []string{"a", "12", "300"}},
+		{"intset", raw(RDBTypeSetIntset, 12, 2, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 5, 0), map[string]struct{}{"-1": {}, "5": {}}},
+		{"zset ziplist", raw(RDBTypeZSetZiplist, append([]byte{byte(len(ziplist))}, ziplist...)...), []RDBZEntry{{"a", 12}}},
+		{"quicklist2", func(e *RDBWriter) {
+			e.Key(RDBTypeListQuicklist2, "k")
+			e.Length(2)
+			e.Length(2)
+			e.Bytes(lp.Bytes())
+			e.Length(1)
+			e.String("plain")
+		}, append(lpWant, "plain")},
+		{"hash listpack", func(e *RDBWriter) {
+			var lp Listpack
+			lp.Append("f")
+			lp.Append("10")
+			e.Key(RDBTypeHashListpack, "k")
+			e.Bytes(lp.Bytes())
+		}, map[string]string{"f": "10"}},
+		{"zset listpack", func(e *RDBWriter) {
+			var lp Listpack
+			lp.Append("m")
+			lp.Append("0.5")
+			e.Key(RDBTypeZSetListpack, "k")
+			e.Bytes(lp.Bytes())
+		}, []RDBZEntry{{"m", 0.5}}},
+		{"stream", func(e *RDBWriter) { e.Key(RDBTypeStreamListpacks, "k"); e.Stream(stream) }, stream},
+		{"module", func(e *RDBWriter) { e.Key(RDBTypeModule2, "k"); e.Module("MBbloomCF", 2, []byte("data")) },
+			RDBModuleValue{Name: "MBbloomCF", EncVer: 2, Fields: []any{"data"}}},
+		{"old module", raw(6, 0), nil},
+	}
+	for _, tt := range tests {
+		d, err := ParseRDB(dump(tt.write))
+		if tt.want == nil {
+			if !errors.Is(err, ErrRDBCorrupt) {
+				t.Errorf("%s: err = %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := d[0]["k"].Val; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRDBStreamGroups(t *testing.T) {
+	entries := []RDBStreamEntry{{MS: 5, Seq: 1, Fields: []string{"f", "v"}}}
+	b := dump(func(e *RDBWriter) {
+		e.Key(RDBTypeStream3, "k")
+		e.Length(1)
+		e.Bytes([]byte{0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 1})
+		e.Bytes(streamListpack(entries))
+		for _, n := range []uint64{1, 5, 1, 5, 1, 0, 0, 1} {
+			e.Length(n)
+		}
+		// a group with one pending entry owned by one consumer
+		e.Length(1)
+		e.String("g")
+		e.Length(5)
+		e.Length(1)
+		e.Length(1)
+		e.Length(1)
+		e.Write(make([]byte, 16+8))
+		e.Length(1)
+		e.Length(1)
+		e.String("c")
+		e.Write(make([]byte, 16))
+		e.Length(1)
+		e.Write(make([]byte, 16))
+		e.Key(RDBTypeString, "after")
+		e.String("v")
+	})
+	d, err := ParseRDB(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d[0]["k"].Val; !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %v", got)
+	}
+	if d[0]["after"].Val != "v" {
+		t.Errorf("key after the stream: %v", d[0]["after"])
+	}
+}
+
+func TestParseRDBErrors(t *testing.T) {
+	ex := time.UnixMilli(1700000000123)
+	b := dump(func(e *RDBWriter) {
+		e.ExpireAt(ex)
+		e.Key(RDBTypeString, "k")
+		e.String("v")
+	})
+	d, err := ParseRDB(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d[0]["k"]; v.Val != "v" || !v.Expiry.Equal(ex) {
+		t.Errorf("got %v", v)
+	}
+
+	bad := bytes.Clone(b)
+	bad[len(bad)-12] ^= 1
+	if _, err := ParseRDB(bad); err != ErrRDBChecksum {
+		t.Errorf("flipped byte: err = %v", err)
+	}
+	// a zero checksum means it was not computed
+	bad = bytes.Clone(b[:len(b)-8])
+	bad = append(bad, make([]byte, 8)...)
+	if _, err := ParseRDB(bad); err != nil {
+		t.Errorf("zero checksum: err = %v", err)
+	}
+	for i := 9; i < len(b); i++ {
+		if _, err := ParseRDB(b[:i]); !errors.Is(err, ErrRDBCorrupt) {
+			t.Errorf("truncated to %d: err = %v", i, err)
+		}
+	}
+	if _, err := ParseRDB([]byte("REDIS0099")); err != ErrInvalidVersion {
+		t.Errorf("version 99: err = %v", err)
+	}
+}
+
+func TestParseRDBPrefix(t *testing.T) {
+	b := dump(func(e *RDBWriter) {
+		e.Key(RDBTypeString, "k")
+		e.String("v")
+	})
+	d, n, err := ParseRDBPrefix(append(bytes.Clone(b), "*1\r\n$4\r\nPING\r\n"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) || d[0]["k"].Val != "v" {
+		t.Errorf("got %d bytes, %v", n, d)
+	}
+}
+
+func TestReadRDBStream(t *testing.T) {
+	ex := time.UnixMilli(1700000000123)
+	b := dump(func(e *RDBWriter) {
+		e.Key(RDBTypeString, "a")
+		e.String(strings.Repeat("v", 70000))
+		e.SelectDB(3)
+		e.ExpireAt(ex)
+		e.Key(RDBTypeString, "b")
+		e.String("w")
+	})
+	type key struct {
+		db int
+		k  string
+	}
+	got := make(map[key]RDBStoreValue)
+	r := iotest.OneByteReader(bytes.NewReader(append(bytes.Clone(b), "after"...)))
+	err := ReadRDBStream(r, func(db int, k string, v RDBStoreValue) error {
+		got[key{db, k}] = v
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || len(got[key{0, "a"}].Val.(string)) != 70000 ||
+		got[key{3, "b"}].Val != "w" || !got[key{3, "b"}].Expiry.Equal(ex) {
+		t.Errorf("got %v", got)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "after" {
+		t.Errorf("read past the dump: %q left", rest)
+	}
+
+	bad := bytes.Clone(b)
+	bad[len(bad)-12] ^= 1
+	if err := ReadRDBStream(bytes.NewReader(bad), func(int, string, RDBStoreValue) error { return nil }); err != ErrRDBChecksum {
+		t.Errorf("flipped byte: err = %v", err)
+	}
+	if err := ReadRDBStream(bytes.NewReader(b[:len(b)-3]), func(int, string, RDBStoreValue) error { return nil }); !errors.Is(err, ErrRDBCorrupt) {
+		t.Errorf("truncated: err = %v", err)
+	}
+}
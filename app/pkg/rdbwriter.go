@@ -0,0 +1,316 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RDBVersion is the version written to the header of new dumps.
+const RDBVersion = 11
+
+// Value types.
+const (
+	RDBTypeString          = 0
+	RDBTypeList            = 1
+	RDBTypeSet             = 2
+	RDBTypeZSet            = 3
+	RDBTypeHash            = 4
+	RDBTypeZSet2           = 5
+	RDBTypeModule2         = 7
+	RDBTypeHashZipmap      = 9
+	RDBTypeListZiplist     = 10
+	RDBTypeSetIntset       = 11
+	RDBTypeZSetZiplist     = 12
+	RDBTypeHashZiplist     = 13
+	RDBTypeListQuicklist   = 14
+	RDBTypeStreamListpacks = 15
+	RDBTypeHashListpack    = 16
+	RDBTypeZSetListpack    = 17
+	RDBTypeListQuicklist2  = 18
+	RDBTypeStream2         = 19
+	RDBTypeSetListpack     = 20
+	RDBTypeStream3         = 21
+)
+
+// Opcodes that may appear in place of a value type.
+const (
+	rdbOpFunction2 = 0xf5
+	rdbOpModuleAux = 0xf7
+	rdbOpIdle      = 0xf8
+	rdbOpFreq      = 0xf9
+	rdbOpAux       = 0xfa
+	rdbOpResizeDB  = 0xfb
+	rdbOpExpireMs  = 0xfc
+	rdbOpExpire    = 0xfd
+	rdbOpSelectDB  = 0xfe
+	rdbOpEOF       = 0xff
+)
+
+// Module value opcodes, which tag each field a module saves.
+const (
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSInt   = 1
+	rdbModuleOpUInt   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
+)
+
+// moduleCharset encodes the 9 character module type names in module IDs.
+const moduleCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// RDBWriter encodes a dump. Errors are sticky: after the first failed write
+// the rest are skipped and End reports it.
+type RDBWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func NewRDBWriter(w io.Writer) *RDBWriter {
+	return &RDBWriter{w: w}
+}
+
+// Write writes p as is, including it in the checksum.
+func (e *RDBWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	var n int
+	n, e.err = e.w.Write(p)
+	e.crc = CRC64(e.crc, p[:n])
+	return n, e.err
+}
+
+func (e *RDBWriter) byte(b byte) {
+	e.Write([]byte{b})
+}
+
+func (e *RDBWriter) Header() {
+	e.Write([]byte(fmt.Sprintf("REDIS%04d", RDBVersion)))
+}
+
+func (e *RDBWriter) Aux(k, v string) {
+	e.byte(rdbOpAux)
+	e.String(k)
+	e.String(v)
+}
+
+func (e *RDBWriter) SelectDB(n int) {
+	e.byte(rdbOpSelectDB)
+	e.Length(uint64(n))
+}
+
+func (e *RDBWriter) ResizeDB(keys, expires int) {
+	e.byte(rdbOpResizeDB)
+	e.Length(uint64(keys))
+	e.Length(uint64(expires))
+}
+
+func (e *RDBWriter) ExpireAt(t time.Time) {
+	e.byte(rdbOpExpireMs)
+	e.Write(binary.LittleEndian.AppendUint64(nil, uint64(t.UnixMilli())))
+}
+
+// Key starts a key of value type t.
+func (e *RDBWriter) Key(t byte, k string) {
+	e.Type(t)
+	e.String(k)
+}
+
+// Type starts a value of type t without a key, as in DUMP payloads.
+func (e *RDBWriter) Type(t byte) {
+	e.byte(t)
+}
+
+// Length writes n in the smallest of the 6, 14, 32 and 64 bit encodings.
+func (e *RDBWriter) Length(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.byte(byte(n))
+	case n < 1<<14:
+		e.Write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		e.Write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		e.Write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+// String writes s, as an 8, 16 or 32 bit integer when it is the canonical
+// form of one.
+func (e *RDBWriter) String(s string) {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			switch {
+			case v >= math.MinInt8 && v <= math.MaxInt8:
+				e.Write([]byte{0xc0, byte(v)})
+			case v >= math.MinInt16 && v <= math.MaxInt16:
+				e.Write(binary.LittleEndian.AppendUint16([]byte{0xc1}, uint16(v)))
+			default:
+				e.Write(binary.LittleEndian.AppendUint32([]byte{0xc2}, uint32(v)))
+			}
+			return
+		}
+	}
+	e.Length(uint64(len(s)))
+	e.Write([]byte(s))
+}
+
+// Bytes writes b as a string without trying the integer encodings.
+func (e *RDBWriter) Bytes(b []byte) {
+	e.Length(uint64(len(b)))
+	e.Write(b)
+}
+
+// Double writes f in the 8 byte binary form of sorted set scores.
+func (e *RDBWriter) Double(f float64) {
+	e.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+// ModuleID packs a 9 character module type name and its encoding version.
+func ModuleID(name string, encver int) uint64 {
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		for j := 0; j < len(moduleCharset); j++ {
+			if moduleCharset[j] == name[i] {
+				id = id<<6 | uint64(j)
+				break
+			}
+		}
+	}
+	return id<<10 | uint64(encver&1023)
+}
+
+// Module writes a module value whose only field is payload.
+func (e *RDBWriter) Module(name string, encver int, payload []byte) {
+	e.Length(ModuleID(name, encver))
+	e.Length(rdbModuleOpString)
+	e.Bytes(payload)
+	e.Length(rdbModuleOpEOF)
+}
+
+// RDBStreamEntry is one stream entry: its ID and its field value pairs.
+type RDBStreamEntry struct {
+	MS, Seq uint64
+	Fields  []string
+}
+
+// streamNodeMaxEntries is stream-node-max-entries: how many entries share a
+// listpack.
+const streamNodeMaxEntries = 100
+
+// Stream entry flags.
+const (
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// Stream writes entries, which must be in ID order, as a listpack stream
+// without consumer groups.
+func (e *RDBWriter) Stream(entries []RDBStreamEntry) {
+	nodes := (len(entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	e.Length(uint64(nodes))
+	for i := 0; i < len(entries); i += streamNodeMaxEntries {
+		node := entries[i:min(i+streamNodeMaxEntries, len(entries))]
+		master := node[0]
+		key := binary.BigEndian.AppendUint64(nil, master.MS)
+		e.Bytes(binary.BigEndian.AppendUint64(key, master.Seq))
+		e.Bytes(streamListpack(node))
+	}
+
+	e.Length(uint64(len(entries)))
+	var last RDBStreamEntry
+	if len(entries) > 0 {
+		last = entries[len(entries)-1]
+	}
+	e.Length(last.MS)
+	e.Length(last.Seq)
+	e.Length(0)
+}
+
+// streamListpack encodes a stream node. It starts with a master entry
+// holding the first entry's fields; entries with exactly those fields only
+// store their values.
+func streamListpack(node []RDBStreamEntry) []byte {
+	master := node[0]
+	var lp Listpack
+	lp.AppendInt(int64(len(node)))
+	lp.AppendInt(0)
+	lp.AppendInt(int64(len(master.Fields) / 2))
+	for i := 0; i < len(master.Fields); i += 2 {
+		lp.Append(master.Fields[i])
+	}
+	lp.AppendInt(0)
+
+	for _, en := range node {
+		same := len(en.Fields) == len(master.Fields)
+		for i := 0; same && i < len(en.Fields); i += 2 {
+			same = en.Fields[i] == master.Fields[i]
+		}
+		var flags int64
+		if same {
+			flags = streamItemSameFields
+		}
+		lp.AppendInt(flags)
+		lp.AppendInt(int64(en.MS - master.MS))
+		lp.AppendInt(int64(en.Seq - master.Seq))
+		if !same {
+			lp.AppendInt(int64(len(en.Fields) / 2))
+		}
+		for i := 0; i < len(en.Fields); i += 2 {
+			if !same {
+				lp.Append(en.Fields[i])
+			}
+			lp.Append(en.Fields[i+1])
+		}
+		// the count of elements in the entry, so it can be read backwards
+		n := 3 + len(en.Fields)/2
+		if !same {
+			n += 1 + len(en.Fields)/2
+		}
+		lp.AppendInt(int64(n))
+	}
+	return lp.Bytes()
+}
+
+// SortedFields flattens a map into field value pairs in field order.
+func SortedFields(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]string, 0, 2*len(m))
+	for _, k := range keys {
+		res = append(res, k, m[k])
+	}
+	return res
+}
+
+// Dump builds a DUMP payload: the value written by fn, then the RDB version
+// and a checksum of both.
+func Dump(fn func(e *RDBWriter)) []byte {
+	var buf bytes.Buffer
+	e := NewRDBWriter(&buf)
+	fn(e)
+	e.Write(binary.LittleEndian.AppendUint16(nil, RDBVersion))
+	return binary.LittleEndian.AppendUint64(buf.Bytes(), e.crc)
+}
+
+// End writes the end of file marker and the checksum, and reports the first
+// error encountered.
+func (e *RDBWriter) End() error {
+	e.byte(rdbOpEOF)
+	if e.err != nil {
+		return e.err
+	}
+	_, err := e.w.Write(binary.LittleEndian.AppendUint64(nil, e.crc))
+	return err
+}
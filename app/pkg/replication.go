@@ -6,6 +6,10 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
 )
 
 type ReplicaType string
@@ -19,68 +23,348 @@ var (
 	ErrInvalidMaster = errors.New("invalid master")
 )
 
+// LinkState is how far a replica got in connecting to its master.
+type LinkState string
+
+const (
+	LinkNone       LinkState = "none"
+	LinkConnecting LinkState = "connecting"
+	LinkHandshake  LinkState = "handshake"
+	LinkTransfer   LinkState = "transfer"
+	LinkConnected  LinkState = "connected"
+)
+
 type Replica struct {
 	sId  int64
-	capa map[string]string
+	capa map[string]bool
 	port int
 
 	Conf      bool
 	Psync     bool
 	Handshake bool
-	Conn      net.Conn
 	Ack       int
 
-	ch   chan []byte
-	cmds []string
+	// pending holds what is still to be written to conn. Nothing is queued
+	// before Sync or Hold, as the snapshot sent by Sync holds every earlier
+	// write. held stops the writes queued after Hold until Sync puts the
+	// snapshot ahead of them.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn
+	synced  bool
+	held    bool
+	pending [][]byte
+	closed  bool
 }
 
 func NewReplica(id int64) *Replica {
-	r := &Replica{
-		sId: id,
-		ch:  make(chan []byte, 1024),
-	}
-
+	r := &Replica{sId: id, capa: make(map[string]bool)}
+	r.cond = sync.NewCond(&r.mu)
 	go r.Start()
 	return r
 }
 
+// AddCapa records a capability announced with REPLCONF capa, such as eof
+// for diskless transfers.
+func (r *Replica) AddCapa(c string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.capa[strings.ToLower(c)] = true
+}
+
+func (r *Replica) HasCapa(c string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.capa[c]
+}
+
+// Sync queues the start of a resynchronization, b, ahead of the writes that
+// follow it, or that were pushed since Hold.
+func (r *Replica) Sync(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.held {
+		r.pending = append([][]byte{b}, r.pending...)
+		r.held = false
+	} else {
+		r.pending = append(r.pending, b)
+	}
+	r.synced = true
+	r.cond.Signal()
+}
+
+// Hold queues the writes that follow, to be sent once Sync queues the start
+// of the resynchronization they follow, such as a snapshot still being
+// encoded.
+func (r *Replica) Hold() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.synced, r.held = true, true
+}
+
+// Push queues a write for a synced replica. It never blocks, so a slow
+// replica does not hold up the master.
 func (r *Replica) Push(b []byte) {
-	r.cmds = append(r.cmds, fmt.Sprintf("%q", string(b)))
-	r.ch <- b
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.synced {
+		return
+	}
+	r.pending = append(r.pending, b)
+	r.cond.Signal()
 }
 
-func (r *Replica) Start() {
-	for r.Conn == nil {
+// SetConn starts writing to conn.
+func (r *Replica) SetConn(conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		r.conn = conn
+		r.cond.Signal()
+	}
+}
+
+// Close drops the connection to the replica, which has to sync again.
+func (r *Replica) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.conn != nil {
+		r.conn.Close()
 	}
+	r.cond.Signal()
+}
+
+func (r *Replica) Start() {
+	for {
+		r.mu.Lock()
+		for !r.closed && (r.conn == nil || r.held || len(r.pending) == 0) {
+			r.cond.Wait()
+		}
+		if r.closed {
+			r.mu.Unlock()
+			return
+		}
+		conn, pending := r.conn, r.pending
+		r.pending = nil
+		r.mu.Unlock()
 
-	for v := range r.ch {
-		_, err := r.Conn.Write(v)
-		if err != nil {
-			fmt.Println("write to slave: ", err.Error())
+		for _, b := range pending {
+			if _, err := conn.Write(b); err != nil {
+				fmt.Println("write to slave: ", err.Error())
+			}
 		}
 	}
 }
 
 type Replication struct {
-	Role   ReplicaType
-	Of     string
-	ID     string
+	role   ReplicaType
+	of     string
 	config Config
 	slaves map[int64]*Replica
+	// handshaking holds the replicas set up with REPLCONF that have not
+	// sent PSYNC yet. They are not fed.
+	handshaking map[int64]*Replica
+
+	// id names the stream and backlog holds its tail. id2 is the ID of the
+	// stream this one continues, such as the old master's after a
+	// promotion; replicas of it can continue up to id2Offset.
+	id        string
+	id2       string
+	id2Offset int64
+	backlog   *Backlog
+	// cached is set on a replica once it has synced, so it can try a
+	// partial resync with id after losing its master.
+	cached bool
+	// link is the state of the connection to the master, and lastIO when
+	// something was last read from it.
+	link   LinkState
+	lastIO time.Time
+
+	// seldb is the database last selected in the replication stream.
+	// -1 makes the next propagated command start with a SELECT.
+	seldb int
+	mu    sync.Mutex
+}
+
+// ReplState holds the fields of the replication section of INFO.
+type ReplState struct {
+	ID, ID2          string
+	Offset           int64
+	ID2Offset        int64
+	BacklogSize      int
+	BacklogFirstByte int64
+	BacklogHistlen   int
+
+	Link   LinkState
+	LastIO time.Time
 }
 
 func NewReplication(role ReplicaType, of string, config Config) *Replication {
 	return &Replication{
-		Role:   role,
-		Of:     of,
-		config: config,
-		ID:     "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb",
-		slaves: make(map[int64]*Replica),
+		role:        role,
+		of:          of,
+		config:      config,
+		id:          utils.RandomHex(40),
+		id2:         strings.Repeat("0", 40),
+		id2Offset:   -1,
+		backlog:     NewBacklog(config.ReplBacklogSize),
+		slaves:      make(map[int64]*Replica),
+		handshaking: make(map[int64]*Replica),
+		link:        LinkNone,
+		seldb:       -1,
+	}
+}
+
+func (r *Replication) State() ReplState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ReplState{
+		ID:               r.id,
+		ID2:              r.id2,
+		Offset:           r.backlog.Offset(),
+		ID2Offset:        r.id2Offset,
+		BacklogSize:      r.backlog.Size(),
+		BacklogFirstByte: r.backlog.FirstByte(),
+		BacklogHistlen:   r.backlog.Len(),
+		Link:             r.link,
+		LastIO:           r.lastIO,
+	}
+}
+
+func (r *Replication) Role() ReplicaType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role
+}
+
+// Master returns the address of the master as "host port".
+func (r *Replication) Master() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.of
+}
+
+// Follow makes this server a replica of the master at of. It tries to
+// continue its own stream with the new master, and drops its replicas so
+// they sync again with what it receives.
+func (r *Replication) Follow(of string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.role, r.of = SlaveReplica, of
+	r.cached = true
+	for id, s := range r.slaves {
+		s.Close()
+		delete(r.slaves, id)
+	}
+}
+
+func (r *Replication) SetLinkState(st LinkState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.link = st
+}
+
+// MasterIO records that something was read from the master.
+func (r *Replication) MasterIO() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastIO = time.Now()
+}
+
+func (r *Replication) ID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id
+}
+
+// Offset returns how many bytes of the stream were fed.
+func (r *Replication) Offset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backlog.Offset()
+}
+
+// Feed adds b to the stream: a write propagated by a master, or one
+// received by a replica. It is kept in the backlog and queued for every
+// synced replica.
+func (r *Replication) Feed(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backlog.Write(b)
+	for _, s := range r.slaves {
+		s.Push(b)
+	}
+}
+
+// PartialResync reports whether a replica holding the stream id up to
+// before off can continue from off. If so, start is called with the current
+// ID and the bytes the replica missed, before anything else is fed.
+func (r *Replication) PartialResync(id string, off int64, start func(id string, missing []byte)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id != r.id && (id != r.id2 || off > r.id2Offset) {
+		return false
+	}
+	missing, ok := r.backlog.Since(off)
+	if !ok {
+		return false
+	}
+	start(r.id, missing)
+	return true
+}
+
+// Promote makes a replica a master. It starts a new stream continuing the
+// one it received, so replicas of its old master can continue with it.
+func (r *Replication) Promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.role, r.of = MasterReplica, ""
+	r.link = LinkNone
+	r.id2, r.id2Offset = r.id, r.backlog.Offset()+1
+	r.id = utils.RandomHex(40)
+	r.seldb = -1
+	// replicas reconnect and continue with id2
+	for id, s := range r.slaves {
+		s.Close()
+		delete(r.slaves, id)
+	}
+}
+
+// PsyncArgs returns what a replica asks its master for: the stream it holds
+// and the offset it continues from, or "?" and -1 for a full resync.
+func (r *Replication) PsyncArgs() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.cached {
+		return "?", -1
+	}
+	return r.id, r.backlog.Offset() + 1
+}
+
+// FullResynced takes on the stream of a master whose snapshot was taken at
+// offset.
+func (r *Replication) FullResynced(id string, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.id, r.id2, r.id2Offset = id, strings.Repeat("0", 40), -1
+	r.backlog.Reset(offset)
+	r.cached = true
+}
+
+// Continued records the ID a master answered a partial resync with. A
+// master that changed its ID continues the stream under the new one.
+func (r *Replication) Continued(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id != "" && id != r.id {
+		r.id2, r.id2Offset = r.id, r.backlog.Offset()+1
+		r.id = id
 	}
 }
 
 func (r *Replication) Dial() (net.Conn, error) {
-	master := strings.Split(r.Of, " ")
+	master := strings.Split(r.Master(), " ")
 	if len(master) < 2 {
 		return nil, ErrInvalidMaster
 	}
@@ -90,22 +374,78 @@ func (r *Replication) Dial() (net.Conn, error) {
 		return nil, fmt.Errorf("invalid port: %w", err)
 	}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	timeout := time.Duration(r.config.ReplTimeout) * time.Second
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
 	if err != nil {
 		return nil, err
 	}
 	return conn, nil
 }
 
+// SelectDB records db as the database of the next propagated command and
+// reports whether a SELECT has to be sent first.
+func (r *Replication) SelectDB(db int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seldb == db {
+		return false
+	}
+	r.seldb = db
+	return true
+}
+
+// ResetSelectedDB forces a SELECT before the next propagated command, as a
+// new replica starts without a selected database.
+func (r *Replication) ResetSelectedDB() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seldb = -1
+}
+
 func (r *Replication) GetSlave(id int64) (*Replica, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	s, ok := r.slaves[id]
 	return s, ok
 }
+
+// Handshaking returns the replica the session id sets up with REPLCONF,
+// creating it. It is fed once PSYNC registers it with SetSlave.
+func (r *Replication) Handshaking(id int64) *Replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.handshaking[id]
+	if !ok {
+		s = NewReplica(id)
+		r.handshaking[id] = s
+	}
+	return s
+}
+
+// SetSlave registers the replica of the session id, which sent PSYNC.
 func (r *Replication) SetSlave(id int64, replica *Replica) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handshaking, id)
 	r.slaves[id] = replica
 }
 
+// DelSlave closes and forgets the replica of the session id, registered or
+// still handshaking.
+func (r *Replication) DelSlave(id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range []map[int64]*Replica{r.slaves, r.handshaking} {
+		if s, ok := m[id]; ok {
+			s.Close()
+			delete(m, id)
+		}
+	}
+}
+
 func (r *Replication) GetSlaves() []*Replica {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	var res []*Replica
 	for _, v := range r.slaves {
 		res = append(res, v)
@@ -0,0 +1,176 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReplicaQueue(t *testing.T) {
+	r := NewReplica(1)
+	r.Push([]byte("dropped;"))
+	r.Sync([]byte("rdb;"))
+	r.Push([]byte("a;"))
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	r.SetConn(c1)
+	r.Push([]byte("b;"))
+
+	want := "rdb;a;b;"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c2, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplicaHold(t *testing.T) {
+	r := NewReplica(1)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	r.SetConn(c1)
+	r.Hold()
+	r.Push([]byte("a;"))
+	r.Sync([]byte("rdb;"))
+	r.Push([]byte("b;"))
+
+	want := "rdb;a;b;"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c2, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	b := NewBacklog(8)
+	b.Write([]byte("abcde"))
+	b.Write([]byte("fghij")) // wraps, dropping "ab"
+
+	tests := []struct {
+		off  int64
+		want string
+		ok   bool
+	}{
+		{off: 3, want: "cdefghij", ok: true},
+		{off: 9, want: "ij", ok: true},
+		{off: 11, want: "", ok: true},
+		{off: 2},
+		{off: 12},
+	}
+	for _, tt := range tests {
+		got, ok := b.Since(tt.off)
+		if ok != tt.ok || string(got) != tt.want {
+			t.Errorf("Since(%d) = %q, %v, want %q, %v", tt.off, got, ok, tt.want, tt.ok)
+		}
+	}
+	if b.Offset() != 10 || b.FirstByte() != 3 || b.Len() != 8 {
+		t.Errorf("offset %d, first byte %d, len %d", b.Offset(), b.FirstByte(), b.Len())
+	}
+
+	b.Write([]byte("0123456789"))
+	if got, _ := b.Since(13); string(got) != "23456789" {
+		t.Errorf("after a write larger than the backlog got %q", got)
+	}
+	b.Reset(100)
+	if _, ok := b.Since(101); !ok {
+		t.Error("reset backlog cannot continue from its offset")
+	}
+	if _, ok := b.Since(100); ok {
+		t.Error("reset backlog still holds old bytes")
+	}
+}
+
+func TestPartialResync(t *testing.T) {
+	r := NewReplication(MasterReplica, "", Config{ReplBacklogSize: 16})
+	r.Feed([]byte("abc"))
+	old := r.ID()
+	r.Promote()
+	r.Feed([]byte("de"))
+
+	tests := []struct {
+		name string
+		id   string
+		off  int64
+		want string
+		ok   bool
+	}{
+		{name: "current id", id: r.ID(), off: 2, want: "bcde", ok: true},
+		{name: "old id", id: old, off: 4, want: "de", ok: true},
+		{name: "old id past promotion", id: old, off: 5},
+		{name: "unknown id", id: "x", off: 4},
+		{name: "ahead of the stream", id: r.ID(), off: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			ok := r.PartialResync(tt.id, tt.off, func(id string, missing []byte) {
+				if id != r.id {
+					t.Errorf("continued with id %q", id)
+				}
+				got = string(missing)
+			})
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPsyncArgs(t *testing.T) {
+	r := NewReplication(SlaveReplica, "", Config{ReplBacklogSize: 16})
+	if id, off := r.PsyncArgs(); id != "?" || off != -1 {
+		t.Fatalf("before syncing got %q %d", id, off)
+	}
+	r.FullResynced("m1", 10)
+	r.Feed([]byte("abc"))
+	if id, off := r.PsyncArgs(); id != "m1" || off != 14 {
+		t.Errorf("got %q %d", id, off)
+	}
+	r.Continued("m2")
+	if st := r.State(); st.ID != "m2" || st.ID2 != "m1" || st.ID2Offset != 14 {
+		t.Errorf("after the master changed id got %+v", st)
+	}
+}
+
+func TestFollowPromote(t *testing.T) {
+	r := NewReplication(MasterReplica, "", Config{ReplBacklogSize: 16})
+	sl := NewReplica(1)
+	c1, c2 := net.Pipe()
+	sl.SetConn(c1)
+	r.SetSlave(1, sl)
+	r.Feed([]byte("abc"))
+
+	// a former master continues its own stream with the new one
+	id := r.ID()
+	r.Follow("localhost 6380")
+	if r.Role() != SlaveReplica || r.Master() != "localhost 6380" {
+		t.Fatalf("role %s of %q", r.Role(), r.Master())
+	}
+	if got, off := r.PsyncArgs(); got != id || off != 4 {
+		t.Errorf("psync %q %d", got, off)
+	}
+	if len(r.GetSlaves()) != 0 {
+		t.Error("replicas kept after following a master")
+	}
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("replica connection still open")
+	}
+
+	r.SetSlave(2, NewReplica(2))
+	r.Promote()
+	if r.Role() != MasterReplica || r.Master() != "" {
+		t.Fatalf("role %s of %q after promotion", r.Role(), r.Master())
+	}
+	if len(r.GetSlaves()) != 0 {
+		t.Error("replicas kept after promotion")
+	}
+	if !r.SelectDB(0) {
+		t.Error("promoted master did not reset the selected database")
+	}
+}
@@ -1,10 +1,11 @@
 package resp
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
@@ -29,10 +30,12 @@ var (
 	ErrUnsupportedType   = errors.New("unsupported type")
 	ErrInvalidTerminator = errors.New("invalid terminator")
 	ErrMaxBulkLen        = errors.New("max bulk length")
+	ErrIncomplete        = errors.New("incomplete input")
 
-	Nil  = []byte("$-1\r\n")
-	Ok   = []byte("+OK\r\n")
-	Pong = []byte("+PONG\r\n")
+	Nil      = []byte("$-1\r\n")
+	NilArray = []byte("*-1\r\n")
+	Ok       = []byte("+OK\r\n")
+	Pong     = []byte("+PONG\r\n")
 )
 
 type Value struct {
@@ -58,17 +61,92 @@ func EncodeSimple(s string) []byte {
 	return []byte(fmt.Sprintf("+%s%s", s, crlf))
 }
 
-func EncodeRDB() []byte {
-	f, _ := hex.DecodeString("524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2")
-	b := []byte(fmt.Sprintf("$%d", len(f)))
+// EncodeRDB frames a dump sent on full resynchronization: a bulk string
+// without the trailing CRLF.
+func EncodeRDB(rdb []byte) []byte {
+	b := []byte(fmt.Sprintf("$%d", len(rdb)))
 	b = append(b, crlf...)
-	b = append(b, f...)
-	//b = append(b, crlf...)
-	return b
+	return append(b, rdb...)
 }
 
+// RDBEOFMarkLen is the length of the mark ending a diskless transfer.
+const RDBEOFMarkLen = 40
+
+// EncodeRDBEOF frames a dump whose length is not sent up front: it is
+// announced as $EOF:<mark> and ends with mark.
+func EncodeRDBEOF(rdb []byte, mark string) []byte {
+	b := []byte("$EOF:" + mark)
+	b = append(b, crlf...)
+	b = append(b, rdb...)
+	return append(b, mark...)
+}
+
+// ReadRDB reads the framing of a dump sent on full resynchronization and
+// returns a reader of the dump itself, which ends where the dump does.
+func ReadRDB(r *bufio.Reader) (io.Reader, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, string(crlf))
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok {
+		if len(mark) != RDBEOFMarkLen {
+			return nil, fmt.Errorf("invalid RDB EOF mark %q", mark)
+		}
+		return &eofReader{r: r, mark: []byte(mark)}, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64)
+	if err != nil || !strings.HasPrefix(line, "$") || n < 0 {
+		return nil, fmt.Errorf("invalid RDB transfer header %q", line)
+	}
+	return io.LimitReader(r, n), nil
+}
+
+// eofReader reads up to mark. Bytes are held back until they cannot be the
+// start of mark.
+type eofReader struct {
+	r    *bufio.Reader
+	mark []byte
+	done bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	if e.done {
+		return 0, io.EOF
+	}
+	w, err := e.r.Peek(len(e.mark))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if bytes.Equal(w, e.mark) {
+		e.r.Discard(len(e.mark))
+		e.done = true
+		return 0, io.EOF
+	}
+	w, _ = e.r.Peek(e.r.Buffered())
+	n := len(w) - len(e.mark) + 1
+	if i := bytes.Index(w, e.mark); i >= 0 {
+		n = i
+	}
+	n = copy(p, w[:n])
+	e.r.Discard(n)
+	return n, nil
+}
+
+// errorCodes are the error prefixes sent in place of the generic ERR.
+var errorCodes = []string{"WRONGTYPE", "READONLY", "BUSYKEY", "INVALIDOBJ"}
+
 func EncodeError(err error) []byte {
-	return []byte(fmt.Sprintf("-ERR %s%s", utils.Catpialize(err.Error()), crlf))
+	msg := err.Error()
+	for _, code := range errorCodes {
+		if strings.HasPrefix(msg, code+" ") {
+			return []byte(fmt.Sprintf("-%s%s", msg, crlf))
+		}
+	}
+	return []byte(fmt.Sprintf("-ERR %s%s", utils.Catpialize(msg), crlf))
 }
 
 func Encode(v any) []byte {
@@ -84,7 +162,7 @@ func Encode(v any) []byte {
 
 	t := reflect.TypeOf(v)
 	switch t.Kind() {
-	case reflect.Int:
+	case reflect.Int, reflect.Int64:
 		res = encodeInt(v)
 	case reflect.String:
 		res = encodeBulkString(v)
@@ -153,6 +231,9 @@ func Decode(d []byte, v *Value) (n int, err error) {
 	if v == nil {
 		return 0, nil
 	}
+	if len(d) == 0 {
+		return 0, ErrIncomplete
+	}
 
 	switch TYPE(d[0]) {
 	case SimpleString:
@@ -169,20 +250,16 @@ func Decode(d []byte, v *Value) (n int, err error) {
 
 func decodeSimple(d []byte, v *Value) (int, error) {
 	if len(d) < 3 {
-		return 0, fmt.Errorf("invalid simple string")
+		return 0, ErrIncomplete
 	}
 
-	var i int
-	for i = 0; i < len(d); i++ {
-		_, err := readNewLine(d[i+1 : i+3])
-		if err == nil {
-			break
-		}
+	i := bytes.Index(d, crlf)
+	if i < 0 {
+		return 0, ErrIncomplete
 	}
-	d = d[1 : i+1]
-	v.Val = string(d)
+	v.Val = string(d[1:i])
 	v.Type = SimpleString
-	return i + 3, nil
+	return i + crlLen, nil
 }
 
 // decodeArray *<number-of-elements>\r\n<element-1>...<element-n>
@@ -233,7 +310,10 @@ func decodeBulk(d []byte, v *Value) (int, error) {
 		return 0, err
 	}
 	d = d[n:]
-	n, _ = readNewLine(d) // optional last terminator
+	n, err = readNewLine(d)
+	if err != nil {
+		return 0, err
+	}
 	d = d[n:]
 	v.Val = s
 	return n0 - len(d), nil
@@ -241,7 +321,7 @@ func decodeBulk(d []byte, v *Value) (int, error) {
 
 func readString(d []byte, l int) (int, string, error) {
 	if len(d) < l {
-		return 0, "", errors.New("not enough data to read")
+		return 0, "", ErrIncomplete
 	}
 	if l > MaxBulkLen {
 		return 0, "", ErrMaxBulkLen
@@ -263,6 +343,9 @@ func readLength(d []byte) (int, int, error) {
 			break
 		}
 	}
+	if len(buf) == len(d) {
+		return 0, 0, ErrIncomplete
+	}
 	l, err := strconv.Atoi(string(buf))
 	if err != nil {
 		return 0, 0, err
@@ -271,6 +354,9 @@ func readLength(d []byte) (int, int, error) {
 }
 
 func readNewLine(d []byte) (int, error) {
+	if len(d) < crlLen {
+		return 0, ErrIncomplete
+	}
 	if !bytes.Equal(d[0:2], crlf) {
 		return 0, fmt.Errorf("%v, %v, %w", d[0:2], crlf, ErrInvalidTerminator)
 	}
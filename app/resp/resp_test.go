@@ -1,6 +1,14 @@
 package resp
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
 
 func TestDecodeSimple(t *testing.T) {
 	ts := []struct {
@@ -34,3 +42,77 @@ func TestDecodeSimple(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodePartial(t *testing.T) {
+	frames := []string{
+		"+OK\r\n",
+		"$5\r\nhello\r\n",
+		"$0\r\n\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n",
+		"*2\r\n*1\r\n+a\r\n$2\r\nbc\r\n",
+	}
+	for _, f := range frames {
+		// every cut short of the whole frame waits for more input
+		for i := 0; i < len(f); i++ {
+			var v Value
+			if _, err := Decode([]byte(f[:i]), &v); !errors.Is(err, ErrIncomplete) {
+				t.Errorf("%q cut at %d: got err %v", f, i, err)
+			}
+		}
+		var v Value
+		n, err := Decode([]byte(f+"+next\r\n"), &v)
+		if err != nil || n != len(f) {
+			t.Errorf("%q: got %d, %v", f, n, err)
+		}
+	}
+}
+
+func TestReadRDB(t *testing.T) {
+	mark := strings.Repeat("m", RDBEOFMarkLen)
+	// runs one byte short of the mark must not end the transfer
+	payload := "REDIS0011" + strings.Repeat(strings.Repeat("m", RDBEOFMarkLen-1)+"x", 200)
+	ts := []struct {
+		name string
+		in   []byte
+		want string
+		err  bool
+	}{
+		{name: "length", in: EncodeRDB([]byte(payload)), want: payload},
+		{name: "eof mark", in: EncodeRDBEOF([]byte(payload), mark), want: payload},
+		{name: "empty eof", in: EncodeRDBEOF(nil, mark), want: ""},
+		{name: "short mark", in: []byte("$EOF:abc\r\nREDIS"), err: true},
+		{name: "bad header", in: []byte("+OK\r\n"), err: true},
+		{name: "missing mark", in: []byte("$EOF:" + mark + "\r\nREDIS"), err: true},
+	}
+
+	for _, tt := range ts {
+		t.Run(tt.name, func(t *testing.T) {
+			in := append(tt.in, "*1\r\n$4\r\nPING\r\n"...)
+			if tt.name == "missing mark" {
+				in = tt.in
+			}
+			br := bufio.NewReader(iotest.HalfReader(bytes.NewReader(in)))
+			r, err := ReadRDB(br)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(r)
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+			rest, _ := io.ReadAll(br)
+			if string(rest) != "*1\r\n$4\r\nPING\r\n" {
+				t.Fatalf("rest %q", rest)
+			}
+		})
+	}
+}
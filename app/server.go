@@ -3,15 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
 	"github.com/codecrafters-io/redis-starter-go/app/handler"
 	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
 	"github.com/codecrafters-io/redis-starter-go/app/session"
 	"github.com/codecrafters-io/redis-starter-go/app/store"
+	"io"
 	"log"
 	"net"
 	"os"
 	"path"
-	"sync/atomic"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -19,6 +25,23 @@ var (
 	replicaOf  string
 	dbDir      string
 	dbFileName string
+	databases  int
+	save       string
+
+	appendOnly     string
+	appendFsync    string
+	appendFileName string
+	appendDirName  string
+	loadTruncated  string
+	rdbPreamble    string
+
+	disklessSync      string
+	disklessSyncDelay int
+	disklessLoad      string
+	backlogSize       int
+	replTimeout       int
+	pingPeriod        int
+	replicaReadOnly   string
 )
 
 func main() {
@@ -28,20 +51,49 @@ func main() {
 	flag.StringVar(&replicaOf, "replicaof", "", "the master to follow")
 	flag.StringVar(&dbDir, "dir", "./", "db dir")
 	flag.StringVar(&dbFileName, "dbfilename", "dump.rdb", "db file name")
+	flag.IntVar(&databases, "databases", 16, "number of logical databases")
+	flag.StringVar(&save, "save", pkg.DefaultSave, "save points as <seconds> <changes> pairs")
+	flag.StringVar(&appendOnly, "appendonly", "no", "log every write to the append only file (yes or no)")
+	flag.StringVar(&appendFsync, "appendfsync", aof.FsyncEverysec, "when to fsync the append only file: always, everysec or no")
+	flag.StringVar(&appendFileName, "appendfilename", "appendonly.aof", "append only file base name")
+	flag.StringVar(&appendDirName, "appenddirname", "appendonlydir", "append only file directory, under dir")
+	flag.StringVar(&loadTruncated, "aof-load-truncated", "yes", "load an append only file cut short mid-command (yes or no)")
+	flag.StringVar(&rdbPreamble, "aof-use-rdb-preamble", "yes", "write rewritten append only file bases as RDB (yes or no)")
+	flag.StringVar(&disklessSync, "repl-diskless-sync", "no", "send full resync snapshots with an EOF mark to batched replicas (yes or no)")
+	flag.IntVar(&disklessSyncDelay, "repl-diskless-sync-delay", 5, "seconds to wait for more replicas before a diskless transfer")
+	flag.StringVar(&disklessLoad, "repl-diskless-load", pkg.DisklessLoadDisabled, "how a replica loads the snapshot: disabled, on-empty-db or swapdb")
+	flag.IntVar(&backlogSize, "repl-backlog-size", 1<<20, "bytes of the replication stream kept for partial resyncs")
+	flag.IntVar(&replTimeout, "repl-timeout", 60, "seconds of silence after which a replication link is dropped")
+	flag.IntVar(&pingPeriod, "repl-ping-replica-period", 10, "seconds between the pings a master sends its replicas")
+	flag.StringVar(&replicaReadOnly, "replica-read-only", "yes", "reject writes from clients other than the master on a replica (yes or no)")
 	flag.Parse()
 
-	config := pkg.Config{Port: port, DbFileName: dbFileName, DbDir: dbDir}
-
-	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", config.Port))
+	savePoints, err := pkg.ParseSavePoints(save)
 	if err != nil {
-		fmt.Println("Failed to bind to port 6379")
+		fmt.Println("save", err.Error())
+		os.Exit(1)
+	}
+	config := pkg.Config{
+		Port: port, DbFileName: dbFileName, DbDir: dbDir, Databases: databases, Save: savePoints,
+		AppendOnly: yesNo("appendonly", appendOnly), AppendFsync: appendFsync,
+		AppendFileName: appendFileName, AppendDirName: appendDirName,
+		AOFLoadTruncated:      yesNo("aof-load-truncated", loadTruncated),
+		AOFUseRDBPreamble:     yesNo("aof-use-rdb-preamble", rdbPreamble),
+		ReplDisklessSync:      yesNo("repl-diskless-sync", disklessSync),
+		ReplDisklessSyncDelay: disklessSyncDelay,
+		ReplBacklogSize:       backlogSize,
+		ReplTimeout:           replTimeout,
+		ReplPingReplicaPeriod: pingPeriod,
+		ReplicaReadOnly:       yesNo("replica-read-only", replicaReadOnly),
+	}
+	if config.ReplDisklessLoad, err = pkg.ParseDisklessLoad(disklessLoad); err != nil {
+		fmt.Println("repl-diskless-load", err.Error())
 		os.Exit(1)
 	}
 
-	store := store.New()
-	err = store.Load(path.Join(config.DbDir, config.DbFileName))
+	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", config.Port))
 	if err != nil {
-		fmt.Println("load rdb", err.Error())
+		fmt.Println("Failed to bind to port 6379")
 		os.Exit(1)
 	}
 
@@ -50,46 +102,287 @@ func main() {
 		role = pkg.SlaveReplica
 	}
 	repl := pkg.NewReplication(role, replicaOf, config)
-	handlers := map[string]handler.Handler{
+
+	store := store.New(config.Databases)
+	var a *aof.AOF
+	if config.AppendOnly {
+		a, err = aof.Open(aof.Options{
+			Dir:       path.Join(config.DbDir, config.AppendDirName),
+			FileName:  config.AppendFileName,
+			Fsync:     config.AppendFsync,
+			Databases: config.Databases,
+
+			LoadTruncated: config.AOFLoadTruncated,
+			RDBPreamble:   config.AOFUseRDBPreamble,
+		}, replayer(config, repl))
+		if err != nil {
+			fmt.Println("open aof", err.Error())
+			os.Exit(1)
+		}
+	}
+	// the append only file, when there is one, is more recent than the dump
+	if a != nil && a.Exists() {
+		err = a.Load(store)
+	} else {
+		err = store.Load(path.Join(config.DbDir, config.DbFileName))
+	}
+	if err != nil {
+		fmt.Println("load", err.Error())
+		os.Exit(1)
+	}
+	store.ResetDirty()
+	if a != nil {
+		if err := a.Start(store); err != nil {
+			fmt.Println("start aof", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	store.SetReplica(role == pkg.SlaveReplica)
+	store.StartActiveExpire()
+	store.StartSavePoints(path.Join(config.DbDir, config.DbFileName), config.Save)
+	handlers := newHandlers(store, config, repl, a)
+
+	handlers["REPLCONF"] = handler.NewReplicaConfig(repl)
+	handlers["WAIT"] = handler.NewWait(repl, store)
+
+	var propagateMu sync.Mutex
+	store.OnPropagate(func(db int, args []string) {
+		if a != nil {
+			a.Append(db, args)
+		}
+		if repl.Role() != pkg.MasterReplica {
+			return
+		}
+		propagateMu.Lock()
+		defer propagateMu.Unlock()
+
+		var b []byte
+		if repl.SelectDB(db) {
+			b = resp.Encode([]string{"SELECT", strconv.Itoa(db)})
+		}
+		b = append(b, resp.Encode(args)...)
+		repl.Feed(b)
+	})
+
+	go pingReplicas(store, repl, time.Duration(config.ReplPingReplicaPeriod)*time.Second)
+
+	link := session.NewLink(handlers, repl, config, func(r io.Reader) error {
+		if err := loadSync(store, config.ReplDisklessLoad, r); err != nil {
+			return err
+		}
+		if a != nil {
+			return a.Reset(store)
+		}
+		return nil
+	}).Exec(store.Exec)
+	handlers["REPLICAOF"] = handler.NewReplicaOf(repl, store, link)
+	handlers["SLAVEOF"] = handlers["REPLICAOF"]
+	if role == pkg.SlaveReplica {
+		link.Connect()
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal("Error accepting connection: ", err.Error())
+		}
+
+		s := session.New(conn, handlers, repl, config)
+		go s.Start()
+	}
+}
+
+// pingReplicas keeps idle replication links from timing out. The PING goes
+// through the stream under the store gate, like a write, so snapshots and
+// replica offsets account for it.
+func pingReplicas(s *store.Store, repl *pkg.Replication, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	ping := resp.Encode([]string{"PING"})
+	for range time.Tick(period) {
+		s.Exec(func() {
+			if repl.Role() == pkg.MasterReplica && len(repl.GetSlaves()) > 0 {
+				repl.Feed(ping)
+			}
+		})
+	}
+}
+
+// newHandlers builds the command table. a is nil when appendonly is off.
+func newHandlers(store *store.Store, config pkg.Config, repl *pkg.Replication, a *aof.AOF) map[string]handler.Handler {
+	h := map[string]handler.Handler{
 		"PING":   handler.Ping{},
 		"ECHO":   handler.Echo{},
 		"SET":    handler.NewSet(store),
 		"GET":    handler.NewGet(store),
-		"INFO":   handler.NewInfo(repl),
-		"PSYNC":  handler.NewPsync(repl),
+		"INFO":   handler.NewInfo(repl, store, a),
+		"PSYNC":  handler.NewPsync(repl, store, config),
 		"CONFIG": handler.NewConf(config),
-		"KEYS":   handler.NewKeys(config),
+		"KEYS":   handler.NewKeys(store),
 		"TYPE":   handler.NewType(store),
 		"XADD":   handler.NewXadd(store),
 		"XRANGE": handler.NewXrange(store),
 		"XREAD":  handler.NewXread(store),
+
+		"DEL":         handler.NewDel(store),
+		"UNLINK":      handler.NewDel(store),
+		"EXISTS":      handler.NewExists(store),
+		"EXPIRE":      handler.NewExpire(store),
+		"PEXPIRE":     handler.NewPexpire(store),
+		"EXPIREAT":    handler.NewExpireat(store),
+		"PEXPIREAT":   handler.NewPexpireat(store),
+		"TTL":         handler.NewTTL(store),
+		"PTTL":        handler.NewPTTL(store),
+		"EXPIRETIME":  handler.NewExpiretime(store),
+		"PEXPIRETIME": handler.NewPexpiretime(store),
+		"PERSIST":     handler.NewPersist(store),
+		"SCAN":        handler.NewScan(store),
+		"HSCAN":       handler.NewHscan(store),
+		"SSCAN":       handler.NewSscan(store),
+		"ZSCAN":       handler.NewZscan(store),
+		"SELECT":      handler.NewSelect(store),
+		"MOVE":        handler.NewMove(store),
+		"SWAPDB":      handler.NewSwapDB(store),
+		"FLUSHDB":     handler.NewFlushDB(store),
+		"FLUSHALL":    handler.NewFlushAll(store),
+		"DBSIZE":      handler.NewDBSize(store),
+		"INCR":        handler.NewIncr(store),
+		"DECR":        handler.NewDecr(store),
+		"INCRBY":      handler.NewIncrBy(store),
+		"DECRBY":      handler.NewDecrBy(store),
+		"INCRBYFLOAT": handler.NewIncrByFloat(store),
+		"APPEND":      handler.NewAppend(store),
+		"STRLEN":      handler.NewStrlen(store),
+		"GETRANGE":    handler.NewGetRange(store),
+		"SETRANGE":    handler.NewSetRange(store),
+		"MGET":        handler.NewMGet(store),
+		"MSET":        handler.NewMSet(store),
+		"MSETNX":      handler.NewMSetNX(store),
+		"GETDEL":      handler.NewGetDel(store),
+		"GETEX":       handler.NewGetEx(store),
+		"LCS":         handler.NewLCS(store),
+		"OBJECT":      handler.NewObject(store),
+		"SETBIT":      handler.NewSetBit(store),
+		"GETBIT":      handler.NewGetBit(store),
+		"BITCOUNT":    handler.NewBitCount(store),
+		"BITPOS":      handler.NewBitPos(store),
+		"BITOP":       handler.NewBitOp(store),
+		"BITFIELD":    handler.NewBitField(store),
+		"BITFIELD_RO": handler.NewBitFieldRO(store),
+		"PFADD":       handler.NewPFAdd(store),
+		"PFCOUNT":     handler.NewPFCount(store),
+		"PFMERGE":     handler.NewPFMerge(store),
+
+		"GEOADD":         handler.NewGeoAdd(store),
+		"GEODIST":        handler.NewGeoDist(store),
+		"GEOPOS":         handler.NewGeoPos(store),
+		"GEOHASH":        handler.NewGeoHash(store),
+		"GEOSEARCH":      handler.NewGeoSearch(store),
+		"GEOSEARCHSTORE": handler.NewGeoSearchStore(store),
+
+		"JSON.SET":       handler.NewJSONSet(store),
+		"JSON.GET":       handler.NewJSONGet(store),
+		"JSON.MGET":      handler.NewJSONMGet(store),
+		"JSON.DEL":       handler.NewJSONDel(store),
+		"JSON.FORGET":    handler.NewJSONDel(store),
+		"JSON.NUMINCRBY": handler.NewJSONNumIncrBy(store),
+		"JSON.ARRAPPEND": handler.NewJSONArrAppend(store),
+		"JSON.ARRLEN":    handler.NewJSONArrLen(store),
+		"JSON.OBJKEYS":   handler.NewJSONObjKeys(store),
+		"JSON.TYPE":      handler.NewJSONType(store),
+
+		"BF.RESERVE": handler.NewBFReserve(store),
+		"BF.ADD":     handler.NewBFAdd(store),
+		"BF.MADD":    handler.NewBFMAdd(store),
+		"BF.EXISTS":  handler.NewBFExists(store),
+		"BF.MEXISTS": handler.NewBFMExists(store),
+		"BF.INFO":    handler.NewBFInfo(store),
+		"CF.RESERVE": handler.NewCFReserve(store),
+		"CF.ADD":     handler.NewCFAdd(store),
+		"CF.ADDNX":   handler.NewCFAddNX(store),
+		"CF.DEL":     handler.NewCFDel(store),
+		"CF.EXISTS":  handler.NewCFExists(store),
+		"CF.COUNT":   handler.NewCFCount(store),
+
+		"TS.CREATE":    handler.NewTSCreate(store),
+		"TS.ADD":       handler.NewTSAdd(store),
+		"TS.MADD":      handler.NewTSMAdd(store),
+		"TS.RANGE":     handler.NewTSRange(store),
+		"TS.REVRANGE":  handler.NewTSRevRange(store),
+		"TS.MRANGE":    handler.NewTSMRange(store),
+		"TS.MREVRANGE": handler.NewTSMRevRange(store),
+
+		"SAVE":     handler.NewSave(store, config),
+		"BGSAVE":   handler.NewBGSave(store, config),
+		"LASTSAVE": handler.NewLastSave(store),
+
+		"DUMP":         handler.NewDump(store),
+		"RESTORE":      handler.NewRestore(store),
+		"BGREWRITEAOF": handler.NewBGRewriteAOF(a),
+	}
+	for name, hd := range h {
+		// XREAD may block, and PSYNC and SAVE take a snapshot themselves
+		if name != "XREAD" && name != "PSYNC" && name != "SAVE" {
+			h[name] = handler.NewGated(store, hd)
+		}
 	}
 
-	ack0, ack1 := &atomic.Int64{}, &atomic.Int64{}
+	return h
+}
 
-	if role == pkg.SlaveReplica {
-		go func() {
-			conn, err := repl.Dial()
-			if err != nil {
-				fmt.Println("dial master: ", err.Error())
-				os.Exit(1)
-			}
+// loadSync replaces the dataset with the snapshot a replica reads from r,
+// buffering it first unless policy lets it load as it arrives.
+func loadSync(store *store.Store, policy string, r io.Reader) error {
+	if policy == pkg.DisklessLoadSwapDB || policy == pkg.DisklessLoadOnEmptyDB && store.Empty() {
+		return store.ReplaceFrom(r)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return store.Replace(b)
+}
 
-			handlers["REPLCONF"] = handler.NewReplicaConfig(repl, ack0)
-			s := session.New(conn, handlers, repl, config, ack0).Responsive(false).Handshake(true)
-			go s.Start()
-		}()
+// yesNo parses the boolean flag name, exiting when it is invalid.
+func yesNo(name, v string) bool {
+	b, err := pkg.ParseYesNo(v)
+	if err != nil {
+		fmt.Println(name, err.Error())
+		os.Exit(1)
 	}
+	return b
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal("Error accepting connection: ", err.Error())
-		}
+// replaySession is the session id commands read from the append only file
+// run under.
+const replaySession = -1
 
-		handlers["REPLCONF"] = handler.NewReplicaConfig(repl, ack1)
-		handlers["WAIT"] = handler.NewWait(repl, ack1)
-		s := session.New(conn, handlers, repl, config, ack1)
-		go s.Start()
+// replayer applies commands from the append only file through the command
+// table, discarding their replies.
+func replayer(config pkg.Config, repl *pkg.Replication) aof.Replayer {
+	return func(s *store.Store) func(args []string) error {
+		handlers := newHandlers(s, config, repl, nil)
+		return func(args []string) error {
+			cmd := strings.ToUpper(args[0])
+			h, ok := handlers[cmd]
+			if !ok {
+				return fmt.Errorf("unknown command '%s' reading the append only file", args[0])
+			}
+			vals := make([]resp.Value, len(args))
+			for i, a := range args {
+				vals[i] = resp.Value{Type: resp.BulkString, Val: a}
+			}
+			res := make(chan []byte)
+			go func() {
+				for range res {
+				}
+			}()
+			defer close(res)
+			// a failing command failed when it was first run too
+			h.Handle(replaySession, vals, res)
+			return nil
+		}
 	}
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/handler"
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+)
+
+func TestHandlersHaveFlags(t *testing.T) {
+	config := pkg.Config{}
+	handlers := newHandlers(store.New(1), config, pkg.NewReplication(pkg.MasterReplica, "", config), nil)
+	// main registers these after the rest
+	names := []string{"REPLCONF", "WAIT"}
+	for name := range handlers {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if _, ok := handler.CommandFlags(name); !ok {
+			t.Errorf("%s has no command flags", name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package session
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/handler"
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+)
+
+// the wait before reconnecting to the master doubles from linkRetryMin with
+// every failed attempt, up to linkRetryMax
+const (
+	linkRetryMin = 500 * time.Millisecond
+	linkRetryMax = 30 * time.Second
+)
+
+// Link is a replica's connection to its master. It reconnects whenever the
+// connection drops, until Connect or Disconnect retarget it, as REPLICAOF
+// does.
+type Link struct {
+	handlers map[string]handler.Handler
+	repl     *pkg.Replication
+	config   pkg.Config
+	onSync   func(r io.Reader) error
+	exec     func(fn func())
+
+	mu sync.Mutex
+	s  *Session
+	// gen counts retargets. A run loop stops once its gen is not current.
+	gen int
+}
+
+func NewLink(handlers map[string]handler.Handler, repl *pkg.Replication, config pkg.Config, onSync func(r io.Reader) error) *Link {
+	return &Link{handlers: handlers, repl: repl, config: config, onSync: onSync}
+}
+
+// Exec sets how the sessions of the link run what the store gate covers.
+func (l *Link) Exec(fn func(fn func())) *Link {
+	l.exec = fn
+	return l
+}
+
+// Connect drops the current master link and keeps connecting to the master
+// repl follows, running the handshake and resyncing each time. It does not
+// wait for the connection.
+func (l *Link) Connect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	l.stop()
+	go l.run(l.gen)
+}
+
+// Disconnect drops the master link.
+func (l *Link) Disconnect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	l.stop()
+}
+
+func (l *Link) stop() {
+	if l.s != nil {
+		l.s.Stop()
+		l.s = nil
+	}
+}
+
+func (l *Link) run(gen int) {
+	retry := linkRetryMin
+	for l.setState(gen, pkg.LinkConnecting) {
+		conn, err := l.repl.Dial()
+		if err != nil {
+			fmt.Println("dial master: ", err.Error())
+		} else {
+			s := l.start(gen, conn)
+			if s == nil {
+				return
+			}
+			<-s.Done()
+			if s.Synced() {
+				retry = linkRetryMin
+			}
+			fmt.Println("lost master link, reconnecting")
+		}
+
+		if !l.setState(gen, pkg.LinkConnecting) {
+			return
+		}
+		time.Sleep(retry)
+		retry = min(2*retry, linkRetryMax)
+	}
+}
+
+// setState records the link state, unless the link was retargeted since gen.
+func (l *Link) setState(gen int, st pkg.LinkState) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if gen != l.gen {
+		return false
+	}
+	l.repl.SetLinkState(st)
+	return true
+}
+
+// start runs the session with the master on conn, unless the link was
+// retargeted since gen.
+func (l *Link) start(gen int, conn net.Conn) *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if gen != l.gen {
+		conn.Close()
+		return nil
+	}
+	l.repl.SetLinkState(pkg.LinkHandshake)
+	l.s = New(conn, l.handlers, l.repl, l.config).Responsive(false).Handshake(true).OnSync(l.onSync).Exec(l.exec)
+	l.s.Start()
+	return l.s
+}
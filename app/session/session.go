@@ -1,6 +1,8 @@
 package session
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/codecrafters-io/redis-starter-go/app/handler"
@@ -8,6 +10,8 @@ import (
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
 	"io"
 	"net"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -17,11 +21,16 @@ import (
 type Input struct {
 	b []byte
 	v resp.Value
+	// synced marks the end of a full resynchronization, whose snapshot
+	// readLoop already loaded.
+	synced bool
 }
 
 // Session is the life cycle of a connection
 type Session struct {
 	conn       net.Conn
+	in         io.Reader
+	done       chan struct{}
 	handlers   map[string]handler.Handler
 	inC        chan Input
 	outC       chan []byte
@@ -35,13 +44,22 @@ type Session struct {
 	handshaking      atomic.Bool
 	handshakeStepper chan any
 	handshakeCmd     string
-	fullResync       bool
-
-	// ack
-	ack *atomic.Int64
+	// resyncID and resyncOffset are the stream a FULLRESYNC reply announced,
+	// taken on once its snapshot is loaded.
+	resyncID     string
+	resyncOffset int64
+	// onSync loads the snapshot the master sends on full resynchronization.
+	// It must read r to its end.
+	onSync func(r io.Reader) error
+	// exec runs fn under the store gate, as the writes fed to replicas are.
+	exec func(fn func())
 }
 
-func New(conn net.Conn, handlers map[string]handler.Handler, repl *pkg.Replication, config pkg.Config, ack *atomic.Int64) *Session {
+// masterLinkID is the session id of every connection to the master, so the
+// database selected by the replication stream outlives a reconnection.
+const masterLinkID int64 = -2
+
+func New(conn net.Conn, handlers map[string]handler.Handler, repl *pkg.Replication, config pkg.Config) *Session {
 	return &Session{
 		conn:             conn,
 		handlers:         handlers,
@@ -52,7 +70,8 @@ func New(conn net.Conn, handlers map[string]handler.Handler, repl *pkg.Replicati
 		responsive:       true,
 		config:           config,
 		handshakeStepper: make(chan any),
-		ack:              ack,
+		done:             make(chan struct{}),
+		exec:             func(fn func()) { fn() },
 	}
 }
 
@@ -63,55 +82,146 @@ func (s *Session) Responsive(v bool) *Session {
 func (s *Session) Handshake(v bool) *Session {
 	s.shouldHandshake = v
 	s.handshaking.Store(v)
+	if v {
+		s.id = masterLinkID
+	}
+	return s
+}
+
+func (s *Session) OnSync(fn func(r io.Reader) error) *Session {
+	s.onSync = fn
+	return s
+}
+
+// Exec sets how the session runs what the store gate covers. A nil fn runs
+// it directly.
+func (s *Session) Exec(fn func(fn func())) *Session {
+	if fn != nil {
+		s.exec = fn
+	}
 	return s
 }
 
 func (s *Session) Start() {
+	s.in = s.conn
+	if s.shouldHandshake {
+		s.in = &masterReader{conn: s.conn, repl: s.repl, timeout: time.Duration(s.config.ReplTimeout) * time.Second}
+	}
 	go s.worker()
 	go s.readLoop()
 	go s.writeLoop()
 
-	if s.repl.Role == pkg.SlaveReplica && s.shouldHandshake {
+	if s.repl.Role() == pkg.SlaveReplica && s.shouldHandshake {
 		go s.handshake()
 	}
 }
 
 func (s *Session) handshake() {
+	// a replica that synced before asks to continue where it stopped
+	id, off := s.repl.PsyncArgs()
 	handshakeCmds := [][]string{
 		{"PING"},
 		{"REPLCONF", "listening-port", strconv.Itoa(s.config.Port)},
-		{"REPLCONF", "capa", "psync2"},
-		{"PSYNC", "?", "-1"},
+		{"REPLCONF", "capa", "eof", "capa", "psync2"},
+		{"PSYNC", id, strconv.FormatInt(off, 10)},
 	}
 	for _, cmd := range handshakeCmds {
 		s.handshakeCmd = cmd[0]
 		s.conn.Write(resp.Encode(cmd))
-		<-s.handshakeStepper
+		select {
+		case <-s.handshakeStepper:
+		case <-s.done:
+			return
+		}
 	}
+}
 
-	<-s.handshakeStepper
+// step lets handshake send its next command.
+func (s *Session) step() {
+	select {
+	case s.handshakeStepper <- 1:
+	case <-s.done:
+	}
 }
 
 func (s *Session) handleHandshakeRes(in Input) {
-	r := strings.ToUpper(in.v.Val.(string))
-	if (s.handshakeCmd == "PING" && r == "PONG") ||
-		(s.handshakeCmd == "REPLCONF" && r == "OK") {
-		s.handshakeStepper <- 1
+	if s.handshakeCmd == "PSYNC" && in.synced {
+		fmt.Println("rdb received")
+		s.repl.FullResynced(s.resyncID, s.resyncOffset)
+		s.endHandshake()
+		return
 	}
-	if s.handshakeCmd == "PSYNC" {
-		if !strings.HasPrefix(r, "FULLRESYNC") {
-			fmt.Println("rdb received")
-			s.handshaking.Store(false)
-			s.handshakeCmd = ""
+
+	r, _ := in.v.Val.(string)
+	fields := strings.Fields(r)
+	if len(fields) == 0 {
+		return
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "PONG":
+		if s.handshakeCmd == "PING" {
+			s.step()
+		}
+	case "OK":
+		if s.handshakeCmd == "REPLCONF" {
+			s.step()
+		}
+	case "FULLRESYNC":
+		// the snapshot follows; the handshake ends once it is loaded
+		if s.handshakeCmd == "PSYNC" && len(fields) == 3 {
+			s.resyncID = fields[1]
+			s.resyncOffset, _ = strconv.ParseInt(fields[2], 10, 64)
+			s.repl.SetLinkState(pkg.LinkTransfer)
+		}
+	case "CONTINUE":
+		// the missing writes follow as commands
+		if s.handshakeCmd == "PSYNC" {
+			var id string
+			if len(fields) > 1 {
+				id = fields[1]
+			}
+			s.repl.Continued(id)
+			s.endHandshake()
 		}
-		s.handshakeStepper <- 1
 	}
 }
 
+func (s *Session) endHandshake() {
+	s.handshaking.Store(false)
+	s.handshakeCmd = ""
+	s.repl.SetLinkState(pkg.LinkConnected)
+	s.step()
+}
+
+// Done is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Synced reports whether the handshake with the master completed.
+func (s *Session) Synced() bool {
+	return s.shouldHandshake && !s.handshaking.Load()
+}
+
+// Stop closes the connection. The session ends once readLoop notices.
+func (s *Session) Stop() {
+	s.conn.Close()
+}
+
 func (s *Session) Close() {
+	// the master link keeps its state for the next connection
+	if !s.shouldHandshake {
+		for _, h := range s.handlers {
+			if c, ok := h.(handler.Closer); ok {
+				c.Close(s.id)
+			}
+		}
+		s.repl.DelSlave(s.id)
+	}
 	s.conn.Close()
 	close(s.inC)
 	close(s.outC)
+	close(s.done)
 }
 
 func (s *Session) worker() {
@@ -131,6 +241,22 @@ func (s *Session) worker() {
 }
 
 func (s *Session) handle(in Input) error {
+	// the master link counts every byte it reads, whatever the command
+	// does, so its offset stays the master's
+	var fed bool
+	feed := func() {
+		if s.shouldHandshake && !fed {
+			fed = true
+			s.repl.Feed(in.b)
+		}
+	}
+	// gated handlers feed from within the gate; the rest take it here, so
+	// the feed never lands inside a snapshot
+	defer func() {
+		if s.shouldHandshake && !fed {
+			s.exec(feed)
+		}
+	}()
 	cmd, args, err := resp.DecodeCmd(in.v)
 	if err != nil {
 		return err
@@ -155,27 +281,35 @@ func (s *Session) handle(in Input) error {
 		}
 	}()
 
-	err = h.Handle(s.id, args, res)
+	if f, _ := handler.CommandFlags(cmd); f.Has(handler.FlagWrite) && s.readOnly() {
+		err = handler.ErrReadOnly
+	} else if g, ok := h.(handler.Gated); ok && s.shouldHandshake {
+		// a snapshot for a sub-replica must not hold a write that it will
+		// also get from the backlog
+		err = g.HandleThen(s.id, args, res, feed)
+	} else {
+		err = h.Handle(s.id, args, res)
+	}
 	if err != nil {
 		res <- resp.EncodeError(err)
 		return err
 	}
 
-	//a master connection
-	if s.shouldHandshake {
-		s.ack.Add(int64(len(in.b)))
-		fmt.Printf("added %d to ack from master. val=%d, source=%q\n", len(in.b), s.ack.Load(), string(in.b))
-	}
-
 	// setup slave conn
 	sl, ok := s.repl.GetSlave(s.id)
-	if ok && sl.Handshake && sl.Conn == nil {
-		sl.Conn = s.conn
+	if ok && sl.Handshake {
+		sl.SetConn(s.conn)
 	}
 
 	return nil
 }
 
+// readOnly reports whether writes are rejected: on a read only replica,
+// from any session but the master link.
+func (s *Session) readOnly() bool {
+	return !s.shouldHandshake && s.config.ReplicaReadOnly && s.repl.Role() == pkg.SlaveReplica
+}
+
 func (s *Session) writeLoop() {
 	for d := range s.outC {
 		_, err := s.conn.Write(d)
@@ -186,68 +320,131 @@ func (s *Session) writeLoop() {
 }
 
 func (s *Session) readLoop() {
+	var pending []byte
 	for {
 		buf := make([]byte, 1024)
-		n, err := s.conn.Read(buf)
-		if errors.Is(err, io.EOF) {
+		n, err := s.in.Read(buf)
+		if err != nil {
+			// the connection is gone, or the master went silent
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				fmt.Println("master timed out")
+			case !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed):
+				fmt.Println("session read: ", err.Error())
+			}
 			s.Close()
 			return
 		}
-		if err != nil {
-			fmt.Println("session read: ", err.Error())
-			continue
+		pending = append(pending, buf[:n]...)
+		if pending, err = s.deliver(pending); err != nil {
+			fmt.Println("full resync: ", err.Error())
+			s.Close()
+			return
 		}
-		buf = buf[:n]
-		bufs, vals := parseInputs(buf)
-		if len(bufs) != len(vals) {
-			fmt.Println("len mismatch. want ", len(bufs), " got ", len(vals))
-			continue
+	}
+}
+
+// deliver passes every complete value in pending to the worker, loading the
+// snapshot that follows a FULLRESYNC reply, and returns what is left for the
+// next read.
+func (s *Session) deliver(pending []byte) ([]byte, error) {
+	for {
+		bufs, vals, err := parseInputs(pending)
+		if err != nil {
+			fmt.Printf("decode input: %q: %s\n", string(pending), err.Error())
+			pending = nil
 		}
 		for i := range bufs {
-			s.push(bufs[i], vals[i])
+			if pending != nil {
+				pending = pending[len(bufs[i]):]
+			}
 			s.inC <- Input{
 				b: bufs[i],
 				v: vals[i],
 			}
 		}
+		if len(vals) == 0 || !s.shouldHandshake || !s.handshaking.Load() || !isFullResync(vals[len(vals)-1]) {
+			return pending, nil
+		}
+		// the master may have sent commands along with the end of the
+		// snapshot; they are parsed at once rather than after the next read
+		if pending, err = s.receiveSync(pending); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// receiveSync reads the snapshot following a FULLRESYNC reply, straight
+// from the connection after what was already read into pending, and passes
+// it to onSync. It returns what was read past the snapshot.
+func (s *Session) receiveSync(pending []byte) ([]byte, error) {
+	pr := bytes.NewReader(pending)
+	br := bufio.NewReader(io.MultiReader(pr, s.in))
+	r, err := resp.ReadRDB(br)
+	if err != nil {
+		return nil, err
+	}
+	if s.onSync != nil {
+		err = s.onSync(r)
+	}
+	// skip what onSync left, so the commands that follow line up
+	if _, cerr := io.Copy(io.Discard, r); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
 	}
+	s.inC <- Input{synced: true}
+
+	rest, _ := br.Peek(br.Buffered())
+	rest = append(slices.Clone(rest), pending[len(pending)-pr.Len():]...)
+	return rest, nil
 }
 
-func parseInputs(buf []byte) ([][]byte, []resp.Value) {
+func isFullResync(v resp.Value) bool {
+	r, ok := v.Val.(string)
+	return ok && v.Type == resp.SimpleString && strings.HasPrefix(strings.ToUpper(r), "FULLRESYNC")
+}
+
+// parseInputs decodes every complete value in buf. A trailing partial value
+// is left for the next read, and so is everything after a FULLRESYNC reply,
+// which is followed by a snapshot rather than a value.
+func parseInputs(buf []byte) ([][]byte, []resp.Value, error) {
 	var bufs [][]byte
 	var vals []resp.Value
 
-	for string(buf) != "" {
+	for len(buf) > 0 && (len(vals) == 0 || !isFullResync(vals[len(vals)-1])) {
 		var val resp.Value
 		n1, err := resp.Decode(buf, &val)
+		if errors.Is(err, resp.ErrIncomplete) {
+			break
+		}
 		if err != nil {
-			fmt.Printf("decode input: %q: %s\n", string(buf), err.Error())
-			continue
+			return bufs, vals, err
 		}
 		buf0, buf1 := buf[0:n1], buf[n1:]
 		bufs = append(bufs, buf0)
 		vals = append(vals, val)
 		buf = buf1
 	}
-	return bufs, vals
+	return bufs, vals, nil
 }
 
-func (s *Session) push(buf []byte, val resp.Value) {
-	if s.repl.Role == pkg.MasterReplica {
-		cmd, _, err := resp.DecodeCmd(val)
-		if err != nil {
-			fmt.Println("decode cmd: ", err.Error())
-			return
-		}
-		if cmd != "SET" {
-			return
-		}
-
-		s.ack.Add(int64(len(buf)))
-		fmt.Printf("added %d to ack. val=%d, source=%q\n", len(buf), s.ack.Load(), string(buf))
+// masterReader reads from the master link. Every read has to complete within
+// timeout, so a master that went silent is noticed.
+type masterReader struct {
+	conn    net.Conn
+	repl    *pkg.Replication
+	timeout time.Duration
+}
 
-		for _, sl := range s.repl.GetSlaves() {
-			sl.Push(buf)
-		}
+func (r *masterReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.repl.MasterIO()
 	}
+	return n, err
 }
@@ -1,9 +1,18 @@
 package session
 
 import (
+	"errors"
 	"fmt"
+	"github.com/codecrafters-io/redis-starter-go/app/handler"
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/store"
+	"io"
+	"net"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseInputs(t *testing.T) {
@@ -48,7 +57,183 @@ func TestParseInputs(t *testing.T) {
 	}
 
 	for _, tt := range ts {
-		_, vals := parseInputs([]byte(tt.in))
+		_, vals, _ := parseInputs([]byte(tt.in))
 		fmt.Println(vals)
 	}
 }
+
+func TestParseInputsSplit(t *testing.T) {
+	in := "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n+OK\r\n"
+	// feed the input in every pair of pieces, as two reads would
+	for cut := 0; cut <= len(in); cut++ {
+		var got []string
+		pending := []byte(in[:cut])
+		for _, more := range []string{"", in[cut:]} {
+			pending = append(pending, more...)
+			bufs, _, err := parseInputs(pending)
+			if err != nil {
+				t.Fatalf("cut at %d: %v", cut, err)
+			}
+			for _, b := range bufs {
+				got = append(got, string(b))
+				pending = pending[len(b):]
+			}
+		}
+		want := []string{"*1\r\n$4\r\nPING\r\n", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "+OK\r\n"}
+		if fmt.Sprint(got) != fmt.Sprint(want) || len(pending) != 0 {
+			t.Errorf("cut at %d: got %q, left %q", cut, got, pending)
+		}
+	}
+}
+
+func TestDeliverAfterSync(t *testing.T) {
+	s := New(nil, nil, pkg.NewReplication(pkg.SlaveReplica, "", pkg.Config{}), pkg.Config{}).Handshake(true)
+	s.in = strings.NewReader("")
+	var rdb []byte
+	s.OnSync(func(r io.Reader) (err error) {
+		rdb, err = io.ReadAll(r)
+		return err
+	})
+	// the snapshot and a write that came with its last bytes, then part of
+	// the next one
+	in := "+FULLRESYNC id 0\r\n$3\r\nrdb*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n*1\r\n"
+	go func() {
+		pending, err := s.deliver([]byte(in))
+		if err != nil || string(pending) != "*1\r\n" {
+			t.Errorf("left %q, err %v", pending, err)
+		}
+		close(s.inC)
+	}()
+
+	var got []string
+	for in := range s.inC {
+		switch {
+		case in.synced:
+			got = append(got, "synced")
+		default:
+			got = append(got, string(in.b))
+		}
+	}
+	want := []string{"+FULLRESYNC id 0\r\n", "synced", "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if string(rdb) != "rdb" {
+		t.Errorf("snapshot %q", rdb)
+	}
+}
+
+type failing struct{}
+
+func (failing) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	return errors.New("failed")
+}
+
+func TestMasterLinkOffset(t *testing.T) {
+	repl := pkg.NewReplication(pkg.SlaveReplica, "", pkg.Config{})
+	handlers := map[string]handler.Handler{"PING": handler.Ping{}, "SET": failing{}}
+	// what ungated handlers leave is fed under the gate
+	var gated int64
+	s := New(nil, handlers, repl, pkg.Config{}).Responsive(false).Handshake(true).Exec(func(fn func()) {
+		off := repl.Offset()
+		fn()
+		gated += repl.Offset() - off
+	})
+
+	// every byte from the master counts, whether the command fails, has
+	// no handler or succeeds
+	var want int64
+	for _, cmd := range [][]string{{"SET", "a", "1"}, {"NOSUCH"}, {"PING"}} {
+		b := resp.Encode(cmd)
+		var v resp.Value
+		if _, err := resp.Decode(b, &v); err != nil {
+			t.Fatal(err)
+		}
+		s.handle(Input{b: b, v: v})
+		want += int64(len(b))
+		if got := repl.Offset(); got != want {
+			t.Errorf("after %s offset %d, want %d", cmd[0], got, want)
+		}
+	}
+	if gated != want {
+		t.Errorf("%d bytes fed under the gate, want %d", gated, want)
+	}
+}
+
+// snapshotting starts a snapshot while it runs, as a sub-replica syncing.
+type snapshotting struct {
+	s    *store.Store
+	repl *pkg.Replication
+	off  chan int64
+}
+
+func (h snapshotting) Handle(sId int64, args []resp.Value, res chan<- []byte) error {
+	go h.s.Snapshot(func() {
+		h.off <- h.repl.Offset()
+	}, func([]byte) {})
+	// let the snapshot wait for the gate
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func TestMasterLinkFeedGated(t *testing.T) {
+	st := store.New(1)
+	repl := pkg.NewReplication(pkg.SlaveReplica, "", pkg.Config{})
+	h := snapshotting{s: st, repl: repl, off: make(chan int64, 1)}
+	handlers := map[string]handler.Handler{"SET": handler.NewGated(st, h)}
+	s := New(nil, handlers, repl, pkg.Config{}).Responsive(false).Handshake(true)
+
+	b := resp.Encode([]string{"SET", "a", "1"})
+	var v resp.Value
+	if _, err := resp.Decode(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	s.handle(Input{b: b, v: v})
+	// the snapshot holds the write, so its offset must count it
+	if got := <-h.off; got != int64(len(b)) {
+		t.Errorf("snapshot at offset %d, want %d", got, len(b))
+	}
+}
+
+func TestMasterReader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	repl := pkg.NewReplication(pkg.SlaveReplica, "", pkg.Config{})
+	r := &masterReader{conn: c1, repl: repl, timeout: 50 * time.Millisecond}
+
+	go c2.Write([]byte("+PING\r\n"))
+	if _, err := r.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if repl.State().LastIO.IsZero() {
+		t.Error("read from the master not recorded")
+	}
+	// a silent master times out
+	if _, err := r.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got err %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       pkg.ReplicaType
+		readOnly   bool
+		masterLink bool
+		want       bool
+	}{
+		{name: "client of a read only replica", role: pkg.SlaveReplica, readOnly: true, want: true},
+		{name: "master link", role: pkg.SlaveReplica, readOnly: true, masterLink: true},
+		{name: "writable replica", role: pkg.SlaveReplica},
+		{name: "master", role: pkg.MasterReplica, readOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := pkg.Config{ReplicaReadOnly: tt.readOnly}
+			s := New(nil, nil, pkg.NewReplication(tt.role, "", config), config).Handshake(tt.masterLink)
+			if got := s.readOnly(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
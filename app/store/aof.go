@@ -0,0 +1,64 @@
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+)
+
+// Commands calls emit with commands that rebuild the dataset: a SELECT for
+// each non-empty database, then a SET for each string and a RESTORE for
+// every other value.
+func (s *Store) Commands(emit func(args []string) error) error {
+	for _, db := range s.dbs {
+		if err := db.commands(emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) commands(emit func(args []string) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	selected := false
+	for k, v := range db.store {
+		if v.expired(now) {
+			continue
+		}
+		if !selected {
+			if err := emit([]string{"SELECT", strconv.Itoa(db.id)}); err != nil {
+				return err
+			}
+			selected = true
+		}
+
+		var cmd []string
+		if str, err := v.val.AsString(); err == nil {
+			cmd = []string{"SET", k, str}
+			if v.canExpire {
+				cmd = append(cmd, "PXAT", strconv.FormatInt(v.ex.UnixMilli(), 10))
+			}
+		} else {
+			var err error
+			payload := pkg.Dump(func(e *pkg.RDBWriter) {
+				err = encodeValue(e, v.val, e.Type)
+			})
+			if err != nil {
+				return err
+			}
+			var at int64
+			if v.canExpire {
+				at = v.ex.UnixMilli()
+			}
+			cmd = []string{"RESTORE", k, strconv.FormatInt(at, 10), string(payload), "ABSTTL", "REPLACE"}
+		}
+		if err := emit(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
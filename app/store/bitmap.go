@@ -0,0 +1,518 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"unsafe"
+)
+
+// MaxBitOffset is the largest offset SETBIT accepts, the last bit of a
+// MaxStringLen string.
+const MaxBitOffset = MaxStringLen*8 - 1
+
+var ErrBitOpKeys = errors.New("BITOP NOT must be called with a single source key.")
+
+type BitOp string
+
+const (
+	BitAnd   BitOp = "AND"
+	BitOr    BitOp = "OR"
+	BitXor   BitOp = "XOR"
+	BitNot   BitOp = "NOT"
+	BitDiff  BitOp = "DIFF"
+	BitDiff1 BitOp = "DIFF1"
+	BitAndOr BitOp = "ANDOR"
+	BitOne   BitOp = "ONE"
+)
+
+// BitRange is an inclusive range of a BITCOUNT or BITPOS call, in bytes or,
+// with Bit, in bits. Negative offsets count from the end.
+type BitRange struct {
+	Start, End int64
+	Bit        bool
+	HasStart   bool
+	HasEnd     bool
+}
+
+// readBytes returns the bytes of a string value without copying. The result
+// must not be modified or kept after db.mu is released.
+func readBytes(t *TypedValue) ([]byte, error) {
+	if t.Type != "string" {
+		return nil, ErrWrongType
+	}
+	switch v := t.Val.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return unsafe.Slice(unsafe.StringData(v), len(v)), nil
+	}
+	s, err := t.AsString()
+	return []byte(s), err
+}
+
+// mutableBytes converts the string at k to a mutable byte slice, stored back
+// in place so later bit operations avoid copying. It must be called with
+// db.mu held.
+func (db *DB) mutableBytes(k string) ([]byte, *Val, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		v = &Val{val: &TypedValue{Type: "string", Val: []byte{}}}
+		db.set(k, v)
+		return nil, v, nil
+	}
+	if v.val.Type != "string" {
+		return nil, nil, ErrWrongType
+	}
+	if b, ok := v.val.Val.([]byte); ok {
+		return b, v, nil
+	}
+	s, err := v.val.AsString()
+	if err != nil {
+		return nil, nil, err
+	}
+	b := []byte(s)
+	v.val = &TypedValue{Type: "string", Val: b}
+	return b, v, nil
+}
+
+func (db *DB) SetBit(k string, offset int64, bit byte) (byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, v, err := db.mutableBytes(k)
+	if err != nil {
+		return 0, err
+	}
+	idx := int(offset >> 3)
+	if idx >= len(b) {
+		b = append(b, make([]byte, idx+1-len(b))...)
+		v.val.Val = b
+	}
+	shift := 7 - uint(offset&7)
+	old := (b[idx] >> shift) & 1
+	if bit == 1 {
+		b[idx] |= 1 << shift
+	} else {
+		b[idx] &^= 1 << shift
+	}
+	return old, nil
+}
+
+func (db *DB) GetBit(k string, offset int64) (byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.lookup(k)
+	if !ok {
+		return 0, nil
+	}
+	b, err := readBytes(v.val)
+	if err != nil {
+		return 0, err
+	}
+	idx := offset >> 3
+	if idx >= int64(len(b)) {
+		return 0, nil
+	}
+	return (b[idx] >> (7 - uint(offset&7))) & 1, nil
+}
+
+// normalize resolves negative offsets against a length of n units. It reports
+// false when the range is empty.
+func (r BitRange) normalize(n int64) (int64, int64, bool) {
+	start, end := r.Start, r.End
+	if !r.HasStart {
+		start = 0
+	}
+	if !r.HasEnd {
+		end = n - 1
+	}
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	start, end = max(start, 0), max(end, 0)
+	end = min(end, n-1)
+	return start, end, start <= end
+}
+
+func (db *DB) BitCount(k string, r BitRange) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.lookup(k)
+	if !ok {
+		return 0, nil
+	}
+	b, err := readBytes(v.val)
+	if err != nil {
+		return 0, err
+	}
+
+	n := int64(len(b))
+	if r.Bit {
+		n *= 8
+	}
+	start, end, ok := r.normalize(n)
+	if !ok {
+		return 0, nil
+	}
+	if !r.Bit {
+		return int64(popcount(b[start : end+1])), nil
+	}
+
+	count := int64(popcount(b[start>>3 : end>>3+1]))
+	// drop the bits of the first and last byte that are out of range
+	count -= int64(bits.OnesCount8(b[start>>3] &^ (0xff >> uint(start&7))))
+	count -= int64(bits.OnesCount8(b[end>>3] & (0xff >> uint(end&7+1))))
+	return count, nil
+}
+
+// BitPos returns the position of the first bit set to bit in the range, or -1.
+// Looking for a clear bit without an explicit end treats the string as padded
+// with zeros, so the first bit past the end is returned.
+func (db *DB) BitPos(k string, bit byte, r BitRange) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.lookup(k)
+	if !ok {
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	b, err := readBytes(v.val)
+	if err != nil {
+		return 0, err
+	}
+
+	n := int64(len(b))
+	if r.Bit {
+		n *= 8
+	}
+	start, end, ok := r.normalize(n)
+	if !ok {
+		return -1, nil
+	}
+	if !r.Bit {
+		start, end = start*8, end*8+7
+	}
+
+	if pos := bitpos(b, bit, start, end); pos >= 0 {
+		return pos, nil
+	}
+	if bit == 0 && !r.HasEnd {
+		return end + 1, nil
+	}
+	return -1, nil
+}
+
+// BitOp stores the result of op over the source keys at dest and returns its
+// length. An empty result deletes dest.
+func (db *DB) BitOp(op BitOp, dest string, keys []string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	srcs := make([][]byte, len(keys))
+	var maxLen int
+	for i, k := range keys {
+		v, ok := db.lookup(k)
+		if !ok {
+			continue
+		}
+		b, err := readBytes(v.val)
+		if err != nil {
+			return 0, err
+		}
+		srcs[i] = b
+		maxLen = max(maxLen, len(b))
+	}
+
+	if maxLen == 0 {
+		db.remove(dest)
+		return 0, nil
+	}
+	res := bitop(op, srcs, maxLen)
+	delete(db.streamDetails, dest)
+	db.set(dest, &Val{val: &TypedValue{Type: "string", Val: res}})
+	return len(res), nil
+}
+
+func popcount(b []byte) int {
+	var n int
+	for len(b) >= 8 {
+		n += bits.OnesCount64(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	}
+	for _, c := range b {
+		n += bits.OnesCount8(c)
+	}
+	return n
+}
+
+// bitpos finds the first bit equal to bit between the bit offsets start and
+// end inclusive.
+func bitpos(b []byte, bit byte, start, end int64) int64 {
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for pos := start; pos <= end; {
+		if pos&7 == 0 && pos+7 <= end {
+			// whole bytes, eight at a time where possible
+			i := pos >> 3
+			for pos+63 <= end && binary.LittleEndian.Uint64(b[i:]) == uint64(skip)*0x0101010101010101 {
+				pos += 64
+				i += 8
+			}
+			if pos+7 <= end && b[i] == skip {
+				pos += 8
+				continue
+			}
+		}
+		if (b[pos>>3]>>(7-uint(pos&7)))&1 == bit {
+			return pos
+		}
+		pos++
+	}
+	return -1
+}
+
+func bitop(op BitOp, srcs [][]byte, n int) []byte {
+	res := make([]byte, n)
+	copy(res, srcs[0])
+	switch op {
+	case BitNot:
+		combine(res, res, func(x, _ uint64) uint64 { return ^x })
+	case BitAnd:
+		for _, src := range srcs[1:] {
+			combine(res, src, func(x, y uint64) uint64 { return x & y })
+			clear(res[len(src):])
+		}
+	case BitOr:
+		for _, src := range srcs[1:] {
+			combine(res, src, func(x, y uint64) uint64 { return x | y })
+		}
+	case BitXor:
+		for _, src := range srcs[1:] {
+			combine(res, src, func(x, y uint64) uint64 { return x ^ y })
+		}
+	case BitDiff, BitDiff1, BitAndOr:
+		// the first key against the union of the others
+		others := make([]byte, n)
+		for _, src := range srcs[1:] {
+			combine(others, src, func(x, y uint64) uint64 { return x | y })
+		}
+		switch op {
+		case BitDiff:
+			combine(res, others, func(x, y uint64) uint64 { return x &^ y })
+		case BitDiff1:
+			combine(res, others, func(x, y uint64) uint64 { return y &^ x })
+		case BitAndOr:
+			combine(res, others, func(x, y uint64) uint64 { return x & y })
+		}
+	case BitOne:
+		// bits set in exactly one source; more holds those seen twice
+		more := make([]byte, n)
+		for _, src := range srcs[1:] {
+			exactlyOne(res, more, src)
+		}
+	}
+	return res
+}
+
+func exactlyOne(res, more, src []byte) {
+	le := binary.LittleEndian
+	i := 0
+	for ; i+8 <= len(src); i += 8 {
+		x, y := le.Uint64(res[i:]), le.Uint64(src[i:])
+		m := le.Uint64(more[i:]) | x&y
+		le.PutUint64(more[i:], m)
+		le.PutUint64(res[i:], (x|y)&^m)
+	}
+	for ; i < len(src); i++ {
+		more[i] |= res[i] & src[i]
+		res[i] = (res[i] | src[i]) &^ more[i]
+	}
+}
+
+// combine sets dst[i] = f(dst[i], src[i]) over the length of src, a word at a
+// time.
+func combine(dst, src []byte, f func(x, y uint64) uint64) {
+	i := 0
+	for ; i+8 <= len(src); i += 8 {
+		binary.LittleEndian.PutUint64(dst[i:], f(binary.LittleEndian.Uint64(dst[i:]), binary.LittleEndian.Uint64(src[i:])))
+	}
+	for ; i < len(src); i++ {
+		dst[i] = byte(f(uint64(dst[i]), uint64(src[i])))
+	}
+}
+
+type BitFieldKind int
+
+const (
+	BitFieldGet BitFieldKind = iota
+	BitFieldSet
+	BitFieldIncrBy
+)
+
+type Overflow int
+
+const (
+	OverflowWrap Overflow = iota
+	OverflowSat
+	OverflowFail
+)
+
+// BitFieldOp is one GET, SET or INCRBY subcommand of BITFIELD, acting on a
+// Bits wide integer at the bit Offset.
+type BitFieldOp struct {
+	Kind     BitFieldKind
+	Signed   bool
+	Bits     uint
+	Offset   int64
+	Val      int64
+	Overflow Overflow
+}
+
+// BitField runs ops in order against the string at k. A nil result marks a
+// write skipped by OverflowFail. changed reports whether anything was written.
+func (db *DB) BitField(k string, ops []BitFieldOp) (res []*int64, changed bool, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var b []byte
+	var v *Val
+	if cur, ok := db.lookup(k); ok {
+		if b, err = readBytes(cur.val); err != nil {
+			return nil, false, err
+		}
+	}
+
+	res = make([]*int64, len(ops))
+	for i, op := range ops {
+		old := getBits(b, op.Offset, op.Bits)
+		if op.Signed && op.Bits < 64 && old>>(op.Bits-1)&1 == 1 {
+			// sign extend
+			old |= ^uint64(0) << op.Bits
+		}
+		if op.Kind == BitFieldGet {
+			n := int64(old)
+			res[i] = &n
+			continue
+		}
+
+		var val uint64
+		var overflow bool
+		ret := int64(old)
+		if op.Kind == BitFieldIncrBy {
+			val, overflow = fieldOverflow(op, old, op.Val)
+			ret = int64(val)
+		} else {
+			val, overflow = fieldOverflow(op, uint64(op.Val), 0)
+		}
+		if overflow && op.Overflow == OverflowFail {
+			continue
+		}
+		// the string is only created or grown by writes that apply, so
+		// nothing changes unless something is propagated
+		if v == nil {
+			if b, v, err = db.mutableBytes(k); err != nil {
+				return nil, false, err
+			}
+		}
+		if last := (op.Offset + int64(op.Bits) - 1) >> 3; last >= int64(len(b)) {
+			b = append(b, make([]byte, last+1-int64(len(b)))...)
+			v.val.Val = b
+		}
+		setBits(b, op.Offset, op.Bits, val)
+		changed = true
+		res[i] = &ret
+	}
+	return res, changed, nil
+}
+
+// fieldOverflow adds incr to value within the range of op's integer type and
+// applies its overflow policy, the way Redis's bitfield overflow checks do.
+func fieldOverflow(op BitFieldOp, value uint64, incr int64) (uint64, bool) {
+	if op.Signed {
+		maxv := int64(1)<<(op.Bits-1) - 1
+		if op.Bits == 64 {
+			maxv = math.MaxInt64
+		}
+		minv := -maxv - 1
+		v := int64(value)
+		maxincr, minincr := int64(uint64(maxv)-value), minv-v
+
+		var limit int64
+		switch {
+		case v > maxv || (op.Bits != 64 && incr > maxincr) || (v >= 0 && incr > 0 && incr > maxincr):
+			limit = maxv
+		case v < minv || (op.Bits != 64 && incr < minincr) || (v < 0 && incr < 0 && incr < minincr):
+			limit = minv
+		default:
+			return uint64(v + incr), false
+		}
+		if op.Overflow != OverflowWrap {
+			return uint64(limit), true
+		}
+		c := value + uint64(incr)
+		if op.Bits < 64 {
+			mask := ^uint64(0) << op.Bits
+			if c>>(op.Bits-1)&1 == 1 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return c, true
+	}
+
+	maxv := uint64(1)<<op.Bits - 1
+	maxincr, minincr := int64(maxv-value), -int64(value)
+	var limit uint64
+	switch {
+	case value > maxv || (incr > 0 && incr > maxincr):
+		limit = maxv
+	case incr < 0 && incr < minincr:
+		limit = 0
+	default:
+		return value + uint64(incr), false
+	}
+	if op.Overflow != OverflowWrap {
+		return limit, true
+	}
+	return (value + uint64(incr)) & maxv, true
+}
+
+// getBits reads an unsigned integer of the given width, most significant bit
+// first. Bits past the end of b read as zero.
+func getBits(b []byte, offset int64, width uint) uint64 {
+	var v uint64
+	for j := int64(0); j < int64(width); j++ {
+		pos := offset + j
+		var bit uint64
+		if pos>>3 < int64(len(b)) {
+			bit = uint64(b[pos>>3]>>(7-uint(pos&7))) & 1
+		}
+		v = v<<1 | bit
+	}
+	return v
+}
+
+func setBits(b []byte, offset int64, width uint, v uint64) {
+	for j := int64(0); j < int64(width); j++ {
+		pos := offset + j
+		mask := byte(1) << (7 - uint(pos&7))
+		if v>>(int64(width)-1-j)&1 == 1 {
+			b[pos>>3] |= mask
+		} else {
+			b[pos>>3] &^= mask
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBitCount(t *testing.T) {
+	db, _ := New(1).Index(0)
+	db.MSet([]string{"k", "foobar"})
+
+	tests := []struct {
+		r    BitRange
+		want int64
+	}{
+		{BitRange{}, 26},
+		{BitRange{Start: 0, End: 0, HasStart: true, HasEnd: true}, 4},
+		{BitRange{Start: 1, End: 1, HasStart: true, HasEnd: true}, 6},
+		{BitRange{Start: -2, End: -1, HasStart: true, HasEnd: true}, 7},
+		{BitRange{Start: 5, End: 30, Bit: true, HasStart: true, HasEnd: true}, 17},
+		{BitRange{Start: 3, End: 1, HasStart: true, HasEnd: true}, 0},
+	}
+	for _, tt := range tests {
+		got, err := db.BitCount("k", tt.r)
+		if err != nil || got != tt.want {
+			t.Errorf("BitCount(%+v) = %d, %v, want %d", tt.r, got, err, tt.want)
+		}
+	}
+}
+
+func TestBitPos(t *testing.T) {
+	db, _ := New(1).Index(0)
+	db.MSet([]string{"a", "\xff\xf0\x00", "b", "\x00\xff\xf0", "c", "\x00\x00\x00", "d", "\xff\xff"})
+
+	tests := []struct {
+		k    string
+		bit  byte
+		r    BitRange
+		want int64
+	}{
+		{"a", 0, BitRange{}, 12},
+		{"b", 1, BitRange{Start: 0, HasStart: true}, 8},
+		{"b", 1, BitRange{Start: 2, HasStart: true}, 16},
+		{"b", 1, BitRange{Start: 2, End: -1, HasStart: true, HasEnd: true}, 16},
+		{"b", 1, BitRange{Start: 7, End: 15, Bit: true, HasStart: true, HasEnd: true}, 8},
+		{"c", 1, BitRange{}, -1},
+		{"c", 1, BitRange{Start: 7, End: -3, Bit: true, HasStart: true, HasEnd: true}, -1},
+		{"d", 0, BitRange{}, 16},
+		{"d", 0, BitRange{Start: 0, End: -1, HasStart: true, HasEnd: true}, -1},
+		{"missing", 0, BitRange{}, 0},
+		{"missing", 1, BitRange{}, -1},
+	}
+	for _, tt := range tests {
+		got, err := db.BitPos(tt.k, tt.bit, tt.r)
+		if err != nil || got != tt.want {
+			t.Errorf("BitPos(%q, %d, %+v) = %d, %v, want %d", tt.k, tt.bit, tt.r, got, err, tt.want)
+		}
+	}
+}
+
+func TestBitOp(t *testing.T) {
+	db, _ := New(1).Index(0)
+	db.MSet([]string{"a", "foobar", "b", "abcdef", "c", "\x0f"})
+
+	tests := []struct {
+		op   BitOp
+		keys []string
+		want string
+	}{
+		{BitAnd, []string{"a", "b"}, "`bc`ab"},
+		{BitOr, []string{"a", "c"}, "ooobar"},
+		{BitNot, []string{"c"}, "\xf0"},
+		{BitDiff, []string{"c", "a"}, "\x09\x00\x00\x00\x00\x00"},
+		{BitDiff1, []string{"c", "a"}, "\x60oobar"},
+		{BitAndOr, []string{"c", "a", "b"}, "\x07\x00\x00\x00\x00\x00"},
+		{BitOne, []string{"a", "b", "c"}, "\x08\x0d\x0c\x06\x04\x14"},
+	}
+	for _, tt := range tests {
+		if _, err := db.BitOp(tt.op, "dest", tt.keys); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, _ := db.GetString("dest"); got != tt.want {
+			t.Errorf("BITOP %s %v = %q, want %q", tt.op, tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestBitField(t *testing.T) {
+	db, _ := New(1).Index(0)
+	incr := func(signed bool, bits uint, offset, by int64, o Overflow) BitFieldOp {
+		return BitFieldOp{Kind: BitFieldIncrBy, Signed: signed, Bits: bits, Offset: offset, Val: by, Overflow: o}
+	}
+	set := func(signed bool, bits uint, offset, v int64, o Overflow) BitFieldOp {
+		return BitFieldOp{Kind: BitFieldSet, Signed: signed, Bits: bits, Offset: offset, Val: v, Overflow: o}
+	}
+	get := func(signed bool, bits uint, offset int64) BitFieldOp {
+		return BitFieldOp{Kind: BitFieldGet, Signed: signed, Bits: bits, Offset: offset}
+	}
+
+	tests := []struct {
+		k    string
+		ops  []BitFieldOp
+		want []any
+	}{
+		{"a", []BitFieldOp{incr(true, 5, 100, 1, OverflowWrap), get(false, 4, 0)}, []any{1, 0}},
+		{"b", []BitFieldOp{incr(false, 2, 100, 1, OverflowWrap), incr(false, 2, 102, 1, OverflowSat)}, []any{1, 1}},
+		{"b", []BitFieldOp{incr(false, 2, 100, 1, OverflowWrap), incr(false, 2, 102, 1, OverflowSat)}, []any{2, 2}},
+		{"b", []BitFieldOp{incr(false, 2, 100, 1, OverflowWrap), incr(false, 2, 102, 1, OverflowSat)}, []any{3, 3}},
+		{"b", []BitFieldOp{incr(false, 2, 100, 1, OverflowWrap), incr(false, 2, 102, 1, OverflowSat)}, []any{0, 3}},
+		{"b", []BitFieldOp{incr(false, 2, 102, 1, OverflowFail)}, []any{nil}},
+		{"c", []BitFieldOp{set(true, 8, 0, 200, OverflowWrap), get(true, 8, 0)}, []any{0, -56}},
+		{"c", []BitFieldOp{set(true, 8, 0, 200, OverflowSat), get(false, 8, 0)}, []any{-56, 127}},
+		{"c", []BitFieldOp{incr(true, 8, 0, -300, OverflowSat), incr(true, 8, 0, -1, OverflowWrap)}, []any{-128, 127}},
+		{"d", []BitFieldOp{set(true, 64, 0, -1, OverflowWrap), incr(true, 64, 0, math.MinInt64, OverflowFail), get(false, 63, 1)}, []any{0, nil, math.MaxInt64}},
+	}
+	for i, tt := range tests {
+		res, _, err := db.BitField(tt.k, tt.ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, r := range res {
+			want := tt.want[j]
+			if (r == nil) != (want == nil) || (r != nil && *r != int64(want.(int))) {
+				t.Errorf("%d: op %d = %v, want %v", i, j, r, want)
+			}
+		}
+	}
+}
+
+func TestBitFieldFailLeavesKey(t *testing.T) {
+	db := New(1).dbs[0]
+	fail := BitFieldOp{Kind: BitFieldSet, Bits: 8, Offset: 800, Val: 300, Overflow: OverflowFail}
+
+	// a skipped write neither creates nor grows the string
+	if _, changed, _ := db.BitField("new", []BitFieldOp{fail}); changed {
+		t.Error("skipped write reported a change")
+	}
+	if _, ok := db.Get("new"); ok {
+		t.Error("skipped write created the key")
+	}
+	db.SetString("old", "a", SetOpts{})
+	if _, changed, _ := db.BitField("old", []BitFieldOp{fail}); changed {
+		t.Error("skipped write reported a change")
+	}
+	if v, _, _ := db.GetString("old"); v != "a" {
+		t.Errorf("skipped write left %q", v)
+	}
+
+	// a write that applies still grows it
+	ok := BitFieldOp{Kind: BitFieldSet, Bits: 8, Offset: 16, Val: 'c', Overflow: OverflowFail}
+	if _, changed, _ := db.BitField("old", []BitFieldOp{fail, ok}); !changed {
+		t.Error("applied write reported no change")
+	}
+	if v, _, _ := db.GetString("old"); v != "a\x00c" {
+		t.Errorf("got %q", v)
+	}
+}
@@ -0,0 +1,364 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Type names of the probabilistic filters, the ones RedisBloom reports.
+const (
+	BloomType  = "MBbloom--"
+	CuckooType = "MBbloomCF"
+)
+
+// Defaults used when BF.ADD and BF.MADD create a filter.
+const (
+	BloomErrorRate = 0.01
+	BloomCapacity  = 100
+	BloomExpansion = 2
+
+	// bloomTightening is the ratio between the error rates of consecutive
+	// layers, which keeps the overall rate of a scaled filter bounded.
+	bloomTightening = 0.5
+	bloomSeed       = 0xc6a4a7935bd1e995
+
+	// filterMaxBytes bounds the size of a Bloom layer or cuckoo table, which
+	// has to fit in a dump.
+	filterMaxBytes = 512 << 20
+)
+
+var (
+	ErrFilterExists    = errors.New("item exists")
+	ErrFilterNotFound  = errors.New("not found")
+	ErrBloomFull       = errors.New("non scaling filter is full")
+	ErrBloomErrorRate  = errors.New("(0 < error rate range < 1)")
+	ErrFilterCapacity  = errors.New("(capacity should be larger than 0)")
+	ErrFilterExpansion = errors.New("expansion should be greater or equal to 1")
+	ErrFilterTooLarge  = errors.New("Insufficient memory to create filter")
+	ErrBadData         = errors.New("received bad data")
+)
+
+// BloomOpts configures a new Bloom filter. A zero Expansion means the filter
+// does not scale.
+type BloomOpts struct {
+	ErrorRate float64
+	Capacity  int64
+	Expansion int64
+}
+
+func (o BloomOpts) validate() error {
+	switch {
+	case !(o.ErrorRate > 0 && o.ErrorRate < 1):
+		return ErrBloomErrorRate
+	case o.Capacity < 1:
+		return ErrFilterCapacity
+	case o.Expansion < 0:
+		return ErrFilterExpansion
+	}
+	return nil
+}
+
+// bloomLayer is one fixed size filter. Lookups set or test hashes bits chosen
+// by double hashing.
+type bloomLayer struct {
+	capacity, items int64
+	hashes          uint32
+	bits            uint64
+	data            []byte
+}
+
+func newBloomLayer(capacity int64, errorRate float64) (*bloomLayer, error) {
+	bpe := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	fbits := math.Ceil(float64(capacity) * bpe)
+	if fbits > filterMaxBytes*8 {
+		return nil, ErrFilterTooLarge
+	}
+	bits := (uint64(fbits) + 63) &^ 63
+	return &bloomLayer{
+		capacity: capacity,
+		hashes:   uint32(math.Ceil(math.Ln2 * bpe)),
+		bits:     bits,
+		data:     make([]byte, bits/8),
+	}, nil
+}
+
+func bloomHash(item string) (uint64, uint64) {
+	h1 := murmurHash64A([]byte(item), bloomSeed)
+	return h1, murmurHash64A([]byte(item), h1)
+}
+
+func (l *bloomLayer) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < uint64(l.hashes); i++ {
+		bit := (h1 + i*h2) % l.bits
+		if l.data[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLayer) add(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(l.hashes); i++ {
+		bit := (h1 + i*h2) % l.bits
+		l.data[bit/8] |= 1 << (bit % 8)
+	}
+	l.items++
+}
+
+// Bloom is a scalable Bloom filter: when its last layer reaches capacity a
+// layer Expansion times larger with a tighter error rate is added.
+type Bloom struct {
+	opts   BloomOpts
+	layers []*bloomLayer
+}
+
+func NewBloom(o BloomOpts) (*Bloom, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	l, err := newBloomLayer(o.Capacity, o.ErrorRate)
+	if err != nil {
+		return nil, err
+	}
+	return &Bloom{opts: o, layers: []*bloomLayer{l}}, nil
+}
+
+func (b *Bloom) exists(h1, h2 uint64) bool {
+	for _, l := range b.layers {
+		if l.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// add reports whether item was added, false meaning it may have been
+// present already.
+func (b *Bloom) add(item string) (bool, error) {
+	h1, h2 := bloomHash(item)
+	if b.exists(h1, h2) {
+		return false, nil
+	}
+	last := b.layers[len(b.layers)-1]
+	if last.items >= last.capacity {
+		if b.opts.Expansion == 0 {
+			return false, ErrBloomFull
+		}
+		if last.capacity > math.MaxInt64/b.opts.Expansion {
+			return false, ErrFilterTooLarge
+		}
+		n := len(b.layers)
+		l, err := newBloomLayer(last.capacity*b.opts.Expansion, b.opts.ErrorRate*math.Pow(bloomTightening, float64(n)))
+		if err != nil {
+			return false, err
+		}
+		last = l
+		b.layers = append(b.layers, last)
+	}
+	last.add(h1, h2)
+	return true, nil
+}
+
+// BloomInfo holds the fields BF.INFO reports.
+type BloomInfo struct {
+	Capacity, Size, Filters, Items, Expansion int64
+}
+
+func (b *Bloom) Info() BloomInfo {
+	i := BloomInfo{Filters: int64(len(b.layers)), Expansion: b.opts.Expansion}
+	for _, l := range b.layers {
+		i.Capacity += l.capacity
+		i.Items += l.items
+		i.Size += int64(len(l.data))
+	}
+	return i
+}
+
+// MarshalBinary encodes the filter for snapshots.
+func (b *Bloom) MarshalBinary() ([]byte, error) {
+	buf := binary.LittleEndian.AppendUint64(nil, math.Float64bits(b.opts.ErrorRate))
+	buf = binary.AppendUvarint(buf, uint64(b.opts.Capacity))
+	buf = binary.AppendUvarint(buf, uint64(b.opts.Expansion))
+	buf = binary.AppendUvarint(buf, uint64(len(b.layers)))
+	for _, l := range b.layers {
+		buf = binary.AppendUvarint(buf, uint64(l.capacity))
+		buf = binary.AppendUvarint(buf, uint64(l.items))
+		buf = binary.AppendUvarint(buf, uint64(l.hashes))
+		buf = binary.AppendUvarint(buf, l.bits)
+		buf = append(buf, l.data...)
+	}
+	return buf, nil
+}
+
+func appendBinString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// binReader decodes the uvarint based encodings of the filters and time
+// series.
+type binReader struct {
+	b   []byte
+	err error
+}
+
+func (r *binReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = ErrBadData
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binReader) bytes(n uint64) []byte {
+	if r.err != nil || uint64(len(r.b)) < n {
+		r.err = ErrBadData
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.b)
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *binReader) uint64() uint64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *binReader) str() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary.
+func (b *Bloom) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return ErrBadData
+	}
+	r := &binReader{b: data[8:]}
+	o := BloomOpts{
+		ErrorRate: math.Float64frombits(binary.LittleEndian.Uint64(data)),
+		Capacity:  int64(r.uvarint()),
+		Expansion: int64(r.uvarint()),
+	}
+	n := r.uvarint()
+	if r.err != nil || o.validate() != nil || n == 0 || n > 64 {
+		return ErrBadData
+	}
+	layers := make([]*bloomLayer, n)
+	for i := range layers {
+		l := &bloomLayer{capacity: int64(r.uvarint()), items: int64(r.uvarint())}
+		hashes := r.uvarint()
+		l.hashes, l.bits = uint32(hashes), r.uvarint()
+		if l.capacity < 1 || l.items < 0 || l.items > l.capacity || hashes == 0 || hashes > math.MaxUint32 ||
+			l.bits == 0 || l.bits%64 != 0 {
+			return ErrBadData
+		}
+		l.data = r.bytes(l.bits / 8)
+		layers[i] = l
+	}
+	if r.err != nil || len(r.b) != 0 {
+		return ErrBadData
+	}
+	b.opts, b.layers = o, layers
+	return nil
+}
+
+// bloom returns the filter at k, or nil when k does not exist. It must be
+// called with db.mu held.
+func (db *DB) bloom(k string) (*Bloom, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, nil
+	}
+	b, ok := v.val.Val.(*Bloom)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return b, nil
+}
+
+// BFReserve creates an empty filter at k, which must not exist.
+func (db *DB) BFReserve(k string, o BloomOpts) error {
+	b, err := NewBloom(o)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.lookup(k); ok {
+		return ErrFilterExists
+	}
+	db.set(k, &Val{val: &TypedValue{Type: BloomType, Val: b}})
+	return nil
+}
+
+// BFAdd adds items to the filter at k, creating it with the defaults. Each
+// result is whether the item was added, or the error that stopped it.
+func (db *DB) BFAdd(k string, items []string) ([]any, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, err := db.bloom(k)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		b, _ = NewBloom(BloomOpts{ErrorRate: BloomErrorRate, Capacity: BloomCapacity, Expansion: BloomExpansion})
+		db.set(k, &Val{val: &TypedValue{Type: BloomType, Val: b}})
+	}
+	res := make([]any, len(items))
+	for i, item := range items {
+		added, err := b.add(item)
+		if err != nil {
+			res[i] = err
+		} else {
+			res[i] = added
+		}
+	}
+	return res, nil
+}
+
+// BFExists reports for each item whether it may be in the filter at k.
+func (db *DB) BFExists(k string, items []string) ([]bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	b, err := db.bloom(k)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]bool, len(items))
+	if b == nil {
+		return res, nil
+	}
+	for i, item := range items {
+		res[i] = b.exists(bloomHash(item))
+	}
+	return res, nil
+}
+
+func (db *DB) BFInfo(k string) (BloomInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	b, err := db.bloom(k)
+	if err != nil {
+		return BloomInfo{}, err
+	}
+	if b == nil {
+		return BloomInfo{}, ErrFilterNotFound
+	}
+	return b.Info(), nil
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    BloomOpts
+		items   int
+		filters int64
+		full    bool
+	}{
+		{"fits", BloomOpts{ErrorRate: 0.01, Capacity: 1000, Expansion: 2}, 1000, 1, false},
+		{"scales", BloomOpts{ErrorRate: 0.01, Capacity: 100, Expansion: 2}, 1000, 4, false},
+		{"nonscaling", BloomOpts{ErrorRate: 0.01, Capacity: 100}, 1000, 1, true},
+	}
+	for _, tt := range tests {
+		b, err := NewBloom(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var full bool
+		for i := 0; i < tt.items; i++ {
+			if _, err := b.add(fmt.Sprint("item", i)); err == ErrBloomFull {
+				full = true
+			}
+		}
+		info := b.Info()
+		if info.Filters != tt.filters || full != tt.full {
+			t.Errorf("%s: filters = %d, full = %v", tt.name, info.Filters, full)
+		}
+		if !tt.full && info.Items > int64(tt.items) {
+			t.Errorf("%s: %d items inserted", tt.name, info.Items)
+		}
+
+		for i := 0; i < min(tt.items, int(info.Items)); i++ {
+			if !b.exists(bloomHash(fmt.Sprint("item", i))) {
+				t.Fatalf("%s: item%d missing", tt.name, i)
+			}
+		}
+		var fp int
+		for i := 0; i < 10000; i++ {
+			if b.exists(bloomHash(fmt.Sprint("other", i))) {
+				fp++
+			}
+		}
+		if fp > 200 {
+			t.Errorf("%s: %d false positives in 10000", tt.name, fp)
+		}
+	}
+
+	if _, err := NewBloom(BloomOpts{ErrorRate: 1, Capacity: 10}); err != ErrBloomErrorRate {
+		t.Errorf("error rate 1: err = %v", err)
+	}
+}
+
+func TestCuckoo(t *testing.T) {
+	c, err := NewCuckoo(CuckooOpts{Capacity: 100, BucketSize: 2, MaxIterations: 20, Expansion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := c.add(fmt.Sprint("item", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.tables) < 2 {
+		t.Errorf("filter did not expand: %d tables", len(c.tables))
+	}
+	for i := 0; i < 1000; i++ {
+		if c.count(fmt.Sprint("item", i)) == 0 {
+			t.Fatalf("item%d missing", i)
+		}
+	}
+
+	c.add("dup")
+	c.add("dup")
+	if n := c.count("dup"); n < 2 {
+		t.Errorf("count(dup) = %d", n)
+	}
+	if !c.del("dup") || !c.del("dup") {
+		t.Error("del(dup) failed")
+	}
+	if c.items != 1000 {
+		t.Errorf("items = %d", c.items)
+	}
+
+	small, _ := NewCuckoo(CuckooOpts{Capacity: 4, BucketSize: 1, MaxIterations: 5})
+	var full bool
+	for i := 0; i < 100 && !full; i++ {
+		full = small.add(fmt.Sprint(i)) == ErrCuckooFull
+	}
+	if !full {
+		t.Error("non-expanding filter never filled")
+	}
+}
+
+func TestCuckooDeterministic(t *testing.T) {
+	var dumps [][]byte
+	for range 2 {
+		c, _ := NewCuckoo(CuckooOpts{Capacity: 64, BucketSize: 2, MaxIterations: 20})
+		for i := 0; i < 200; i++ {
+			c.add(fmt.Sprint(i))
+		}
+		data, _ := c.MarshalBinary()
+		dumps = append(dumps, data)
+	}
+	if !bytes.Equal(dumps[0], dumps[1]) {
+		t.Error("the same adds built different tables")
+	}
+}
+
+func TestFilterTooLarge(t *testing.T) {
+	if _, err := NewBloom(BloomOpts{ErrorRate: 0.01, Capacity: 1 << 60, Expansion: 2}); err != ErrFilterTooLarge {
+		t.Errorf("bloom: err = %v", err)
+	}
+	if _, err := NewCuckoo(CuckooOpts{Capacity: 1 << 62, BucketSize: 2, MaxIterations: 20}); err != ErrFilterTooLarge {
+		t.Errorf("cuckoo: err = %v", err)
+	}
+
+	// few bits per item keep the layer small, but the next one's capacity
+	// overflows
+	b, err := NewBloom(BloomOpts{ErrorRate: 0.9999999, Capacity: 1 << 40, Expansion: 1 << 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.layers[0].items = b.layers[0].capacity
+	if _, err := b.add("x"); err != ErrFilterTooLarge {
+		t.Errorf("bloom growth: err = %v", err)
+	}
+
+	c, err := NewCuckoo(CuckooOpts{Capacity: 1 << 16, BucketSize: 1, MaxIterations: 1, Expansion: 1 << 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range c.tables[0].data {
+		c.tables[0].data[i] = 1
+	}
+	if err := c.add("x"); err != ErrFilterTooLarge {
+		t.Errorf("cuckoo growth: err = %v", err)
+	}
+}
+
+type binaryCodec interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+func TestFilterEncoding(t *testing.T) {
+	b, _ := NewBloom(BloomOpts{ErrorRate: 0.001, Capacity: 50, Expansion: 3})
+	c, _ := NewCuckoo(CuckooOpts{Capacity: 50, BucketSize: 4, MaxIterations: 10, Expansion: 2})
+	for i := 0; i < 200; i++ {
+		b.add(fmt.Sprint(i))
+		c.add(fmt.Sprint(i))
+	}
+
+	tests := []struct {
+		f, empty binaryCodec
+	}{
+		{b, &Bloom{}},
+		{c, &Cuckoo{}},
+	}
+	for _, tt := range tests {
+		data, _ := tt.f.MarshalBinary()
+		if err := tt.empty.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		again, _ := tt.empty.MarshalBinary()
+		if !bytes.Equal(data, again) {
+			t.Errorf("%T did not round trip", tt.f)
+		}
+		if err := tt.empty.UnmarshalBinary(data[:len(data)-1]); err != ErrBadData {
+			t.Errorf("%T truncated: err = %v", tt.f, err)
+		}
+	}
+}
+
+func TestBloomDecodeInvalid(t *testing.T) {
+	layer := func(capacity, items, hashes uint64) []byte {
+		buf := binary.LittleEndian.AppendUint64(nil, math.Float64bits(0.01))
+		for _, v := range []uint64{100, 2, 1, capacity, items, hashes, 64} {
+			buf = binary.AppendUvarint(buf, v)
+		}
+		return append(buf, make([]byte, 8)...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"valid", layer(10, 10, 3), true},
+		{"zero capacity", layer(0, 0, 3), false},
+		{"no hashes", layer(10, 0, 0), false},
+		{"items past capacity", layer(10, 11, 3), false},
+	}
+	for _, tt := range tests {
+		err := (&Bloom{}).UnmarshalBinary(tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
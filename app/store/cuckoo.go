@@ -0,0 +1,350 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Defaults used when CF.ADD creates a filter.
+const (
+	CuckooCapacity      = 1024
+	CuckooBucketSize    = 2
+	CuckooMaxIterations = 20
+	CuckooExpansion     = 1
+
+	cuckooAltMul = 0x5bd1e995
+)
+
+var (
+	ErrCuckooFull       = errors.New("filter is full")
+	ErrCuckooBucketSize = errors.New("bucket size must be between 1 and 255")
+	ErrCuckooIterations = errors.New("max iterations must be between 1 and 65535")
+)
+
+// CuckooOpts configures a new cuckoo filter. Larger buckets raise the error
+// rate, about 2*BucketSize/255, in exchange for a fuller table. A zero
+// Expansion means the filter does not grow.
+type CuckooOpts struct {
+	Capacity      int64
+	BucketSize    int64
+	MaxIterations int64
+	Expansion     int64
+}
+
+func (o CuckooOpts) validate() error {
+	switch {
+	case o.Capacity < 1:
+		return ErrFilterCapacity
+	case o.BucketSize < 1 || o.BucketSize > 255:
+		return ErrCuckooBucketSize
+	case o.MaxIterations < 1 || o.MaxIterations > 65535:
+		return ErrCuckooIterations
+	case o.Expansion < 0 || o.Expansion > 32768:
+		return ErrFilterExpansion
+	}
+	return nil
+}
+
+// cuckooTable holds one byte fingerprints, zero meaning an empty slot, in a
+// power of two number of buckets.
+type cuckooTable struct {
+	buckets uint64
+	data    []byte
+}
+
+func (t *cuckooTable) bucket(i uint64, size int) []byte {
+	return t.data[i*uint64(size) : (i+1)*uint64(size)]
+}
+
+// indexes returns the two buckets a fingerprint may live in. Each is the
+// other's alternate, so entries can be moved without the original item.
+func (t *cuckooTable) indexes(h uint64, fp byte) (uint64, uint64) {
+	i := h & (t.buckets - 1)
+	return i, t.alt(i, fp)
+}
+
+func (t *cuckooTable) alt(i uint64, fp byte) uint64 {
+	return (i ^ uint64(fp)*cuckooAltMul) & (t.buckets - 1)
+}
+
+// Cuckoo is a cuckoo filter, which unlike a Bloom filter supports deletion
+// and counting. When an insert fails after MaxIterations relocations a new
+// table Expansion times larger is added.
+type Cuckoo struct {
+	opts           CuckooOpts
+	items, deletes int64
+	tables         []*cuckooTable
+}
+
+func newCuckooTable(slots int64, bucketSize int64) (*cuckooTable, error) {
+	n := uint64(max(slots/bucketSize+min(slots%bucketSize, 1), 1))
+	if n > filterMaxBytes/uint64(bucketSize) {
+		return nil, ErrFilterTooLarge
+	}
+	n = 1 << bits.Len64(n-1)
+	if n > filterMaxBytes/uint64(bucketSize) {
+		return nil, ErrFilterTooLarge
+	}
+	return &cuckooTable{buckets: n, data: make([]byte, n*uint64(bucketSize))}, nil
+}
+
+func NewCuckoo(o CuckooOpts) (*Cuckoo, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	t, err := newCuckooTable(o.Capacity, o.BucketSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Cuckoo{opts: o, tables: []*cuckooTable{t}}, nil
+}
+
+func cuckooHash(item string) (uint64, byte) {
+	h := murmurHash64A([]byte(item), 0)
+	return h, byte(h%255 + 1)
+}
+
+// count returns how many times the fingerprint of item occurs.
+func (c *Cuckoo) count(item string) int64 {
+	h, fp := cuckooHash(item)
+	size := int(c.opts.BucketSize)
+	var n int64
+	for _, t := range c.tables {
+		i1, i2 := t.indexes(h, fp)
+		for _, i := range []uint64{i1, i2} {
+			for _, s := range t.bucket(i, size) {
+				if s == fp {
+					n++
+				}
+			}
+			if i1 == i2 {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// del removes one occurrence of item, newest tables first.
+func (c *Cuckoo) del(item string) bool {
+	h, fp := cuckooHash(item)
+	size := int(c.opts.BucketSize)
+	for j := len(c.tables) - 1; j >= 0; j-- {
+		i1, i2 := c.tables[j].indexes(h, fp)
+		for _, i := range []uint64{i1, i2} {
+			b := c.tables[j].bucket(i, size)
+			for s := range b {
+				if b[s] == fp {
+					b[s] = 0
+					c.items--
+					c.deletes++
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func cuckooPlace(b []byte, fp byte) bool {
+	for s := range b {
+		if b[s] == 0 {
+			b[s] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// add inserts item. A free slot in any table is used first; otherwise
+// entries of the last table are relocated, and a new table is added when
+// that fails.
+func (c *Cuckoo) add(item string) error {
+	h, fp := cuckooHash(item)
+	size := int(c.opts.BucketSize)
+	for _, t := range c.tables {
+		i1, i2 := t.indexes(h, fp)
+		if cuckooPlace(t.bucket(i1, size), fp) || cuckooPlace(t.bucket(i2, size), fp) {
+			c.items++
+			return nil
+		}
+	}
+
+	last := c.tables[len(c.tables)-1]
+	if !c.relocate(last, h, fp) {
+		if c.opts.Expansion == 0 {
+			return ErrCuckooFull
+		}
+		// a table is at most filterMaxBytes and Expansion at most 32768, so
+		// the product cannot overflow
+		t, err := newCuckooTable(int64(last.buckets)*int64(size)*c.opts.Expansion, int64(size))
+		if err != nil {
+			return err
+		}
+		last = t
+		c.tables = append(c.tables, last)
+		i1, _ := last.indexes(h, fp)
+		cuckooPlace(last.bucket(i1, size), fp)
+	}
+	c.items++
+	return nil
+}
+
+// relocate makes room for fp by moving entries to their alternate buckets.
+// If no room is found within MaxIterations moves they are undone. Victims
+// are taken in turn rather than at random, so replaying the same adds builds
+// the same table.
+func (c *Cuckoo) relocate(t *cuckooTable, h uint64, fp byte) bool {
+	type slot struct {
+		i uint64
+		s int
+	}
+	size := int(c.opts.BucketSize)
+	victim := fp
+	i, _ := t.indexes(h, fp)
+	var path []slot
+	var s int
+	for n := int64(0); n < c.opts.MaxIterations; n++ {
+		b := t.bucket(i, size)
+		victim, b[s] = b[s], victim
+		path = append(path, slot{i, s})
+		i = t.alt(i, victim)
+		if cuckooPlace(t.bucket(i, size), victim) {
+			return true
+		}
+		s = (s + 1) % size
+	}
+	for j := len(path) - 1; j >= 0; j-- {
+		b := t.bucket(path[j].i, size)
+		victim, b[path[j].s] = b[path[j].s], victim
+	}
+	return false
+}
+
+// MarshalBinary encodes the filter for snapshots.
+func (c *Cuckoo) MarshalBinary() ([]byte, error) {
+	var buf []byte
+	for _, v := range []int64{c.opts.Capacity, c.opts.BucketSize, c.opts.MaxIterations, c.opts.Expansion, c.items, c.deletes, int64(len(c.tables))} {
+		buf = binary.AppendUvarint(buf, uint64(v))
+	}
+	for _, t := range c.tables {
+		buf = binary.AppendUvarint(buf, t.buckets)
+		buf = append(buf, t.data...)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary.
+func (c *Cuckoo) UnmarshalBinary(data []byte) error {
+	r := &binReader{b: data}
+	o := CuckooOpts{
+		Capacity:      int64(r.uvarint()),
+		BucketSize:    int64(r.uvarint()),
+		MaxIterations: int64(r.uvarint()),
+		Expansion:     int64(r.uvarint()),
+	}
+	items, deletes, n := int64(r.uvarint()), int64(r.uvarint()), r.uvarint()
+	if r.err != nil || o.validate() != nil || items < 0 || deletes < 0 || n == 0 || n > 64 {
+		return ErrBadData
+	}
+	tables := make([]*cuckooTable, n)
+	for i := range tables {
+		t := &cuckooTable{buckets: r.uvarint()}
+		if t.buckets == 0 || t.buckets&(t.buckets-1) != 0 || t.buckets > 1<<40 {
+			return ErrBadData
+		}
+		t.data = r.bytes(t.buckets * uint64(o.BucketSize))
+		tables[i] = t
+	}
+	if r.err != nil || len(r.b) != 0 {
+		return ErrBadData
+	}
+	c.opts, c.items, c.deletes, c.tables = o, items, deletes, tables
+	return nil
+}
+
+// cuckoo returns the filter at k, or nil when k does not exist. It must be
+// called with db.mu held.
+func (db *DB) cuckoo(k string) (*Cuckoo, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, nil
+	}
+	c, ok := v.val.Val.(*Cuckoo)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return c, nil
+}
+
+// CFReserve creates an empty filter at k, which must not exist.
+func (db *DB) CFReserve(k string, o CuckooOpts) error {
+	c, err := NewCuckoo(o)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.lookup(k); ok {
+		return ErrFilterExists
+	}
+	db.set(k, &Val{val: &TypedValue{Type: CuckooType, Val: c}})
+	return nil
+}
+
+// CFAdd adds item to the filter at k, creating it with the defaults. With nx
+// it is only added when not already present, and the result reports whether
+// it was.
+func (db *DB) CFAdd(k, item string, nx bool) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, err := db.cuckoo(k)
+	if err != nil {
+		return false, err
+	}
+	if c == nil {
+		c, _ = NewCuckoo(CuckooOpts{
+			Capacity:      CuckooCapacity,
+			BucketSize:    CuckooBucketSize,
+			MaxIterations: CuckooMaxIterations,
+			Expansion:     CuckooExpansion,
+		})
+		db.set(k, &Val{val: &TypedValue{Type: CuckooType, Val: c}})
+	}
+	if nx && c.count(item) > 0 {
+		return false, nil
+	}
+	return true, c.add(item)
+}
+
+// CFDel removes one occurrence of item from the filter at k.
+func (db *DB) CFDel(k, item string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, err := db.cuckoo(k)
+	if err != nil {
+		return false, err
+	}
+	if c == nil {
+		return false, ErrFilterNotFound
+	}
+	return c.del(item), nil
+}
+
+// CFCount returns how many times item may have been added to the filter at
+// k. Fingerprint collisions can make it an overestimate.
+func (db *DB) CFCount(k, item string) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c, err := db.cuckoo(k)
+	if c == nil || err != nil {
+		return 0, err
+	}
+	return c.count(item), nil
+}
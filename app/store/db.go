@@ -0,0 +1,270 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+)
+
+var (
+	ErrDBIndex = errors.New("DB index is out of range")
+	ErrSameDB  = errors.New("source and destination objects are the same")
+)
+
+// Store holds the logical databases and which one each session selected.
+type Store struct {
+	dbs []*DB
+
+	mu       sync.RWMutex
+	selected map[int64]int
+
+	propagate func(db int, args []string)
+	replica   atomic.Bool
+	// gate is held shared by commands from their change to its
+	// propagation, and exclusively by snapshots, so a snapshot never holds
+	// a write that has not been propagated yet.
+	gate sync.RWMutex
+
+	statsMu sync.Mutex
+	stats   ExpireStats
+
+	persist persistence
+}
+
+func New(databases int) *Store {
+	s := &Store{selected: make(map[int64]int)}
+	for i := 0; i < databases; i++ {
+		s.dbs = append(s.dbs, newDB(i, s))
+	}
+	s.persist.lastSave.Store(time.Now().Unix())
+	s.persist.lastOK.Store(true)
+	return s
+}
+
+// SetReplica marks the store as owned by a replica. Replicas never delete
+// expired keys themselves; they wait for the master's DEL.
+func (s *Store) SetReplica(v bool) {
+	s.replica.Store(v)
+}
+
+// OnPropagate registers fn to receive the effective form of every write
+// that has to reach replicas, along with the database it applies to.
+func (s *Store) OnPropagate(fn func(db int, args []string)) {
+	s.propagate = fn
+}
+
+// Propagate forwards a successfully applied write command.
+func (s *Store) Propagate(db int, args ...string) {
+	s.persist.dirty.Add(1)
+	if s.propagate != nil {
+		s.propagate(db, args)
+	}
+}
+
+func (s *Store) Len() int {
+	return len(s.dbs)
+}
+
+// DB returns the database selected by the session sId.
+func (s *Store) DB(sId int64) *DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dbs[s.selected[sId]]
+}
+
+// Index returns the database at idx.
+func (s *Store) Index(idx int) (*DB, error) {
+	if idx < 0 || idx >= len(s.dbs) {
+		return nil, ErrDBIndex
+	}
+	return s.dbs[idx], nil
+}
+
+func (s *Store) Select(sId int64, idx int) error {
+	if idx < 0 || idx >= len(s.dbs) {
+		return ErrDBIndex
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idx == 0 {
+		delete(s.selected, sId)
+	} else {
+		s.selected[sId] = idx
+	}
+	return nil
+}
+
+// Forget drops the selection of a closed session.
+func (s *Store) Forget(sId int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.selected, sId)
+}
+
+// lockPair locks two distinct databases in index order.
+func lockPair(a, b *DB) func() {
+	if a.id > b.id {
+		a, b = b, a
+	}
+	a.mu.Lock()
+	b.mu.Lock()
+	return func() {
+		b.mu.Unlock()
+		a.mu.Unlock()
+	}
+}
+
+// Move moves k from src to the database at dst. It reports false when the key
+// does not exist in src or already exists in dst.
+func (s *Store) Move(src *DB, k string, dst int) (bool, error) {
+	to, err := s.Index(dst)
+	if err != nil {
+		return false, err
+	}
+	if to == src {
+		return false, ErrSameDB
+	}
+	unlock := lockPair(src, to)
+	defer unlock()
+
+	v, ok := src.lookup(k)
+	if !ok {
+		return false, nil
+	}
+	if _, ok := to.lookup(k); ok {
+		return false, nil
+	}
+	detail := src.streamDetails[k]
+	src.remove(k)
+	to.set(k, v)
+	if detail != nil {
+		to.streamDetails[k] = detail
+	}
+	return true, nil
+}
+
+// SwapDB swaps the contents of two databases, so sessions that selected one
+// of them immediately see the other's data.
+func (s *Store) SwapDB(a, b int) error {
+	da, err := s.Index(a)
+	if err != nil {
+		return err
+	}
+	db, err := s.Index(b)
+	if err != nil {
+		return err
+	}
+	if da == db {
+		return nil
+	}
+	unlock := lockPair(da, db)
+	defer unlock()
+
+	da.store, db.store = db.store, da.store
+	da.index, db.index = db.index, da.index
+	da.expires, db.expires = db.expires, da.expires
+	da.streamDetails, db.streamDetails = db.streamDetails, da.streamDetails
+	return nil
+}
+
+func (s *Store) FlushAll() {
+	for _, db := range s.dbs {
+		db.Flush()
+	}
+}
+
+// Flush removes every key. The old values are left to the garbage collector,
+// so dropping them costs the same with or without ASYNC.
+func (db *DB) Flush() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.store = make(map[string]*Val)
+	db.index = nil
+	db.expires = make(map[string]struct{})
+	db.streamDetails = make(map[string]*streamDetail)
+}
+
+func (db *DB) Size() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.store)
+}
+
+type KeyspaceStats struct {
+	Keys    int
+	Expires int
+	AvgTTL  time.Duration
+}
+
+func (db *DB) KeyspaceStats() KeyspaceStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	st := KeyspaceStats{Keys: len(db.store), Expires: len(db.expires)}
+	now := time.Now()
+	var total time.Duration
+	var n int
+	for k := range db.expires {
+		if ttl := db.store[k].ex.Sub(now); ttl > 0 {
+			total += ttl
+			n++
+		}
+	}
+	if n > 0 {
+		st.AvgTTL = total / time.Duration(n)
+	}
+	return st
+}
+
+func (s *Store) Load(path string) error {
+	d, err := pkg.ReadRDB(path)
+	if err != nil {
+		return err
+	}
+	return s.load(d)
+}
+
+// LoadRDB loads the dump at the start of b and returns its length.
+func (s *Store) LoadRDB(b []byte) (int, error) {
+	d, n, err := pkg.ParseRDBPrefix(b)
+	if err != nil {
+		return 0, err
+	}
+	return n, s.load(d)
+}
+
+func (s *Store) load(d map[int]map[string]pkg.RDBStoreValue) error {
+	now := time.Now()
+	for idx, keys := range d {
+		for k, v := range keys {
+			if err := s.loadKey(idx, k, v, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadKey stores a key read from a dump, unless it expired before now.
+func (s *Store) loadKey(idx int, k string, v pkg.RDBStoreValue, now time.Time) error {
+	db, err := s.Index(idx)
+	if err != nil {
+		return err
+	}
+	canExpire := !v.Expiry.IsZero()
+	if canExpire && !v.Expiry.After(now) {
+		return nil
+	}
+	tv, err := loadValue(v)
+	if err != nil {
+		return fmt.Errorf("key %q: %w", k, err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.set(k, &Val{val: tv, ex: v.Expiry, canExpire: canExpire})
+	return nil
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"time"
+)
+
+const (
+	// activeExpireHz is how many active expire cycles run per second.
+	activeExpireHz = 10
+	// activeExpireKeysPerLoop is the number of keys with an expiry sampled
+	// per iteration of a cycle.
+	activeExpireKeysPerLoop = 20
+	// activeExpireAcceptableStale is the percentage of expired keys in a
+	// sample below which the cycle stops early.
+	activeExpireAcceptableStale = 10
+	// activeExpireCycleBudget is the percentage of each tick a cycle may use.
+	activeExpireCycleBudget = 25
+)
+
+type ExpireStats struct {
+	ExpiredKeys         int64
+	ExpiredStalePerc    float64
+	TimeCapReachedCount int64
+	CycleCPU            time.Duration
+}
+
+func (s *Store) ExpireStats() ExpireStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// StartActiveExpire runs the active expire cycle in the background. It
+// complements the lazy deletion done on access, so keys that are never read
+// again are still reclaimed.
+func (s *Store) StartActiveExpire() {
+	tick := time.Second / activeExpireHz
+	budget := tick * activeExpireCycleBudget / 100
+
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.replica.Load() {
+				continue
+			}
+			s.activeExpireCycle(budget)
+		}
+	}()
+}
+
+// activeExpireCycle samples keys with an expiry in every database and deletes
+// the expired ones. It keeps sampling a database while more than
+// activeExpireAcceptableStale percent of a sample was expired, until budget
+// runs out.
+func (s *Store) activeExpireCycle(budget time.Duration) {
+	start := time.Now()
+	var sampled, expired int
+	defer func() {
+		s.statsMu.Lock()
+		defer s.statsMu.Unlock()
+		if sampled > 0 {
+			perc := float64(expired) / float64(sampled)
+			s.stats.ExpiredStalePerc = perc*0.05 + s.stats.ExpiredStalePerc*0.95
+		}
+		s.stats.CycleCPU += time.Since(start)
+	}()
+
+	for _, db := range s.dbs {
+		for {
+			var n int
+			var keys []string
+			s.Exec(func() {
+				n, keys = db.expireSample(activeExpireKeysPerLoop)
+				db.expired(keys)
+			})
+			if n == 0 {
+				break
+			}
+			sampled += n
+			expired += len(keys)
+
+			if time.Since(start) > budget {
+				s.statsMu.Lock()
+				s.stats.TimeCapReachedCount++
+				s.statsMu.Unlock()
+				return
+			}
+			if len(keys)*100/n <= activeExpireAcceptableStale {
+				break
+			}
+		}
+	}
+}
+
+// expireSample looks at up to n keys with an expiry and deletes those that
+// have expired. It returns how many keys were sampled and which were deleted.
+func (db *DB) expireSample(n int) (int, []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	var sampled int
+	var keys []string
+	for k := range db.expires {
+		if sampled == n {
+			break
+		}
+		sampled++
+		if db.store[k].expired(now) {
+			db.remove(k)
+			keys = append(keys, k)
+		}
+	}
+	return sampled, keys
+}
+
+// expireIfNeeded lazily deletes k if it has expired. Replicas keep the key
+// until the master propagates its deletion. It must run under the gate, as
+// the deletion is propagated.
+func (db *DB) expireIfNeeded(k string) {
+	if db.srv.replica.Load() {
+		return
+	}
+
+	db.mu.Lock()
+	v, ok := db.store[k]
+	deleted := ok && v.expired(time.Now())
+	if deleted {
+		db.remove(k)
+	}
+	db.mu.Unlock()
+
+	if deleted {
+		db.expired([]string{k})
+	}
+}
+
+// expired records and propagates the deletion of expired keys.
+func (db *DB) expired(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	db.srv.statsMu.Lock()
+	db.srv.stats.ExpiredKeys += int64(len(keys))
+	db.srv.statsMu.Unlock()
+
+	for _, k := range keys {
+		db.Propagate("DEL", k)
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLazyExpireGated(t *testing.T) {
+	s := New(1)
+	db := s.dbs[0]
+	if _, err := db.SetStream("s", "1-1", map[string]string{"f": "v"}, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	var dels, ungated int
+	s.OnPropagate(func(_ int, args []string) {
+		dels++
+		// a snapshot could take the gate between the deletion and its DEL
+		if s.gate.TryLock() {
+			s.gate.Unlock()
+			ungated++
+		}
+	})
+	time.Sleep(2 * time.Millisecond)
+
+	// XREAD is not gated, so its reads take the gate themselves
+	if res := db.ReadStream([][]string{{"s", "0-0"}}, -1); len(res) != 0 {
+		t.Errorf("read expired stream: %v", res)
+	}
+	if dels != 1 || ungated != 0 {
+		t.Errorf("%d DELs, %d outside the gate", dels, ungated)
+	}
+}
+
+// fill stores n keys in db that expire at ex.
+func fill(db *DB, prefix string, n int, ex time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := 0; i < n; i++ {
+		db.set(fmt.Sprint(prefix, i), &Val{val: newString("v"), ex: ex, canExpire: true})
+	}
+}
+
+func TestExpireSample(t *testing.T) {
+	s := New(1)
+	db := s.dbs[0]
+	past := time.Now().Add(-time.Second)
+	fill(db, "old", 30, past)
+	db.SetString("persistent", "v", SetOpts{})
+
+	n, keys := db.expireSample(activeExpireKeysPerLoop)
+	if n != activeExpireKeysPerLoop || len(keys) != n {
+		t.Errorf("sampled %d, deleted %d", n, len(keys))
+	}
+	// only keys with an expiry are sampled
+	n, keys = db.expireSample(activeExpireKeysPerLoop)
+	if n != 10 || len(keys) != 10 {
+		t.Errorf("sampled %d, deleted %d", n, len(keys))
+	}
+	if n, _ := db.expireSample(activeExpireKeysPerLoop); n != 0 || db.Size() != 1 {
+		t.Errorf("sampled %d, %d keys left", n, db.Size())
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name    string
+		stale   int
+		fresh   int
+		budget  time.Duration
+		left    int
+		timeCap int64
+	}{
+		// a sample that is mostly stale keeps the cycle going
+		{name: "all stale", stale: 100, budget: time.Second, left: 0},
+		// a sample with no stale keys ends it well within the budget
+		{name: "fresh", fresh: 200, budget: time.Second, left: 200},
+		// the first sample always runs, but the budget stops the next
+		{name: "time cap", stale: 100, budget: 0, left: 100 - activeExpireKeysPerLoop, timeCap: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(2)
+			fill(s.dbs[1], "old", tt.stale, past)
+			fill(s.dbs[1], "new", tt.fresh, future)
+			var dels int
+			s.OnPropagate(func(int, []string) { dels++ })
+
+			s.activeExpireCycle(tt.budget)
+			if left := s.dbs[1].Size(); left != tt.left {
+				t.Errorf("%d keys left, want %d", left, tt.left)
+			}
+			st := s.ExpireStats()
+			if st.ExpiredKeys != int64(dels) || int(st.ExpiredKeys) != tt.stale+tt.fresh-tt.left {
+				t.Errorf("expired %d keys, propagated %d DELs", st.ExpiredKeys, dels)
+			}
+			if st.TimeCapReachedCount != tt.timeCap {
+				t.Errorf("time cap reached %d times, want %d", st.TimeCapReachedCount, tt.timeCap)
+			}
+			if st.CycleCPU <= 0 {
+				t.Error("cycle time not recorded")
+			}
+		})
+	}
+}
+
+func TestExpireStalePerc(t *testing.T) {
+	s := New(1)
+	fill(s.dbs[0], "old", activeExpireKeysPerLoop, time.Now().Add(-time.Second))
+	s.activeExpireCycle(time.Second)
+	// one fully stale cycle moves the average 5% of the way
+	if got := s.ExpireStats().ExpiredStalePerc; got != 0.05 {
+		t.Errorf("stale perc %v, want 0.05", got)
+	}
+}
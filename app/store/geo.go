@@ -0,0 +1,464 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"slices"
+)
+
+// Geo points are sorted set members scored with a 52 bit geohash, latitude
+// and longitude bits interleaved, exactly as Redis encodes them.
+const (
+	geoStepMax      = 26
+	geoLatMin       = -85.05112878
+	geoLatMax       = 85.05112878
+	geoLongMin      = -180.0
+	geoLongMax      = 180.0
+	earthRadius     = 6372797.560856
+	mercatorMax     = 20037726.37
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+var ErrGeoMember = errors.New("could not decode requested zset member")
+
+// GeoUnits maps the units GEO commands accept to meters.
+var GeoUnits = map[string]float64{"m": 1, "km": 1000, "ft": 0.3048, "mi": 1609.34}
+
+type geoRange struct{ min, max float64 }
+
+type geohashBits struct {
+	bits uint64
+	step uint
+}
+
+type geohashArea struct {
+	long, lat geoRange
+}
+
+type GeoPoint struct {
+	Member   string
+	Lon, Lat float64
+	// Dist is the distance from the search center in meters.
+	Dist  float64
+	Score uint64
+}
+
+func interleave64(xlo, ylo uint32) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0f0f0f0f0f0f0f0f, 0x00ff00ff00ff00ff, 0x0000ffff0000ffff}
+	s := [...]uint{1, 2, 4, 8, 16}
+	x, y := uint64(xlo), uint64(ylo)
+	for i := 4; i >= 0; i-- {
+		x = (x | x<<s[i]) & b[i]
+		y = (y | y<<s[i]) & b[i]
+	}
+	return x | y<<1
+}
+
+func deinterleave64(v uint64) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0f0f0f0f0f0f0f0f, 0x00ff00ff00ff00ff, 0x0000ffff0000ffff, 0x00000000ffffffff}
+	s := [...]uint{0, 1, 2, 4, 8, 16}
+	x, y := v, v>>1
+	for i := range b {
+		x = (x | x>>s[i]) & b[i]
+		y = (y | y>>s[i]) & b[i]
+	}
+	return x | y<<32
+}
+
+func geohashEncode(long, lat geoRange, lon, la float64, step uint) geohashBits {
+	latOffset := (la - lat.min) / (lat.max - lat.min) * float64(uint64(1)<<step)
+	longOffset := (lon - long.min) / (long.max - long.min) * float64(uint64(1)<<step)
+	return geohashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}
+}
+
+func geohashDecode(long, lat geoRange, h geohashBits) geohashArea {
+	sep := deinterleave64(h.bits)
+	ilat, ilon := float64(uint32(sep)), float64(uint32(sep>>32))
+	scale := float64(uint64(1) << h.step)
+	return geohashArea{
+		lat:  geoRange{lat.min + ilat/scale*(lat.max-lat.min), lat.min + (ilat+1)/scale*(lat.max-lat.min)},
+		long: geoRange{long.min + ilon/scale*(long.max-long.min), long.min + (ilon+1)/scale*(long.max-long.min)},
+	}
+}
+
+var (
+	geoLong = geoRange{geoLongMin, geoLongMax}
+	geoLat  = geoRange{geoLatMin, geoLatMax}
+)
+
+// ValidLonLat reports whether a point can be indexed.
+func ValidLonLat(lon, lat float64) bool {
+	return lon >= geoLongMin && lon <= geoLongMax && lat >= geoLatMin && lat <= geoLatMax
+}
+
+// GeoScore returns the sorted set score of a point.
+func GeoScore(lon, lat float64) uint64 {
+	return geohashEncode(geoLong, geoLat, lon, lat, geoStepMax).bits
+}
+
+// GeoDecode returns the center of the cell a score encodes.
+func GeoDecode(score uint64) (float64, float64) {
+	a := geohashDecode(geoLong, geoLat, geohashBits{bits: score, step: geoStepMax})
+	lon := min(max((a.long.min+a.long.max)/2, geoLongMin), geoLongMax)
+	lat := min(max((a.lat.min+a.lat.max)/2, geoLatMin), geoLatMax)
+	return lon, lat
+}
+
+// Geohash returns the standard 11 character geohash of a point, which uses
+// the full -90,90 latitude range rather than the one used for scores.
+func Geohash(lon, lat float64) string {
+	h := geohashEncode(geoRange{-180, 180}, geoRange{-90, 90}, lon, lat, geoStepMax)
+	buf := make([]byte, 11)
+	for i := range buf {
+		// only 52 bits are available, the last character is always 0
+		var idx uint64
+		if i < 10 {
+			idx = h.bits >> (52 - (i+1)*5) & 0x1f
+		}
+		buf[i] = geohashAlphabet[idx]
+	}
+	return string(buf)
+}
+
+func degRad(d float64) float64 { return d * (math.Pi / 180) }
+func radDeg(r float64) float64 { return r / (math.Pi / 180) }
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadius * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// GeoDistance returns the haversine distance in meters between two points.
+func GeoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	v := math.Sin((degRad(lon2) - degRad(lon1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func (h *geohashBits) moveX(d int) {
+	x, y := h.bits&0xaaaaaaaaaaaaaaaa, h.bits&0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - h.step*2)
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - h.step*2)
+	h.bits = x | y
+}
+
+func (h *geohashBits) moveY(d int) {
+	x, y := h.bits&0xaaaaaaaaaaaaaaaa, h.bits&0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - h.step*2)
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+	y &= 0x5555555555555555 >> (64 - h.step*2)
+	h.bits = x | y
+}
+
+func (h geohashBits) neighbor(dx, dy int) geohashBits {
+	if dx != 0 {
+		h.moveX(dx)
+	}
+	if dy != 0 {
+		h.moveY(dy)
+	}
+	return h
+}
+
+// GeoQuery describes a GEOSEARCH. Radius, Width and Height are in the unit
+// given by Conversion, the number of meters per unit.
+type GeoQuery struct {
+	Member     string
+	FromMember bool
+	Lon, Lat   float64
+
+	Box           bool
+	Radius        float64
+	Width, Height float64
+	Conversion    float64
+
+	// Sort is 1 for ascending and -1 for descending distance.
+	Sort  int
+	Count int
+	Any   bool
+}
+
+// within reports whether the point is inside the query shape and its
+// distance in meters from the center.
+func (q GeoQuery) within(lon, lat float64) (float64, bool) {
+	if !q.Box {
+		d := GeoDistance(q.Lon, q.Lat, lon, lat)
+		return d, d <= q.Radius*q.Conversion
+	}
+	if geoLatDistance(lat, q.Lat) > q.Height*q.Conversion/2 {
+		return 0, false
+	}
+	if GeoDistance(lon, lat, q.Lon, lat) > q.Width*q.Conversion/2 {
+		return 0, false
+	}
+	return GeoDistance(q.Lon, q.Lat, lon, lat), true
+}
+
+func geoEstimateSteps(meters, lat float64) uint {
+	if meters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for meters < mercatorMax {
+		meters *= 2
+		step++
+	}
+	step -= 2
+	// cells are narrower towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// areas returns the center cell and its eight neighbors covering the query
+// shape. Cells that cannot hold matches are zeroed.
+func (q GeoQuery) areas() [9]geohashBits {
+	height, width := q.Radius, q.Radius
+	if q.Box {
+		height, width = q.Height/2, q.Width/2
+	}
+	height *= q.Conversion
+	width *= q.Conversion
+	latDelta := radDeg(height / earthRadius)
+	longDeltaTop := radDeg(width / earthRadius / math.Cos(degRad(q.Lat+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadius / math.Cos(degRad(q.Lat-latDelta)))
+	minLon, maxLon := q.Lon-longDeltaTop, q.Lon+longDeltaTop
+	if q.Lat < 0 {
+		minLon, maxLon = q.Lon-longDeltaBottom, q.Lon+longDeltaBottom
+	}
+	minLat, maxLat := q.Lat-latDelta, q.Lat+latDelta
+
+	meters := q.Radius
+	if q.Box {
+		meters = math.Sqrt((q.Width/2)*(q.Width/2) + (q.Height/2)*(q.Height/2))
+	}
+	meters *= q.Conversion
+	steps := geoEstimateSteps(meters, q.Lat)
+
+	hash := geohashEncode(geoLong, geoLat, q.Lon, q.Lat, steps)
+	// a larger step is needed when a neighbor does not reach the edge of the
+	// search area
+	north := geohashDecode(geoLong, geoLat, hash.neighbor(0, 1))
+	south := geohashDecode(geoLong, geoLat, hash.neighbor(0, -1))
+	east := geohashDecode(geoLong, geoLat, hash.neighbor(1, 0))
+	west := geohashDecode(geoLong, geoLat, hash.neighbor(-1, 0))
+	if steps > 1 && (north.lat.max < maxLat || south.lat.min > minLat || east.long.max < maxLon || west.long.min > minLon) {
+		steps--
+		hash = geohashEncode(geoLong, geoLat, q.Lon, q.Lat, steps)
+	}
+	area := geohashDecode(geoLong, geoLat, hash)
+
+	// center, north, south, east, west, north east, north west, south east,
+	// south west: the order Redis visits them in
+	dirs := [9][2]int{{0, 0}, {0, 1}, {0, -1}, {1, 0}, {-1, 0}, {1, 1}, {-1, 1}, {1, -1}, {-1, -1}}
+	var cells [9]geohashBits
+	for i, d := range dirs {
+		cells[i] = hash.neighbor(d[0], d[1])
+		if steps < 2 || i == 0 {
+			continue
+		}
+		if (d[1] < 0 && area.lat.min < minLat) || (d[1] > 0 && area.lat.max > maxLat) ||
+			(d[0] < 0 && area.long.min < minLon) || (d[0] > 0 && area.long.max > maxLon) {
+			cells[i] = geohashBits{}
+		}
+	}
+	return cells
+}
+
+// zset returns the sorted set at k, or nil when k does not exist. It must be
+// called with db.mu held.
+func (db *DB) zset(k string) (*ZSet, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, nil
+	}
+	z, ok := v.val.Val.(*ZSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return z, nil
+}
+
+type GeoAddOpts struct {
+	NX, XX, CH bool
+}
+
+// GeoAdd adds or updates points and returns how many were added, or with CH
+// added or moved.
+func (db *DB) GeoAdd(k string, points []GeoPoint, o GeoAddOpts) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	z, err := db.zset(k)
+	if err != nil {
+		return 0, err
+	}
+	if z == nil {
+		if o.XX {
+			return 0, nil
+		}
+		z = NewZSet()
+		db.set(k, &Val{val: &TypedValue{Type: "zset", Val: z}})
+	}
+
+	var n int
+	for _, p := range points {
+		score := float64(GeoScore(p.Lon, p.Lat))
+		old, exists := z.Score(p.Member)
+		if (exists && o.NX) || (!exists && o.XX) {
+			continue
+		}
+		z.Add(p.Member, score)
+		if !exists || (o.CH && old != score) {
+			n++
+		}
+	}
+	if z.Len() == 0 {
+		db.remove(k)
+	}
+	return n, nil
+}
+
+// GeoPos returns the position of each member, or nil when it is missing.
+func (db *DB) GeoPos(k string, members []string) ([]*GeoPoint, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	z, err := db.zset(k)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*GeoPoint, len(members))
+	if z == nil {
+		return res, nil
+	}
+	for i, m := range members {
+		if score, ok := z.Score(m); ok {
+			p := &GeoPoint{Member: m, Score: uint64(score)}
+			p.Lon, p.Lat = GeoDecode(p.Score)
+			res[i] = p
+		}
+	}
+	return res, nil
+}
+
+// GeoSearch returns the members inside the query shape.
+func (db *DB) GeoSearch(k string, q GeoQuery) ([]GeoPoint, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.geoSearch(k, q)
+}
+
+func (db *DB) geoSearch(k string, q GeoQuery) ([]GeoPoint, error) {
+	z, err := db.zset(k)
+	if z == nil || err != nil {
+		return nil, err
+	}
+	if q.FromMember {
+		score, ok := z.Score(q.Member)
+		if !ok {
+			return nil, ErrGeoMember
+		}
+		q.Lon, q.Lat = GeoDecode(uint64(score))
+	}
+
+	limit := 0
+	if q.Any {
+		limit = q.Count
+	}
+	var res []GeoPoint
+	var last geohashBits
+	for i, cell := range q.areas() {
+		// huge radiuses can make adjacent neighbors the same cell
+		if cell == (geohashBits{}) || cell == last {
+			continue
+		}
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		minScore := float64(cell.bits << (52 - cell.step*2))
+		maxScore := float64((cell.bits + 1) << (52 - cell.step*2))
+		for _, e := range z.RangeByScore(minScore, maxScore) {
+			p := GeoPoint{Member: e.Member, Score: uint64(e.Score)}
+			p.Lon, p.Lat = GeoDecode(p.Score)
+			var ok bool
+			if p.Dist, ok = q.within(p.Lon, p.Lat); !ok {
+				continue
+			}
+			res = append(res, p)
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+		}
+		if i > 0 {
+			last = cell
+		}
+	}
+
+	sort := q.Sort
+	if sort == 0 && q.Count > 0 && !q.Any {
+		sort = 1
+	}
+	if sort != 0 {
+		slices.SortStableFunc(res, func(a, b GeoPoint) int {
+			if a.Dist == b.Dist {
+				return 0
+			}
+			if (a.Dist < b.Dist) == (sort > 0) {
+				return -1
+			}
+			return 1
+		})
+	}
+	if q.Count > 0 && len(res) > q.Count {
+		res = res[:q.Count]
+	}
+	return res, nil
+}
+
+// GeoSearchStore stores the result of a search at dest, scored by geohash
+// or, with storeDist, by distance in the query unit. An empty result deletes
+// dest.
+func (db *DB) GeoSearchStore(dest, src string, q GeoQuery, storeDist bool) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, err := db.geoSearch(src, q)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		db.remove(dest)
+		return 0, nil
+	}
+	z := NewZSet()
+	for _, p := range res {
+		score := float64(p.Score)
+		if storeDist {
+			score = p.Dist / q.Conversion
+		}
+		z.Add(p.Member, score)
+	}
+	delete(db.streamDetails, dest)
+	db.set(dest, &Val{val: &TypedValue{Type: "zset", Val: z}})
+	return len(res), nil
+}
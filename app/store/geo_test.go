@@ -0,0 +1,108 @@
+package store
+
+import (
+	"math"
+	"testing"
+)
+
+func sicily(t *testing.T) *DB {
+	db, _ := New(1).Index(0)
+	_, err := db.GeoAdd("Sicily", []GeoPoint{
+		{Member: "Palermo", Lon: 13.361389, Lat: 38.115556},
+		{Member: "Catania", Lon: 15.087269, Lat: 37.502669},
+		{Member: "edge1", Lon: 12.758489, Lat: 38.788135},
+		{Member: "edge2", Lon: 17.241510, Lat: 38.788135},
+	}, GeoAddOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestGeoEncoding(t *testing.T) {
+	tests := []struct {
+		lon, lat       float64
+		score          uint64
+		decLon, decLat float64
+		hash           string
+	}{
+		{13.361389, 38.115556, 3479099956230698, 13.36138933897018433, 38.11555639549629859, "sqc8b49rny0"},
+		{15.087269, 37.502669, 3479447370796909, 15.08726745843887329, 37.50266842333162032, "sqdtr74hyu0"},
+	}
+	for _, tt := range tests {
+		score := GeoScore(tt.lon, tt.lat)
+		if score != tt.score {
+			t.Errorf("GeoScore(%v, %v) = %d, want %d", tt.lon, tt.lat, score, tt.score)
+		}
+		lon, lat := GeoDecode(score)
+		if lon != tt.decLon || lat != tt.decLat {
+			t.Errorf("GeoDecode(%d) = %v, %v, want %v, %v", score, lon, lat, tt.decLon, tt.decLat)
+		}
+		if h := Geohash(lon, lat); h != tt.hash {
+			t.Errorf("Geohash(%v, %v) = %s, want %s", lon, lat, h, tt.hash)
+		}
+	}
+
+	d := GeoDistance(tests[0].decLon, tests[0].decLat, tests[1].decLon, tests[1].decLat)
+	if math.Abs(d-166274.1516) > 0.0001 {
+		t.Errorf("distance = %f, want 166274.1516", d)
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	db := sicily(t)
+	tests := []struct {
+		name string
+		q    GeoQuery
+		want []string
+		dist []float64
+	}{
+		{
+			name: "radius",
+			q:    GeoQuery{Lon: 15, Lat: 37, Radius: 200, Conversion: 1000, Sort: 1},
+			want: []string{"Catania", "Palermo"},
+		},
+		{
+			name: "box",
+			q:    GeoQuery{Lon: 15, Lat: 37, Box: true, Width: 400, Height: 400, Conversion: 1000, Sort: 1},
+			want: []string{"Catania", "Palermo", "edge2", "edge1"},
+			dist: []float64{56.4413, 190.4424, 279.7403, 279.7405},
+		},
+		{
+			name: "desc count",
+			q:    GeoQuery{Lon: 15, Lat: 37, Radius: 200, Conversion: 1000, Sort: -1, Count: 1},
+			want: []string{"Palermo"},
+		},
+		{
+			name: "count sorts ascending",
+			q:    GeoQuery{Lon: 15, Lat: 37, Box: true, Width: 400, Height: 400, Conversion: 1000, Count: 2},
+			want: []string{"Catania", "Palermo"},
+		},
+		{
+			name: "from member",
+			q:    GeoQuery{Member: "Palermo", FromMember: true, Radius: 50, Conversion: 1000},
+			want: []string{"Palermo"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := db.GeoSearch("Sicily", tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for i, p := range got {
+			if p.Member != tt.want[i] {
+				t.Errorf("%s: %d = %s, want %s", tt.name, i, p.Member, tt.want[i])
+			}
+			if tt.dist != nil && math.Abs(p.Dist/1000-tt.dist[i]) > 0.00005 {
+				t.Errorf("%s: %s dist = %.4f, want %.4f", tt.name, p.Member, p.Dist/1000, tt.dist[i])
+			}
+		}
+	}
+
+	if _, err := db.GeoSearch("Sicily", GeoQuery{Member: "Rome", FromMember: true, Radius: 1, Conversion: 1}); err != ErrGeoMember {
+		t.Errorf("missing member: err = %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogs are strings laid out exactly like Redis's: a 16 byte header
+// ("HYLL", the encoding, three unused bytes and the cached cardinality as a
+// little endian uint64) followed by the registers, either dense (6 bits
+// each, packed little endian) or sparse (run length opcodes).
+const (
+	hllP             = 14
+	hllQ             = 64 - hllP
+	hllRegisters     = 1 << hllP
+	hllBits          = 6
+	hllHdrSize       = 16
+	hllDenseSize     = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllAlphaInf      = 0.721347520444481703680
+	hllSeed          = 0xadc83b19
+	hllDense         = 0
+	hllSparse        = 1
+	hllSparseValMax  = 32
+	hllSparseValLen  = 4
+	hllSparseZeroLen = 64
+	hllSparseXZero   = 16384
+
+	// HLLSparseMaxBytes is hll-sparse-max-bytes: larger sparse values are
+	// converted to the dense encoding.
+	HLLSparseMaxBytes = 3000
+)
+
+var (
+	ErrNotHLL     = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	ErrInvalidHLL = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+// newHLL returns an empty sparse HyperLogLog with a valid cached cardinality
+// of zero.
+func newHLL() []byte {
+	b := make([]byte, hllHdrSize, hllHdrSize+2)
+	copy(b, "HYLL")
+	b[4] = hllSparse
+	n := hllRegisters - 1
+	return append(b, 0x40|byte(n>>8), byte(n))
+}
+
+func checkHLL(b []byte) error {
+	if len(b) < hllHdrSize || string(b[:4]) != "HYLL" || b[4] > hllSparse {
+		return ErrNotHLL
+	}
+	if b[4] == hllDense && len(b) != hllDenseSize {
+		return ErrNotHLL
+	}
+	return nil
+}
+
+func hllCached(b []byte) (uint64, bool) {
+	if b[15]&0x80 != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(b[8:16]), true
+}
+
+func hllInvalidate(b []byte) {
+	b[15] |= 0x80
+}
+
+// hllPatLen returns the register an element maps to and the length of the
+// run of zeros that follows, plus one.
+func hllPatLen(e string) (int, uint8) {
+	h := murmurHash64A([]byte(e), hllSeed)
+	idx := int(h & (hllRegisters - 1))
+	h >>= hllP
+	h |= 1 << hllQ
+	return idx, uint8(bits.TrailingZeros64(h) + 1)
+}
+
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(data))*m
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+func denseGet(r []byte, i int) uint8 {
+	idx, fb := i*hllBits/8, uint(i*hllBits&7)
+	v := uint(r[idx]) >> fb
+	if idx+1 < len(r) {
+		v |= uint(r[idx+1]) << (8 - fb)
+	}
+	return uint8(v & 63)
+}
+
+func denseSet(r []byte, i int, v uint8) {
+	idx, fb := i*hllBits/8, uint(i*hllBits&7)
+	r[idx] &^= 63 << fb
+	r[idx] |= v << fb
+	if idx+1 < len(r) {
+		r[idx+1] &^= 63 >> (8 - fb)
+		r[idx+1] |= v >> (8 - fb)
+	}
+}
+
+// hllRegisterValues decodes the registers of a checked HyperLogLog.
+func hllRegisterValues(b []byte) ([]uint8, error) {
+	regs := make([]uint8, hllRegisters)
+	if b[4] == hllDense {
+		for i := range regs {
+			regs[i] = denseGet(b[hllHdrSize:], i)
+		}
+		return regs, nil
+	}
+
+	idx := 0
+	p := b[hllHdrSize:]
+	for len(p) > 0 {
+		var n int
+		var v uint8
+		switch op := p[0]; {
+		case op&0xc0 == 0x00: // ZERO
+			n, p = int(op&0x3f)+1, p[1:]
+		case op&0xc0 == 0x40: // XZERO
+			if len(p) < 2 {
+				return nil, ErrInvalidHLL
+			}
+			n, p = (int(op&0x3f)<<8|int(p[1]))+1, p[2:]
+		default: // VAL
+			n, v, p = int(op&0x3)+1, (op>>2)&0x1f+1, p[1:]
+		}
+		if idx+n > hllRegisters {
+			return nil, ErrInvalidHLL
+		}
+		for j := 0; j < n; j++ {
+			regs[idx+j] = v
+		}
+		idx += n
+	}
+	if idx != hllRegisters {
+		return nil, ErrInvalidHLL
+	}
+	return regs, nil
+}
+
+// encodeHLL builds a HyperLogLog from regs with an invalidated cache. It
+// uses the sparse encoding when asked to and the registers allow it.
+func encodeHLL(regs []uint8, sparse bool) []byte {
+	b := make([]byte, hllHdrSize, hllDenseSize)
+	copy(b, "HYLL")
+	hllInvalidate(b)
+	if sparse {
+		if p, ok := sparseEncode(regs); ok && hllHdrSize+len(p) <= HLLSparseMaxBytes {
+			b[4] = hllSparse
+			return append(b, p...)
+		}
+	}
+	b = b[:hllDenseSize]
+	for i, v := range regs {
+		denseSet(b[hllHdrSize:], i, v)
+	}
+	return b
+}
+
+func sparseEncode(regs []uint8) ([]byte, bool) {
+	var p []byte
+	for i := 0; i < len(regs); {
+		v := regs[i]
+		j := i + 1
+		for j < len(regs) && regs[j] == v {
+			j++
+		}
+		if v > hllSparseValMax {
+			return nil, false
+		}
+		for run := j - i; run > 0; {
+			switch {
+			case v != 0:
+				n := min(run, hllSparseValLen)
+				p = append(p, 0x80|(v-1)<<2|byte(n-1))
+				run -= n
+			case run <= hllSparseZeroLen:
+				p = append(p, byte(run-1))
+				run = 0
+			default:
+				n := min(run, hllSparseXZero)
+				p = append(p, 0x40|byte((n-1)>>8), byte(n-1))
+				run -= n
+			}
+		}
+		i = j
+	}
+	return p, true
+}
+
+// hllCount estimates the cardinality from the register histogram, following
+// Otmar Ertl's "New cardinality estimation algorithms for HyperLogLog
+// sketches" as Redis does. A dense string set by a client may hold any 6 bit
+// register, so the histogram covers them all.
+func hllCount(regs []uint8) uint64 {
+	var histo [1 << hllBits]int
+	for _, v := range regs {
+		histo[v]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// hllBytes returns the HyperLogLog at k for reading, or nil when k does not
+// exist. It must be called with db.mu held.
+func (db *DB) hllBytes(k string) ([]byte, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, nil
+	}
+	b, err := readBytes(v.val)
+	if err != nil {
+		return nil, err
+	}
+	return b, checkHLL(b)
+}
+
+// PFAdd adds elems to the HyperLogLog at k, creating it when needed. It
+// reports whether the key was created or any register changed.
+func (db *DB) PFAdd(k string, elems []string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, err := db.hllBytes(k)
+	if err != nil {
+		return false, err
+	}
+	created := b == nil
+	if created {
+		db.set(k, &Val{val: &TypedValue{Type: "string", Val: newHLL()}})
+	}
+	b, v, err := db.mutableBytes(k)
+	if err != nil {
+		return false, err
+	}
+
+	var updated bool
+	if b[4] == hllDense {
+		for _, e := range elems {
+			idx, count := hllPatLen(e)
+			if denseGet(b[hllHdrSize:], idx) < count {
+				denseSet(b[hllHdrSize:], idx, count)
+				updated = true
+			}
+		}
+	} else {
+		regs, err := hllRegisterValues(b)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range elems {
+			idx, count := hllPatLen(e)
+			if regs[idx] < count {
+				regs[idx] = count
+				updated = true
+			}
+		}
+		if updated {
+			b = encodeHLL(regs, true)
+			v.val.Val = b
+		}
+	}
+	if updated {
+		hllInvalidate(b)
+	}
+	return created || updated, nil
+}
+
+// PFCount estimates the cardinality of the union of the HyperLogLogs at keys.
+// For a single key the result is cached in the header.
+func (db *DB) PFCount(keys []string) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(keys) == 1 {
+		b, err := db.hllBytes(keys[0])
+		if b == nil || err != nil {
+			return 0, err
+		}
+		if n, ok := hllCached(b); ok {
+			return n, nil
+		}
+		regs, err := hllRegisterValues(b)
+		if err != nil {
+			return 0, err
+		}
+		n := hllCount(regs)
+		b, _, _ = db.mutableBytes(keys[0])
+		binary.LittleEndian.PutUint64(b[8:16], n)
+		return n, nil
+	}
+
+	regs, _, err := db.hllUnion(keys)
+	if err != nil {
+		return 0, err
+	}
+	return hllCount(regs), nil
+}
+
+// hllUnion returns the register-wise maximum of the HyperLogLogs at keys and
+// whether any of them is dense. It must be called with db.mu held.
+func (db *DB) hllUnion(keys []string) ([]uint8, bool, error) {
+	max := make([]uint8, hllRegisters)
+	var dense bool
+	for _, k := range keys {
+		b, err := db.hllBytes(k)
+		if err != nil {
+			return nil, false, err
+		}
+		if b == nil {
+			continue
+		}
+		regs, err := hllRegisterValues(b)
+		if err != nil {
+			return nil, false, err
+		}
+		dense = dense || b[4] == hllDense
+		for i, v := range regs {
+			if v > max[i] {
+				max[i] = v
+			}
+		}
+	}
+	return max, dense, nil
+}
+
+// PFMerge stores the union of dest and keys at dest. The result is dense if
+// any input is.
+func (db *DB) PFMerge(dest string, keys []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	regs, dense, err := db.hllUnion(append([]string{dest}, keys...))
+	if err != nil {
+		return err
+	}
+	db.replaceString(dest, &TypedValue{Type: "string", Val: encodeHLL(regs, !dense)})
+	return nil
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHLLCount(t *testing.T) {
+	tests := []struct {
+		n      int
+		sparse bool
+	}{
+		{0, true},
+		{1, true},
+		{7, true},
+		{100, true},
+		{1000, true},
+		{5000, false},
+		{100000, false},
+	}
+	for _, tt := range tests {
+		db, _ := New(1).Index(0)
+		var elems []string
+		for i := 0; i < tt.n; i++ {
+			elems = append(elems, fmt.Sprintf("elem:%d", i))
+		}
+		if _, err := db.PFAdd("hll", elems); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := db.hllBytes("hll")
+		if got := b[4] == hllSparse; got != tt.sparse {
+			t.Errorf("n=%d: sparse = %v, want %v", tt.n, got, tt.sparse)
+		}
+		got, err := db.PFCount([]string{"hll"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := math.Abs(float64(got) - float64(tt.n)); diff > float64(tt.n)*0.02 {
+			t.Errorf("n=%d: count = %d", tt.n, got)
+		}
+		if cached, ok := hllCached(b); !ok || cached != got {
+			t.Errorf("n=%d: cache = %d, %v, want %d", tt.n, cached, ok, got)
+		}
+
+		// the same registers give the same estimate in either encoding
+		regs, _ := hllRegisterValues(b)
+		for _, sparse := range []bool{true, false} {
+			enc := encodeHLL(regs, sparse)
+			decoded, err := hllRegisterValues(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := hllCount(decoded); n != got {
+				t.Errorf("n=%d sparse=%v: count = %d, want %d", tt.n, sparse, n, got)
+			}
+		}
+	}
+}
+
+func TestPFMerge(t *testing.T) {
+	db, _ := New(1).Index(0)
+	db.PFAdd("a", []string{"x", "y", "z"})
+	db.PFAdd("b", []string{"z", "w"})
+	if err := db.PFMerge("dest", []string{"a", "b", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range [][]string{{"dest"}, {"a", "b"}} {
+		if n, err := db.PFCount(keys); err != nil || n != 4 {
+			t.Errorf("PFCount(%v) = %d, %v, want 4", keys, n, err)
+		}
+	}
+}
+
+func TestHLLCountHighRegisters(t *testing.T) {
+	db, _ := New(1).Index(0)
+	// a dense value with every register at 63, past any run PFADD makes
+	b := make([]byte, hllDenseSize)
+	copy(b, "HYLL")
+	b[15] = 0x80
+	for i := hllHdrSize; i < len(b); i++ {
+		b[i] = 0xff
+	}
+	db.SetString("hll", string(b), SetOpts{})
+	if _, err := db.PFCount([]string{"hll"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHLLInvalid(t *testing.T) {
+	db, _ := New(1).Index(0)
+	db.MSet([]string{
+		"plain", "foo",
+		"short", "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f",
+		"overrun", "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f\xff\x00",
+		"dense", "HYLL\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+	})
+	tests := []struct {
+		k    string
+		want error
+	}{
+		{"plain", ErrNotHLL},
+		{"short", ErrInvalidHLL},
+		{"overrun", ErrInvalidHLL},
+		{"dense", ErrNotHLL},
+	}
+	for _, tt := range tests {
+		if _, err := db.PFCount([]string{tt.k}); err != tt.want {
+			t.Errorf("PFCount(%s) = %v, want %v", tt.k, err, tt.want)
+		}
+	}
+}
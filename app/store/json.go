@@ -0,0 +1,712 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JSONType is the type name of JSON documents, the one RedisJSON reports so
+// clients recognise the keys.
+const JSONType = "ReJSON-RL"
+
+var (
+	ErrJSONNewAtRoot = errors.New("new objects must be created at the root")
+	ErrJSONNoKey     = errors.New("could not perform this operation on a key that doesn't exist")
+	ErrJSONNotNumber = errors.New("expected a number")
+	ErrJSONNaN       = errors.New("result is not a number")
+)
+
+// JSON is a document. Values in the tree are nil, bool, int64, float64,
+// string, *jsonArray or *jsonObject.
+type JSON struct {
+	root any
+}
+
+// jsonObject keeps its members in insertion order.
+type jsonObject struct {
+	keys []string
+	vals map[string]any
+}
+
+type jsonArray struct {
+	vals []any
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{vals: make(map[string]any)}
+}
+
+func (o *jsonObject) set(k string, v any) {
+	if _, ok := o.vals[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.vals[k] = v
+}
+
+// jsonClone deeply copies a value of a document tree.
+func jsonClone(v any) any {
+	switch x := v.(type) {
+	case *jsonObject:
+		o := &jsonObject{keys: slices.Clone(x.keys), vals: make(map[string]any, len(x.vals))}
+		for k, e := range x.vals {
+			o.vals[k] = jsonClone(e)
+		}
+		return o
+	case *jsonArray:
+		a := &jsonArray{vals: make([]any, len(x.vals))}
+		for i, e := range x.vals {
+			a.vals[i] = jsonClone(e)
+		}
+		return a
+	}
+	return v
+}
+
+func (o *jsonObject) del(k string) {
+	delete(o.vals, k)
+	o.keys = slices.DeleteFunc(o.keys, func(s string) bool { return s == k })
+}
+
+// IsJSONPath reports whether path uses JSONPath syntax, whose commands reply
+// with one result per match, rather than the legacy single value syntax.
+func IsJSONPath(path string) bool {
+	return strings.HasPrefix(path, "$")
+}
+
+func errJSONPathMissing(p jsonPath) error {
+	return fmt.Errorf("Path '%s' does not exist", p.text)
+}
+
+func errJSONWrongType(want string, v any) error {
+	return fmt.Errorf("WRONGTYPE wrong type of path value - expected %s but found %s", want, jsonTypeName(v))
+}
+
+func parseJSON(s string) (any, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing characters after JSON value")
+	}
+	return v, nil
+}
+
+func decodeJSON(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			arr := &jsonArray{vals: []any{}}
+			for dec.More() {
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr.vals = append(arr.vals, v)
+			}
+			_, err := dec.Token()
+			return arr, err
+		}
+		obj := newJSONObject()
+		for dec.More() {
+			k, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.set(k.(string), v)
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n, nil
+		}
+		return t.Float64()
+	}
+	return tok, nil
+}
+
+func cloneJSON(v any) any {
+	switch c := v.(type) {
+	case *jsonObject:
+		o := newJSONObject()
+		for _, k := range c.keys {
+			o.set(k, cloneJSON(c.vals[k]))
+		}
+		return o
+	case *jsonArray:
+		a := &jsonArray{vals: make([]any, len(c.vals))}
+		for i, e := range c.vals {
+			a.vals[i] = cloneJSON(e)
+		}
+		return a
+	}
+	return v
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *jsonArray:
+		return "array"
+	}
+	return "object"
+}
+
+// JSONFormat holds the INDENT, NEWLINE and SPACE options of JSON.GET.
+type JSONFormat struct {
+	Indent, Newline, Space string
+}
+
+func (f JSONFormat) String(v any) string {
+	var b strings.Builder
+	f.write(&b, v, 0)
+	return b.String()
+}
+
+func (f JSONFormat) write(b *strings.Builder, v any, depth int) {
+	switch c := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(c))
+	case int64:
+		b.WriteString(strconv.FormatInt(c, 10))
+	case float64:
+		b.WriteString(formatJSONFloat(c))
+	case string:
+		writeJSONString(b, c)
+	case *jsonArray:
+		if len(c.vals) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteByte('[')
+		for i, e := range c.vals {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			f.newline(b, depth+1)
+			f.write(b, e, depth+1)
+		}
+		f.newline(b, depth)
+		b.WriteByte(']')
+	case *jsonObject:
+		if len(c.keys) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteByte('{')
+		for i, k := range c.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			f.newline(b, depth+1)
+			writeJSONString(b, k)
+			b.WriteByte(':')
+			b.WriteString(f.Space)
+			f.write(b, c.vals[k], depth+1)
+		}
+		f.newline(b, depth)
+		b.WriteByte('}')
+	}
+}
+
+func (f JSONFormat) newline(b *strings.Builder, depth int) {
+	b.WriteString(f.Newline)
+	for i := 0; i < depth; i++ {
+		b.WriteString(f.Indent)
+	}
+}
+
+// formatJSONFloat formats f the way RedisJSON does: always with a fraction
+// or exponent, so it reads back as a float.
+func formatJSONFloat(f float64) string {
+	abs := math.Abs(f)
+	if abs != 0 && (abs < 1e-5 || abs >= 1e16) {
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		s = strings.Replace(s, "e+", "e", 1)
+		s = strings.Replace(s, "e-0", "e-", 1)
+		return strings.Replace(s, "e0", "e", 1)
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+func (l jsonLoc) set(doc *JSON, v any) {
+	switch p := l.parent.(type) {
+	case nil:
+		doc.root = v
+	case *jsonObject:
+		p.set(l.key, v)
+	case *jsonArray:
+		p.vals[l.idx] = v
+	}
+}
+
+// compareSteps orders locations by their position in the document.
+func compareSteps(a, b []any) int {
+	for i := 0; i < min(len(a), len(b)); i++ {
+		switch x := a[i].(type) {
+		case int:
+			y, ok := b[i].(int)
+			if !ok {
+				return -1
+			}
+			if x != y {
+				return x - y
+			}
+		case string:
+			y, ok := b[i].(string)
+			if !ok {
+				return 1
+			}
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(a) - len(b)
+}
+
+// jsonDoc returns the document at k, or nil when k does not exist. It must be
+// called with db.mu held.
+func (db *DB) jsonDoc(k string) (*JSON, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, nil
+	}
+	doc, ok := v.val.Val.(*JSON)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return doc, nil
+}
+
+// jsonMatches parses path and evaluates it against the document at k. Legacy
+// paths that match nothing are an error.
+func (db *DB) jsonMatches(k, path string) (*JSON, jsonPath, []jsonLoc, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, p, nil, err
+	}
+	doc, err := db.jsonDoc(k)
+	if doc == nil || err != nil {
+		return nil, p, nil, err
+	}
+	locs := p.eval(doc.root)
+	if p.legacy && len(locs) == 0 {
+		return nil, p, nil, errJSONPathMissing(p)
+	}
+	return doc, p, locs, nil
+}
+
+// JSONSet sets the value at path. New keys must be set at the root, and only
+// a missing final object member is created. It reports false when nothing
+// was set, because of nx or xx or because the path does not resolve.
+func (db *DB) JSONSet(k, path, value string, nx, xx bool) (bool, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+	v, err := parseJSON(value)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	doc, err := db.jsonDoc(k)
+	if err != nil {
+		return false, err
+	}
+	if doc == nil {
+		if !p.isRoot() {
+			return false, ErrJSONNewAtRoot
+		}
+		if xx {
+			return false, nil
+		}
+		db.set(k, &Val{val: &TypedValue{Type: JSONType, Val: &JSON{root: v}}})
+		return true, nil
+	}
+
+	if locs := p.eval(doc.root); len(locs) > 0 {
+		if nx {
+			return false, nil
+		}
+		for i, l := range locs {
+			if i > 0 {
+				v = cloneJSON(v)
+			}
+			l.set(doc, v)
+		}
+		return true, nil
+	}
+	key, ok := p.lastKey()
+	if xx || !ok {
+		return false, nil
+	}
+	var set bool
+	for _, l := range p.parent().eval(doc.root) {
+		if o, ok := l.val.(*jsonObject); ok {
+			if set {
+				v = cloneJSON(v)
+			}
+			o.set(key, v)
+			set = true
+		}
+	}
+	return set, nil
+}
+
+// jsonGet serializes the values paths match. A single legacy path gives its
+// value; a JSONPath gives an array of matches; several paths give an object
+// keyed by path.
+func jsonGet(doc *JSON, paths []jsonPath, f JSONFormat) (string, error) {
+	legacy := true
+	for _, p := range paths {
+		legacy = legacy && p.legacy
+	}
+	result := func(p jsonPath) (any, error) {
+		locs := p.eval(doc.root)
+		if legacy {
+			if len(locs) == 0 {
+				return nil, errJSONPathMissing(p)
+			}
+			return locs[0].val, nil
+		}
+		arr := &jsonArray{vals: []any{}}
+		for _, l := range locs {
+			arr.vals = append(arr.vals, l.val)
+		}
+		return arr, nil
+	}
+
+	if len(paths) == 1 {
+		v, err := result(paths[0])
+		if err != nil {
+			return "", err
+		}
+		return f.String(v), nil
+	}
+	obj := newJSONObject()
+	for _, p := range paths {
+		v, err := result(p)
+		if err != nil {
+			return "", err
+		}
+		obj.set(p.text, v)
+	}
+	return f.String(obj), nil
+}
+
+// JSONGet returns the serialized values at paths, or false when k does not
+// exist. No paths means the root.
+func (db *DB) JSONGet(k string, paths []string, f JSONFormat) (string, bool, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	parsed := make([]jsonPath, len(paths))
+	for i, path := range paths {
+		var err error
+		if parsed[i], err = parseJSONPath(path); err != nil {
+			return "", false, err
+		}
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	doc, err := db.jsonDoc(k)
+	if doc == nil || err != nil {
+		return "", false, err
+	}
+	s, err := jsonGet(doc, parsed, f)
+	return s, err == nil, err
+}
+
+// JSONMGet returns the value at path in each key, or nil when the key is
+// missing, is not a document, or a legacy path does not exist in it.
+func (db *DB) JSONMGet(keys []string, path string) ([]*string, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := make([]*string, len(keys))
+	for i, k := range keys {
+		doc, err := db.jsonDoc(k)
+		if doc == nil || err != nil {
+			continue
+		}
+		if s, err := jsonGet(doc, []jsonPath{p}, JSONFormat{}); err == nil {
+			res[i] = &s
+		}
+	}
+	return res, nil
+}
+
+// JSONDel removes the values at path and returns how many were removed.
+// Removing the root deletes the key.
+func (db *DB) JSONDel(k, path string) (int, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	doc, err := db.jsonDoc(k)
+	if doc == nil || err != nil {
+		return 0, err
+	}
+	if p.isRoot() {
+		db.remove(k)
+		return 1, nil
+	}
+
+	locs := p.eval(doc.root)
+	slices.SortFunc(locs, func(a, b jsonLoc) int { return compareSteps(a.steps, b.steps) })
+	// values nested in one already being removed go with it
+	var kept []jsonLoc
+	for _, l := range locs {
+		if n := len(kept); n > 0 {
+			last := kept[n-1].steps
+			if len(last) <= len(l.steps) && compareSteps(last, l.steps[:len(last)]) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, l)
+	}
+	// later array elements first so earlier indexes stay valid
+	for i := len(kept) - 1; i >= 0; i-- {
+		switch c := kept[i].parent.(type) {
+		case *jsonObject:
+			c.del(kept[i].key)
+		case *jsonArray:
+			c.vals = slices.Delete(c.vals, kept[i].idx, kept[i].idx+1)
+		}
+	}
+	return len(kept), nil
+}
+
+// JSONNumIncrBy adds by to the numbers at path. It returns the new value for
+// a legacy path, or a JSON array with null for values that are not numbers.
+func (db *DB) JSONNumIncrBy(k, path, by string) (string, error) {
+	n, err := parseJSON(by)
+	if err != nil {
+		return "", ErrJSONNotNumber
+	}
+	switch n.(type) {
+	case int64, float64:
+	default:
+		return "", ErrJSONNotNumber
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	doc, p, locs, err := db.jsonMatches(k, path)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", ErrJSONNoKey
+	}
+
+	results := &jsonArray{vals: make([]any, len(locs))}
+	for i, l := range locs {
+		sum, ok := addJSONNumbers(l.val, n)
+		if !ok {
+			if p.legacy {
+				return "", errJSONWrongType("a number", l.val)
+			}
+			continue
+		}
+		if f, ok := sum.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			return "", ErrJSONNaN
+		}
+		results.vals[i] = sum
+	}
+	for i, l := range locs {
+		if results.vals[i] != nil {
+			l.set(doc, results.vals[i])
+		}
+	}
+	if p.legacy {
+		return JSONFormat{}.String(results.vals[len(locs)-1]), nil
+	}
+	return JSONFormat{}.String(results), nil
+}
+
+// addJSONNumbers adds two JSON numbers, staying an integer unless either is
+// a float or the sum overflows.
+func addJSONNumbers(a, b any) (any, bool) {
+	toFloat := func(v any) float64 {
+		if i, ok := v.(int64); ok {
+			return float64(i)
+		}
+		return v.(float64)
+	}
+	switch a.(type) {
+	case int64, float64:
+	default:
+		return nil, false
+	}
+	x, xok := a.(int64)
+	y, yok := b.(int64)
+	if xok && yok {
+		if s := x + y; (s > x) == (y > 0) {
+			return s, true
+		}
+	}
+	return toFloat(a) + toFloat(b), true
+}
+
+// jsonEach applies fn to every value path matches in k. For legacy paths a
+// value of the wrong kind is an error naming want; for JSONPath its result is
+// nil. It reports false when k does not exist.
+func (db *DB) jsonEach(k, path, want string, fn func(v any) (any, bool)) ([]any, bool, error) {
+	doc, p, locs, err := db.jsonMatches(k, path)
+	if doc == nil || err != nil {
+		return nil, false, err
+	}
+	res := make([]any, len(locs))
+	for i, l := range locs {
+		r, ok := fn(l.val)
+		if !ok && p.legacy {
+			return nil, true, errJSONWrongType(want, l.val)
+		}
+		res[i] = r
+	}
+	return res, true, nil
+}
+
+// JSONArrAppend appends values to the arrays at path and returns their new
+// lengths.
+func (db *DB) JSONArrAppend(k, path string, values []string) ([]any, error) {
+	vals := make([]any, len(values))
+	for i, s := range values {
+		var err error
+		if vals[i], err = parseJSON(s); err != nil {
+			return nil, err
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, ok, err := db.jsonEach(k, path, "an array", func(v any) (any, bool) {
+		arr, ok := v.(*jsonArray)
+		if !ok {
+			return nil, false
+		}
+		for _, e := range vals {
+			arr.vals = append(arr.vals, cloneJSON(e))
+		}
+		return int64(len(arr.vals)), true
+	})
+	if err == nil && !ok {
+		err = ErrJSONNoKey
+	}
+	return res, err
+}
+
+// JSONArrLen returns the length of the arrays at path.
+func (db *DB) JSONArrLen(k, path string) ([]any, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.jsonEach(k, path, "an array", func(v any) (any, bool) {
+		if arr, ok := v.(*jsonArray); ok {
+			return int64(len(arr.vals)), true
+		}
+		return nil, false
+	})
+}
+
+// JSONObjKeys returns the member names of the objects at path.
+func (db *DB) JSONObjKeys(k, path string) ([]any, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.jsonEach(k, path, "an object", func(v any) (any, bool) {
+		if obj, ok := v.(*jsonObject); ok {
+			return append([]string{}, obj.keys...), true
+		}
+		return nil, false
+	})
+}
+
+// JSONTypes returns the JSON type name of the values at path.
+func (db *DB) JSONTypes(k, path string) ([]any, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.jsonEach(k, path, "", func(v any) (any, bool) {
+		return jsonTypeName(v), true
+	})
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"testing"
+)
+
+const jsonDoc = `{"a":1,"b":{"a":2.5,"c":[1,2,3]},"s":"x\"y","n":null,"t":true}`
+
+func TestJSONGet(t *testing.T) {
+	db, _ := New(1).Index(0)
+	if _, err := db.JSONSet("doc", "$", jsonDoc, false, false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		paths []string
+		f     JSONFormat
+		want  string
+	}{
+		{nil, JSONFormat{}, jsonDoc},
+		{[]string{"$.a"}, JSONFormat{}, `[1]`},
+		{[]string{".a"}, JSONFormat{}, `1`},
+		{[]string{"b.c[-1]"}, JSONFormat{}, `3`},
+		{[]string{"$..a"}, JSONFormat{}, `[1,2.5]`},
+		{[]string{"$.b.c[0:2]"}, JSONFormat{}, `[1,2]`},
+		{[]string{"$.b.c[::2]"}, JSONFormat{}, `[1,3]`},
+		{[]string{"$.b.c[1:3:2]"}, JSONFormat{}, `[2]`},
+		{[]string{"$.b.c[-3::5]"}, JSONFormat{}, `[1]`},
+		{[]string{"$.b.*"}, JSONFormat{}, `[2.5,[1,2,3]]`},
+		{[]string{`$["s","t"]`}, JSONFormat{}, `["x\"y",true]`},
+		{[]string{"$.missing"}, JSONFormat{}, `[]`},
+		{[]string{".a", ".n"}, JSONFormat{}, `{".a":1,".n":null}`},
+		{[]string{"$.a", ".t"}, JSONFormat{}, `{"$.a":[1],".t":[true]}`},
+		{[]string{"$.b"}, JSONFormat{Indent: "\t", Newline: "\n", Space: " "}, "[\n\t{\n\t\t\"a\": 2.5,\n\t\t\"c\": [\n\t\t\t1,\n\t\t\t2,\n\t\t\t3\n\t\t]\n\t}\n]"},
+	}
+	for _, tt := range tests {
+		got, ok, err := db.JSONGet("doc", tt.paths, tt.f)
+		if err != nil || !ok {
+			t.Errorf("JSONGet(%q) = %v, %v", tt.paths, ok, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("JSONGet(%q) = %s, want %s", tt.paths, got, tt.want)
+		}
+	}
+
+	if _, _, err := db.JSONGet("doc", []string{".missing"}, JSONFormat{}); err == nil {
+		t.Error("missing legacy path: expected an error")
+	}
+	if _, _, err := db.JSONGet("doc", []string{"$.a..", "$"}, JSONFormat{}); err == nil {
+		t.Error("invalid path: expected an error")
+	}
+	for _, path := range []string{"$.b.c[0:3:0]", "$.b.c[::-1]", "$.b.c[::x]"} {
+		if _, _, err := db.JSONGet("doc", []string{path}, JSONFormat{}); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestJSONUpdate(t *testing.T) {
+	db, _ := New(1).Index(0)
+	if _, err := db.JSONSet("doc", ".a", "1", false, false); err != ErrJSONNewAtRoot {
+		t.Errorf("set below missing root: err = %v", err)
+	}
+	db.JSONSet("doc", "$", jsonDoc, false, false)
+
+	if ok, _ := db.JSONSet("doc", "$.a", "5", true, false); ok {
+		t.Error("NX on an existing path should not set")
+	}
+	if ok, _ := db.JSONSet("doc", "$.z", `{"q":[]}`, false, false); !ok {
+		t.Error("set of a new member failed")
+	}
+	if ok, _ := db.JSONSet("doc", "$.x.y", "1", false, false); ok {
+		t.Error("set below a missing member should not set")
+	}
+
+	if s, err := db.JSONNumIncrBy("doc", "$..a", "2"); err != nil || s != "[3,4.5]" {
+		t.Errorf("NumIncrBy = %s, %v", s, err)
+	}
+	if s, err := db.JSONNumIncrBy("doc", ".a", "9223372036854775807"); err != nil || s != "9.223372036854776e18" {
+		t.Errorf("NumIncrBy overflow = %s, %v", s, err)
+	}
+	if _, err := db.JSONNumIncrBy("doc", ".s", "1"); err == nil {
+		t.Error("NumIncrBy on a string: expected an error")
+	}
+
+	if lens, err := db.JSONArrAppend("doc", "$..[?]", nil); err == nil {
+		t.Errorf("ArrAppend with invalid path = %v", lens)
+	}
+	lens, err := db.JSONArrAppend("doc", "$.*.*", []string{`"v"`})
+	if err != nil || len(lens) != 3 || lens[0] != nil || lens[1] != int64(4) || lens[2] != int64(1) {
+		t.Errorf("ArrAppend = %v, %v", lens, err)
+	}
+
+	if n, _ := db.JSONDel("doc", "$.b.c[0,2]"); n != 2 {
+		t.Errorf("Del indexes = %d", n)
+	}
+	if n, _ := db.JSONDel("doc", "$..q"); n != 1 {
+		t.Errorf("Del recursive = %d", n)
+	}
+	got, _, _ := db.JSONGet("doc", nil, JSONFormat{})
+	if want := `{"a":9.223372036854776e18,"b":{"a":4.5,"c":[2,"v"]},"s":"x\"y","n":null,"t":true,"z":{}}`; got != want {
+		t.Errorf("document = %s, want %s", got, want)
+	}
+
+	types, _, _ := db.JSONTypes("doc", "$.*")
+	want := []string{"number", "object", "string", "null", "boolean", "object"}
+	for i, ty := range types {
+		if ty != want[i] {
+			t.Errorf("type %d = %v, want %s", i, ty, want[i])
+		}
+	}
+
+	if n, _ := db.JSONDel("doc", "$"); n != 1 {
+		t.Errorf("Del root = %d", n)
+	}
+	if _, ok, _ := db.JSONGet("doc", nil, JSONFormat{}); ok {
+		t.Error("key exists after deleting the root")
+	}
+}
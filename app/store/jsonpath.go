@@ -0,0 +1,344 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type jsonSegKind int
+
+const (
+	segKeys jsonSegKind = iota
+	segIndexes
+	segWildcard
+	segSlice
+)
+
+// jsonSeg selects children of a node: named keys, array indexes, every
+// child, or an array slice. With recursive it applies to the node and all of
+// its descendants, as in $..a.
+type jsonSeg struct {
+	kind      jsonSegKind
+	recursive bool
+	keys      []string
+	idxs      []int
+
+	start, end, step int
+	hasStart, hasEnd bool
+}
+
+// jsonPath is a parsed path. Paths starting with $ are JSONPath and may match
+// many values; anything else is a legacy path that refers to a single value.
+type jsonPath struct {
+	text   string
+	legacy bool
+	segs   []jsonSeg
+}
+
+func (p jsonPath) isRoot() bool {
+	return len(p.segs) == 0
+}
+
+// lastKey returns the key a path ends with when its last segment names
+// exactly one object member, which is the only case JSON.SET creates values.
+func (p jsonPath) lastKey() (string, bool) {
+	if len(p.segs) == 0 {
+		return "", false
+	}
+	s := p.segs[len(p.segs)-1]
+	if s.kind != segKeys || s.recursive || len(s.keys) != 1 {
+		return "", false
+	}
+	return s.keys[0], true
+}
+
+func (p jsonPath) parent() jsonPath {
+	p.segs = p.segs[:len(p.segs)-1]
+	return p
+}
+
+func errJSONPath(text string) error {
+	return fmt.Errorf("JSON Path error: invalid path %q", text)
+}
+
+func parseJSONPath(text string) (jsonPath, error) {
+	p := jsonPath{text: text}
+	i := 0
+	switch {
+	case strings.HasPrefix(text, "$"):
+		i = 1
+	case text == ".":
+		p.legacy = true
+		return p, nil
+	default:
+		p.legacy = true
+		if !strings.HasPrefix(text, ".") && !strings.HasPrefix(text, "[") {
+			// legacy paths may omit the leading dot: a.b is .a.b
+			text = "." + text
+		}
+	}
+
+	for i < len(text) {
+		var seg jsonSeg
+		switch {
+		case strings.HasPrefix(text[i:], ".."):
+			seg.recursive = true
+			i += 2
+		case text[i] == '.':
+			i++
+		case text[i] != '[':
+			return p, errJSONPath(p.text)
+		}
+		if i >= len(text) {
+			return p, errJSONPath(p.text)
+		}
+
+		switch text[i] {
+		case '[':
+			end, err := closingBracket(text, i)
+			if err != nil {
+				return p, errJSONPath(p.text)
+			}
+			if err := parseBracket(text[i+1:end], &seg); err != nil {
+				return p, errJSONPath(p.text)
+			}
+			i = end + 1
+		case '*':
+			seg.kind = segWildcard
+			i++
+		default:
+			j := i
+			for j < len(text) && text[j] != '.' && text[j] != '[' {
+				j++
+			}
+			if j == i {
+				return p, errJSONPath(p.text)
+			}
+			seg.kind, seg.keys = segKeys, []string{text[i:j]}
+			i = j
+		}
+		p.segs = append(p.segs, seg)
+	}
+	return p, nil
+}
+
+// closingBracket returns the index of the ] closing the [ at i, skipping
+// quoted names.
+func closingBracket(s string, i int) (int, error) {
+	var quote byte
+	for j := i + 1; j < len(s); j++ {
+		switch c := s[j]; {
+		case quote != 0 && c == '\\':
+			j++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ']':
+			return j, nil
+		}
+	}
+	return 0, errJSONPath(s)
+}
+
+func parseBracket(s string, seg *jsonSeg) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "*":
+		seg.kind = segWildcard
+		return nil
+	case s == "":
+		return errJSONPath(s)
+	case s[0] == '"' || s[0] == '\'':
+		seg.kind = segKeys
+		for _, part := range splitUnion(s) {
+			part = strings.TrimSpace(part)
+			if len(part) < 2 || (part[0] != '"' && part[0] != '\'') || part[len(part)-1] != part[0] {
+				return errJSONPath(s)
+			}
+			name := part[1 : len(part)-1]
+			if part[0] == '"' {
+				var err error
+				if name, err = strconv.Unquote(part); err != nil {
+					return err
+				}
+			} else {
+				name = strings.ReplaceAll(name, `\'`, `'`)
+			}
+			seg.keys = append(seg.keys, name)
+		}
+		return nil
+	case strings.Contains(s, ":"):
+		seg.kind = segSlice
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return errJSONPath(s)
+		}
+		var err error
+		if a := strings.TrimSpace(parts[0]); a != "" {
+			if seg.start, err = strconv.Atoi(a); err != nil {
+				return err
+			}
+			seg.hasStart = true
+		}
+		if b := strings.TrimSpace(parts[1]); b != "" {
+			if seg.end, err = strconv.Atoi(b); err != nil {
+				return err
+			}
+			seg.hasEnd = true
+		}
+		seg.step = 1
+		if len(parts) == 3 {
+			if c := strings.TrimSpace(parts[2]); c != "" {
+				// only forward steps are supported
+				if seg.step, err = strconv.Atoi(c); err != nil || seg.step < 1 {
+					return errJSONPath(s)
+				}
+			}
+		}
+		return nil
+	}
+	seg.kind = segIndexes
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		seg.idxs = append(seg.idxs, n)
+	}
+	return nil
+}
+
+// splitUnion splits a bracket of quoted names on the commas between them.
+func splitUnion(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for j := 0; j < len(s); j++ {
+		switch c := s[j]; {
+		case quote != 0 && c == '\\':
+			j++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:j])
+			start = j + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// jsonLoc is a value matched by a path along with where it lives, so it can
+// be replaced or removed.
+type jsonLoc struct {
+	val    any
+	parent any // *jsonObject, *jsonArray, or nil for the root
+	key    string
+	idx    int
+	steps  []any // the keys and indexes leading to val
+}
+
+func (l jsonLoc) child(parent any, key string, idx int, val any) jsonLoc {
+	var step any = key
+	if _, ok := parent.(*jsonArray); ok {
+		step = idx
+	}
+	return jsonLoc{val: val, parent: parent, key: key, idx: idx, steps: append(slices.Clip(l.steps), step)}
+}
+
+// descendants returns l and every value nested in it, depth first.
+func (l jsonLoc) descendants() []jsonLoc {
+	res := []jsonLoc{l}
+	switch c := l.val.(type) {
+	case *jsonObject:
+		for _, k := range c.keys {
+			res = append(res, l.child(c, k, 0, c.vals[k]).descendants()...)
+		}
+	case *jsonArray:
+		for i, v := range c.vals {
+			res = append(res, l.child(c, "", i, v).descendants()...)
+		}
+	}
+	return res
+}
+
+func (s jsonSeg) selectChildren(l jsonLoc) []jsonLoc {
+	var res []jsonLoc
+	switch c := l.val.(type) {
+	case *jsonObject:
+		switch s.kind {
+		case segWildcard:
+			for _, k := range c.keys {
+				res = append(res, l.child(c, k, 0, c.vals[k]))
+			}
+		case segKeys:
+			for _, k := range s.keys {
+				if v, ok := c.vals[k]; ok {
+					res = append(res, l.child(c, k, 0, v))
+				}
+			}
+		}
+	case *jsonArray:
+		n := len(c.vals)
+		switch s.kind {
+		case segWildcard:
+			for i, v := range c.vals {
+				res = append(res, l.child(c, "", i, v))
+			}
+		case segIndexes:
+			for _, i := range s.idxs {
+				if i < 0 {
+					i += n
+				}
+				if i >= 0 && i < n {
+					res = append(res, l.child(c, "", i, c.vals[i]))
+				}
+			}
+		case segSlice:
+			start, end := 0, n
+			if s.hasStart {
+				start = s.start
+			}
+			if s.hasEnd {
+				end = s.end
+			}
+			if start < 0 {
+				start = max(start+n, 0)
+			}
+			if end < 0 {
+				end = max(end+n, 0)
+			}
+			for i := start; i < min(end, n); i += s.step {
+				res = append(res, l.child(c, "", i, c.vals[i]))
+			}
+		}
+	}
+	return res
+}
+
+// eval returns every value p matches in the document rooted at root.
+func (p jsonPath) eval(root any) []jsonLoc {
+	locs := []jsonLoc{{val: root}}
+	for _, seg := range p.segs {
+		var next []jsonLoc
+		for _, l := range locs {
+			if !seg.recursive {
+				next = append(next, seg.selectChildren(l)...)
+				continue
+			}
+			for _, d := range l.descendants() {
+				next = append(next, seg.selectChildren(d)...)
+			}
+		}
+		locs = next
+	}
+	return locs
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"time"
+)
+
+// ExpireFlag holds the conditions of an EXPIRE call. They combine, as in
+// XX GT.
+type ExpireFlag int
+
+const (
+	ExpireAlways ExpireFlag = 0
+	ExpireNX     ExpireFlag = 1 << iota
+	ExpireXX
+	ExpireGT
+	ExpireLT
+)
+
+// lookup returns the live value stored at k. It must be called with db.mu held.
+func (db *DB) lookup(k string) (*Val, bool) {
+	v, ok := db.store[k]
+	if !ok || v.expired(time.Now()) {
+		return nil, false
+	}
+	return v, true
+}
+
+func (db *DB) remove(k string) (*Val, bool) {
+	v, ok := db.lookup(k)
+	if _, ok := db.store[k]; ok {
+		db.index.remove(k)
+	}
+	delete(db.store, k)
+	delete(db.expires, k)
+	delete(db.streamDetails, k)
+	return v, ok
+}
+
+func (db *DB) Del(keys ...string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int
+	for _, k := range keys {
+		if _, ok := db.remove(k); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (db *DB) Exists(keys ...string) int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var n int
+	for _, k := range keys {
+		if _, ok := db.lookup(k); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Expire sets the expiry of k to at, if every condition in flag holds. A key
+// without an expiry counts as expiring never. A time in the past
+// deletes the key. It reports whether the key was updated.
+func (db *DB) Expire(k string, at time.Time, flag ExpireFlag) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	v, ok := db.lookup(k)
+	if !ok {
+		return false
+	}
+
+	if flag&ExpireNX != 0 && v.canExpire {
+		return false
+	}
+	if flag&ExpireXX != 0 && !v.canExpire {
+		return false
+	}
+	if flag&ExpireGT != 0 && (!v.canExpire || !at.After(v.ex)) {
+		return false
+	}
+	if flag&ExpireLT != 0 && v.canExpire && !at.Before(v.ex) {
+		return false
+	}
+
+	if !at.After(time.Now()) {
+		db.remove(k)
+		return true
+	}
+	v.ex = at
+	v.canExpire = true
+	db.expires[k] = struct{}{}
+	return true
+}
+
+// Expiry returns the expiry of k. ok is false when the key does not exist and
+// canExpire is false when the key has no associated expiry.
+func (db *DB) Expiry(k string) (ex time.Time, ok bool, canExpire bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.lookup(k)
+	if !ok {
+		return time.Time{}, false, false
+	}
+	return v.ex, true, v.canExpire
+}
+
+func (db *DB) Persist(k string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	v, ok := db.lookup(k)
+	if !ok || !v.canExpire {
+		return false
+	}
+	v.ex = time.Time{}
+	v.canExpire = false
+	delete(db.expires, k)
+	return true
+}
@@ -0,0 +1,564 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+)
+
+var (
+	ErrSaveInProgress = errors.New("Background save already in progress")
+	ErrBusyKey        = errors.New("BUSYKEY Target key name already exists.")
+	ErrBadDumpData    = errors.New("Bad data format")
+)
+
+// bgsaveRetryDelay is how long save points wait after a failed save before
+// trying again.
+const bgsaveRetryDelay = 5 * time.Second
+
+// jsonEncVer is the module encoding version of JSON documents: the
+// serialized text, as RedisJSON stores it.
+const jsonEncVer = 3
+
+// persistence tracks snapshots. dirty counts the writes since the last
+// successful save.
+type persistence struct {
+	dirty    atomic.Int64
+	saving   atomic.Bool
+	lastSave atomic.Int64
+	lastTry  atomic.Int64
+	lastOK   atomic.Bool
+}
+
+// SaveStats holds the fields of the persistence section of INFO.
+type SaveStats struct {
+	Changes    int64
+	InProgress bool
+	LastSave   time.Time
+	LastOK     bool
+}
+
+func (s *Store) SaveStats() SaveStats {
+	return SaveStats{
+		Changes:    s.persist.dirty.Load(),
+		InProgress: s.persist.saving.Load(),
+		LastSave:   time.Unix(s.persist.lastSave.Load(), 0),
+		LastOK:     s.persist.lastOK.Load(),
+	}
+}
+
+// LastSave returns when the dataset was last saved successfully, or when the
+// store was created.
+func (s *Store) LastSave() time.Time {
+	return time.Unix(s.persist.lastSave.Load(), 0)
+}
+
+// ResetDirty forgets the writes made while loading the dataset from disk.
+func (s *Store) ResetDirty() {
+	s.persist.dirty.Store(0)
+}
+
+// WriteRDB writes a snapshot of every database. The databases are copied
+// together under the gate, so the snapshot is one point in time, and
+// encoded once it is released, so commands only wait for the copy.
+func (s *Store) WriteRDB(w *bufio.Writer) error {
+	dbs, err := s.copyDBsGated()
+	if err != nil {
+		return err
+	}
+	return writeRDB(w, dbs, false)
+}
+
+// WriteAOFBase writes a snapshot marked as the preamble of an AOF base.
+func (s *Store) WriteAOFBase(w *bufio.Writer) error {
+	dbs, err := s.copyDBsGated()
+	if err != nil {
+		return err
+	}
+	return writeRDB(w, dbs, true)
+}
+
+func (s *Store) copyDBsGated() ([]*DB, error) {
+	s.gate.Lock()
+	defer s.gate.Unlock()
+	return s.copyDBs()
+}
+
+// copyDBs copies every database for encoding. It must be called with the
+// gate held exclusively.
+func (s *Store) copyDBs() ([]*DB, error) {
+	dbs := make([]*DB, len(s.dbs))
+	for i, db := range s.dbs {
+		c, err := db.copy()
+		if err != nil {
+			return nil, err
+		}
+		dbs[i] = c
+	}
+	return dbs, nil
+}
+
+// copy returns the live keys of db with their values cloned, so they can
+// be encoded while db changes.
+func (db *DB) copy() (*DB, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	c := &DB{id: db.id, store: make(map[string]*Val, len(db.store))}
+	for k, v := range db.store {
+		if v.expired(now) {
+			continue
+		}
+		tv, err := cloneValue(v.val)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k, err)
+		}
+		c.store[k] = &Val{val: tv, ex: v.ex, canExpire: v.canExpire}
+	}
+	return c, nil
+}
+
+func writeRDB(w *bufio.Writer, dbs []*DB, aofBase bool) error {
+	e := pkg.NewRDBWriter(w)
+	e.Header()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	e.Aux("redis-ver", "7.2.0")
+	e.Aux("redis-bits", "64")
+	e.Aux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	e.Aux("used-mem", strconv.FormatUint(mem.HeapAlloc, 10))
+	base := "0"
+	if aofBase {
+		base = "1"
+	}
+	e.Aux("aof-base", base)
+
+	for _, db := range dbs {
+		b, err := db.encodeRDB()
+		if err != nil {
+			return err
+		}
+		e.Write(b)
+	}
+	if err := e.End(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (db *DB) encodeRDB() ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	var keys, expires int
+	for _, v := range db.store {
+		if !v.expired(now) {
+			keys++
+			if v.canExpire {
+				expires++
+			}
+		}
+	}
+	if keys == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	e := pkg.NewRDBWriter(&buf)
+	e.SelectDB(db.id)
+	e.ResizeDB(keys, expires)
+	for k, v := range db.store {
+		if v.expired(now) {
+			continue
+		}
+		if v.canExpire {
+			e.ExpireAt(v.ex)
+		}
+		if err := writeValue(e, k, v.val); err != nil {
+			return nil, fmt.Errorf("key %q: %w", k, err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// marshaled is a value of a module type already encoded by MarshalBinary.
+type marshaled []byte
+
+func (m marshaled) MarshalBinary() ([]byte, error) {
+	return m, nil
+}
+
+// cloneValue copies what encodeValue reads from v, sharing only what never
+// changes in place.
+func cloneValue(v *TypedValue) (*TypedValue, error) {
+	var c any
+	switch x := v.Val.(type) {
+	case int64, string:
+		c = x
+	case []byte:
+		c = bytes.Clone(x)
+	case Hash:
+		c = Hash{fields: maps.Clone(x.fields)}
+	case List:
+		c = slices.Clone(x)
+	case Set:
+		c = Set{members: maps.Clone(x.members)}
+	case *ZSet:
+		c = &ZSet{entries: slices.Clone(x.entries)}
+	case *Stream:
+		c = &Stream{Entries: slices.Clone(x.Entries)}
+	case *JSON:
+		c = &JSON{root: jsonClone(x.root)}
+	case encoding.BinaryMarshaler:
+		b, err := x.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		c = marshaled(b)
+	default:
+		return nil, fmt.Errorf("cannot save values of type %s", v.Type)
+	}
+	return &TypedValue{Type: v.Type, Val: c}, nil
+}
+
+func writeValue(e *pkg.RDBWriter, k string, v *TypedValue) error {
+	return encodeValue(e, v, func(t byte) { e.Key(t, k) })
+}
+
+// encodeValue writes v, calling start with its value type before the value
+// itself.
+func encodeValue(e *pkg.RDBWriter, v *TypedValue, start func(t byte)) error {
+	switch c := v.Val.(type) {
+	case int64:
+		start(pkg.RDBTypeString)
+		e.String(strconv.FormatInt(c, 10))
+	case string:
+		start(pkg.RDBTypeString)
+		e.String(c)
+	case []byte:
+		start(pkg.RDBTypeString)
+		e.Bytes(c)
+	case Hash:
+		start(pkg.RDBTypeHash)
+		e.Length(uint64(len(c.fields)))
+		for f, fv := range c.fields {
+			e.String(f)
+			e.String(fv)
+		}
+	case List:
+		start(pkg.RDBTypeList)
+		e.Length(uint64(len(c)))
+		for _, m := range c {
+			e.String(m)
+		}
+	case Set:
+		start(pkg.RDBTypeSet)
+		e.Length(uint64(len(c.members)))
+		for m := range c.members {
+			e.String(m)
+		}
+	case *ZSet:
+		start(pkg.RDBTypeZSet2)
+		e.Length(uint64(c.Len()))
+		for _, en := range c.entries {
+			e.String(en.Member)
+			e.Double(en.Score)
+		}
+	case *Stream:
+		entries := make([]pkg.RDBStreamEntry, len(c.Entries))
+		for i, en := range c.Entries {
+			ms, seq, _ := strings.Cut(en.ID, "-")
+			entries[i].MS, _ = strconv.ParseUint(ms, 10, 64)
+			entries[i].Seq, _ = strconv.ParseUint(seq, 10, 64)
+			entries[i].Fields = pkg.SortedFields(en.Values)
+		}
+		start(pkg.RDBTypeStreamListpacks)
+		e.Stream(entries)
+	case *JSON:
+		start(pkg.RDBTypeModule2)
+		e.Module(JSONType, jsonEncVer, []byte(JSONFormat{}.String(c.root)))
+	case encoding.BinaryMarshaler:
+		b, err := c.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		start(pkg.RDBTypeModule2)
+		e.Module(v.Type, 0, b)
+	default:
+		return fmt.Errorf("cannot save values of type %s", v.Type)
+	}
+	return nil
+}
+
+// loadValue builds the value of a key read from a dump.
+func loadValue(v pkg.RDBStoreValue) (*TypedValue, error) {
+	switch v.Kind {
+	case pkg.RDBString:
+		return newString(v.Val.(string)), nil
+	case pkg.RDBList:
+		return &TypedValue{Type: "list", Val: List(v.Val.([]string))}, nil
+	case pkg.RDBSet:
+		return &TypedValue{Type: "set", Val: newSet(v.Val.(map[string]struct{}))}, nil
+	case pkg.RDBHash:
+		return &TypedValue{Type: "hash", Val: newHash(v.Val.(map[string]string))}, nil
+	case pkg.RDBZSet:
+		z := NewZSet()
+		for _, e := range v.Val.([]pkg.RDBZEntry) {
+			z.Add(e.Member, e.Score)
+		}
+		return &TypedValue{Type: "zset", Val: z}, nil
+	case pkg.RDBStream:
+		entries := v.Val.([]pkg.RDBStreamEntry)
+		st := &Stream{Entries: make([]StreamEntry, len(entries))}
+		for i, e := range entries {
+			values := make(map[string]string, len(e.Fields)/2)
+			for j := 0; j+1 < len(e.Fields); j += 2 {
+				values[e.Fields[j]] = e.Fields[j+1]
+			}
+			st.Entries[i] = StreamEntry{ID: fmt.Sprintf("%d-%d", e.MS, e.Seq), Values: values}
+		}
+		return &TypedValue{Type: "stream", Val: st}, nil
+	case pkg.RDBModule:
+		return loadModule(v.Val.(pkg.RDBModuleValue))
+	}
+	return nil, fmt.Errorf("unknown value kind %d", v.Kind)
+}
+
+// loadModule decodes a module value saved by writeValue, whose only field
+// is its serialized form.
+func loadModule(m pkg.RDBModuleValue) (*TypedValue, error) {
+	var payload string
+	if len(m.Fields) == 1 {
+		payload, _ = m.Fields[0].(string)
+	}
+	if len(m.Fields) != 1 || payload == "" {
+		return nil, fmt.Errorf("unsupported encoding %d of module type %s", m.EncVer, m.Name)
+	}
+
+	var v encoding.BinaryUnmarshaler
+	switch {
+	case m.Name == JSONType && m.EncVer == jsonEncVer:
+		root, err := parseJSON(payload)
+		if err != nil {
+			return nil, err
+		}
+		return &TypedValue{Type: JSONType, Val: &JSON{root: root}}, nil
+	case m.Name == BloomType && m.EncVer == 0:
+		v = &Bloom{}
+	case m.Name == CuckooType && m.EncVer == 0:
+		v = &Cuckoo{}
+	case m.Name == TimeSeriesType && m.EncVer == 0:
+		v = &TimeSeries{}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %d of module type %s", m.EncVer, m.Name)
+	}
+	if err := v.UnmarshalBinary([]byte(payload)); err != nil {
+		return nil, err
+	}
+	return &TypedValue{Type: m.Name, Val: v}, nil
+}
+
+// Exec runs a command, which snapshots wait for.
+func (s *Store) Exec(fn func()) {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+	fn()
+}
+
+// Snapshot copies every database and calls at before any other command
+// runs, so at can start following the propagated writes from exactly that
+// point. The copy is then encoded as a dump, which is passed to fn, while
+// commands go on. at may be nil.
+func (s *Store) Snapshot(at func(), fn func(rdb []byte)) error {
+	s.gate.Lock()
+	dbs, err := s.copyDBs()
+	if err == nil && at != nil {
+		at()
+	}
+	s.gate.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := writeRDB(bufio.NewWriter(&buf), dbs, false); err != nil {
+		return err
+	}
+	fn(buf.Bytes())
+	return nil
+}
+
+// Replace flushes every database and loads the dump b in their place, as a
+// replica does with its master's snapshot. A dump that does not parse
+// leaves the databases alone.
+func (s *Store) Replace(b []byte) error {
+	d, _, err := pkg.ParseRDBPrefix(b)
+	if err != nil {
+		return err
+	}
+	s.gate.Lock()
+	defer s.gate.Unlock()
+	s.FlushAll()
+	if err := s.load(d); err != nil {
+		return err
+	}
+	s.ResetDirty()
+	return nil
+}
+
+// ReplaceFrom loads a dump as it is read from r into fresh databases, and
+// swaps them in once it has loaded completely, so a failed transfer leaves
+// the databases alone.
+func (s *Store) ReplaceFrom(r io.Reader) error {
+	fresh := New(len(s.dbs))
+	now := time.Now()
+	err := pkg.ReadRDBStream(r, func(idx int, k string, v pkg.RDBStoreValue) error {
+		return fresh.loadKey(idx, k, v, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.gate.Lock()
+	defer s.gate.Unlock()
+	for i, db := range s.dbs {
+		src := fresh.dbs[i]
+		db.mu.Lock()
+		db.store, db.expires, db.streamDetails = src.store, src.expires, src.streamDetails
+		db.index = src.index
+		db.mu.Unlock()
+	}
+	s.ResetDirty()
+	return nil
+}
+
+// Empty reports whether every database is empty.
+func (s *Store) Empty() bool {
+	for _, db := range s.dbs {
+		if db.Size() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Dump serializes the value at k in the format RESTORE takes.
+func (db *DB) Dump(k string) ([]byte, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, false, nil
+	}
+	var err error
+	b := pkg.Dump(func(e *pkg.RDBWriter) {
+		err = encodeValue(e, v.val, e.Type)
+	})
+	return b, true, err
+}
+
+// Restore stores a value serialized by Dump at k, expiring at ex unless ex
+// is zero. A value that has already expired is not stored, and replacing
+// an existing key with it deletes the key. It reports whether k was stored.
+func (db *DB) Restore(k string, payload []byte, ex time.Time, replace bool) (bool, error) {
+	rv, err := pkg.ParseDump(payload)
+	if errors.Is(err, pkg.ErrRDBCorrupt) {
+		return false, ErrBadDumpData
+	}
+	if err != nil {
+		return false, err
+	}
+	tv, err := loadValue(rv)
+	if err != nil {
+		return false, ErrBadDumpData
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.lookup(k); ok && !replace {
+		return false, ErrBusyKey
+	}
+	db.remove(k)
+	if !ex.IsZero() && !ex.After(time.Now()) {
+		return false, nil
+	}
+	db.set(k, &Val{val: tv, ex: ex, canExpire: !ex.IsZero()})
+	return true, nil
+}
+
+// Save writes a snapshot to path. It is written to a temporary file in the
+// same directory and renamed over path, so path always holds a complete
+// dump.
+func (s *Store) Save(path string) error {
+	if !s.persist.saving.CompareAndSwap(false, true) {
+		return ErrSaveInProgress
+	}
+	defer s.persist.saving.Store(false)
+	return s.save(path)
+}
+
+// BGSave starts saving a snapshot to path in the background.
+func (s *Store) BGSave(path string) error {
+	if !s.persist.saving.CompareAndSwap(false, true) {
+		return ErrSaveInProgress
+	}
+	go func() {
+		defer s.persist.saving.Store(false)
+		if err := s.save(path); err != nil {
+			fmt.Println("background save: ", err.Error())
+			return
+		}
+		fmt.Println("Background saving terminated with success")
+	}()
+	return nil
+}
+
+func (s *Store) save(path string) error {
+	dirty := s.persist.dirty.Load()
+	s.persist.lastTry.Store(time.Now().Unix())
+	err := pkg.WriteFileAtomic(path, s.WriteRDB)
+	s.persist.lastOK.Store(err == nil)
+	if err != nil {
+		return err
+	}
+	s.persist.dirty.Add(-dirty)
+	s.persist.lastSave.Store(time.Now().Unix())
+	return nil
+}
+
+// StartSavePoints saves to path in the background whenever one of points is
+// reached. After a failed save it waits before trying again.
+func (s *Store) StartSavePoints(path string, points []pkg.SavePoint) {
+	if len(points) == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Second) {
+			now := time.Now().Unix()
+			if !s.persist.lastOK.Load() && now-s.persist.lastTry.Load() < int64(bgsaveRetryDelay/time.Second) {
+				continue
+			}
+			dirty := s.persist.dirty.Load()
+			for _, p := range points {
+				if dirty >= p.Changes && dirty > 0 && now-s.persist.lastSave.Load() >= p.Seconds {
+					s.BGSave(path)
+					break
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,434 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/pkg"
+)
+
+func TestWriteRDB(t *testing.T) {
+	ex := time.UnixMilli(0x20000000000)
+	zset := NewZSet()
+	zset.Add("m", 1.5)
+	listpack := []byte{
+		0x1d, 0, 0, 0, 10, 0,
+		1, 1, 0, 1, 1, 1, 0x81, 'f', 2, 0, 1,
+		2, 1, 0, 1, 0, 1, 0x81, 'v', 2, 4, 1,
+		0xff,
+	}
+	tests := []struct {
+		name string
+		val  *Val
+		want []byte
+	}{
+		{"int", &Val{val: &TypedValue{Type: "string", Val: int64(7)}},
+			[]byte{0, 1, 'k', 0xc0, 7}},
+		{"int16", &Val{val: &TypedValue{Type: "string", Val: "300"}},
+			[]byte{0, 1, 'k', 0xc1, 0x2c, 0x01}},
+		{"int32", &Val{val: &TypedValue{Type: "string", Val: "70000"}},
+			[]byte{0, 1, 'k', 0xc2, 0x70, 0x11, 0x01, 0x00}},
+		{"leading zero", &Val{val: &TypedValue{Type: "string", Val: "007"}},
+			[]byte{0, 1, 'k', 3, '0', '0', '7'}},
+		{"bytes", &Val{val: &TypedValue{Type: "string", Val: []byte("12")}},
+			[]byte{0, 1, 'k', 2, '1', '2'}},
+		{"expiry", &Val{val: &TypedValue{Type: "string", Val: "v"}, ex: ex, canExpire: true},
+			[]byte{0xfc, 0, 0, 0, 0, 0, 2, 0, 0, 0, 1, 'k', 1, 'v'}},
+		{"hash", &Val{val: &TypedValue{Type: "hash", Val: newHash(map[string]string{"f": "v"})}},
+			[]byte{4, 1, 'k', 1, 1, 'f', 1, 'v'}},
+		{"set", &Val{val: &TypedValue{Type: "set", Val: newSet(map[string]struct{}{"a": {}})}},
+			[]byte{2, 1, 'k', 1, 1, 'a'}},
+		{"zset", &Val{val: &TypedValue{Type: "zset", Val: zset}},
+			[]byte{5, 1, 'k', 1, 1, 'm', 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"stream", &Val{val: &TypedValue{Type: "stream", Val: &Stream{Entries: []StreamEntry{{ID: "1-1", Values: map[string]string{"f": "v"}}}}}},
+			append(append([]byte{15, 1, 'k', 1, 16, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 29}, listpack...), 1, 1, 1, 0)},
+	}
+	for _, tt := range tests {
+		s := New(1)
+		db, _ := s.Index(0)
+		db.set("k", tt.val)
+
+		var buf bytes.Buffer
+		if err := s.WriteRDB(bufio.NewWriter(&buf)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b := buf.Bytes()
+		if !bytes.HasPrefix(b, []byte("REDIS0011")) {
+			t.Errorf("%s: header %q", tt.name, b[:9])
+		}
+		body, sum := b[:len(b)-8], binary.LittleEndian.Uint64(b[len(b)-8:])
+		if crc := pkg.CRC64(0, body); crc != sum {
+			t.Errorf("%s: checksum %x, want %x", tt.name, sum, crc)
+		}
+		expires := byte(0)
+		if tt.val.canExpire {
+			expires = 1
+		}
+		want := append([]byte{0xfe, 0, 0xfb, 1, expires}, tt.want...)
+		want = append(want, 0xff)
+		if !bytes.HasSuffix(body, want) {
+			t.Errorf("%s: got % x, want suffix % x", tt.name, body, want)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.rdb")
+	s := New(2)
+	db, _ := s.Index(1)
+	db.set("k", &Val{val: &TypedValue{Type: "string", Val: "v"}})
+	db.set("gone", &Val{val: &TypedValue{Type: "string", Val: "v"}, ex: time.Now().Add(-time.Second), canExpire: true})
+	s.Propagate(1, "SET", "k", "v")
+
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte{0xfe, 1, 0xfb, 1, 0, 0, 1, 'k', 1, 'v', 0xff}) {
+		t.Errorf("dump % x", b)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files left in dir", len(entries))
+	}
+	if st := s.SaveStats(); st.Changes != 0 || !st.LastOK || st.InProgress {
+		t.Errorf("stats after save: %+v", st)
+	}
+
+	if err := s.Save(filepath.Join(dir, "missing", "dump.rdb")); err == nil {
+		t.Error("save into a missing dir succeeded")
+	}
+	if s.SaveStats().LastOK {
+		t.Error("failed save reported ok")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	s := New(2)
+	db, _ := s.Index(0)
+	zset := NewZSet()
+	zset.Add("a", 1)
+	zset.Add("b", -2.5)
+	db.set("int", &Val{val: newString("42")})
+	db.set("str", &Val{val: newString("hello")})
+	db.set("bytes", &Val{val: &TypedValue{Type: "string", Val: []byte{0, 1}}})
+	db.set("ttl", &Val{val: newString("v"), ex: time.Now().Add(time.Hour).Truncate(time.Millisecond), canExpire: true})
+	db.set("list", &Val{val: &TypedValue{Type: "list", Val: List{"a", "1", "a"}}})
+	db.set("hash", &Val{val: &TypedValue{Type: "hash", Val: newHash(map[string]string{"f": "v", "n": "2"})}})
+	db.set("set", &Val{val: &TypedValue{Type: "set", Val: newSet(map[string]struct{}{"x": {}, "7": {}})}})
+	db.set("zset", &Val{val: &TypedValue{Type: "zset", Val: zset}})
+	db.SetStream("stream", "1-1", map[string]string{"f": "v"}, 0)
+	db.SetStream("stream", "2-0", map[string]string{"g": "w", "h": "x"}, 0)
+	db.JSONSet("json", "$", `{"a":[1,2.5,"s",null,true]}`, false, false)
+	db.BFAdd("bloom", []string{"a", "b"})
+	db.CFAdd("cuckoo", "a", false)
+	db.TSAdd("ts", Sample{TS: 10, Val: 1.5}, TSOpts{Labels: []Label{{Name: "l", Value: "v"}}}, "")
+	db1, _ := s.Index(1)
+	db1.set("other", &Val{val: newString("db1")})
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a key that expires while the dump sits on disk is not loaded
+	b, _ := os.ReadFile(path)
+	var buf bytes.Buffer
+	e := pkg.NewRDBWriter(&buf)
+	e.Write(b[:len(b)-9])
+	e.ExpireAt(time.Now().Add(-time.Second))
+	e.Key(pkg.RDBTypeString, "expired")
+	e.String("v")
+	e.End()
+	os.WriteFile(path, buf.Bytes(), 0o644)
+
+	l := New(2)
+	if err := l.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		want, _ := s.Index(i)
+		got, _ := l.Index(i)
+		if len(got.store) != len(want.store) {
+			t.Errorf("db%d: %d keys, want %d", i, len(got.store), len(want.store))
+		}
+		for k, wv := range want.store {
+			gv, ok := got.store[k]
+			if !ok {
+				t.Errorf("%s: not loaded", k)
+				continue
+			}
+			if gv.val.Type != wv.val.Type || gv.canExpire != wv.canExpire || wv.canExpire && !gv.ex.Equal(wv.ex) {
+				t.Errorf("%s: got %s %v, want %s %v", k, gv.val.Type, gv.ex, wv.val.Type, wv.ex)
+			}
+			switch w := wv.val.Val.(type) {
+			case []byte:
+				if g, _ := gv.val.AsString(); g != string(w) {
+					t.Errorf("%s: got %q", k, g)
+				}
+			case *JSON:
+				var f JSONFormat
+				if g := f.String(gv.val.Val.(*JSON).root); g != f.String(w.root) {
+					t.Errorf("%s: got %s", k, g)
+				}
+			case encoding.BinaryMarshaler:
+				wb, _ := w.MarshalBinary()
+				gb, _ := gv.val.Val.(encoding.BinaryMarshaler).MarshalBinary()
+				if !bytes.Equal(gb, wb) {
+					t.Errorf("%s: got %x, want %x", k, gb, wb)
+				}
+			default:
+				if !reflect.DeepEqual(gv.val.Val, wv.val.Val) {
+					t.Errorf("%s: got %v, want %v", k, gv.val.Val, wv.val.Val)
+				}
+			}
+		}
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	s := New(1)
+	db, _ := s.Index(0)
+	z := NewZSet()
+	z.Add("a", 1.5)
+	db.set("z", &Val{val: &TypedValue{Type: "zset", Val: z}})
+	db.set("s", &Val{val: &TypedValue{Type: "string", Val: "v"}})
+
+	payload, ok, err := db.Dump("z")
+	if err != nil || !ok {
+		t.Fatalf("dump: %v %v", ok, err)
+	}
+	if _, ok, _ := db.Dump("missing"); ok {
+		t.Error("dumped a missing key")
+	}
+
+	if _, err := db.Restore("s", payload, time.Time{}, false); !errors.Is(err, ErrBusyKey) {
+		t.Errorf("restore over existing key: %v", err)
+	}
+	if ok, err := db.Restore("s", payload, time.Time{}, true); !ok || err != nil {
+		t.Fatalf("restore replace: %v %v", ok, err)
+	}
+	v, _ := db.Get("s")
+	if got, ok := v.Val.(*ZSet); v.Type != "zset" || !ok || got.Len() != 1 {
+		t.Errorf("restored %+v", v)
+	}
+
+	if ok, err := db.Restore("old", payload, time.Now().Add(-time.Second), false); ok || err != nil {
+		t.Errorf("restore expired: %v %v", ok, err)
+	}
+	if _, ok := db.Get("old"); ok {
+		t.Error("expired value stored")
+	}
+
+	bad := slices.Clone(payload)
+	bad[len(bad)-1] ^= 0xff
+	if _, err := db.Restore("x", bad, time.Time{}, false); !errors.Is(err, pkg.ErrDumpPayload) {
+		t.Errorf("bad checksum: %v", err)
+	}
+}
+
+func TestSnapshotCopy(t *testing.T) {
+	s := New(1)
+	db, _ := s.Index(0)
+	h := newHash(map[string]string{"f": "v"})
+	db.set("hash", &Val{val: &TypedValue{Type: "hash", Val: h}})
+	db.SetStream("stream", "1-1", map[string]string{"f": "v"}, 0)
+	db.GeoAdd("geo", []GeoPoint{{Member: "a", Lon: 13.36, Lat: 38.11}}, GeoAddOpts{})
+	db.JSONSet("json", "$", `{"a":[1]}`, false, false)
+	db.BFAdd("bloom", []string{"a"})
+	db.SetBit("bits", 1, 1)
+
+	c, err := db.copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := func() map[string]string {
+		m := make(map[string]string)
+		for k, v := range c.store {
+			m[k] = string(pkg.Dump(func(e *pkg.RDBWriter) { encodeValue(e, v.val, e.Type) }))
+		}
+		return m
+	}
+	before := dump()
+	// writes after the copy do not reach it
+	h.fields["g"] = "w"
+	db.SetStream("stream", "2-1", map[string]string{"f": "v"}, 0)
+	db.GeoAdd("geo", []GeoPoint{{Member: "b", Lon: 13.36, Lat: 38.11}}, GeoAddOpts{})
+	db.JSONSet("json", "$.a[0]", "2", false, false)
+	db.BFAdd("bloom", []string{"b"})
+	db.SetBit("bits", 100, 1)
+	for k, v := range dump() {
+		if v != before[k] {
+			t.Errorf("copy of %s changed with the database", k)
+		}
+	}
+
+	// the dump is encoded once commands can run again
+	err = s.Snapshot(nil, func([]byte) {
+		done := make(chan struct{})
+		go s.Exec(func() { close(done) })
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("commands wait for the encoding")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteRDBPointInTime(t *testing.T) {
+	s := New(2)
+	db0, _ := s.Index(0)
+	db1, _ := s.Index(1)
+	db0.SetString("k", "v", SetOpts{})
+
+	// a save started while a command moves k between databases
+	var buf bytes.Buffer
+	done := make(chan error)
+	s.Exec(func() {
+		go func() {
+			w := bufio.NewWriter(&buf)
+			done <- s.WriteRDB(w)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		db0.Del("k")
+		time.Sleep(10 * time.Millisecond)
+		db1.SetString("k", "v", SetOpts{})
+	})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(2)
+	if _, err := r.LoadRDB(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	r0, _ := r.Index(0)
+	r1, _ := r.Index(1)
+	if r0.Size() != 0 || r1.Size() != 1 {
+		t.Errorf("saved %d keys in db 0 and %d in db 1", r0.Size(), r1.Size())
+	}
+}
+
+func TestSnapshotReplace(t *testing.T) {
+	s := New(2)
+	db, _ := s.Index(1)
+	db.set("k", &Val{val: &TypedValue{Type: "string", Val: "v"}})
+
+	var rdb []byte
+	if err := s.Snapshot(nil, func(b []byte) { rdb = b }); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(2)
+	db0, _ := r.Index(0)
+	db0.set("old", &Val{val: &TypedValue{Type: "string", Val: "v"}})
+	if err := r.Replace([]byte("REDIS0011garbage")); err == nil {
+		t.Error("replaced with a corrupt dump")
+	}
+	if db0.Size() != 1 {
+		t.Error("corrupt dump flushed the databases")
+	}
+	if err := r.Replace(rdb); err != nil {
+		t.Fatal(err)
+	}
+	db1, _ := r.Index(1)
+	if v, _, _ := db1.GetString("k"); v != "v" || db0.Size() != 0 {
+		t.Errorf("after replace: k=%q, %d keys in db 0", v, db0.Size())
+	}
+	if _, keys := db1.Scan(ScanOpts{}); len(keys) != 1 || keys[0] != "k" {
+		t.Errorf("scan after replace: %q", keys)
+	}
+}
+
+func TestReplaceFrom(t *testing.T) {
+	s := New(2)
+	db, _ := s.Index(1)
+	db.set("k", &Val{val: &TypedValue{Type: "string", Val: "v"}})
+	var rdb []byte
+	if err := s.Snapshot(nil, func(b []byte) { rdb = b }); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(2)
+	db0, _ := r.Index(0)
+	db0.set("old", &Val{val: &TypedValue{Type: "string", Val: "v"}})
+	if r.Empty() {
+		t.Error("empty with a key")
+	}
+	if err := r.ReplaceFrom(bytes.NewReader(rdb[:len(rdb)-1])); err == nil {
+		t.Error("replaced from a truncated dump")
+	}
+	if db0.Size() != 1 {
+		t.Error("failed transfer flushed the databases")
+	}
+	if err := r.ReplaceFrom(bytes.NewReader(rdb)); err != nil {
+		t.Fatal(err)
+	}
+	db1, _ := r.Index(1)
+	if v, _, _ := db1.GetString("k"); v != "v" || db0.Size() != 0 {
+		t.Errorf("after replace: k=%q, %d keys in db 0", v, db0.Size())
+	}
+	if _, keys := db1.Scan(ScanOpts{}); len(keys) != 1 || keys[0] != "k" {
+		t.Errorf("scan after replace: %q", keys)
+	}
+}
+
+func TestLoadedStreamXAdd(t *testing.T) {
+	s := New(1)
+	db, _ := s.Index(0)
+	db.SetStream("s", "1-1", map[string]string{"f": "v"}, 0)
+	var rdb []byte
+	if err := s.Snapshot(nil, func(b []byte) { rdb = b }); err != nil {
+		t.Fatal(err)
+	}
+	payload, _, err := db.Dump("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		load func(s *Store) error
+	}{
+		{name: "rdb", load: func(s *Store) error {
+			_, err := s.LoadRDB(rdb)
+			return err
+		}},
+		{name: "replace", load: func(s *Store) error { return s.Replace(rdb) }},
+		{name: "replace from", load: func(s *Store) error { return s.ReplaceFrom(bytes.NewReader(rdb)) }},
+		{name: "restore", load: func(s *Store) error {
+			db, _ := s.Index(0)
+			_, err := db.Restore("s", payload, time.Time{}, false)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(1)
+			if err := tt.load(l); err != nil {
+				t.Fatal(err)
+			}
+			db, _ := l.Index(0)
+			if _, err := db.SetStream("s", "2-0", map[string]string{"g": "w"}, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := db.RangeStream("s", "0-0", "9-9"); len(got) != 2 {
+				t.Errorf("got %d entries", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"cmp"
+	"hash/maphash"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/utils"
+)
+
+// scanSeed is fixed for the life of the process so cursors stay valid across
+// calls.
+var scanSeed = maphash.MakeSeed()
+
+type ScanOpts struct {
+	Cursor uint64
+	Count  int
+	Match  string
+	Type   string
+}
+
+func (o ScanOpts) match(k string) bool {
+	return o.Match == "" || utils.GlobMatch(o.Match, k, false)
+}
+
+// scanEntry is a key and its scan hash.
+type scanEntry struct {
+	h uint64
+	k string
+}
+
+func compareScanEntry(a, b scanEntry) int {
+	if c := cmp.Compare(a.h, b.h); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.k, b.k)
+}
+
+// hashIndex keeps keys ordered by their scan hash, so scan can resume at a
+// cursor without walking every key.
+type hashIndex []scanEntry
+
+func indexKeys[V any](m map[string]V) hashIndex {
+	idx := make(hashIndex, 0, len(m))
+	for k := range m {
+		idx = append(idx, scanEntry{maphash.String(scanSeed, k), k})
+	}
+	slices.SortFunc(idx, compareScanEntry)
+	return idx
+}
+
+// add inserts k unless it is already indexed.
+func (idx *hashIndex) add(k string) {
+	e := scanEntry{maphash.String(scanSeed, k), k}
+	i, found := slices.BinarySearchFunc(*idx, e, compareScanEntry)
+	if !found {
+		*idx = slices.Insert(*idx, i, e)
+	}
+}
+
+func (idx *hashIndex) remove(k string) {
+	e := scanEntry{maphash.String(scanSeed, k), k}
+	if i, found := slices.BinarySearchFunc(*idx, e, compareScanEntry); found {
+		*idx = slices.Delete(*idx, i, i+1)
+	}
+}
+
+// scan visits the keys of idx in the order of their hash, starting at
+// o.Cursor. Because that order does not depend on the number of keys, every
+// key present for a whole iteration is returned even while keys come and go.
+// It returns the next cursor, or 0 once the iteration is complete, and the
+// visited keys accepted by keep.
+func scan(idx hashIndex, o ScanOpts, keep func(k string) bool) (uint64, []string) {
+	count := o.Count
+	if count <= 0 {
+		count = 10
+	}
+
+	i, _ := slices.BinarySearchFunc(idx, o.Cursor, func(e scanEntry, h uint64) int {
+		return cmp.Compare(e.h, h)
+	})
+	end := min(i+count, len(idx))
+	// keys sharing a hash are visited together, as the cursor cannot tell
+	// them apart
+	for end > i && end < len(idx) && idx[end].h == idx[end-1].h {
+		end++
+	}
+
+	var keys []string
+	for _, e := range idx[i:end] {
+		if keep(e.k) && o.match(e.k) {
+			keys = append(keys, e.k)
+		}
+	}
+	if end == len(idx) {
+		return 0, keys
+	}
+	return idx[end-1].h + 1, keys
+}
+
+// Keys returns every live key matching the glob pattern.
+func (db *DB) Keys(pattern string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	keys := []string{}
+	for k, v := range db.store {
+		if v.expired(now) {
+			continue
+		}
+		if utils.GlobMatch(pattern, k, false) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (db *DB) Scan(o ScanOpts) (uint64, []string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	return scan(db.index, o, func(k string) bool {
+		v := db.store[k]
+		if v.expired(now) {
+			return false
+		}
+		// module types such as ReJSON-RL are named in mixed case
+		return o.Type == "" || strings.EqualFold(v.val.Type, o.Type)
+	})
+}
+
+// ScanCollection iterates the members of the hash, set or sorted set at k.
+// The returned slice holds field/value pairs for hashes, member/score pairs
+// for sorted sets and members for sets.
+func (db *DB) ScanCollection(k string, typ string, o ScanOpts) (uint64, []string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	v, ok := db.lookup(k)
+	if !ok {
+		return 0, []string{}, nil
+	}
+	if v.val.Type != typ {
+		return 0, nil, ErrWrongType
+	}
+
+	all := func(string) bool { return true }
+	res := []string{}
+	switch c := v.val.Val.(type) {
+	case Hash:
+		next, fields := scan(c.index, o, all)
+		for _, f := range fields {
+			res = append(res, f, c.fields[f])
+		}
+		return next, res, nil
+	case Set:
+		next, members := scan(c.index, o, all)
+		return next, append(res, members...), nil
+	case *ZSet:
+		next, members := scan(c.index, o, all)
+		for _, m := range members {
+			res = append(res, m, utils.FormatFloat(c.dict[m]))
+		}
+		return next, res, nil
+	}
+	return 0, nil, ErrWrongType
+}
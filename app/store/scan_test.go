@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScanWhileGrowing(t *testing.T) {
+	var idx hashIndex
+	for i := 0; i < 100; i++ {
+		idx.add(fmt.Sprintf("stable:%d", i))
+	}
+
+	seen := make(map[string]int)
+	keep := func(string) bool { return true }
+	o := ScanOpts{Count: 10}
+	for i := 0; ; i++ {
+		next, keys := scan(idx, o, keep)
+		for _, k := range keys {
+			seen[k]++
+		}
+		if next == 0 {
+			break
+		}
+		o.Cursor = next
+		for j := 0; j < 5; j++ {
+			idx.add(fmt.Sprintf("new:%d:%d", i, j))
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("stable:%d", i)
+		if seen[k] != 1 {
+			t.Fatalf("%s: want 1, got %d", k, seen[k])
+		}
+	}
+}
+
+func TestScanMatch(t *testing.T) {
+	idx := indexKeys(map[string]int{"user:1": 1, "user:2": 2, "order:1": 3})
+	keep := func(string) bool { return true }
+
+	var got []string
+	o := ScanOpts{Count: 1, Match: "user:*"}
+	for {
+		next, keys := scan(idx, o, keep)
+		got = append(got, keys...)
+		if next == 0 {
+			break
+		}
+		o.Cursor = next
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2, got %d", len(got))
+	}
+}
+
+func TestScanVisitsCount(t *testing.T) {
+	s := New(1)
+	db := s.dbs[0]
+	for i := 0; i < 10000; i++ {
+		db.SetString(fmt.Sprint("k", i), "v", SetOpts{})
+	}
+	db.Del("k0", "k1")
+
+	var visited, total int
+	o := ScanOpts{Count: 10}
+	for {
+		next, keys := scan(db.index, o, func(string) bool {
+			visited++
+			return true
+		})
+		// a call only looks at the keys it returns
+		if visited != len(keys) || visited > 10 {
+			t.Fatalf("visited %d keys, returned %d", visited, len(keys))
+		}
+		total += visited
+		visited = 0
+		if next == 0 {
+			break
+		}
+		o.Cursor = next
+	}
+	if total != 9998 {
+		t.Errorf("scanned %d keys, want 9998", total)
+	}
+}
+
+func TestScanType(t *testing.T) {
+	db := New(1).dbs[0]
+	db.SetString("str", "v", SetOpts{})
+	db.JSONSet("json", "$", "1", false, false)
+	db.BFAdd("bloom", []string{"a"})
+	db.CFAdd("cuckoo", "a", false)
+	db.TSCreate("ts", TSOpts{})
+
+	tests := []struct {
+		typ  string
+		want string
+	}{
+		{"string", "str"},
+		{"STRING", "str"},
+		{"ReJSON-RL", "json"},
+		{"rejson-rl", "json"},
+		{"MBbloom--", "bloom"},
+		{"mbbloomcf", "cuckoo"},
+		{"TSDB-TYPE", "ts"},
+	}
+	for _, tt := range tests {
+		_, keys := db.Scan(ScanOpts{Count: 100, Type: tt.typ})
+		if len(keys) != 1 || keys[0] != tt.want {
+			t.Errorf("TYPE %s: got %q, want %s", tt.typ, keys, tt.want)
+		}
+	}
+}
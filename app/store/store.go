@@ -2,7 +2,6 @@ package store
 
 import (
 	"fmt"
-	"github.com/codecrafters-io/redis-starter-go/app/pkg"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +16,7 @@ type TypedValue struct {
 var (
 	ErrSmallXaddID = fmt.Errorf("the ID specified in XADD is equal or smaller than the target stream top item")
 	ErrZeroXaddID  = fmt.Errorf("the ID specified in XADD must be greater than 0-0")
+	ErrWrongType   = fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
 )
 
 type StreamEntry struct {
@@ -38,54 +38,139 @@ type streamDetail struct {
 	c int
 	r int
 }
-type Store struct {
-	store map[string]*Val
+
+// DB is a logical database: a keyspace selected with SELECT.
+type DB struct {
+	id      int
+	store   map[string]*Val
+	expires map[string]struct{}
+	// index orders the keys for SCAN.
+	index hashIndex
 	mu    sync.RWMutex
 
 	streamDetails map[string]*streamDetail
+
+	srv *Store
 }
 
-func New() *Store {
-	return &Store{
+func newDB(id int, srv *Store) *DB {
+	return &DB{
+		id:            id,
 		store:         make(map[string]*Val),
+		expires:       make(map[string]struct{}),
 		streamDetails: make(map[string]*streamDetail),
+		srv:           srv,
 	}
 }
 
-func (s *Store) Get(k string) (*TypedValue, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// Propagate forwards a successfully applied write command.
+func (db *DB) Propagate(args ...string) {
+	db.srv.Propagate(db.id, args...)
+}
+
+func (db *DB) Get(k string) (*TypedValue, bool) {
+	db.mu.RLock()
+	v, ok := db.store[k]
+	expired := ok && v.expired(time.Now())
+	db.mu.RUnlock()
 
-	v, ok := s.store[k]
 	if !ok {
 		return nil, false
 	}
-	if v.canExpire && time.Now().After(v.ex) {
+	if expired {
+		db.expireIfNeeded(k)
 		return nil, false
 	}
 	return v.val, true
 }
 
-func (s *Store) SetString(k string, v string, px time.Duration) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+type SetOpts struct {
+	NX      bool
+	XX      bool
+	At      time.Time
+	KeepTTL bool
+	Get     bool
+}
+
+type SetResult struct {
+	Old    string
+	HadOld bool
+	// Written is false when NX or XX prevented the write.
+	Written bool
+}
+
+// SetString sets k to v as a single check-and-set. The previous value is only
+// read, and checked to be a string, when o.Get is set. An o.At in the past
+// deletes the key.
+func (db *DB) SetString(k string, v string, o SetOpts) (SetResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var r SetResult
+	cur, exists := db.lookup(k)
+	if o.Get && exists {
+		old, err := cur.val.AsString()
+		if err != nil {
+			return r, err
+		}
+		r.Old, r.HadOld = old, true
+	}
+	if (o.NX && exists) || (o.XX && !exists) {
+		return r, nil
+	}
+
+	r.Written = true
+	if !o.At.IsZero() && !o.At.After(time.Now()) {
+		db.remove(k)
+		return r, nil
+	}
+
+	nv := &Val{val: newString(v), ex: o.At, canExpire: !o.At.IsZero()}
+	if o.KeepTTL && exists {
+		nv.ex, nv.canExpire = cur.ex, cur.canExpire
+	}
+	delete(db.streamDetails, k)
+	db.set(k, nv)
+	return r, nil
+}
 
-	s.store[k] = &Val{
-		val:       &TypedValue{Type: "string", Val: v},
-		ex:        time.Now().Add(px),
-		canExpire: px > 0,
+// set stores v at k and keeps the expires index and stream details in sync.
+// It must be called with db.mu held.
+func (db *DB) set(k string, v *Val) {
+	if _, ok := db.store[k]; !ok {
+		db.index.add(k)
+	}
+	db.store[k] = v
+	if v.canExpire {
+		db.expires[k] = struct{}{}
+	} else {
+		delete(db.expires, k)
+	}
+	if st, ok := v.val.Val.(*Stream); ok {
+		db.streamDetails[k] = &streamDetail{c: len(st.Entries)}
+	} else {
+		delete(db.streamDetails, k)
 	}
 }
 
-func (s *Store) SetStream(k string, id string, data map[string]string, px time.Duration) (string, error) {
+func (v *Val) expired(now time.Time) bool {
+	return v.canExpire && now.After(v.ex)
+}
+
+func (db *DB) SetStream(k string, id string, data map[string]string, px time.Duration) (string, error) {
+	if sv, _ := db.Get(k); sv != nil {
+		if _, ok := sv.Val.(*Stream); !ok {
+			return "", ErrWrongType
+		}
+	}
 	idParts := strings.Split(id, "-")
 	if len(idParts) == 2 {
 		if idParts[0] != "*" && idParts[1] == "*" {
 			ms, _ := strconv.ParseInt(idParts[0], 10, 64)
-			seq := s.generateSeq(k, ms)
+			seq := db.generateSeq(k, ms)
 			id = fmt.Sprintf("%d-%d", ms, seq)
 		} else {
-			err := s.validateStreamID(k, id)
+			err := db.validateStreamID(k, id)
 			if err != nil {
 				return "", err
 			}
@@ -94,14 +179,14 @@ func (s *Store) SetStream(k string, id string, data map[string]string, px time.D
 
 	if id == "*" {
 		ms := time.Now().UnixMilli()
-		seq := s.generateSeq(k, ms)
+		seq := db.generateSeq(k, ms)
 		id = fmt.Sprintf("%d-%d", ms, seq)
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	storeVal, ok := s.store[k]
+	storeVal, ok := db.store[k]
 	if !ok {
 		v := &TypedValue{Type: "stream",
 			Val: &Stream{
@@ -113,26 +198,28 @@ func (s *Store) SetStream(k string, id string, data map[string]string, px time.D
 				},
 			},
 		}
-		s.store[k] = &Val{
+		db.set(k, &Val{
 			val:       v,
 			ex:        time.Now().Add(px),
 			canExpire: px > 0,
-		}
-		s.streamDetails[k] = &streamDetail{c: 1}
+		})
 		return id, nil
 	}
 
-	stream := storeVal.val.Val.(*Stream)
+	stream, ok := storeVal.val.Val.(*Stream)
+	if !ok {
+		return "", ErrWrongType
+	}
 	stream.Entries = append(stream.Entries, StreamEntry{
 		ID:     id,
 		Values: data,
 	})
-	s.streamDetails[k].c++
+	db.streamDetails[k].c++
 	return id, nil
 }
 
-func (s *Store) RangeStream(k, startId, endId string) []StreamEntry {
-	sv, _ := s.Get(k)
+func (db *DB) RangeStream(k, startId, endId string) []StreamEntry {
+	sv, _ := db.Get(k)
 	if sv == nil {
 		return nil
 	}
@@ -141,14 +228,14 @@ func (s *Store) RangeStream(k, startId, endId string) []StreamEntry {
 		return strings.Index(id, "-") < 0
 	}
 	inRange := func(id, start, end string) bool {
-		idMs, idSeq, _ := s.parseStreamId(id)
-		startMs, startSeq, _ := s.parseStreamId(start)
+		idMs, idSeq, _ := db.parseStreamId(id)
+		startMs, startSeq, _ := db.parseStreamId(start)
 
 		msPass := idMs >= startMs
 		seqPass := skipSequenceCheck(start) || idSeq >= startSeq
 		startPass := msPass && seqPass
 
-		endMs, endSeq, _ := s.parseStreamId(end)
+		endMs, endSeq, _ := db.parseStreamId(end)
 		msPass = idMs <= endMs
 		seqPass = skipSequenceCheck(end) || idSeq <= endSeq
 		endPass := msPass && seqPass
@@ -173,13 +260,13 @@ type ReadStreamRes struct {
 	Entries []StreamEntry
 }
 
-func (s *Store) readStreams(req [][]string) []*ReadStreamRes {
+func (db *DB) readStreams(req [][]string) []*ReadStreamRes {
 	skipSequenceCheck := func(id string) bool {
 		return strings.Index(id, "-") < 0
 	}
 	inRange := func(id, start string) bool {
-		idMs, idSeq, _ := s.parseStreamId(id)
-		startMs, startSeq, _ := s.parseStreamId(start)
+		idMs, idSeq, _ := db.parseStreamId(id)
+		startMs, startSeq, _ := db.parseStreamId(start)
 
 		if idMs > startMs {
 			return true
@@ -193,7 +280,7 @@ func (s *Store) readStreams(req [][]string) []*ReadStreamRes {
 	var res []*ReadStreamRes
 	for _, streamReq := range req {
 		k, startId := streamReq[0], streamReq[1]
-		sv, _ := s.Get(k)
+		sv, _ := db.Get(k)
 		if sv == nil {
 			continue
 		}
@@ -215,7 +302,7 @@ func (s *Store) readStreams(req [][]string) []*ReadStreamRes {
 	return res
 }
 
-func (s *Store) sanitizeReadStream(res []*ReadStreamRes, req [][]string, details map[string]int) []*ReadStreamRes {
+func (db *DB) sanitizeReadStream(res []*ReadStreamRes, req [][]string, details map[string]int) []*ReadStreamRes {
 	freshOnly := make(map[string]bool)
 	for _, v := range req {
 		freshOnly[v[0]] = false
@@ -233,8 +320,16 @@ func (s *Store) sanitizeReadStream(res []*ReadStreamRes, req [][]string, details
 	return res
 }
 
-func (s *Store) ReadStream(req [][]string, block time.Duration) []*ReadStreamRes {
-	res := s.readStreams(req)
+// ReadStream serves XREAD, which is not gated since it may block. Each read
+// takes the gate itself, as it may delete and propagate expired keys.
+func (db *DB) ReadStream(req [][]string, block time.Duration) []*ReadStreamRes {
+	var res []*ReadStreamRes
+	read := func() {
+		db.srv.Exec(func() {
+			res = db.readStreams(req)
+		})
+	}
+	read()
 	if block < 0 {
 		return res
 	}
@@ -263,26 +358,26 @@ func (s *Store) ReadStream(req [][]string, block time.Duration) []*ReadStreamRes
 
 	if block > 0 {
 		time.Sleep(block)
-		res = s.readStreams(req)
+		read()
 		if !updated() {
 			return nil
 		}
-		return s.sanitizeReadStream(res, req, read0)
+		return db.sanitizeReadStream(res, req, read0)
 	}
 
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 	for {
 		<-ticker.C
-		res = s.readStreams(req)
+		read()
 		if !updated() {
 			continue
 		}
-		return s.sanitizeReadStream(res, req, read0)
+		return db.sanitizeReadStream(res, req, read0)
 	}
 }
 
-func (s *Store) parseStreamId(id string) (int64, int, error) {
+func (db *DB) parseStreamId(id string) (int64, int, error) {
 	parts := strings.Split(id, "-")
 	var ms int64
 	var seq int
@@ -300,8 +395,8 @@ func (s *Store) parseStreamId(id string) (int64, int, error) {
 	return ms, seq, nil
 }
 
-func (s *Store) generateSeq(k string, ms int64) int {
-	sv, _ := s.Get(k)
+func (db *DB) generateSeq(k string, ms int64) int {
+	sv, _ := db.Get(k)
 	if sv == nil {
 		if ms == 0 {
 			return 1
@@ -311,10 +406,10 @@ func (s *Store) generateSeq(k string, ms int64) int {
 	var lastSeq int
 	empty := true
 	for _, e := range sv.Val.(*Stream).Entries {
-		entryMs, _, _ := s.parseStreamId(e.ID)
+		entryMs, _, _ := db.parseStreamId(e.ID)
 		if entryMs == ms {
 			empty = false
-			_, lastSeq, _ = s.parseStreamId(e.ID)
+			_, lastSeq, _ = db.parseStreamId(e.ID)
 		}
 	}
 
@@ -329,52 +424,33 @@ func (s *Store) generateSeq(k string, ms int64) int {
 	return lastSeq + 1
 }
 
-func (s *Store) validateStreamID(k string, id string) error {
-	ms, seq, err := s.parseStreamId(id)
+func (db *DB) validateStreamID(k string, id string) error {
+	ms, seq, err := db.parseStreamId(id)
 	if err != nil {
 		return err
 	}
 
 	var lastMs int64
 	var lastSeq int
-	sv, _ := s.Get(k)
+	sv, _ := db.Get(k)
 	if sv != nil {
 		entries := sv.Val.(*Stream).Entries
 		last := entries[len(entries)-1]
-		lastMs, lastSeq, err = s.parseStreamId(last.ID)
+		lastMs, lastSeq, err = db.parseStreamId(last.ID)
 	}
 
 	if ms == 0 && seq == 0 {
 		return ErrZeroXaddID
 	}
 
-	if ms < lastMs {
-		return ErrSmallXaddID
-	}
-	if seq <= lastSeq {
+	if ms < lastMs || (ms == lastMs && seq <= lastSeq) {
 		return ErrSmallXaddID
 	}
 	return nil
 }
 
-func (s *Store) Print() string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return fmt.Sprintf("%+v", s.store)
-}
-
-func (s *Store) Load(path string) error {
-	d, err := pkg.ReadRDB(path)
-	if err != nil {
-		return err
-	}
-
-	for k, v := range d {
-		s.store[k] = &Val{
-			val:       &TypedValue{Type: "string", Val: v.Val.(string)},
-			ex:        v.Expiry,
-			canExpire: !v.Expiry.Equal(time.Time{}),
-		}
-	}
-	return nil
+func (db *DB) Print() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fmt.Sprintf("%+v", db.store)
 }
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// MaxStringLen is the largest string value, matching proto-max-bulk-len.
+const MaxStringLen = 512 << 20
+
+var (
+	ErrNotInteger  = errors.New("value is not an integer or out of range")
+	ErrNotFloat    = errors.New("value is not a valid float")
+	ErrOverflow    = errors.New("increment or decrement would overflow")
+	ErrNaN         = errors.New("increment would produce NaN or Infinity")
+	ErrStringLimit = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+)
+
+// newString builds a string value. Values that are canonical 64 bit integers
+// are kept as int64, the equivalent of Redis's int encoding.
+func newString(v string) *TypedValue {
+	if n, ok := parseCanonicalInt(v); ok {
+		return &TypedValue{Type: "string", Val: n}
+	}
+	return &TypedValue{Type: "string", Val: v}
+}
+
+func parseCanonicalInt(v string) (int64, bool) {
+	if len(v) == 0 || len(v) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != v {
+		return 0, false
+	}
+	return n, true
+}
+
+// AsString returns the value of a string key.
+func (t *TypedValue) AsString() (string, error) {
+	if t.Type != "string" {
+		return "", ErrWrongType
+	}
+	switch v := t.Val.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case string:
+		return v, nil
+	case []byte:
+		// strings modified by bit operations are kept as mutable bytes
+		return string(v), nil
+	}
+	return "", ErrWrongType
+}
+
+// Encoding returns the name OBJECT ENCODING reports for t.
+func (t *TypedValue) Encoding() string {
+	switch v := t.Val.(type) {
+	case int64:
+		return "int"
+	case string:
+		if len(v) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case *Stream:
+		return "stream"
+	case Hash:
+		if len(v.fields) <= 128 {
+			return "listpack"
+		}
+		return "hashtable"
+	case List:
+		if len(v) <= 128 {
+			return "listpack"
+		}
+		return "quicklist"
+	case Set:
+		if len(v.members) <= 128 {
+			return "listpack"
+		}
+		return "hashtable"
+	case *ZSet:
+		if v.Len() <= 128 {
+			return "listpack"
+		}
+		return "skiplist"
+	}
+	return "raw"
+}
+
+// getString returns the string at k. It must be called with db.mu held.
+func (db *DB) getString(k string) (string, bool, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return "", false, nil
+	}
+	s, err := v.val.AsString()
+	if err != nil {
+		return "", false, err
+	}
+	return s, true, nil
+}
+
+// replaceString stores s at k and keeps any existing expiry. It must be
+// called with db.mu held.
+func (db *DB) replaceString(k string, s *TypedValue) {
+	if v, ok := db.lookup(k); ok {
+		v.val = s
+		return
+	}
+	db.set(k, &Val{val: s})
+}
+
+func (db *DB) GetString(k string) (string, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getString(k)
+}
+
+func (db *DB) IncrBy(k string, delta int64) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int64
+	if v, ok := db.lookup(k); ok {
+		if v.val.Type != "string" {
+			return 0, ErrWrongType
+		}
+		if cur, ok := v.val.Val.(int64); ok {
+			n = cur
+		} else {
+			s, _ := v.val.AsString()
+			if n, ok = parseCanonicalInt(s); !ok {
+				return 0, ErrNotInteger
+			}
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	n += delta
+	db.replaceString(k, &TypedValue{Type: "string", Val: n})
+	return n, nil
+}
+
+func (db *DB) IncrByFloat(k string, delta float64) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, _, err := db.getString(k)
+	if err != nil {
+		return "", err
+	}
+	var f float64
+	if cur != "" {
+		f, err = strconv.ParseFloat(cur, 64)
+		if err != nil || math.IsNaN(f) {
+			return "", ErrNotFloat
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", ErrNaN
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	db.replaceString(k, newString(s))
+	return s, nil
+}
+
+func (db *DB) Append(k string, s string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, _, err := db.getString(k)
+	if err != nil {
+		return 0, err
+	}
+	if len(cur)+len(s) > MaxStringLen {
+		return 0, ErrStringLimit
+	}
+	cur += s
+	db.replaceString(k, &TypedValue{Type: "string", Val: cur})
+	return len(cur), nil
+}
+
+func (db *DB) Strlen(k string) (int, error) {
+	s, _, err := db.GetString(k)
+	return len(s), err
+}
+
+// GetRange returns the substring between the inclusive offsets start and end.
+// Negative offsets count from the end of the string.
+func (db *DB) GetRange(k string, start, end int64) (string, error) {
+	s, _, err := db.GetString(k)
+	if err != nil {
+		return "", err
+	}
+	n := int64(len(s))
+	if start < 0 && end < 0 && start > end {
+		return "", nil
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end || n == 0 {
+		return "", nil
+	}
+	return s[start : end+1], nil
+}
+
+// SetRange overwrites part of the string at k starting at offset, padding
+// with zero bytes when needed. It returns the new length.
+func (db *DB) SetRange(k string, offset int64, s string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, _, err := db.getString(k)
+	if err != nil {
+		return 0, err
+	}
+	if len(s) == 0 {
+		return len(cur), nil
+	}
+	if offset+int64(len(s)) > MaxStringLen {
+		return 0, ErrStringLimit
+	}
+	end := int(offset) + len(s)
+	b := []byte(cur)
+	if end > len(b) {
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	copy(b[offset:], s)
+	db.replaceString(k, &TypedValue{Type: "string", Val: string(b)})
+	return len(b), nil
+}
+
+// MGet returns the value of each key, or nil when the key is missing or does
+// not hold a string.
+func (db *DB) MGet(keys ...string) []*string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	res := make([]*string, len(keys))
+	for i, k := range keys {
+		if s, ok, err := db.getString(k); ok && err == nil {
+			res[i] = &s
+		}
+	}
+	return res
+}
+
+// MSet sets every key/value pair, discarding any previous expiry.
+func (db *DB) MSet(pairs []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		db.set(pairs[i], &Val{val: newString(pairs[i+1])})
+	}
+}
+
+// MSetNX sets every pair only if none of the keys exist.
+func (db *DB) MSetNX(pairs []string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if _, ok := db.lookup(pairs[i]); ok {
+			return false
+		}
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		db.set(pairs[i], &Val{val: newString(pairs[i+1])})
+	}
+	return true
+}
+
+func (db *DB) GetDel(k string) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok, err := db.getString(k)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	db.remove(k)
+	return s, true, nil
+}
+
+type GetExOpts struct {
+	At      time.Time
+	Persist bool
+}
+
+// GetEx returns the string at k and updates its expiry: to o.At when set, or
+// removed with o.Persist. An expiry in the past deletes the key.
+func (db *DB) GetEx(k string, o GetExOpts) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok, err := db.getString(k)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	v, _ := db.lookup(k)
+	switch {
+	case o.Persist:
+		v.ex, v.canExpire = time.Time{}, false
+		delete(db.expires, k)
+	case !o.At.IsZero() && !o.At.After(time.Now()):
+		db.remove(k)
+	case !o.At.IsZero():
+		v.ex, v.canExpire = o.At, true
+		db.expires[k] = struct{}{}
+	}
+	return s, true, nil
+}
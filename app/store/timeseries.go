@@ -0,0 +1,398 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// TimeSeriesType is the type name of time series, the one RedisTimeSeries
+// reports.
+const TimeSeriesType = "TSDB-TYPE"
+
+// DuplicatePolicy decides what happens when a sample is added at a
+// timestamp that already has one.
+type DuplicatePolicy string
+
+const (
+	DuplicateBlock DuplicatePolicy = "BLOCK"
+	DuplicateFirst DuplicatePolicy = "FIRST"
+	DuplicateLast  DuplicatePolicy = "LAST"
+	DuplicateMin   DuplicatePolicy = "MIN"
+	DuplicateMax   DuplicatePolicy = "MAX"
+	DuplicateSum   DuplicatePolicy = "SUM"
+)
+
+var duplicatePolicies = []DuplicatePolicy{DuplicateBlock, DuplicateFirst, DuplicateLast, DuplicateMin, DuplicateMax, DuplicateSum}
+
+// Aggregator names an aggregation of the samples in a bucket.
+type Aggregator string
+
+const (
+	AggAvg   Aggregator = "avg"
+	AggSum   Aggregator = "sum"
+	AggMin   Aggregator = "min"
+	AggMax   Aggregator = "max"
+	AggCount Aggregator = "count"
+	AggFirst Aggregator = "first"
+	AggLast  Aggregator = "last"
+)
+
+var (
+	ErrTSExists    = errors.New("TSDB: key already exists")
+	ErrTSNoKey     = errors.New("TSDB: the key does not exist")
+	ErrTSBlocked   = errors.New("TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+	ErrTSRetention = errors.New("TSDB: Timestamp is older than retention")
+	ErrTSNoMatcher = errors.New("TSDB: please provide at least one matcher")
+)
+
+type Sample struct {
+	TS  int64
+	Val float64
+}
+
+type Label struct {
+	Name, Value string
+}
+
+// TSOpts configures a new time series. A zero Retention keeps samples
+// forever.
+type TSOpts struct {
+	Retention int64
+	Policy    DuplicatePolicy
+	Labels    []Label
+}
+
+// TimeSeries holds samples ordered by timestamp. Samples more than Retention
+// milliseconds older than the newest one are dropped as new ones arrive.
+type TimeSeries struct {
+	opts    TSOpts
+	samples []Sample
+}
+
+func NewTimeSeries(o TSOpts) *TimeSeries {
+	if o.Policy == "" {
+		o.Policy = DuplicateBlock
+	}
+	return &TimeSeries{opts: o}
+}
+
+func (ts *TimeSeries) Labels() []Label {
+	return ts.opts.Labels
+}
+
+func (ts *TimeSeries) label(name string) (string, bool) {
+	for _, l := range ts.opts.Labels {
+		if l.Name == name {
+			return l.Value, true
+		}
+	}
+	return "", false
+}
+
+// add inserts a sample, resolving an existing one at the same timestamp with
+// policy, or the series' own policy when it is empty.
+func (ts *TimeSeries) add(s Sample, policy DuplicatePolicy) error {
+	if policy == "" {
+		policy = ts.opts.Policy
+	}
+	n := len(ts.samples)
+	if ts.opts.Retention > 0 && n > 0 && s.TS < ts.samples[n-1].TS-ts.opts.Retention {
+		return ErrTSRetention
+	}
+	if n == 0 || s.TS > ts.samples[n-1].TS {
+		ts.samples = append(ts.samples, s)
+		ts.trim()
+		return nil
+	}
+
+	i, found := slices.BinarySearchFunc(ts.samples, s.TS, func(e Sample, t int64) int {
+		switch {
+		case e.TS < t:
+			return -1
+		case e.TS > t:
+			return 1
+		}
+		return 0
+	})
+	if !found {
+		ts.samples = slices.Insert(ts.samples, i, s)
+		return nil
+	}
+	old := &ts.samples[i]
+	switch policy {
+	case DuplicateBlock:
+		return ErrTSBlocked
+	case DuplicateLast:
+		old.Val = s.Val
+	case DuplicateMin:
+		old.Val = math.Min(old.Val, s.Val)
+	case DuplicateMax:
+		old.Val = math.Max(old.Val, s.Val)
+	case DuplicateSum:
+		old.Val += s.Val
+	}
+	return nil
+}
+
+// trim drops the samples that fell out of the retention window.
+func (ts *TimeSeries) trim() {
+	if ts.opts.Retention <= 0 || len(ts.samples) == 0 {
+		return
+	}
+	oldest := ts.samples[len(ts.samples)-1].TS - ts.opts.Retention
+	i := sort.Search(len(ts.samples), func(i int) bool { return ts.samples[i].TS >= oldest })
+	ts.samples = slices.Delete(ts.samples, 0, i)
+}
+
+// TSRange selects samples from a series. With an Aggregator, samples are
+// grouped into buckets of Bucket milliseconds starting at multiples of
+// Bucket offset by Align, and each non-empty bucket is reported at its start.
+type TSRange struct {
+	From, To int64
+	Count    int
+	Agg      Aggregator
+	Bucket   int64
+	Align    int64
+	Reverse  bool
+}
+
+func (ts *TimeSeries) rng(r TSRange) []Sample {
+	lo := sort.Search(len(ts.samples), func(i int) bool { return ts.samples[i].TS >= r.From })
+	hi := sort.Search(len(ts.samples), func(i int) bool { return ts.samples[i].TS > r.To })
+	var res []Sample
+	if lo < hi {
+		res = slices.Clone(ts.samples[lo:hi])
+	}
+	if r.Agg != "" {
+		res = aggregate(res, r)
+	}
+	if r.Reverse {
+		slices.Reverse(res)
+	}
+	if r.Count > 0 && len(res) > r.Count {
+		res = res[:r.Count]
+	}
+	return res
+}
+
+func aggregate(samples []Sample, r TSRange) []Sample {
+	var res []Sample
+	for i := 0; i < len(samples); {
+		off := (samples[i].TS - r.Align) % r.Bucket
+		if off < 0 {
+			off += r.Bucket
+		}
+		start := samples[i].TS - off
+		j := i
+		for j < len(samples) && samples[j].TS < start+r.Bucket {
+			j++
+		}
+		// timestamps are never negative, even for a bucket that starts before 0
+		res = append(res, Sample{TS: max(start, 0), Val: reduce(samples[i:j], r.Agg)})
+		i = j
+	}
+	return res
+}
+
+func reduce(samples []Sample, agg Aggregator) float64 {
+	switch agg {
+	case AggCount:
+		return float64(len(samples))
+	case AggFirst:
+		return samples[0].Val
+	case AggLast:
+		return samples[len(samples)-1].Val
+	}
+	v := samples[0].Val
+	for _, s := range samples[1:] {
+		switch agg {
+		case AggMin:
+			v = math.Min(v, s.Val)
+		case AggMax:
+			v = math.Max(v, s.Val)
+		default:
+			v += s.Val
+		}
+	}
+	if agg == AggAvg {
+		v /= float64(len(samples))
+	}
+	return v
+}
+
+// timeSeries returns the series at k, or nil when k does not exist. It must
+// be called with db.mu held.
+func (db *DB) timeSeries(k string) (*TimeSeries, error) {
+	v, ok := db.lookup(k)
+	if !ok {
+		return nil, nil
+	}
+	ts, ok := v.val.Val.(*TimeSeries)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return ts, nil
+}
+
+func (db *DB) TSCreate(k string, o TSOpts) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.lookup(k); ok {
+		return ErrTSExists
+	}
+	db.set(k, &Val{val: &TypedValue{Type: TimeSeriesType, Val: NewTimeSeries(o)}})
+	return nil
+}
+
+// TSAdd adds a sample to the series at k, creating it with o when it does
+// not exist. onDuplicate overrides the series' duplicate policy.
+func (db *DB) TSAdd(k string, s Sample, o TSOpts, onDuplicate DuplicatePolicy) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ts, err := db.timeSeries(k)
+	if err != nil {
+		return err
+	}
+	if ts == nil {
+		ts = NewTimeSeries(o)
+		db.set(k, &Val{val: &TypedValue{Type: TimeSeriesType, Val: ts}})
+	}
+	return ts.add(s, onDuplicate)
+}
+
+// TSMAdd adds a sample to each of keys, which must exist. Each result is nil
+// or the error that stopped the sample from being added.
+func (db *DB) TSMAdd(keys []string, samples []Sample) []error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res := make([]error, len(keys))
+	for i, k := range keys {
+		ts, err := db.timeSeries(k)
+		switch {
+		case err != nil:
+			res[i] = err
+		case ts == nil:
+			res[i] = ErrTSNoKey
+		default:
+			res[i] = ts.add(samples[i], "")
+		}
+	}
+	return res
+}
+
+func (db *DB) TSRange(k string, r TSRange) ([]Sample, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ts, err := db.timeSeries(k)
+	if err != nil {
+		return nil, err
+	}
+	if ts == nil {
+		return nil, ErrTSNoKey
+	}
+	return ts.rng(r), nil
+}
+
+// TSFilter matches series by a label. It matches when the label has one of
+// Values, or, with Neq, when it has none of them. A missing label counts as
+// the empty value, so label= matches series without it.
+type TSFilter struct {
+	Label  string
+	Values []string
+	Neq    bool
+}
+
+// matcher reports whether f can select series on its own: label=value
+// rather than only excluding or checking for absence.
+func (f TSFilter) matcher() bool {
+	return !f.Neq && slices.ContainsFunc(f.Values, func(v string) bool { return v != "" })
+}
+
+func (f TSFilter) match(ts *TimeSeries) bool {
+	v, _ := ts.label(f.Label)
+	return slices.Contains(f.Values, v) != f.Neq
+}
+
+// TSSeries is one series selected by TSMRange.
+type TSSeries struct {
+	Key     string
+	Labels  []Label
+	Samples []Sample
+}
+
+// TSMRange applies r to every series matching all filters, ordered by key.
+func (db *DB) TSMRange(filters []TSFilter, r TSRange) ([]TSSeries, error) {
+	if !slices.ContainsFunc(filters, TSFilter.matcher) {
+		return nil, ErrTSNoMatcher
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var res []TSSeries
+	for k := range db.store {
+		ts, err := db.timeSeries(k)
+		if ts == nil || err != nil {
+			continue
+		}
+		matched := true
+		for _, f := range filters {
+			matched = matched && f.match(ts)
+		}
+		if matched {
+			res = append(res, TSSeries{Key: k, Labels: ts.Labels(), Samples: ts.rng(r)})
+		}
+	}
+	slices.SortFunc(res, func(a, b TSSeries) int { return strings.Compare(a.Key, b.Key) })
+	return res, nil
+}
+
+// MarshalBinary encodes the series for snapshots.
+func (ts *TimeSeries) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(ts.opts.Retention))
+	buf = appendBinString(buf, string(ts.opts.Policy))
+	buf = binary.AppendUvarint(buf, uint64(len(ts.opts.Labels)))
+	for _, l := range ts.opts.Labels {
+		buf = appendBinString(buf, l.Name)
+		buf = appendBinString(buf, l.Value)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(ts.samples)))
+	for _, s := range ts.samples {
+		buf = binary.AppendUvarint(buf, uint64(s.TS))
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(s.Val))
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a series encoded by MarshalBinary.
+func (ts *TimeSeries) UnmarshalBinary(data []byte) error {
+	r := &binReader{b: data}
+	o := TSOpts{Retention: int64(r.uvarint()), Policy: DuplicatePolicy(r.str())}
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		o.Labels = append(o.Labels, Label{Name: r.str(), Value: r.str()})
+	}
+	n = r.uvarint()
+	var samples []Sample
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		t := int64(r.uvarint())
+		// rng searches the samples, which must be in order
+		if len(samples) > 0 && t <= samples[len(samples)-1].TS {
+			return ErrBadData
+		}
+		samples = append(samples, Sample{TS: t, Val: math.Float64frombits(r.uint64())})
+	}
+	if r.err != nil || len(r.b) != 0 || o.Retention < 0 || !slices.Contains(duplicatePolicies, o.Policy) {
+		return ErrBadData
+	}
+	ts.opts, ts.samples = o, samples
+	return nil
+}
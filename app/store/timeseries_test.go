@@ -0,0 +1,151 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestTimeSeriesAdd(t *testing.T) {
+	tests := []struct {
+		policy DuplicatePolicy
+		err    error
+		want   float64
+	}{
+		{DuplicateBlock, ErrTSBlocked, 10},
+		{DuplicateFirst, nil, 10},
+		{DuplicateLast, nil, 4},
+		{DuplicateMin, nil, 4},
+		{DuplicateMax, nil, 10},
+		{DuplicateSum, nil, 14},
+	}
+	for _, tt := range tests {
+		ts := NewTimeSeries(TSOpts{Policy: tt.policy})
+		ts.add(Sample{TS: 100, Val: 10}, "")
+		if err := ts.add(Sample{TS: 100, Val: 4}, ""); err != tt.err {
+			t.Errorf("%s: err = %v", tt.policy, err)
+		}
+		if got := ts.samples[0].Val; len(ts.samples) != 1 || got != tt.want {
+			t.Errorf("%s: samples = %v, want %v", tt.policy, ts.samples, tt.want)
+		}
+	}
+
+	ts := NewTimeSeries(TSOpts{Retention: 100})
+	for _, at := range []int64{50, 10, 120, 200} {
+		ts.add(Sample{TS: at, Val: 1}, "")
+	}
+	if len(ts.samples) != 2 || ts.samples[0].TS != 120 {
+		t.Errorf("retention kept %v", ts.samples)
+	}
+	if err := ts.add(Sample{TS: 99, Val: 1}, ""); err != ErrTSRetention {
+		t.Errorf("add before retention: err = %v", err)
+	}
+}
+
+func TestTimeSeriesRange(t *testing.T) {
+	ts := NewTimeSeries(TSOpts{})
+	for i, v := range []float64{1, 2, 3, 4, 5, 6, 7} {
+		ts.add(Sample{TS: int64(i * 10), Val: v}, "")
+	}
+	tests := []struct {
+		name string
+		r    TSRange
+		want []Sample
+	}{
+		{"range", TSRange{From: 15, To: 40}, []Sample{{20, 3}, {30, 4}, {40, 5}}},
+		{"reverse count", TSRange{To: math.MaxInt64, Reverse: true, Count: 2}, []Sample{{60, 7}, {50, 6}}},
+		{"avg", TSRange{To: math.MaxInt64, Agg: AggAvg, Bucket: 25}, []Sample{{0, 2}, {25, 4.5}, {50, 6.5}}},
+		{"count aligned", TSRange{To: math.MaxInt64, Agg: AggCount, Bucket: 25, Align: 5}, []Sample{{0, 1}, {5, 2}, {30, 3}, {55, 1}}},
+		{"max", TSRange{From: 10, To: 60, Agg: AggMax, Bucket: 30}, []Sample{{0, 3}, {30, 6}, {60, 7}}},
+		{"first reversed", TSRange{To: math.MaxInt64, Agg: AggFirst, Bucket: 30, Reverse: true}, []Sample{{60, 7}, {30, 4}, {0, 1}}},
+		{"empty", TSRange{From: 61, To: 100}, nil},
+	}
+	for _, tt := range tests {
+		got := ts.rng(tt.r)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTSMRange(t *testing.T) {
+	db, _ := New(1).Index(0)
+	db.TSCreate("temp:1", TSOpts{Labels: []Label{{"type", "temp"}, {"room", "a"}}})
+	db.TSCreate("temp:2", TSOpts{Labels: []Label{{"type", "temp"}, {"room", "b"}}})
+	db.TSCreate("hum:1", TSOpts{Labels: []Label{{"type", "hum"}}})
+	db.set("other", &Val{val: &TypedValue{Type: "string", Val: "x"}})
+
+	tests := []struct {
+		filters []TSFilter
+		want    []string
+	}{
+		{[]TSFilter{{Label: "type", Values: []string{"temp"}}}, []string{"temp:1", "temp:2"}},
+		{[]TSFilter{{Label: "type", Values: []string{"temp", "hum"}}, {Label: "room", Values: []string{"a"}, Neq: true}}, []string{"hum:1", "temp:2"}},
+		{[]TSFilter{{Label: "type", Values: []string{"hum", "temp"}}, {Label: "room", Values: []string{""}}}, []string{"hum:1"}},
+		{[]TSFilter{{Label: "type", Values: []string{"none"}}}, nil},
+	}
+	for _, tt := range tests {
+		got, err := db.TSMRange(tt.filters, TSRange{To: math.MaxInt64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.filters, got, tt.want)
+			continue
+		}
+		for i, s := range got {
+			if s.Key != tt.want[i] {
+				t.Errorf("%v: got %v, want %v", tt.filters, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if _, err := db.TSMRange([]TSFilter{{Label: "room", Values: []string{""}, Neq: true}}, TSRange{}); err != ErrTSNoMatcher {
+		t.Errorf("no matcher: err = %v", err)
+	}
+}
+
+func TestTimeSeriesDecodeInvalid(t *testing.T) {
+	ts := NewTimeSeries(TSOpts{Labels: []Label{{"a", "b"}}})
+	ts.add(Sample{TS: 1, Val: 1}, "")
+	ts.add(Sample{TS: 2, Val: 2}, "")
+	data, _ := ts.MarshalBinary()
+
+	encode := func(policy string, stamps ...uint64) []byte {
+		buf := binary.AppendUvarint(nil, 0)
+		buf = appendBinString(buf, policy)
+		buf = binary.AppendUvarint(buf, 0)
+		buf = binary.AppendUvarint(buf, uint64(len(stamps)))
+		for _, s := range stamps {
+			buf = binary.AppendUvarint(buf, s)
+			buf = binary.LittleEndian.AppendUint64(buf, 0)
+		}
+		return buf
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"valid", data, true},
+		{"truncated sample", data[:len(data)-3], false},
+		{"missing sample value", data[:len(data)-8], false},
+		{"unknown policy", encode("NEWEST", 1), false},
+		{"unordered samples", encode("LAST", 2, 1), false},
+		{"duplicate samples", encode("LAST", 1, 1), false},
+	}
+	for _, tt := range tests {
+		err := (&TimeSeries{}).UnmarshalBinary(tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+}
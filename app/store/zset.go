@@ -0,0 +1,114 @@
+package store
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Hash is a hash value. Its fields are indexed for HSCAN.
+type Hash struct {
+	fields map[string]string
+	index  hashIndex
+}
+
+func newHash(fields map[string]string) Hash {
+	return Hash{fields: fields, index: indexKeys(fields)}
+}
+
+// Set is a set value. Its members are indexed for SSCAN.
+type Set struct {
+	members map[string]struct{}
+	index   hashIndex
+}
+
+func newSet(members map[string]struct{}) Set {
+	return Set{members: members, index: indexKeys(members)}
+}
+
+type List []string
+
+type ZEntry struct {
+	Member string
+	Score  float64
+}
+
+// ZSet is a sorted set. Entries are kept ordered by score, then member, and
+// members are indexed for ZSCAN.
+type ZSet struct {
+	dict    map[string]float64
+	entries []ZEntry
+	index   hashIndex
+}
+
+func NewZSet() *ZSet {
+	return &ZSet{dict: make(map[string]float64)}
+}
+
+func compareZEntry(a, b ZEntry) int {
+	if c := cmp.Compare(a.Score, b.Score); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Member, b.Member)
+}
+
+func (z *ZSet) Len() int {
+	return len(z.entries)
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// Add sets the score of member and reports whether it was newly added.
+func (z *ZSet) Add(member string, score float64) bool {
+	old, exists := z.dict[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.delete(ZEntry{Member: member, Score: old})
+	} else {
+		z.index.add(member)
+	}
+	z.dict[member] = score
+	e := ZEntry{Member: member, Score: score}
+	i, _ := slices.BinarySearchFunc(z.entries, e, compareZEntry)
+	z.entries = slices.Insert(z.entries, i, e)
+	return !exists
+}
+
+func (z *ZSet) Remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	delete(z.dict, member)
+	z.index.remove(member)
+	z.delete(ZEntry{Member: member, Score: score})
+	return true
+}
+
+func (z *ZSet) delete(e ZEntry) {
+	i, found := slices.BinarySearchFunc(z.entries, e, compareZEntry)
+	if found {
+		z.entries = slices.Delete(z.entries, i, i+1)
+	}
+}
+
+// Entries returns the entries ordered by score. The slice must not be modified.
+func (z *ZSet) Entries() []ZEntry {
+	return z.entries
+}
+
+// RangeByScore returns the entries with min <= score < max, in order. The
+// slice must not be modified.
+func (z *ZSet) RangeByScore(min, max float64) []ZEntry {
+	byScore := func(e ZEntry, s float64) int { return cmp.Compare(e.Score, s) }
+	lo, _ := slices.BinarySearchFunc(z.entries, min, byScore)
+	hi, _ := slices.BinarySearchFunc(z.entries, max, byScore)
+	if hi < lo {
+		return nil
+	}
+	return z.entries[lo:hi]
+}
@@ -0,0 +1,111 @@
+package utils
+
+// GlobMatch reports whether s matches the glob-style pattern as Redis does:
+// '*' and '?' wildcards, '[...]' classes with ranges and '^' negation, and
+// '\' escapes.
+func GlobMatch(pattern, s string, nocase bool) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if GlobMatch(pattern[1:], s[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			ok, pattern = matchClass(pattern[1:], s[0], nocase)
+			if !ok {
+				return false
+			}
+			s = s[1:]
+			// matchClass leaves pattern on the closing bracket
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || !equalFold(pattern[0], s[0], nocase) {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the class starting right after '['. It returns
+// the pattern positioned on the closing ']' (or its last byte if unclosed).
+func matchClass(pattern string, c byte, nocase bool) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+
+	var match bool
+	for len(pattern) > 0 {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			pattern = pattern[1:]
+			if equalFold(pattern[0], c, nocase) {
+				match = true
+			}
+		case pattern[0] == ']':
+			return match != not, pattern
+		case len(pattern) >= 3 && pattern[1] == '-':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			lc := c
+			if nocase {
+				start, end, lc = lower(start), lower(end), lower(c)
+			}
+			if lc >= start && lc <= end {
+				match = true
+			}
+			pattern = pattern[2:]
+		default:
+			if equalFold(pattern[0], c, nocase) {
+				match = true
+			}
+		}
+		if len(pattern) == 1 {
+			// unterminated class, treat the end of the pattern as ']'
+			return match != not, pattern
+		}
+		pattern = pattern[1:]
+	}
+	return match != not, " "
+}
+
+func equalFold(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	ts := []struct {
+		pattern string
+		s       string
+		nocase  bool
+		out     bool
+	}{
+		{pattern: "*", s: "", out: true},
+		{pattern: "*", s: "anything", out: true},
+		{pattern: "h?llo", s: "hello", out: true},
+		{pattern: "h?llo", s: "hllo", out: false},
+		{pattern: "h*llo", s: "heeeello", out: true},
+		{pattern: "h[ae]llo", s: "hallo", out: true},
+		{pattern: "h[ae]llo", s: "hillo", out: false},
+		{pattern: "h[^e]llo", s: "hallo", out: true},
+		{pattern: "h[^e]llo", s: "hello", out: false},
+		{pattern: "h[a-b]llo", s: "hbllo", out: true},
+		{pattern: "h[b-a]llo", s: "hallo", out: true},
+		{pattern: "h\\*llo", s: "h*llo", out: true},
+		{pattern: "h\\*llo", s: "hello", out: false},
+		{pattern: "user:*:name", s: "user:42:name", out: true},
+		{pattern: "user:*:name", s: "user:42:email", out: false},
+		{pattern: "HELLO", s: "hello", out: false},
+		{pattern: "HELLO", s: "hello", nocase: true, out: true},
+		{pattern: "[A-C]x", s: "bx", nocase: true, out: true},
+		{pattern: "a[bc", s: "ab", out: true},
+	}
+
+	for _, tt := range ts {
+		if got := GlobMatch(tt.pattern, tt.s, tt.nocase); got != tt.out {
+			t.Fatalf("%q ~ %q: want %v, got %v", tt.pattern, tt.s, tt.out, got)
+		}
+	}
+}
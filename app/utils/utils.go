@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
 	"slices"
+	"strconv"
 	"unicode"
 )
 
@@ -26,3 +30,21 @@ func MapCopy[M1 ~map[K]V, K comparable, V any](src M1) M1 {
 	}
 	return dst
 }
+
+// FormatFloat formats f the way Redis replies with doubles.
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// RandomHex returns n random hex digits.
+func RandomHex(n int) string {
+	b := make([]byte, (n+1)/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)[:n]
+}